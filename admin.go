@@ -0,0 +1,160 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminServer serves the admin endpoint, which allows listing and purging responses in the caches.
+type adminServer struct {
+	h     HTTPRecord
+	token string
+}
+
+func newAdminServer(h HTTPRecord) *adminServer {
+	return &adminServer{h: h, token: h.AdminToken}
+}
+
+// handler returns the handler of the admin endpoint.
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/purge", a.purge)
+	mux.HandleFunc("/cache", a.list)
+	return a.authorize(mux)
+}
+
+// authorize rejects requests without the admin token, if one is configured.
+func (a *adminServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		expected := "Bearer " + a.token
+		if a.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// purge removes the responses for a name, optionally of a type, or for all names in a zone from the caches.
+func (a *adminServer) purge(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, zone, rtype := r.FormValue("name"), r.FormValue("zone"), strings.ToUpper(r.FormValue("type"))
+	if (name == "") == (zone == "") {
+		http.Error(rw, "expected either name or zone", http.StatusBadRequest)
+		return
+	}
+	if _, ok := dns.StringToType[rtype]; rtype != "" && (!ok || zone != "") {
+		http.Error(rw, "invalid type "+rtype, http.StatusBadRequest)
+		return
+	}
+
+	var matches func(response backendResponse) bool
+	if name != "" {
+		name = plugin.Name(name).Normalize()
+		matches = func(response backendResponse) bool {
+			return response.Name == name && (rtype == "" || response.Type == rtype)
+		}
+	} else {
+		zone = plugin.Name(zone).Normalize()
+		matches = func(response backendResponse) bool {
+			return plugin.Name(zone).Matches(response.Name)
+		}
+	}
+
+	purged := a.h.purge(matches)
+	log.Infof("Purged %d cached responses for %s%s", purged, name, zone)
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]int{"purged": purged})
+}
+
+// purge removes the responses matches returns true for from the caches, and their copies from the shared cache, and
+// returns their number.
+func (h HTTPRecord) purge(matches func(response backendResponse) bool) int {
+	var keys []uint64
+	h.walkCaches(func(zone string, key uint64, response backendResponse) bool {
+		if matches(response) {
+			keys = append(keys, key)
+			return true
+		}
+		return false
+	})
+	h.unshare(keys)
+	return len(keys)
+}
+
+// cachedResponse describes a response kept in a cache as it is listed by the admin endpoint.
+type cachedResponse struct {
+	// Zone is the origin of the zone the response is kept for if caches are kept per zone.
+	Zone string `json:"zone,omitempty"`
+	Key  string `json:"key"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// TTL is the number of seconds until the response expires, which is negative once it has.
+	TTL int64 `json:"ttl"`
+	// Rcode is set for negative responses.
+	Rcode string `json:"rcode,omitempty"`
+}
+
+// list returns the responses kept in the caches with their remaining TTLs, ordered by name and type.
+func (a *adminServer) list(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	responses := []cachedResponse{}
+	a.h.walkCaches(func(zone string, key uint64, response backendResponse) bool {
+		expires := response.Fetched.Add(time.Duration(response.TTL) * time.Second)
+		cached := cachedResponse{
+			Zone: zone,
+			Key:  strconv.FormatUint(key, 16),
+			Name: response.Name,
+			Type: response.Type,
+			TTL:  int64(expires.Sub(now).Round(time.Second) / time.Second),
+		}
+		if response.Error != nil {
+			cached.Rcode = dns.RcodeToString[response.Error.DNSResponseCode]
+		}
+		responses = append(responses, cached)
+		return false
+	})
+	sort.Slice(responses, func(i, j int) bool {
+		if responses[i].Name != responses[j].Name {
+			return responses[i].Name < responses[j].Name
+		}
+		return responses[i].Type < responses[j].Type
+	})
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(responses)
+}
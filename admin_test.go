@@ -0,0 +1,141 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"encoding/json"
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminServer_Purge(t *testing.T) {
+	tests := []struct {
+		method    string
+		target    string
+		token     string
+		status    int
+		remaining []string
+	}{
+		{"POST", "/purge?name=www.example.com", "s3cret", 200, []string{"mail.example.com. MX", "www.example.org. A"}},
+		{"POST", "/purge?name=WWW.example.com.&type=aaaa", "s3cret", 200,
+			[]string{"mail.example.com. MX", "www.example.com. A", "www.example.org. A"}},
+		{"POST", "/purge?zone=example.com", "s3cret", 200, []string{"www.example.org. A"}},
+		{"POST", "/purge?zone=.", "s3cret", 200, nil},
+		{"POST", "/purge?name=www.example.com&type=BOGUS", "s3cret", 400, nil},
+		{"POST", "/purge?name=www.example.com&zone=example.com", "s3cret", 400, nil},
+		{"POST", "/purge", "s3cret", 400, nil},
+		{"GET", "/purge?name=www.example.com", "s3cret", 405, nil},
+		{"POST", "/purge?name=www.example.com", "wrong", 401, nil},
+	}
+
+	for i, test := range tests {
+		h := HTTPRecord{
+			Cache:      cache.New(100),
+			zoneCaches: map[string]*cache.Cache{"example.com.": cache.New(100)},
+		}
+		h.add(cacheSlot{store: h.zoneCaches["example.com."], key: 1, name: "www.example.com.", rtype: "A"},
+			backendResponse{})
+		h.add(cacheSlot{store: h.zoneCaches["example.com."], key: 2, name: "www.example.com.", rtype: "AAAA"},
+			backendResponse{})
+		h.add(cacheSlot{store: h.zoneCaches["example.com."], key: 3, name: "mail.example.com.", rtype: "MX"},
+			backendResponse{})
+		h.add(cacheSlot{store: h.Cache, key: 4, name: "www.example.org.", rtype: "A"}, backendResponse{})
+		h.AdminToken = "s3cret"
+		// Purged responses are removed from the shared cache too, which would promote them again otherwise.
+		shared := &memoryStore{values: map[string][]byte{}}
+		for key := uint64(1); key <= 4; key++ {
+			shared.set(sharedCacheKey(key), []byte("{}"), time.Minute)
+		}
+		h.shared = shared
+
+		req := httptest.NewRequest(test.method, test.target, nil)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		rec := httptest.NewRecorder()
+		newAdminServer(h).handler().ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("Test %d: expected status %d, got %d: %s", i, test.status, rec.Code, rec.Body)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+
+		var remaining []string
+		h.walkCaches(func(zone string, key uint64, response backendResponse) bool {
+			remaining = append(remaining, response.Name+" "+response.Type)
+			return false
+		})
+		sort.Strings(remaining)
+		if strings.Join(remaining, ", ") != strings.Join(test.remaining, ", ") {
+			t.Errorf("Test %d: expected %v to remain, got %v", i, test.remaining, remaining)
+		}
+		if len(shared.values) != len(test.remaining) {
+			t.Errorf("Test %d: expected %d responses to remain shared, got %d", i, len(test.remaining),
+				len(shared.values))
+		}
+	}
+}
+
+func TestAdminServer_List(t *testing.T) {
+	h := HTTPRecord{
+		Cache:      cache.New(100),
+		zoneCaches: map[string]*cache.Cache{"example.com.": cache.New(100)},
+	}
+	now := time.Now()
+	h.add(cacheSlot{zone: "example.com.", store: h.zoneCaches["example.com."], key: 1, name: "www.example.com.",
+		rtype: "A"}, backendResponse{TTL: 60, Fetched: now.Add(-10 * time.Second)})
+	h.add(cacheSlot{store: h.Cache, key: 26, name: "nx.example.org.", rtype: "A"},
+		backendResponse{TTL: 30, Fetched: now.Add(-40 * time.Second),
+			Error: &BackendIndicatedError{DNSResponseCode: dns.RcodeNameError}})
+
+	tests := []struct {
+		method   string
+		status   int
+		expected []cachedResponse
+	}{
+		{"GET", 200, []cachedResponse{
+			{Key: "1a", Name: "nx.example.org.", Type: "A", TTL: -10, Rcode: "NXDOMAIN"},
+			{Zone: "example.com.", Key: "1", Name: "www.example.com.", Type: "A", TTL: 50},
+		}},
+		{"POST", 405, nil},
+	}
+
+	for i, test := range tests {
+		rec := httptest.NewRecorder()
+		newAdminServer(h).handler().ServeHTTP(rec, httptest.NewRequest(test.method, "/cache", nil))
+
+		if rec.Code != test.status {
+			t.Errorf("Test %d: expected status %d, got %d: %s", i, test.status, rec.Code, rec.Body)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+
+		var listed []cachedResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil {
+			t.Fatalf("Test %d: expected JSON, got %v", i, err)
+		}
+		if !reflect.DeepEqual(listed, test.expected) {
+			t.Errorf("Test %d: expected %+v, got %+v", i, test.expected, listed)
+		}
+	}
+}
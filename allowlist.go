@@ -0,0 +1,156 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Allowlist restricts the hosts requests can be sent to, which protects against query names steering requests to
+// other hosts.
+type Allowlist struct {
+	// Hosts are allowed by name, regardless of the addresses they resolve to.
+	Hosts []string
+	// Networks are the addresses other hosts are allowed to resolve to.
+	Networks []*net.IPNet
+}
+
+// Add allows the host or CIDR network given by value.
+func (a *Allowlist) Add(value string) error {
+	if _, network, err := net.ParseCIDR(value); err == nil {
+		a.Networks = append(a.Networks, network)
+		return nil
+	}
+	if ip := net.ParseIP(value); ip != nil {
+		a.Networks = append(a.Networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		return nil
+	}
+	if value == "" || strings.ContainsAny(value, "/:") {
+		return fmt.Errorf("invalid host or network: %s", value)
+	}
+	a.Hosts = append(a.Hosts, strings.ToLower(strings.TrimSuffix(value, ".")))
+	return nil
+}
+
+func (a *Allowlist) allowsHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range a.Hosts {
+		if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Allowlist) allowsIP(ip net.IP) bool {
+	for _, network := range a.Networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkURI returns an error if requests to uri are not allowed. Hosts that are not allowed by name are only accepted
+// if networks are allowed, in which case they are checked once resolved by dialContext, or by proxy for requests sent
+// through a proxy.
+func (a *Allowlist) checkURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		if a.allowsIP(ip) {
+			return nil
+		}
+	} else if a.allowsHost(host) || len(a.Networks) > 0 {
+		return nil
+	}
+	return fmt.Errorf("backend %s is not allowed", host)
+}
+
+// dialContext wraps dial to only connect to hosts allowed by name or addresses in the allowed networks. Hosts are
+// resolved before connecting to the address that was checked.
+func (a *Allowlist) dialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(
+	ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if a.allowsHost(host) {
+			return dial(ctx, network, addr)
+		}
+
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		err = fmt.Errorf("backend %s is not allowed", host)
+		for _, ip := range ips {
+			if !a.allowsIP(ip.IP) {
+				continue
+			}
+			var conn net.Conn
+			if conn, err = dial(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// proxy wraps proxy to check the hosts of requests sent through a proxy, as dialContext only sees the address of the
+// proxy then. Hosts that are not allowed by name need to resolve to addresses in the allowed networks only, since the
+// proxy connects to any of them.
+func (a *Allowlist) proxy(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := proxy(req)
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+
+		host := req.URL.Hostname()
+		if a.allowsHost(host) {
+			return proxyURL, nil
+		}
+		var ips []net.IP
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else {
+			addrs, err := net.DefaultResolver.LookupIPAddr(req.Context(), host)
+			if err != nil {
+				return nil, err
+			}
+			for _, addr := range addrs {
+				ips = append(ips, addr.IP)
+			}
+		}
+		for _, ip := range ips {
+			if !a.allowsIP(ip) {
+				return nil, fmt.Errorf("backend %s is not allowed", host)
+			}
+		}
+		return proxyURL, nil
+	}
+}
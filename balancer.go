@@ -0,0 +1,102 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Policies for choosing the order in which the URIs of a zone or record are tried.
+const (
+	// PolicySequential tries the URIs in the configured order.
+	PolicySequential = "sequential"
+	// PolicyRoundRobin starts with the next URI for every lookup.
+	PolicyRoundRobin = "round_robin"
+	// PolicyLeastFailed starts with the URI that failed least recently.
+	PolicyLeastFailed = "least_failed"
+	// PolicyLeastRequests starts with the URI with the fewest requests in flight.
+	PolicyLeastRequests = "least_requests"
+)
+
+// balancer orders URIs according to a policy and keeps track of the requests to them.
+type balancer struct {
+	policy string
+
+	mu          sync.Mutex
+	next        int
+	lastFailure map[string]time.Time
+	inFlight    map[string]int
+}
+
+func newBalancer(policy string) *balancer {
+	return &balancer{
+		policy:      policy,
+		lastFailure: make(map[string]time.Time),
+		inFlight:    make(map[string]int),
+	}
+}
+
+// order returns uris in the order they should be tried in.
+func (b *balancer) order(uris []string) []string {
+	if b == nil || len(uris) < 2 {
+		return uris
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ordered := append([]string(nil), uris...)
+	switch b.policy {
+	case PolicyRoundRobin:
+		start := b.next % len(uris)
+		b.next++
+		ordered = append(ordered[start:], ordered[:start]...)
+	case PolicyLeastFailed:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return b.lastFailure[ordered[i]].Before(b.lastFailure[ordered[j]])
+		})
+	case PolicyLeastRequests:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return b.inFlight[ordered[i]] < b.inFlight[ordered[j]]
+		})
+	}
+	return ordered
+}
+
+// start records a request to uri. The returned function has to be called once it finished, with whether the backend
+// failed.
+func (b *balancer) start(uri string) func(failed bool) {
+	if b == nil {
+		return func(bool) {}
+	}
+
+	b.mu.Lock()
+	b.inFlight[uri]++
+	b.mu.Unlock()
+
+	return func(failed bool) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if b.inFlight[uri]--; b.inFlight[uri] == 0 {
+			delete(b.inFlight, uri)
+		}
+		if failed {
+			b.lastFailure[uri] = time.Now()
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBalancer(t *testing.T) {
+	uris := []string{"a", "b", "c"}
+
+	rr := newBalancer(PolicyRoundRobin)
+	for i, expected := range [][]string{{"a", "b", "c"}, {"b", "c", "a"}, {"c", "a", "b"}, {"a", "b", "c"}} {
+		if ordered := rr.order(uris); !reflect.DeepEqual(ordered, expected) {
+			t.Errorf("Round robin %d expected %v, got %v", i, expected, ordered)
+		}
+	}
+
+	lf := newBalancer(PolicyLeastFailed)
+	lf.start("a")(true)
+	lf.start("c")(false)
+	if ordered, expected := lf.order(uris), []string{"b", "c", "a"}; !reflect.DeepEqual(ordered, expected) {
+		t.Errorf("Least failed expected %v, got %v", expected, ordered)
+	}
+	lf.start("b")(true)
+	if ordered, expected := lf.order(uris), []string{"c", "a", "b"}; !reflect.DeepEqual(ordered, expected) {
+		t.Errorf("Least failed expected %v, got %v", expected, ordered)
+	}
+
+	lr := newBalancer(PolicyLeastRequests)
+	doneA := lr.start("a")
+	lr.start("b")
+	lr.start("b")
+	if ordered, expected := lr.order(uris), []string{"c", "a", "b"}; !reflect.DeepEqual(ordered, expected) {
+		t.Errorf("Least requests expected %v, got %v", expected, ordered)
+	}
+	doneA(false)
+	if ordered, expected := lr.order(uris), []string{"a", "c", "b"}; !reflect.DeepEqual(ordered, expected) {
+		t.Errorf("Least requests expected %v, got %v", expected, ordered)
+	}
+
+	var sequential *balancer
+	if ordered := sequential.order(uris); !reflect.DeepEqual(ordered, uris) {
+		t.Errorf("Sequential expected %v, got %v", uris, ordered)
+	}
+	sequential.start("a")(true)
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControl holds the caching directives of a response (RFC 7234).
+type cacheControl struct {
+	// MaxAge is the freshness lifetime given by s-maxage, max-age or Expires, in this order. It is only valid if
+	// HasMaxAge is set.
+	MaxAge    time.Duration
+	HasMaxAge bool
+	NoCache   bool
+	NoStore   bool
+	// StaleIfError and StaleWhileRevalidate extend the lifetime for serving stale responses (RFC 5861).
+	StaleIfError         time.Duration
+	StaleWhileRevalidate time.Duration
+}
+
+// parseCacheControl parses the Cache-Control header of a response, falling back to Expires for its lifetime.
+func parseCacheControl(hdr http.Header) cacheControl {
+	var cc cacheControl
+	var maxAge, sMaxAge time.Duration
+	var hasMaxAge, hasSMaxAge bool
+
+	for _, value := range hdr.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+
+			// Earlier versions only understood "max-age: N", so a colon is accepted as well.
+			name, arg := directive, ""
+			if i := strings.IndexAny(directive, "=:"); i >= 0 {
+				name, arg = directive[:i], strings.Trim(strings.TrimSpace(directive[i+1:]), `"`)
+			}
+
+			var err error
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "max-age":
+				maxAge, err = parseDeltaSeconds(arg)
+				hasMaxAge = err == nil
+			case "s-maxage":
+				sMaxAge, err = parseDeltaSeconds(arg)
+				hasSMaxAge = err == nil
+			case "no-cache":
+				cc.NoCache = true
+			case "no-store":
+				cc.NoStore = true
+			case "stale-if-error":
+				cc.StaleIfError, err = parseDeltaSeconds(arg)
+			case "stale-while-revalidate":
+				cc.StaleWhileRevalidate, err = parseDeltaSeconds(arg)
+			}
+			if err != nil {
+				log.Warningf("Unable to parse Cache-Control directive: %s", directive)
+			}
+		}
+	}
+
+	switch {
+	case hasSMaxAge:
+		cc.MaxAge, cc.HasMaxAge = sMaxAge, true
+	case hasMaxAge:
+		cc.MaxAge, cc.HasMaxAge = maxAge, true
+	case hdr.Get("Expires") != "":
+		cc.MaxAge, cc.HasMaxAge = expiresIn(hdr), true
+	}
+	return cc
+}
+
+// parseDeltaSeconds parses a non-negative number of seconds.
+func parseDeltaSeconds(value string) (time.Duration, error) {
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// expiresIn returns the lifetime given by the Expires header relative to the Date header or, without Date, the
+// current time. Invalid dates mean the response has already expired.
+func expiresIn(hdr http.Header) time.Duration {
+	expires, err := http.ParseTime(hdr.Get("Expires"))
+	if err != nil {
+		return 0
+	}
+
+	date, err := http.ParseTime(hdr.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+	if lifetime := expires.Sub(date); lifetime > 0 {
+		return lifetime
+	}
+	return 0
+}
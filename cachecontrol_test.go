@@ -0,0 +1,187 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestExtractTTL(t *testing.T) {
+	tests := []struct {
+		header   http.Header
+		maxTTL   uint32
+		expected uint32
+	}{
+		{http.Header{}, 0, 3600},
+		{http.Header{}, 600, 600},
+		{http.Header{"Cache-Control": {"max-age=1800"}}, 0, 1800},
+		{http.Header{"Cache-Control": {"public, max-age: 1800"}}, 0, 1800},
+		{http.Header{"Cache-Control": {`max-age="1800"`}}, 0, 1800},
+		{http.Header{"Cache-Control": {"max-age=1800"}}, 600, 600},
+		{http.Header{"Cache-Control": {"max-age=0"}}, 600, 0},
+		{http.Header{"Cache-Control": {"max-age=1800, s-maxage=60"}}, 0, 60},
+		{http.Header{"Cache-Control": {"public", "max-age=60"}}, 0, 60},
+		{http.Header{"Cache-Control": {"max-age=forever"}}, 0, 3600},
+		{http.Header{"Cache-Control": {"no-cache"}}, 0, 0},
+		{http.Header{"Cache-Control": {"max-age=60, no-store"}}, 0, 0},
+		{http.Header{
+			"Date":    {"Mon, 02 Jan 2006 15:04:05 GMT"},
+			"Expires": {"Mon, 02 Jan 2006 15:14:05 GMT"},
+		}, 0, 600},
+		{http.Header{
+			"Cache-Control": {"max-age=60"},
+			"Date":          {"Mon, 02 Jan 2006 15:04:05 GMT"},
+			"Expires":       {"Mon, 02 Jan 2006 15:14:05 GMT"},
+		}, 0, 60},
+		{http.Header{"Expires": {"0"}}, 0, 0},
+		{http.Header{"Cache-Control": {"max-age=1800"}, "Age": {"600"}}, 0, 1200},
+		{http.Header{"Cache-Control": {"max-age=1800"}, "Age": {"3600"}}, 0, 0},
+		{http.Header{"Cache-Control": {"max-age=1800"}, "Age": {"600"}}, 600, 600},
+		// Without a lifetime given by the backend, Age is irrelevant.
+		{http.Header{"Age": {"600"}}, 0, 3600},
+	}
+
+	for i, test := range tests {
+		h := HTTPRecord{MaxTTL: test.maxTTL}
+		if ttl := h.extractTTL(test.header, nil); ttl != test.expected {
+			t.Errorf("Test %d expected TTL %d, got %d", i, test.expected, ttl)
+		}
+	}
+}
+
+func TestExtractTTL_MinTTL(t *testing.T) {
+	tests := []struct {
+		header   http.Header
+		maxTTL   uint32
+		expected uint32
+	}{
+		{http.Header{"Cache-Control": {"max-age=1"}}, 0, 30},
+		{http.Header{"Cache-Control": {"max-age=0"}}, 0, 30},
+		{http.Header{"Cache-Control": {"max-age=1800"}, "Age": {"1790"}}, 0, 30},
+		{http.Header{"Cache-Control": {"max-age=60"}}, 0, 60},
+		{http.Header{"Cache-Control": {"max-age=1"}}, 10, 10},
+		// Responses the backend forbade reusing are not raised.
+		{http.Header{"Cache-Control": {"no-cache"}}, 0, 0},
+		{http.Header{"Cache-Control": {"max-age=60, no-store"}}, 0, 0},
+	}
+
+	for i, test := range tests {
+		h := HTTPRecord{MaxTTL: test.maxTTL}
+		if ttl := h.extractTTL(test.header, &Backend{MinTTL: 30}); ttl != test.expected {
+			t.Errorf("Test %d expected TTL %d, got %d", i, test.expected, ttl)
+		}
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	cc := parseCacheControl(http.Header{
+		"Cache-Control": {"max-age=60, stale-while-revalidate=30, stale-if-error=86400"},
+	})
+
+	expected := cacheControl{
+		MaxAge:               time.Minute,
+		HasMaxAge:            true,
+		StaleIfError:         24 * time.Hour,
+		StaleWhileRevalidate: 30 * time.Second,
+	}
+	if cc != expected {
+		t.Errorf("Expected %+v, got %+v", expected, cc)
+	}
+}
+
+func TestBackendResponse_UsableOnError(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		response backendResponse
+		maxStale time.Duration
+		expected bool
+	}{
+		{backendResponse{TTL: 60, Fetched: now.Add(-time.Hour)}, 0, true},
+		{backendResponse{TTL: 60, Fetched: now.Add(-time.Hour), StaleIfError: time.Hour}, 0, true},
+		{backendResponse{TTL: 60, Fetched: now.Add(-2 * time.Hour), StaleIfError: time.Hour}, 0, false},
+		{backendResponse{TTL: 60, Fetched: now.Add(-time.Hour)}, 2 * time.Hour, true},
+		{backendResponse{TTL: 60, Fetched: now.Add(-time.Hour)}, time.Minute, false},
+		{backendResponse{TTL: 60, Fetched: now.Add(-time.Hour), StaleIfError: 2 * time.Hour}, time.Minute, false},
+		{backendResponse{TTL: 60, Fetched: now.Add(-time.Hour), StaleIfError: time.Minute}, 2 * time.Hour, false},
+	}
+
+	for i, test := range tests {
+		if usable := test.response.usableOnError(now, test.maxStale); usable != test.expected {
+			t.Errorf("Test %d expected %v, got %v", i, test.expected, usable)
+		}
+	}
+}
+
+func TestBackendResponse_ServableStale(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		response backendResponse
+		window   time.Duration
+		expected bool
+	}{
+		{backendResponse{TTL: 60, Fetched: now.Add(-time.Hour)}, 2 * time.Hour, true},
+		{backendResponse{TTL: 60, Fetched: now.Add(-time.Hour)}, time.Minute, false},
+		{backendResponse{TTL: 60, Fetched: now.Add(-time.Hour)}, 0, false},
+		{backendResponse{TTL: 60, Fetched: now.Add(-time.Hour), StaleWhileRevalidate: 2 * time.Hour}, 0, true},
+		{backendResponse{TTL: 60, Fetched: now.Add(-time.Hour), StaleWhileRevalidate: time.Minute}, 2 * time.Hour, false},
+		{backendResponse{TTL: 0, Fetched: now.Add(-time.Second)}, time.Hour, false},
+	}
+
+	for i, test := range tests {
+		if servable := test.response.servableStale(now, test.window); servable != test.expected {
+			t.Errorf("Test %d expected %v, got %v", i, test.expected, servable)
+		}
+	}
+}
+
+func TestBackendResponse_Aged(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		fetched  time.Time
+		expected uint32
+	}{
+		{now, 60},
+		{now.Add(-1500 * time.Millisecond), 59},
+		{now.Add(-time.Minute), 0},
+		{now.Add(-time.Hour), 0},
+	}
+
+	for i, test := range tests {
+		response := backendResponse{TTL: 60, Fetched: test.fetched}
+		if ttl := response.aged(now).TTL; ttl != test.expected {
+			t.Errorf("Test %d expected TTL %d, got %d", i, test.expected, ttl)
+		}
+	}
+}
+
+func TestBackendResponse_OnError(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		response backendResponse
+		expected uint32
+	}{
+		{backendResponse{TTL: 60, Fetched: now.Add(-10 * time.Second)}, 50},
+		{backendResponse{TTL: 60, Fetched: now.Add(-time.Hour)}, StaleTTL},
+		{backendResponse{TTL: 0, Fetched: now.Add(-time.Hour)}, 0},
+	}
+
+	for i, test := range tests {
+		if ttl := test.response.onError(now).TTL; ttl != test.expected {
+			t.Errorf("Test %d expected TTL %d, got %d", i, test.expected, ttl)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// caseWriter wraps w to restore the case the query name in state was sent with in responses if it is not all
+// lowercase. Zones and records are matched ignoring case and responses built with the lowercased name, while
+// resolvers using 0x20 randomization expect the case they sent.
+func caseWriter(w dns.ResponseWriter, state request.Request) dns.ResponseWriter {
+	if state.QName() == state.Name() {
+		return w
+	}
+	return &caseResponseWriter{ResponseWriter: w, qname: state.QName(), name: state.Name()}
+}
+
+// caseResponseWriter renames records for the lowercased query name to the query name as sent before writing them.
+type caseResponseWriter struct {
+	dns.ResponseWriter
+	qname, name string
+}
+
+func (w *caseResponseWriter) WriteMsg(m *dns.Msg) error {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for i, rr := range section {
+			if rr.Header().Name != w.name {
+				continue
+			}
+			// Records can be shared, e.g. the SOA record of a zone, so they are copied before renaming.
+			section[i] = dns.Copy(rr)
+			section[i].Header().Name = w.qname
+		}
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"fmt"
+	"github.com/coredns/coredns/plugin/pkg/nonwriter"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// maxChaseDepth is how many CNAMEs are followed in a row at most, which stops CNAMEs pointing at each other.
+const maxChaseDepth = 8
+
+type chaseDepthKey struct{}
+
+// chase answers an address query in state, whose backend response has no records of the queried type, with a CNAME
+// record in the response followed by the records of its target. If flatten is set, the records of the target are
+// returned instead, renamed to the queried name, which allows CNAMEs where they are not allowed, e.g. at the apex of
+// a zone. Answers are empty if the response has no CNAME or the target has no records.
+func (h HTTPRecord) chase(ctx context.Context, w dns.ResponseWriter, state request.Request,
+	response backendResponse, parser ResponseParser, flatten bool) ([]dns.RR, error) {
+	parsed, err := response.records(state.Name(), "CNAME", parser)
+	if err != nil || len(parsed.Answer) == 0 {
+		return nil, nil
+	}
+	cname, ok := parsed.Answer[0].(*dns.CNAME)
+	if !ok {
+		return nil, nil
+	}
+
+	depth, _ := ctx.Value(chaseDepthKey{}).(int)
+	if depth >= maxChaseDepth {
+		return nil, fmt.Errorf("too many CNAMEs following %s", state.Name())
+	}
+	ctx = context.WithValue(ctx, chaseDepthKey{}, depth+1)
+
+	m, err := h.resolve(ctx, w, state, cname.Target, state.QType())
+	if err != nil {
+		return nil, err
+	}
+	if !flatten {
+		return append([]dns.RR{cname}, m.Answer...), nil
+	}
+
+	var answer []dns.RR
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype != state.QType() {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = state.Name()
+		if rr.Header().Ttl > cname.Hdr.Ttl {
+			rr.Header().Ttl = cname.Hdr.Ttl
+		}
+		answer = append(answer, rr)
+	}
+	return answer, nil
+}
+
+// resolve looks up name with h.upstream if it is set, which follows the whole plugin chain, or with the zones and
+// records of the plugin otherwise.
+func (h HTTPRecord) resolve(ctx context.Context, w dns.ResponseWriter, state request.Request, name string,
+	qtype uint16) (*dns.Msg, error) {
+	var m *dns.Msg
+	if h.upstream != nil {
+		var err error
+		if m, err = h.upstream.Lookup(ctx, state, name, qtype); err != nil {
+			return nil, err
+		}
+	} else {
+		r := new(dns.Msg)
+		r.SetQuestion(name, qtype)
+		r.SetEdns0(dns.MaxMsgSize, false)
+		nw := nonwriter.New(w)
+		// Negative responses, e.g. NXDOMAIN for a 404 status, come with an error, but are answers nonetheless.
+		if _, err := h.ServeDNS(ctx, nw, r); err != nil && nw.Msg == nil {
+			return nil, err
+		}
+		m = nw.Msg
+	}
+	if m == nil || m.Rcode == dns.RcodeServerFailure {
+		return nil, fmt.Errorf("unable to look up %s", name)
+	}
+	return m, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"fmt"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"net"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// DebugZone is the zone of the CHAOS class TXT names the runtime state of the plugin can be queried at, e.g.
+// config.httprecord.bind.
+const DebugZone = "httprecord.bind."
+
+// debugQuery returns whether the query in state asks for the runtime state and the client is allowed to.
+func (h HTTPRecord) debugQuery(state request.Request) bool {
+	if len(h.DebugNetworks) == 0 || state.QClass() != dns.ClassCHAOS || state.QType() != dns.TypeTXT ||
+		!dns.IsSubDomain(DebugZone, state.Name()) {
+		return false
+	}
+
+	ip := net.ParseIP(state.IP())
+	for _, network := range h.DebugNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveDebug answers a query for the runtime state with a TXT record per line.
+func (h HTTPRecord) serveDebug(w dns.ResponseWriter, r *dns.Msg, state request.Request) (int, error) {
+	var lines []string
+	switch strings.TrimSuffix(state.Name(), DebugZone) {
+	case "version.":
+		lines = []string{version()}
+	case "config.":
+		lines = h.debugConfig()
+	case "health.":
+		lines = h.debugHealth()
+	case "cache.":
+		lines = h.debugCache()
+	default:
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		w.WriteMsg(m)
+		return dns.RcodeNameError, nil
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	for _, line := range lines {
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: splitTXT(line),
+		})
+	}
+	w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+// version returns the version of the plugin as built into CoreDNS.
+func version() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, module := range append([]*debug.Module{&info.Main}, info.Deps...) {
+			if module.Path == "github.com/mensi/httprecord" {
+				return module.Version
+			}
+		}
+	}
+	return "unknown"
+}
+
+// debugConfig lists the records and zones with their URIs.
+func (h HTTPRecord) debugConfig() []string {
+	var lines []string
+	for _, record := range h.Records {
+		lines = append(lines, strings.Join(append([]string{"record", record.Type, record.Name, record.URI},
+			record.Fallbacks...), " "))
+	}
+	for _, zone := range h.Zones {
+		lines = append(lines, strings.Join(append([]string{"zone", zone.Origin, zone.URI}, zone.Fallbacks...), " "))
+	}
+	return lines
+}
+
+// debugHealth lists whether the URIs probed by health checks were up.
+func (h HTTPRecord) debugHealth() []string {
+	var lines []string
+	for _, backend := range h.backends() {
+		if backend.health == nil {
+			continue
+		}
+		for uri, up := range backend.health.status() {
+			state := "down"
+			if up {
+				state = "up"
+			}
+			lines = append(lines, uri+" "+state)
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// debugCache lists the number of responses kept in each cache, by the origin of its zone or default for Cache.
+func (h HTTPRecord) debugCache() []string {
+	if h.Cache == nil {
+		return nil
+	}
+
+	var lines []string
+	for zone, store := range h.caches() {
+		if zone == "" {
+			zone = "default"
+		}
+		lines = append(lines, fmt.Sprintf("%s %d responses", zone, store.Len()))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// splitTXT splits s into the strings of a TXT record, which are limited to 255 bytes each.
+func splitTXT(s string) []string {
+	var txt []string
+	for len(s) > 255 {
+		txt = append(txt, s[:255])
+		s = s[255:]
+	}
+	return append(txt, s)
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestHTTPRecord_Debug(t *testing.T) {
+	config := HTTPRecord{
+		Records:       []Record{{Type: "A", Name: "www.example.com.", URI: "https://example.com/www"}},
+		Zones:         []Zone{{Origin: "example.org.", URI: "https://example.org/%(fqdn)"}},
+		Cache:         cache.New(100),
+		DebugNetworks: []*net.IPNet{{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)}},
+	}
+
+	tests := []struct {
+		name     string
+		remoteIP string
+		rcode    int
+		expected []string
+	}{
+		{"config.httprecord.bind.", "", dns.RcodeSuccess,
+			[]string{"record A www.example.com. https://example.com/www", "zone example.org. https://example.org/%(fqdn)"}},
+		{"cache.httprecord.bind.", "", dns.RcodeSuccess, []string{"default 0 responses"}},
+		{"health.httprecord.bind.", "", dns.RcodeSuccess, nil},
+		{"missing.httprecord.bind.", "", dns.RcodeNameError, nil},
+		// Clients outside DebugNetworks are answered like any other query.
+		{"config.httprecord.bind.", "192.0.2.1", dns.RcodeSuccess, nil},
+	}
+
+	for i, c := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: c.remoteIP})
+		msg := new(dns.Msg)
+		msg.SetQuestion(c.name, dns.TypeTXT)
+		msg.Question[0].Qclass = dns.ClassCHAOS
+		rcode, _ := config.ServeDNS(context.TODO(), rec, msg)
+		if rcode != c.rcode {
+			t.Errorf("Test %d: expected rcode %d, got %d", i, c.rcode, rcode)
+			continue
+		}
+
+		var lines []string
+		if rec.Msg != nil {
+			for _, rr := range rec.Msg.Answer {
+				lines = append(lines, rr.(*dns.TXT).Txt...)
+			}
+		}
+		if !reflect.DeepEqual(lines, c.expected) {
+			t.Errorf("Test %d: expected %q, got %q", i, c.expected, lines)
+		}
+	}
+}
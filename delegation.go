@@ -0,0 +1,104 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"net"
+)
+
+type delegationKey struct{}
+
+// delegation returns the NS records of the topmost child zone of the zone of the query in state that contains the
+// query name, or nil if the name is not delegated. Only names of records of type NS and Delegated below the zone can
+// be delegated, if their record or zone serves ip and has NS records. The query name itself is left to the backend
+// unless NS records are queried, and the parent answers DS queries for the child zone itself.
+func (h HTTPRecord) delegation(ctx context.Context, w dns.ResponseWriter, state request.Request,
+	ip net.IP) ([]dns.RR, error) {
+	// The lookups of NS and glue records are below the delegation themselves.
+	if ctx.Value(delegationKey{}) != nil {
+		return nil, nil
+	}
+	ctx = context.WithValue(ctx, delegationKey{}, true)
+
+	name := state.Name()
+	origin := h.origin(name)
+	for _, cut := range h.lookups().cuts(name) {
+		if cut == origin || !dns.IsSubDomain(origin, cut) {
+			continue
+		}
+		if cut == name && state.QType() != dns.TypeNS {
+			break
+		}
+		if h.lookups().record(cut, "NS", ip) == nil && h.zoneFor(cut, ip) == nil {
+			continue
+		}
+
+		m, err := h.resolve(ctx, w, state, cut, dns.TypeNS)
+		if err != nil {
+			return nil, err
+		}
+		// Names that do not exist or have no NS records are not delegated.
+		if m.Rcode != dns.RcodeSuccess {
+			continue
+		}
+		var ns []dns.RR
+		for _, rr := range m.Answer {
+			if rr.Header().Rrtype == dns.TypeNS && rr.Header().Name == cut {
+				ns = append(ns, rr)
+			}
+		}
+		if len(ns) > 0 {
+			return ns, nil
+		}
+	}
+	return nil, nil
+}
+
+// refer responds to r with a referral to the name servers ns of a child zone, along with the addresses of those in
+// the child zone itself (glue), which could not be looked up otherwise.
+func (h HTTPRecord) refer(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, state request.Request,
+	ns []dns.RR) (int, error) {
+	ctx = context.WithValue(ctx, delegationKey{}, true)
+	cut := ns[0].Header().Name
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Ns = ns
+	for _, rr := range ns {
+		target := rr.(*dns.NS).Ns
+		if !dns.IsSubDomain(cut, target) {
+			continue
+		}
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			glue, err := h.resolve(ctx, w, state, target, qtype)
+			if err != nil {
+				log.Debugf("Unable to look up glue for %s: %v", target, err)
+				continue
+			}
+			for _, rr := range glue.Answer {
+				if rr.Header().Rrtype == qtype && rr.Header().Name == target {
+					m.Extra = append(m.Extra, rr)
+				}
+			}
+		}
+	}
+
+	w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
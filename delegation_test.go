@@ -0,0 +1,193 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// delegationServer answers for example.com., which delegates child.example.com. to a name server in it and one
+// outside of it. Other names do not exist.
+func delegationServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/child.example.com./DS":
+		case "/child.example.com./NS":
+			rw.Write([]byte("NS ns1.child.example.com.\nNS ns.example.net."))
+		case "/ns1.child.example.com./A":
+			rw.Write([]byte("192.0.2.53"))
+		case "/www.example.com./A":
+			rw.Write([]byte("192.0.2.1"))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestHTTPRecord_Delegations(t *testing.T) {
+	server := delegationServer()
+	defer server.Close()
+
+	config := HTTPRecord{
+		Zones:       []Zone{{Origin: "example.com.", URI: server.URL + "/%(fqdn)/%(qtype)"}},
+		Timeout:     time.Second,
+		Delegations: true,
+		Delegated:   []string{"child.example.com.", "gone.example.com."},
+	}
+
+	tests := []struct {
+		qname    string
+		qtype    uint16
+		referral bool
+	}{
+		{"www.child.example.com.", dns.TypeA, true},
+		{"a.b.child.example.com.", dns.TypeTXT, true},
+		{"child.example.com.", dns.TypeNS, true},
+		{"child.example.com.", dns.TypeDS, false},
+		{"www.example.com.", dns.TypeA, false},
+	}
+
+	for i, c := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		config.ServeDNS(context.TODO(), rec, new(dns.Msg).SetQuestion(c.qname, c.qtype))
+		if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeSuccess {
+			t.Errorf("Test %d: expected NOERROR, got %v", i, rec.Msg)
+			continue
+		}
+		if !c.referral {
+			if !rec.Msg.Authoritative || len(rec.Msg.Ns) > 0 {
+				t.Errorf("Test %d: expected no referral, got %v", i, rec.Msg)
+			}
+			continue
+		}
+
+		if rec.Msg.Authoritative {
+			t.Errorf("Test %d: expected a non-authoritative referral", i)
+		}
+		if err := test.SortAndCheck(rec.Msg, test.Case{Qname: c.qname, Qtype: c.qtype, Ns: []dns.RR{
+			test.NS("child.example.com. 3600 IN NS ns.example.net."),
+			test.NS("child.example.com. 3600 IN NS ns1.child.example.com."),
+		}, Extra: []dns.RR{
+			test.A("ns1.child.example.com. 3600 IN A 192.0.2.53"),
+		}}); err != nil {
+			t.Errorf("Test %d: %v", i, err)
+		}
+	}
+}
+
+func TestHTTPRecord_NotDelegated(t *testing.T) {
+	var requests int32
+	server := delegationServer()
+	defer server.Close()
+	counter := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		server.Config.Handler.ServeHTTP(rw, r)
+	}))
+	defer counter.Close()
+
+	config := HTTPRecord{
+		Zones:       []Zone{{Origin: "example.com.", URI: counter.URL + "/%(fqdn)/%(qtype)"}},
+		Timeout:     time.Second,
+		Delegations: true,
+		Delegated:   []string{"child.example.com.", "gone.example.com."},
+	}
+
+	tests := []struct {
+		qname    string
+		rcode    int
+		requests int32
+	}{
+		// Only names that can be delegated are checked, not the query name itself.
+		{"a.b.missing.example.com.", dns.RcodeNameError, 1},
+		{"gone.example.com.", dns.RcodeNameError, 1},
+		// Names that do not exist are not delegated.
+		{"www.gone.example.com.", dns.RcodeNameError, 2},
+	}
+
+	for i, c := range tests {
+		atomic.StoreInt32(&requests, 0)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		config.ServeDNS(context.TODO(), rec, new(dns.Msg).SetQuestion(c.qname, dns.TypeA))
+		if rec.Msg == nil || rec.Msg.Rcode != c.rcode || len(rec.Msg.Answer) > 0 {
+			t.Errorf("Test %d: expected rcode %d without answer, got %v", i, c.rcode, rec.Msg)
+		}
+		if n := atomic.LoadInt32(&requests); n != c.requests {
+			t.Errorf("Test %d: expected %d requests to the backend, got %d", i, c.requests, n)
+		}
+	}
+}
+
+func TestHTTPRecord_SignedDelegation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httprecord")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := delegationServer()
+	defer server.Close()
+
+	backend := &Backend{DNSSECKeys: []string{writeZoneKey(t, dir, "example.com.")}}
+	config := HTTPRecord{
+		Zones:       []Zone{{Origin: "example.com.", URI: server.URL + "/%(fqdn)/%(qtype)", Backend: backend}},
+		Timeout:     time.Second,
+		Delegations: true,
+		Delegated:   []string{"child.example.com."},
+	}
+	if config.signer, err = newZoneSigner(config.backends()); err != nil {
+		t.Fatal(err)
+	}
+	key := config.signer.dnskeys("example.com.")[0].(*dns.DNSKEY)
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	msg := new(dns.Msg).SetQuestion("www.child.example.com.", dns.TypeA)
+	msg.SetEdns0(4096, true)
+	config.ServeDNS(context.TODO(), rec, msg)
+	if rec.Msg == nil {
+		t.Fatal("Expected a response")
+	}
+
+	// Only the NSEC record proving that the child zone is not signed is.
+	var nsec *dns.NSEC
+	var sig *dns.RRSIG
+	for _, rr := range append(rec.Msg.Ns, rec.Msg.Extra...) {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsec = rr
+		case *dns.RRSIG:
+			if sig != nil || rr.TypeCovered != dns.TypeNSEC {
+				t.Errorf("Expected only the NSEC record to be signed, got %v", rr)
+			}
+			sig = rr
+		}
+	}
+	if nsec == nil || nsec.Hdr.Name != "child.example.com." || hasType(nsec.TypeBitMap, dns.TypeDS) ||
+		!hasType(nsec.TypeBitMap, dns.TypeNS) {
+		t.Fatalf("Expected NSEC record for the delegation without DS, got %v", nsec)
+	}
+	if sig == nil || sig.Verify(key, []dns.RR{nsec}) != nil {
+		t.Errorf("Expected valid signature of the NSEC record, got %v", sig)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Address families that can be preferred when connecting to a backend.
+const (
+	IPv4 = "ipv4"
+	IPv6 = "ipv6"
+)
+
+// DefaultFallbackDelay is how long a connection attempt with the preferred address family runs before one with the
+// other family is started in parallel.
+const DefaultFallbackDelay = 300 * time.Millisecond
+
+// dialFunc connects to an address.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// sourceAddresses returns the addresses of the interface with the given name, at most one per address family.
+// Link-local IPv6 addresses are skipped as they cannot reach backends without a zone.
+func sourceAddresses(name string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var v4, v6 net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		switch {
+		case !ok || ipnet.IP.IsLinkLocalUnicast():
+		case ipnet.IP.To4() != nil && v4 == nil:
+			v4 = ipnet.IP
+		case ipnet.IP.To4() == nil && v6 == nil:
+			v6 = ipnet.IP
+		}
+	}
+
+	var ips []net.IP
+	for _, ip := range []net.IP{v4, v6} {
+		if ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("interface %s has no usable addresses", name)
+	}
+	return ips, nil
+}
+
+// newDial returns the function connecting to backend, which honours its preferred address family, fallback delay
+// and source addresses.
+func newDial(backend *Backend) dialFunc {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if backend == nil {
+		return dialer.DialContext
+	}
+	dialer.FallbackDelay = backend.FallbackDelay
+
+	sources := map[string]*net.TCPAddr{}
+	for _, ip := range backend.SourceAddresses {
+		if ip.To4() != nil {
+			sources["tcp4"] = &net.TCPAddr{IP: ip}
+		} else {
+			sources["tcp6"] = &net.TCPAddr{IP: ip}
+		}
+	}
+
+	// Without a preference, the standard dialer tries the family of the first resolved address first. A single source
+	// address restricts it to the family of that address.
+	if backend.PreferIP == "" && len(sources) < 2 {
+		for _, source := range sources {
+			dialer.LocalAddr = source
+		}
+		return dialer.DialContext
+	}
+
+	networks := []string{"tcp6", "tcp4"}
+	if backend.PreferIP == IPv4 {
+		networks = []string{"tcp4", "tcp6"}
+	}
+
+	d := &dualStackDialer{fallbackDelay: backend.FallbackDelay}
+	if d.fallbackDelay == 0 {
+		d.fallbackDelay = DefaultFallbackDelay
+	}
+	for _, network := range networks {
+		// With source addresses, only their families are used.
+		source, ok := sources[network]
+		if !ok && len(sources) > 0 {
+			continue
+		}
+
+		familyDialer := *dialer
+		if ok {
+			familyDialer.LocalAddr = source
+		}
+		d.dialers = append(d.dialers, &familyDialer)
+		d.networks = append(d.networks, network)
+	}
+	return d.DialContext
+}
+
+// dualStackDialer connects with the preferred address family first and races the other family once the fallback
+// delay passed or the preferred one failed, like net.Dialer does for the family of the first resolved address.
+type dualStackDialer struct {
+	dialers       []*net.Dialer
+	networks      []string
+	fallbackDelay time.Duration
+}
+
+func (d *dualStackDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return d.dialers[0].DialContext(ctx, network, addr)
+	}
+	if len(d.dialers) == 1 {
+		return d.dialers[0].DialContext(ctx, d.networks[0], addr)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(d.dialers))
+	dial := func(i int) {
+		conn, err := d.dialers[i].DialContext(ctx, d.networks[i], addr)
+		results <- result{conn, err}
+	}
+
+	go dial(0)
+	pending := 1
+	fallback := time.NewTimer(d.fallbackDelay)
+	defer fallback.Stop()
+	startFallback := fallback.C
+
+	var firstErr error
+	for {
+		select {
+		case <-startFallback:
+			startFallback = nil
+			go dial(1)
+			pending++
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if pending > 0 {
+					// The other attempt is cancelled, but it might still have connected.
+					go func() {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}()
+				}
+				return r.conn, nil
+			}
+
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if startFallback != nil {
+				startFallback = nil
+				go dial(1)
+				pending++
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
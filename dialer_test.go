@@ -0,0 +1,75 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewDial(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		backend   *Backend
+		shouldErr bool
+	}{
+		{nil, false},
+		// Connecting with IPv6 fails right away, so IPv4 is tried without waiting for the fallback delay.
+		{&Backend{PreferIP: IPv6, FallbackDelay: time.Hour}, false},
+		{&Backend{PreferIP: IPv4}, false},
+		{&Backend{SourceAddresses: []net.IP{net.ParseIP("127.0.0.1")}}, false},
+		{&Backend{PreferIP: IPv6, SourceAddresses: []net.IP{net.ParseIP("127.0.0.1")}}, false},
+		// Only IPv6 is used with an IPv6 source address.
+		{&Backend{PreferIP: IPv4, SourceAddresses: []net.IP{net.ParseIP("::1")}}, true},
+	}
+
+	for i, test := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := newDial(test.backend)(ctx, "tcp", listener.Addr().String())
+		cancel()
+
+		if test.shouldErr {
+			if err == nil {
+				conn.Close()
+				t.Errorf("Test %d expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d expected no error, got %v", i, err)
+			continue
+		}
+		if local := conn.LocalAddr().(*net.TCPAddr); !local.IP.Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("Test %d expected a connection from 127.0.0.1, got %v", i, local)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// digestAlgorithms are the supported digest algorithms, strongest first.
+var digestAlgorithms = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"sha-512", sha512.New},
+	{"sha-256", sha256.New},
+}
+
+// digestVerifier hashes the body of a response to compare it with the digest the backend sent along.
+type digestVerifier struct {
+	algorithm string
+	hash      hash.Hash
+	expected  []byte
+}
+
+// newDigestVerifier returns a verifier for the strongest supported digest in the Content-Digest (RFC 9530) or
+// Digest (RFC 3230) header of hdr, or nil if there is none. Digests with unsupported algorithms are ignored.
+func newDigestVerifier(hdr http.Header) (*digestVerifier, error) {
+	digests := map[string]string{}
+	for _, member := range strings.Split(strings.Join(hdr.Values("Digest"), ","), ",") {
+		if i := strings.Index(member, "="); i > 0 {
+			digests[strings.ToLower(strings.TrimSpace(member[:i]))] = strings.TrimSpace(member[i+1:])
+		}
+	}
+	// Content-Digest takes precedence. Its values are byte sequences enclosed in colons.
+	for _, member := range strings.Split(strings.Join(hdr.Values("Content-Digest"), ","), ",") {
+		if i := strings.Index(member, "="); i > 0 {
+			value := strings.TrimSpace(member[i+1:])
+			if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+				return nil, fmt.Errorf("invalid Content-Digest: %s", member)
+			}
+			digests[strings.ToLower(strings.TrimSpace(member[:i]))] = value[1 : len(value)-1]
+		}
+	}
+
+	for _, algorithm := range digestAlgorithms {
+		value, ok := digests[algorithm.name]
+		if !ok {
+			continue
+		}
+		expected, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s digest: %v", algorithm.name, err)
+		}
+		return &digestVerifier{algorithm: algorithm.name, hash: algorithm.new(), expected: expected}, nil
+	}
+	return nil, nil
+}
+
+// wrap returns body, hashing everything read from it.
+func (v *digestVerifier) wrap(body io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(body, v.hash), body}
+}
+
+// verify reads the rest of the wrapped body and returns an error if it does not match the expected digest, e.g.
+// because it was truncated or corrupted.
+func (v *digestVerifier) verify(body io.Reader) error {
+	if _, err := io.Copy(ioutil.Discard, io.LimitReader(body, MaxHTTPBodySize)); err != nil {
+		return err
+	}
+	if !bytes.Equal(v.hash.Sum(nil), v.expected) {
+		return fmt.Errorf("body does not match its %s digest", v.algorithm)
+	}
+	return nil
+}
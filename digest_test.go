@@ -0,0 +1,68 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDigestVerifier(t *testing.T) {
+	// printf 1.2.3.4 | openssl dgst -sha256 -binary | base64
+	const sha256Digest = "ZpT4PJ9HbaMfXfa8xSADTn5X1CHSR7nTT0ntv8hKdkw="
+
+	tests := []struct {
+		header    http.Header
+		body      string
+		verifies  bool
+		shouldErr bool
+	}{
+		{http.Header{}, "1.2.3.4", false, false},
+		{http.Header{"Content-Digest": {"sha-256=:" + sha256Digest + ":"}}, "1.2.3.4", true, false},
+		{http.Header{"Content-Digest": {"sha-256=:" + sha256Digest + ":"}}, "1.2.3.", true, true},
+		{http.Header{"Content-Digest": {"md5=:AAAA:, SHA-256=:" + sha256Digest + ":"}}, "1.2.3.4", true, false},
+		{http.Header{"Content-Digest": {"md5=:AAAA:"}}, "1.2.3.4", false, false},
+		{http.Header{"Content-Digest": {"sha-256=" + sha256Digest}}, "1.2.3.4", false, true},
+		{http.Header{"Content-Digest": {"sha-256=:not base64:"}}, "1.2.3.4", false, true},
+		{http.Header{"Digest": {"SHA-256=" + sha256Digest}}, "1.2.3.4", true, false},
+		{http.Header{"Digest": {"SHA-256=" + sha256Digest}}, "1.2.3.5", true, true},
+		// Content-Digest takes precedence over Digest.
+		{http.Header{
+			"Content-Digest": {"sha-256=:" + sha256Digest + ":"},
+			"Digest":         {"SHA-256=AAAA"},
+		}, "1.2.3.4", true, false},
+	}
+
+	for i, test := range tests {
+		verifier, err := newDigestVerifier(test.header)
+		if err == nil && verifier != nil {
+			body := verifier.wrap(ioutil.NopCloser(strings.NewReader(test.body)))
+			// Part of the body is read before the rest is verified.
+			body.Read(make([]byte, 3))
+			err = verifier.verify(body)
+		}
+
+		if (verifier != nil) != test.verifies {
+			t.Errorf("Test %d expected verification: %v, got %v", i, test.verifies, verifier != nil)
+		}
+		if err != nil && !test.shouldErr {
+			t.Errorf("Test %d expected no error, got %v", i, err)
+		} else if err == nil && test.shouldErr {
+			t.Errorf("Test %d expected an error", i)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"crypto"
+	"fmt"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Signatures are valid for SignatureValidity, starting SignatureInception before they are made to allow for clock
+// skew. They are made anew once a quarter of their validity is left.
+const (
+	SignatureValidity  = 8 * 24 * time.Hour
+	SignatureInception = 3 * time.Hour
+)
+
+// DNSKEYTTL is the TTL of DNSKEY records.
+const DNSKEYTTL = 3600
+
+// signatureCacheSize is the number of signatures of RRsets kept.
+const signatureCacheSize = 10000
+
+// zoneKey is a key answers for the zone of its owner name are signed with.
+type zoneKey struct {
+	key    *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// readZoneKey reads a key from the files base.key and base.private as written by dnssec-keygen, e.g.
+// Kexample.com.+013+12345.
+func readZoneKey(base string) (zoneKey, error) {
+	base = strings.TrimSuffix(strings.TrimSuffix(base, ".key"), ".private")
+
+	public, err := os.Open(base + ".key")
+	if err != nil {
+		return zoneKey{}, err
+	}
+	defer public.Close()
+	rr, err := dns.ReadRR(public, base+".key")
+	if err != nil {
+		return zoneKey{}, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return zoneKey{}, fmt.Errorf("no DNSKEY in %s.key", base)
+	}
+	key.Hdr.Name = plugin.Name(key.Hdr.Name).Normalize()
+	key.Hdr.Ttl = DNSKEYTTL
+
+	private, err := os.Open(base + ".private")
+	if err != nil {
+		return zoneKey{}, err
+	}
+	defer private.Close()
+	privateKey, err := key.ReadPrivateKey(private, base+".private")
+	if err != nil {
+		return zoneKey{}, err
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return zoneKey{}, fmt.Errorf("unsupported private key in %s.private", base)
+	}
+	return zoneKey{key: key, signer: signer}, nil
+}
+
+// zoneSigner signs answers for the zones it has keys for on the fly.
+type zoneSigner struct {
+	keys    map[string][]zoneKey
+	origins []string
+	sigs    *cache.Cache
+	// blackLies are the origins of the zones names are denied with black lies for.
+	blackLies map[string]bool
+}
+
+// newZoneSigner returns a signer with the keys of the backends, or nil if they have none.
+func newZoneSigner(backends []*Backend) (*zoneSigner, error) {
+	s := &zoneSigner{
+		keys:      make(map[string][]zoneKey),
+		sigs:      cache.New(signatureCacheSize),
+		blackLies: make(map[string]bool),
+	}
+	for _, backend := range backends {
+		for _, path := range backend.DNSSECKeys {
+			key, err := readZoneKey(path)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read DNSSEC key %s: %v", path, err)
+			}
+			origin := key.key.Hdr.Name
+			if _, ok := s.keys[origin]; !ok {
+				s.origins = append(s.origins, origin)
+			}
+			s.keys[origin] = append(s.keys[origin], key)
+			if backend.BlackLies {
+				s.blackLies[origin] = true
+			}
+		}
+	}
+	if len(s.origins) == 0 {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// zone returns the origin of the signed zone name belongs to, or "" if there is none.
+func (s *zoneSigner) zone(name string) string {
+	if s == nil {
+		return ""
+	}
+	return plugin.Zones(s.origins).Matches(name)
+}
+
+// dnskeys returns the DNSKEY records of the signed zone with origin.
+func (s *zoneSigner) dnskeys(origin string) []dns.RR {
+	var rrs []dns.RR
+	for _, key := range s.keys[origin] {
+		rrs = append(rrs, key.key)
+	}
+	return rrs
+}
+
+// signWriter returns w signing the responses to r for the signed zone of the queried name, if the client asked for
+// DNSSEC records, or w itself otherwise.
+func (h HTTPRecord) signWriter(w dns.ResponseWriter, state request.Request) dns.ResponseWriter {
+	origin := h.signer.zone(state.Name())
+	if origin == "" || !state.Do() {
+		return w
+	}
+	return &signingResponseWriter{ResponseWriter: w, signer: h.signer, origin: origin, state: state}
+}
+
+// signingResponseWriter signs the responses for a signed zone before writing them.
+type signingResponseWriter struct {
+	dns.ResponseWriter
+	signer *zoneSigner
+	origin string
+	state  request.Request
+}
+
+func (w *signingResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.signer.sign(m, w.state, w.origin, time.Now())
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// sign adds signatures to the RRsets of the zone with origin in m and, if m is negative, NSEC records denying the
+// existence of the queried name or type. Names that do not exist are denied with NSEC records covering only them and
+// the wildcard at their parent (RFC 4470), or with black lies: a NODATA response with an NSEC record for the name
+// listing no types, so that neither neighbouring names nor the wildcard need to be known. Types are denied with an
+// NSEC record for the name listing all others.
+func (s *zoneSigner) sign(m *dns.Msg, state request.Request, origin string, now time.Time) {
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		m.SetEdns0(uint16(state.Size()), true)
+	}
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return
+	}
+
+	if cut := delegated(m, origin); cut != "" {
+		// Referrals are not authoritative, so neither the NS records nor glue are signed. An NSEC record for the
+		// delegation proves that it has no DS records, i.e. that the child zone is not signed.
+		nsec := newNSEC(cut, child("\\000", cut), m.Ns[0].Header().Ttl, []uint16{dns.TypeNS})
+		m.Ns = append(m.Ns, nsec)
+		m.Ns = append(m.Ns, s.signatures([]dns.RR{nsec}, origin, now)...)
+		return
+	}
+
+	if len(m.Answer) == 0 {
+		var soa *dns.SOA
+		for _, rr := range m.Ns {
+			if rr, ok := rr.(*dns.SOA); ok && rr.Hdr.Name == origin {
+				soa = rr
+			}
+		}
+		if soa == nil {
+			// Without SOA record, there is nothing that could be signed to prove the denial.
+			return
+		}
+
+		ttl := soa.Minttl
+		if soa.Hdr.Ttl < ttl {
+			ttl = soa.Hdr.Ttl
+		}
+		name := state.Name()
+		switch {
+		case m.Rcode == dns.RcodeNameError && s.blackLies[origin]:
+			m.Rcode = dns.RcodeSuccess
+			m.Ns = append(m.Ns, newNSEC(name, child("\\000", name), ttl, nil))
+		case m.Rcode == dns.RcodeNameError:
+			if previous := predecessor(name); previous != "" {
+				m.Ns = append(m.Ns, newNSEC(previous, child("\\000", name), ttl, nil))
+			}
+			encloser := parent(name)
+			m.Ns = append(m.Ns, newNSEC(child("\\)", encloser), child("+", encloser), ttl, nil))
+		default:
+			m.Ns = append(m.Ns, newNSEC(name, child("\\000", name), ttl, existingTypes(state.QType(), name == origin)))
+		}
+	}
+
+	m.Answer = s.signRRsets(m.Answer, origin, now)
+	m.Ns = s.signRRsets(m.Ns, origin, now)
+	m.Extra = s.signRRsets(m.Extra, origin, now)
+}
+
+// delegated returns the name of the child zone m refers to if it is a referral from the zone with origin, or "".
+func delegated(m *dns.Msg, origin string) string {
+	if len(m.Answer) > 0 {
+		return ""
+	}
+	for _, rr := range m.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return ""
+		}
+	}
+	for _, rr := range m.Ns {
+		if rr.Header().Rrtype == dns.TypeNS && rr.Header().Name != origin {
+			return rr.Header().Name
+		}
+	}
+	return ""
+}
+
+// signRRsets returns rrs with signatures for the RRsets of the zone with origin in them.
+func (s *zoneSigner) signRRsets(rrs []dns.RR, origin string, now time.Time) []dns.RR {
+	signed := rrs
+	for _, rrset := range rrsets(rrs) {
+		header := rrset[0].Header()
+		if header.Rrtype == dns.TypeOPT || header.Rrtype == dns.TypeRRSIG || !plugin.Name(origin).Matches(header.Name) ||
+			(header.Rrtype == dns.TypeNS && header.Name != origin) {
+			continue
+		}
+		signed = append(signed, s.signatures(rrset, origin, now)...)
+	}
+	return signed
+}
+
+// signatures returns the signatures of rrset by the keys of the zone with origin, reusing earlier ones while more
+// than a quarter of their validity is left. The TTLs of the records in rrset are set to the lowest of them.
+func (s *zoneSigner) signatures(rrset []dns.RR, origin string, now time.Time) []dns.RR {
+	ttl := rrset[0].Header().Ttl
+	for _, rr := range rrset {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	for _, rr := range rrset {
+		rr.Header().Ttl = ttl
+	}
+
+	// Signatures do not depend on the TTLs of the records, which can be lower than the original TTL.
+	hasher := fnv.New64()
+	records := make([]string, len(rrset))
+	for i, rr := range rrset {
+		records[i] = strings.TrimPrefix(rr.String(), rr.Header().String())
+	}
+	sort.Strings(records)
+	fmt.Fprintf(hasher, "%s %s %d %s", origin, rrset[0].Header().Name, rrset[0].Header().Rrtype,
+		strings.Join(records, " "))
+	key := hasher.Sum64()
+
+	if cached, ok := s.sigs.Get(key); ok {
+		sigs := cached.([]dns.RR)
+		if now.Add(SignatureValidity / 4).Before(time.Unix(int64(sigs[0].(*dns.RRSIG).Expiration), 0)) {
+			fresh := make([]dns.RR, len(sigs))
+			for i, sig := range sigs {
+				fresh[i] = dns.Copy(sig)
+				fresh[i].Header().Ttl = ttl
+			}
+			return fresh
+		}
+	}
+
+	var sigs []dns.RR
+	for _, key := range s.keys[origin] {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: ttl},
+			Algorithm:  key.key.Algorithm,
+			SignerName: origin,
+			KeyTag:     key.key.KeyTag(),
+			Inception:  uint32(now.Add(-SignatureInception).Unix()),
+			Expiration: uint32(now.Add(SignatureValidity).Unix()),
+		}
+		if err := sig.Sign(key.signer, rrset); err != nil {
+			continue
+		}
+		sigs = append(sigs, sig)
+	}
+	if len(sigs) > 0 {
+		s.sigs.Add(key, sigs)
+	}
+	return sigs
+}
+
+// rrsets groups rrs into RRsets, in the order their first records appear in.
+func rrsets(rrs []dns.RR) [][]dns.RR {
+	type rrsetKey struct {
+		name  string
+		rtype uint16
+	}
+	var keys []rrsetKey
+	sets := make(map[rrsetKey][]dns.RR)
+	for _, rr := range rrs {
+		key := rrsetKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		if _, ok := sets[key]; !ok {
+			keys = append(keys, key)
+		}
+		sets[key] = append(sets[key], rr)
+	}
+
+	grouped := make([][]dns.RR, len(keys))
+	for i, key := range keys {
+		grouped[i] = sets[key]
+	}
+	return grouped
+}
+
+// newNSEC returns an NSEC record for name with the types, besides RRSIG and NSEC.
+func newNSEC(name, next string, ttl uint32, types []uint16) *dns.NSEC {
+	types = append([]uint16{dns.TypeRRSIG, dns.TypeNSEC}, types...)
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+// existingTypes returns the types a name could have records of, except qtype. Only qtype is denied, as other types
+// could exist.
+func existingTypes(qtype uint16, apex bool) []uint16 {
+	var types []uint16
+	for name := range responseToRR {
+		if t := dns.StringToType[name]; t != qtype {
+			types = append(types, t)
+		}
+	}
+	if apex {
+		for _, t := range []uint16{dns.TypeSOA, dns.TypeDNSKEY} {
+			if t != qtype {
+				types = append(types, t)
+			}
+		}
+	}
+	return types
+}
+
+// predecessor returns a name immediately preceding name in canonical order, with the last octet of its first label
+// decremented and as many \255 octets as possible appended, or "" if that would be the parent of name.
+func predecessor(name string) string {
+	wire := make([]byte, 256)
+	size, err := dns.PackDomainName(name, wire, 0, nil, false)
+	if err != nil {
+		return ""
+	}
+	label := append([]byte(nil), wire[1:1+wire[0]]...)
+
+	if label[len(label)-1] == 0 {
+		label = label[:len(label)-1]
+		if len(label) == 0 {
+			return ""
+		}
+	} else {
+		label[len(label)-1]--
+		for len(label) < 63 && size-int(wire[0])+len(label) < 255 {
+			label = append(label, 255)
+		}
+	}
+
+	var b strings.Builder
+	for _, c := range label {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\%03d", c)
+		}
+	}
+	return child(b.String(), parent(name))
+}
+
+// parent returns the name of the parent of name.
+func parent(name string) string {
+	i, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[i:]
+}
+
+// child returns the name with label prepended to name.
+func child(label, name string) string {
+	if name == "." {
+		return label + "."
+	}
+	return label + "." + name
+}
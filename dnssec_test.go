@@ -0,0 +1,270 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"bytes"
+	"context"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeZoneKey generates a key for origin and writes it to dir, returning the path for the dnssec directive.
+func writeZoneKey(t *testing.T, dir, origin string) string {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: origin, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	private, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := filepath.Join(dir, "K"+origin)
+	if err := ioutil.WriteFile(base+".key", []byte(key.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(base+".private", []byte(key.PrivateKeyString(private)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return base
+}
+
+func TestHTTPRecord_DNSSEC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httprecord")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/www.example.com.":
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Write([]byte(`{"answer": [{"name": "www.example.com.", "type": "A", "data": "192.0.2.1"}]}`))
+		case "/missing.example.com.":
+			http.NotFound(rw, r)
+		default:
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Write([]byte(`{}`))
+		}
+	}))
+	defer ts.Close()
+
+	backend := &Backend{
+		DNSSECKeys: []string{writeZoneKey(t, dir, "example.com.")},
+		SOA: &SOAParameters{Ns: "ns", Mbox: "hostmaster", Serial: 1, Refresh: 7200, Retry: 1800, Expire: 1209600,
+			MinTTL: 300},
+	}
+	config := HTTPRecord{
+		Zones:   []Zone{{Origin: "example.com.", URI: ts.URL + "/%(fqdn)", Backend: backend}},
+		Timeout: time.Second,
+	}
+	if config.signer, err = newZoneSigner(config.backends()); err != nil {
+		t.Fatal(err)
+	}
+	key := config.signer.dnskeys("example.com.")[0].(*dns.DNSKEY)
+
+	tests := []struct {
+		qname string
+		qtype uint16
+		rcode int
+		// covered are the names denied by NSEC records in the authority section.
+		covered []string
+	}{
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, nil},
+		{"example.com.", dns.TypeDNSKEY, dns.RcodeSuccess, nil},
+		{"www.example.com.", dns.TypeTXT, dns.RcodeSuccess, nil},
+		{"missing.example.com.", dns.TypeA, dns.RcodeNameError, []string{"missing.example.com.", "*.example.com."}},
+	}
+
+	for i, c := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		msg := new(dns.Msg).SetQuestion(c.qname, c.qtype)
+		msg.SetEdns0(4096, true)
+		config.ServeDNS(context.TODO(), rec, msg)
+		if rec.Msg == nil {
+			t.Errorf("Test %d: expected a response", i)
+			continue
+		}
+		if rec.Msg.Rcode != c.rcode {
+			t.Errorf("Test %d: expected rcode %s, got %s", i, dns.RcodeToString[c.rcode], dns.RcodeToString[rec.Msg.Rcode])
+		}
+		if opt := rec.Msg.IsEdns0(); opt == nil || !opt.Do() {
+			t.Errorf("Test %d: expected DO bit in response", i)
+		}
+
+		for _, section := range [][]dns.RR{rec.Msg.Answer, rec.Msg.Ns} {
+			sigs := 0
+			for _, rrset := range rrsets(section) {
+				if rrset[0].Header().Rrtype == dns.TypeRRSIG {
+					continue
+				}
+				verified := false
+				for _, rr := range section {
+					if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rrset[0].Header().Rrtype &&
+						sig.Hdr.Name == rrset[0].Header().Name {
+						sigs++
+						verified = sig.Verify(key, rrset) == nil
+					}
+				}
+				if !verified {
+					t.Errorf("Test %d: expected valid signature for %s", i, rrset[0].Header())
+				}
+			}
+			if len(section) > 0 && sigs == 0 {
+				t.Errorf("Test %d: expected signatures in %v", i, section)
+			}
+		}
+
+		for _, name := range c.covered {
+			covered := false
+			for _, rr := range rec.Msg.Ns {
+				if nsec, ok := rr.(*dns.NSEC); ok && canonicalLess(nsec.Hdr.Name, name) && canonicalLess(name, nsec.NextDomain) {
+					covered = true
+				}
+			}
+			if !covered {
+				t.Errorf("Test %d: expected NSEC covering %s, got %v", i, name, rec.Msg.Ns)
+			}
+		}
+		if c.qtype == dns.TypeTXT {
+			var nsec *dns.NSEC
+			for _, rr := range rec.Msg.Ns {
+				if rr, ok := rr.(*dns.NSEC); ok {
+					nsec = rr
+				}
+			}
+			if nsec == nil || nsec.Hdr.Name != c.qname || !hasType(nsec.TypeBitMap, dns.TypeA) ||
+				hasType(nsec.TypeBitMap, dns.TypeTXT) {
+				t.Errorf("Test %d: expected NSEC denying only TXT, got %v", i, nsec)
+			}
+		}
+	}
+
+	// Clients not asking for DNSSEC records get none.
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	config.ServeDNS(context.TODO(), rec, new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA))
+	if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+		t.Errorf("Expected unsigned answer, got %v", rec.Msg)
+	}
+}
+
+func TestHTTPRecord_BlackLies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httprecord")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	backend := &Backend{
+		DNSSECKeys: []string{writeZoneKey(t, dir, "example.com.")},
+		BlackLies:  true,
+		SOA: &SOAParameters{Ns: "ns", Mbox: "hostmaster", Serial: 1, Refresh: 7200, Retry: 1800, Expire: 1209600,
+			MinTTL: 300},
+	}
+	config := HTTPRecord{
+		Zones:   []Zone{{Origin: "example.com.", URI: ts.URL + "/%(fqdn)", Backend: backend}},
+		Timeout: time.Second,
+	}
+	if config.signer, err = newZoneSigner(config.backends()); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	msg := new(dns.Msg).SetQuestion("missing.example.com.", dns.TypeA)
+	msg.SetEdns0(4096, true)
+	config.ServeDNS(context.TODO(), rec, msg)
+	if rec.Msg == nil {
+		t.Fatal("Expected a response")
+	}
+	if rec.Msg.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected NODATA, got %s", dns.RcodeToString[rec.Msg.Rcode])
+	}
+
+	var nsecs []*dns.NSEC
+	for _, rr := range rec.Msg.Ns {
+		if nsec, ok := rr.(*dns.NSEC); ok {
+			nsecs = append(nsecs, nsec)
+		}
+	}
+	if len(nsecs) != 1 || nsecs[0].Hdr.Name != "missing.example.com." ||
+		nsecs[0].NextDomain != "\\000.missing.example.com." ||
+		!reflect.DeepEqual(nsecs[0].TypeBitMap, []uint16{dns.TypeRRSIG, dns.TypeNSEC}) {
+		t.Errorf("Expected a single NSEC for the name without types, got %v", nsecs)
+	}
+}
+
+func hasType(types []uint16, t uint16) bool {
+	for _, u := range types {
+		if u == t {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalLess returns whether a sorts before b in canonical order (RFC 4034).
+func canonicalLess(a, b string) bool {
+	labels := func(name string) [][]byte {
+		wire := make([]byte, 256)
+		dns.PackDomainName(dns.CanonicalName(name), wire, 0, nil, false)
+		var labels [][]byte
+		for off := 0; wire[off] != 0; off += int(wire[off]) + 1 {
+			labels = append([][]byte{wire[off+1 : off+1+int(wire[off])]}, labels...)
+		}
+		return labels
+	}
+
+	la, lb := labels(a), labels(b)
+	for i := 0; i < len(la) && i < len(lb); i++ {
+		if c := bytes.Compare(la[i], lb[i]); c != 0 {
+			return c < 0
+		}
+	}
+	return len(la) < len(lb)
+}
+
+func TestPredecessor(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"b.example.com.", "a" + strings.Repeat("\\255", 62) + ".example.com."},
+		{"a\\000.example.com.", "a.example.com."},
+		{"\\000.example.com.", ""},
+	}
+
+	for i, c := range tests {
+		if got := predecessor(c.name); got != c.expected {
+			t.Errorf("Test %d: expected %q, got %q", i, c.expected, got)
+		}
+	}
+}
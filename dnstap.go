@@ -0,0 +1,87 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"github.com/coredns/coredns/plugin/dnstap/msg"
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"time"
+)
+
+// tapper is implemented by the dnstap plugin.
+type tapper interface {
+	TapMessage(m *tap.Message)
+}
+
+// taps sends the answers of lookups to the dnstap plugin.
+type taps struct {
+	tapper tapper
+	// raw includes the query and the answer in the messages.
+	raw bool
+}
+
+// tapWriter returns w, which messages to the dnstap plugin are sent for if it is enabled.
+func (h HTTPRecord) tapWriter(w dns.ResponseWriter, query *dns.Msg, start time.Time, zone string,
+	reqs []backendRequest) dns.ResponseWriter {
+	if h.taps == nil || h.taps.tapper == nil {
+		return w
+	}
+	return &tapResponseWriter{ResponseWriter: w, taps: h.taps, query: query, start: start, zone: zone, reqs: reqs}
+}
+
+// tapResponseWriter sends the answer to a lookup to the dnstap plugin as it is written. Answers from the backends
+// are sent as FORWARDER_RESPONSE and answers from the caches as AUTH_RESPONSE.
+type tapResponseWriter struct {
+	dns.ResponseWriter
+	taps  *taps
+	query *dns.Msg
+	start time.Time
+	zone  string
+	// reqs are the requests of the lookup, the first of which tells whether it was answered from the caches.
+	reqs []backendRequest
+}
+
+func (w *tapResponseWriter) WriteMsg(m *dns.Msg) error {
+	err := w.ResponseWriter.WriteMsg(m)
+
+	t := new(tap.Message)
+	msg.SetQueryTime(t, w.start)
+	msg.SetResponseTime(t, time.Now())
+	msg.SetQueryAddress(t, w.RemoteAddr())
+	msg.SetResponseAddress(t, w.LocalAddr())
+	if w.zone != "" {
+		zone := make([]byte, 256)
+		if n, err := dns.PackDomainName(w.zone, zone, 0, nil, false); err == nil {
+			t.QueryZone = zone[:n]
+		}
+	}
+	if w.taps.raw {
+		t.QueryMessage, _ = w.query.Pack()
+		t.ResponseMessage, _ = m.Pack()
+	}
+	if w.cached() {
+		msg.SetType(t, tap.Message_AUTH_RESPONSE)
+	} else {
+		msg.SetType(t, tap.Message_FORWARDER_RESPONSE)
+	}
+	w.taps.tapper.TapMessage(t)
+	return err
+}
+
+// cached returns whether the lookup was answered from the caches.
+func (w *tapResponseWriter) cached() bool {
+	return len(w.reqs) > 0 && (w.reqs[0].CacheResult == "hit" || w.reqs[0].CacheResult == "stale")
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testTapper []*tap.Message
+
+func (t *testTapper) TapMessage(m *tap.Message) {
+	*t = append(*t, m)
+}
+
+func TestHTTPRecord_Dnstap(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+
+	tapper := new(testTapper)
+	config := HTTPRecord{
+		Zones:          []Zone{{URI: server.URL + "/%(fqdn)", Origin: "example.com."}},
+		CacheResponses: true,
+		Cache:          cache.New(100),
+		Timeout:        time.Second,
+		taps:           &taps{tapper: tapper, raw: true},
+	}
+	for i := 0; i < 2; i++ {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		msg := new(dns.Msg)
+		msg.SetQuestion("foo.example.com.", dns.TypeA)
+		if _, err := config.ServeDNS(context.TODO(), rec, msg); err != nil {
+			t.Fatalf("Lookup %d: unexpected error %v", i, err)
+		}
+	}
+
+	expected := []tap.Message_Type{tap.Message_FORWARDER_RESPONSE, tap.Message_AUTH_RESPONSE}
+	if len(*tapper) != len(expected) {
+		t.Fatalf("Expected %d messages, got %d", len(expected), len(*tapper))
+	}
+	for i, m := range *tapper {
+		if m.GetType() != expected[i] {
+			t.Errorf("Message %d: expected type %v, got %v", i, expected[i], m.GetType())
+		}
+		zone, _, err := dns.UnpackDomainName(m.QueryZone, 0)
+		if err != nil || zone != "example.com." {
+			t.Errorf("Message %d: expected zone example.com., got %q (%v)", i, zone, err)
+		}
+		response := new(dns.Msg)
+		if err := response.Unpack(m.ResponseMessage); err != nil || len(response.Answer) != 1 {
+			t.Errorf("Message %d: expected response with 1 answer, got %v (%v)", i, response, err)
+		}
+		if len(m.QueryMessage) == 0 {
+			t.Errorf("Message %d: expected query", i)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// DNSMessageContentType is the content type of DNS messages in wire format (RFC 8484).
+const DNSMessageContentType = "application/dns-message"
+
+// forwards returns whether queries for name are forwarded with DNS-over-HTTPS, in which case they are not limited to
+// the supported types.
+func (h HTTPRecord) forwards(name string) bool {
+	return h.lookups().forwards(name)
+}
+
+// dohRequest turns req into a DNS-over-HTTPS request for the query r.
+func dohRequest(req backendRequest, r *dns.Msg) (backendRequest, error) {
+	query := r.Copy()
+	// The ID is 0 to make identical queries cacheable.
+	query.Id = 0
+	body, err := query.Pack()
+	if err != nil {
+		return req, err
+	}
+
+	req.Method = http.MethodPost
+	req.Body = body
+	req.ContentType = DNSMessageContentType
+	return req, nil
+}
+
+// relay writes the DNS message in response as response to r.
+func relay(w dns.ResponseWriter, r *dns.Msg, response backendResponse) (int, error) {
+	if mediatype, _, err := mime.ParseMediaType(response.ContentType); err != nil || mediatype != DNSMessageContentType {
+		return dns.RcodeServerFailure, fmt.Errorf("unexpected content type from %s: %s", response.URI,
+			response.ContentType)
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(response.Payload); err != nil {
+		return dns.RcodeServerFailure, fmt.Errorf("invalid DNS message from %s: %v", response.URI, err)
+	}
+	if !m.Response || len(m.Question) != 1 || len(r.Question) != 1 ||
+		!strings.EqualFold(m.Question[0].Name, r.Question[0].Name) || m.Question[0].Qtype != r.Question[0].Qtype {
+		return dns.RcodeServerFailure, fmt.Errorf("DNS message from %s does not answer the query", response.URI)
+	}
+
+	m.Id = r.Id
+	m.Question = r.Question
+	w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
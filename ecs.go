@@ -0,0 +1,83 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ECSHeader is the HTTP request header carrying the EDNS Client Subnet of the query as ADDRESS/PREFIX to backends with
+// ECS set.
+const ECSHeader = "X-DNS-ECS"
+
+// ECSScopeHeader is the HTTP response header a backend can use to tell the prefix length of the networks its response
+// applies to, e.g. 0 if it does not depend on the client subnet at all.
+const ECSScopeHeader = "X-DNS-ECS-Scope"
+
+// subnetOption returns the EDNS Client Subnet option of r, or nil if it has none.
+func subnetOption(r *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok && subnet.Address != nil {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// ecsScope returns the scope prefix length in hdr, or nil if there is none or it is invalid.
+func ecsScope(hdr http.Header, uri string) *uint8 {
+	value := strings.TrimSpace(hdr.Get(ECSScopeHeader))
+	if value == "" {
+		return nil
+	}
+	scope, err := strconv.ParseUint(value, 10, 8)
+	if err != nil || scope > 128 {
+		log.Warningf("Ignoring invalid %s from %s: %s", ECSScopeHeader, uri, value)
+		return nil
+	}
+	s := uint8(scope)
+	return &s
+}
+
+// setClientSubnet adds the EDNS Client Subnet of the query in state to m if it has one (RFC 7871). Its scope is the
+// one the backend responded with, or the source prefix length of the query if it did not.
+func setClientSubnet(m *dns.Msg, state request.Request, scope *uint8) {
+	subnet := subnetOption(state.Req)
+	if subnet == nil {
+		return
+	}
+
+	echo := *subnet
+	echo.SourceScope = echo.SourceNetmask
+	if scope != nil {
+		echo.SourceScope = *scope
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(uint16(state.Size()), state.Do())
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &echo)
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPRecord_ECS(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Cache-Control", "max-age=60")
+		switch r.Header.Get(ECSHeader) {
+		case "":
+			rw.Write([]byte(`{"answer": [{"name": "www.example.com.", "type": "A", "data": "192.0.2.1"}]}`))
+		case "198.51.100.0/24":
+			rw.Header().Set(ECSScopeHeader, "16")
+			rw.Write([]byte(`{"answer": [{"name": "www.example.com.", "type": "A", "data": "192.0.2.2"}]}`))
+		default:
+			rw.Write([]byte(`{"answer": [{"name": "www.example.com.", "type": "A", "data": "192.0.2.3"}]}`))
+		}
+	}))
+	defer ts.Close()
+
+	config := HTTPRecord{
+		Records:        []Record{{Name: "www.example.com.", Type: "A", URI: ts.URL, Backend: &Backend{ECS: true}}},
+		Timeout:        time.Second,
+		Cache:          cache.New(100),
+		CacheResponses: true,
+	}
+
+	tests := []struct {
+		subnet   string
+		expected string
+		// scope is the scope of the client subnet in the response, which is only checked if there is one.
+		scope uint8
+	}{
+		{"", "192.0.2.1", 0},
+		{"198.51.100.0/24", "192.0.2.2", 16},
+		{"203.0.113.0/24", "192.0.2.3", 24},
+		// Responses are kept per client subnet.
+		{"198.51.100.0/24", "192.0.2.2", 16},
+	}
+
+	for i, c := range tests {
+		msg := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+		if c.subnet != "" {
+			_, network, _ := net.ParseCIDR(c.subnet)
+			ones, _ := network.Mask.Size()
+			msg.SetEdns0(4096, false)
+			msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: network.IP})
+		}
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		config.ServeDNS(context.TODO(), rec, msg)
+		if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+			t.Errorf("Test %d: expected a single answer, got %v", i, rec.Msg)
+			continue
+		}
+		if got := rec.Msg.Answer[0].(*dns.A).A.String(); got != c.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, c.expected, got)
+		}
+
+		subnet := subnetOption(rec.Msg)
+		switch {
+		case c.subnet == "" && subnet != nil:
+			t.Errorf("Test %d: expected no client subnet, got %v", i, subnet)
+		case c.subnet != "" && subnet == nil:
+			t.Errorf("Test %d: expected client subnet", i)
+		case subnet != nil && subnet.SourceScope != c.scope:
+			t.Errorf("Test %d: expected scope %d, got %d", i, c.scope, subnet.SourceScope)
+		}
+	}
+
+	if requests != 3 {
+		t.Errorf("Expected 3 requests, got %d", requests)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+)
+
+// failureError returns the extended error (RFC 8914) explaining why the lookup with reqs failed with err: a timeout
+// or network error talking to the backend, an HTTP error status or a response that could not be parsed. If a cached
+// response was too old to be returned instead, this is added to the extra text. Details of err are left out, as they
+// could reveal backend URIs to clients.
+func failureError(err error, reqs []backendRequest) *dns.EDNS0_EDE {
+	var ede *dns.EDNS0_EDE
+	var netErr net.Error
+	var bie BackendIndicatedError
+	switch {
+	case errors.As(err, &bie) && bie.HTTPResponseCode >= 500:
+		ede = &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNetworkError,
+			ExtraText: fmt.Sprintf("backend responded with HTTP %d", bie.HTTPResponseCode)}
+	case errors.As(err, &bie):
+		return nil
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		ede = &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNoReachableAuthority, ExtraText: "backend timed out"}
+	case errors.As(err, &netErr):
+		ede = &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNetworkError, ExtraText: "backend unreachable"}
+	default:
+		ede = &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeOther, ExtraText: "backend request failed"}
+	}
+
+	if len(reqs) > 0 && reqs[0].Expired {
+		ede.ExtraText += ", cached response too old to be returned"
+	}
+	return ede
+}
+
+// invalidResponseError is the extended error for backend responses that could not be parsed or were invalid.
+func invalidResponseError() *dns.EDNS0_EDE {
+	return &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeInvalidData, ExtraText: "invalid backend response"}
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHTTPRecord_FailureError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/unavailable":
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		case "/invalid":
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Write([]byte(`{"answer": `))
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		path     string
+		edns     bool
+		expected *dns.EDNS0_EDE
+	}{
+		{"/unavailable", true,
+			&dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNetworkError, ExtraText: "backend responded with HTTP 503"}},
+		{"/slow", true, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNoReachableAuthority, ExtraText: "backend timed out"}},
+		{"/invalid", true, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeInvalidData, ExtraText: "invalid backend response"}},
+		// Without EDNS, CoreDNS responds with SERVFAIL by itself.
+		{"/unavailable", false, nil},
+	}
+
+	for i, c := range tests {
+		config := HTTPRecord{
+			Records: []Record{{Name: "www.example.com.", Type: "A", URI: ts.URL + c.path}},
+			Timeout: 50 * time.Millisecond,
+		}
+		msg := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+		if c.edns {
+			msg.SetEdns0(4096, false)
+		}
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, _ := config.ServeDNS(context.TODO(), rec, msg)
+		if rec.Msg != nil {
+			rcode = rec.Msg.Rcode
+		}
+		if rcode != dns.RcodeServerFailure {
+			t.Errorf("Test %d: expected SERVFAIL, got %s", i, dns.RcodeToString[rcode])
+		}
+
+		var ede *dns.EDNS0_EDE
+		if rec.Msg != nil && rec.Msg.IsEdns0() != nil {
+			for _, option := range rec.Msg.IsEdns0().Option {
+				if option, ok := option.(*dns.EDNS0_EDE); ok {
+					ede = option
+				}
+			}
+		}
+		if !reflect.DeepEqual(ede, c.expected) {
+			t.Errorf("Test %d: expected %v, got %v", i, c.expected, ede)
+		}
+	}
+}
+
+func TestFailureError_Expired(t *testing.T) {
+	err := BackendIndicatedError{HTTPResponseCode: 502, DNSResponseCode: dns.RcodeServerFailure}
+	ede := failureError(err, []backendRequest{{Expired: true}})
+	expected := "backend responded with HTTP 502, cached response too old to be returned"
+	if ede == nil || ede.ExtraText != expected {
+		t.Errorf("Expected %q, got %v", expected, ede)
+	}
+}
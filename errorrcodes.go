@@ -0,0 +1,117 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Conditions of failed lookups that are not HTTP status codes.
+const (
+	// ErrorTimeout is the condition of lookups the backend did not respond to in time.
+	ErrorTimeout = "timeout"
+	// ErrorUnreachable is the condition of lookups the backend could not be connected to for.
+	ErrorUnreachable = "unreachable"
+)
+
+// ErrorRcode is the rcode lookups failing with Condition are answered with instead of the one derived from the failure.
+type ErrorRcode struct {
+	// Condition is an HTTP status code the backend responded with, e.g. 403, a class of them, e.g. 4xx, ErrorTimeout or
+	// ErrorUnreachable.
+	Condition string
+	Rcode     int
+	// ExtendedError, if set, is the INFO-CODE of the extended DNS error (RFC 8914) responses carry.
+	ExtendedError *uint16
+}
+
+// matches returns whether condition, which is not a class of status codes, is the Condition of e or in it.
+func (e ErrorRcode) matches(condition string) bool {
+	return e.Condition == condition || strings.HasSuffix(e.Condition, "xx") && e.Condition[0] == condition[0]
+}
+
+// statusError is the error of backend responses with a status code that has no meaning for lookups.
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", int(e))
+}
+
+// validErrorCondition returns whether condition can be the Condition of an ErrorRcode.
+func validErrorCondition(condition string) bool {
+	if condition == ErrorTimeout || condition == ErrorUnreachable {
+		return true
+	}
+	if len(condition) == 3 && (condition[0] == '4' || condition[0] == '5') && strings.HasSuffix(condition, "xx") {
+		return true
+	}
+	status, err := strconv.Atoi(condition)
+	return err == nil && status >= 400 && status < 600
+}
+
+// errorCondition returns the condition err is in, with a status code in the format of the conditions of
+// ErrorRcode, and an explanation. Status codes are only returned if the backend did not ask for a specific rcode.
+func errorCondition(err error) (condition string, text string) {
+	var netErr net.Error
+	var bie BackendIndicatedError
+	var status statusError
+	switch {
+	case errors.As(err, &bie):
+		derived := dns.RcodeServerFailure
+		if bie.HTTPResponseCode == 404 {
+			derived = dns.RcodeNameError
+		}
+		if bie.HTTPResponseCode < 400 || bie.DNSResponseCode != derived || bie.ExtendedError != nil {
+			return "", ""
+		}
+		return strconv.Itoa(bie.HTTPResponseCode), fmt.Sprintf("backend responded with HTTP %d", bie.HTTPResponseCode)
+	case errors.As(err, &status):
+		return strconv.Itoa(int(status)), fmt.Sprintf("backend responded with HTTP %d", int(status))
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTimeout, "backend timed out"
+	case errors.As(err, &netErr):
+		return ErrorUnreachable, "backend unreachable"
+	}
+	return "", ""
+}
+
+// errorRcode returns the rcode and extended error of the first of h.ErrorRcodes matching the condition of err, or
+// false if there is none.
+func (h HTTPRecord) errorRcode(err error) (int, *dns.EDNS0_EDE, bool) {
+	if len(h.ErrorRcodes) == 0 {
+		return 0, nil, false
+	}
+	condition, text := errorCondition(err)
+	if condition == "" {
+		return 0, nil, false
+	}
+
+	for _, e := range h.ErrorRcodes {
+		if !e.matches(condition) {
+			continue
+		}
+		var ede *dns.EDNS0_EDE
+		if e.ExtendedError != nil {
+			ede = &dns.EDNS0_EDE{InfoCode: *e.ExtendedError, ExtraText: text}
+		}
+		return e.Rcode, ede, true
+	}
+	return 0, nil, false
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHTTPRecord_ErrorRcodes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/explicit":
+			rw.Header().Set("X-DNS-Rcode", "NXDOMAIN")
+			rw.WriteHeader(http.StatusForbidden)
+		default:
+			status, _ := strconv.Atoi(r.URL.Path[1:])
+			rw.WriteHeader(status)
+		}
+	}))
+	defer server.Close()
+
+	prohibited := dns.ExtendedErrorCodeProhibited
+	config := HTTPRecord{
+		Zones:   []Zone{{Origin: "example.com.", URI: server.URL + "/%(name)"}},
+		Timeout: 100 * time.Millisecond,
+		ErrorRcodes: []ErrorRcode{
+			{Condition: "403", Rcode: dns.RcodeRefused},
+			{Condition: "429", Rcode: dns.RcodeServerFailure, ExtendedError: &prohibited},
+			{Condition: "5xx", Rcode: dns.RcodeRefused},
+			{Condition: ErrorTimeout, Rcode: dns.RcodeRefused},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		rcode int
+		ede   *dns.EDNS0_EDE
+	}{
+		{"403.example.com.", dns.RcodeRefused, nil},
+		{"429.example.com.", dns.RcodeServerFailure, &dns.EDNS0_EDE{InfoCode: prohibited,
+			ExtraText: "backend responded with HTTP 429"}},
+		{"503.example.com.", dns.RcodeRefused, nil},
+		{"slow.example.com.", dns.RcodeRefused, nil},
+		{"404.example.com.", dns.RcodeNameError, nil},
+		{"explicit.example.com.", dns.RcodeNameError, nil},
+	}
+
+	for i, c := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		msg := new(dns.Msg).SetQuestion(c.name, dns.TypeA)
+		msg.SetEdns0(4096, false)
+		// Responses with rcodes such as REFUSED are written by CoreDNS unless they carry an extended error.
+		rcode, _ := config.ServeDNS(context.TODO(), rec, msg)
+		if rec.Msg != nil {
+			rcode = rec.Msg.Rcode
+		}
+		if rcode != c.rcode {
+			t.Errorf("Test %d: expected rcode %s, got %s", i, dns.RcodeToString[c.rcode], dns.RcodeToString[rcode])
+			continue
+		}
+
+		var ede *dns.EDNS0_EDE
+		if rec.Msg != nil && rec.Msg.IsEdns0() != nil {
+			for _, option := range rec.Msg.IsEdns0().Option {
+				if option, ok := option.(*dns.EDNS0_EDE); ok {
+					ede = option
+				}
+			}
+		}
+		if (ede == nil) != (c.ede == nil) || ede != nil && *ede != *c.ede {
+			t.Errorf("Test %d: expected extended error %v, got %v", i, c.ede, ede)
+		}
+	}
+}
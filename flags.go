@@ -0,0 +1,46 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// flagsWriter wraps w to set the header bits of responses to the query in state consistently: AA unless
+// NonAuthoritative is set or the response is a referral, RA only if RecursionAvailable is set, AD never as answers
+// are not validated, and CD as in the query. Responses relayed from DNS-over-HTTPS backends keep their bits.
+func (h HTTPRecord) flagsWriter(w dns.ResponseWriter, state request.Request) dns.ResponseWriter {
+	if h.forwards(state.Name()) {
+		return w
+	}
+	return &flagsResponseWriter{ResponseWriter: w, h: h, cd: state.Req.CheckingDisabled}
+}
+
+type flagsResponseWriter struct {
+	dns.ResponseWriter
+	h  HTTPRecord
+	cd bool
+}
+
+func (w *flagsResponseWriter) WriteMsg(m *dns.Msg) error {
+	if w.h.NonAuthoritative {
+		m.Authoritative = false
+	}
+	m.RecursionAvailable = w.h.RecursionAvailable
+	m.AuthenticatedData = false
+	m.CheckingDisabled = w.cd
+	return w.ResponseWriter.WriteMsg(m)
+}
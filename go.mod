@@ -5,5 +5,10 @@ go 1.16
 require (
 	github.com/coredns/caddy v1.1.1
 	github.com/coredns/coredns v1.8.6
+	github.com/dnstap/golang-dnstap v0.4.0
 	github.com/miekg/dns v1.1.43
+	github.com/opentracing/opentracing-go v1.2.0
+	github.com/prometheus/client_golang v1.11.0
+	golang.org/x/net v0.0.0-20210614182718-04defd469f4e
+	google.golang.org/protobuf v1.27.1
 )
@@ -0,0 +1,331 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxHealthCheckTimeout limits how long a health check waits for a response.
+const MaxHealthCheckTimeout = 5 * time.Second
+
+// HealthCheck configures periodic probes of a backend.
+type HealthCheck struct {
+	Interval time.Duration
+	// Method is the HTTP method of probes, HEAD by default.
+	Method string
+	// URI is probed instead of the URIs of the zones and records using the backend. A relative URI, e.g. /health, is
+	// resolved against each of them.
+	URI string
+}
+
+// healthChecker probes the URIs of a backend and keeps track of whether they are up.
+type healthChecker struct {
+	check   HealthCheck
+	backend *Backend
+	// probes maps the URIs of zones and records to the URIs probed for them.
+	probes map[string]string
+	uris   []string
+
+	mu   sync.RWMutex
+	down map[string]bool
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+func newHealthChecker(backend *Backend, probes map[string]string) *healthChecker {
+	var uris []string
+	seen := make(map[string]bool)
+	for _, uri := range probes {
+		if !seen[uri] {
+			seen[uri] = true
+			uris = append(uris, uri)
+		}
+	}
+	sort.Strings(uris)
+
+	return &healthChecker{
+		check:   *backend.HealthCheck,
+		backend: backend,
+		probes:  probes,
+		uris:    uris,
+		down:    make(map[string]bool),
+		stop:    make(chan struct{}),
+	}
+}
+
+// healthCheckProbes maps the URIs of the zones and records using backend to the URIs to probe for them. These are
+// the URIs themselves with their origin or name as queried name, unless the health check has a URI of its own.
+func (h HTTPRecord) healthCheckProbes(backend *Backend) map[string]string {
+	probes := make(map[string]string)
+	add := func(uris []string, name, rtype string) {
+		origin := h.origin(name)
+		values := placeholders{
+			"fqdn":      name,
+			"name":      relativeName(name, origin),
+			"zone":      origin,
+			"qtype":     rtype,
+			"protocol":  "",
+			"client_ip": "",
+			"ecs":       "",
+		}
+		for _, uri := range uris {
+			if _, ok := probes[uri]; ok {
+				continue
+			}
+			probe := values.expand(uri, uriEscaper(backend))
+			if backend.HealthCheck.URI != "" {
+				probe = resolveReference(probe, backend.HealthCheck.URI)
+			}
+			probes[uri] = probe
+		}
+	}
+	for _, zone := range h.Zones {
+		if zone.Backend == backend {
+			add(append([]string{zone.URI}, zone.Fallbacks...), zone.Origin, "SOA")
+			for _, uris := range backend.ProtocolURIs {
+				add(uris, zone.Origin, "SOA")
+			}
+		}
+	}
+	for _, record := range h.Records {
+		if record.Backend == backend {
+			add(append([]string{record.URI}, record.Fallbacks...), record.Name, record.Type)
+			for _, uris := range backend.ProtocolURIs {
+				add(uris, record.Name, record.Type)
+			}
+		}
+	}
+	return probes
+}
+
+// resolveReference resolves ref relative to uri.
+func resolveReference(uri, ref string) string {
+	base, err := url.Parse(uri)
+	if err != nil {
+		return ref
+	}
+	resolved, err := base.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return resolved.String()
+}
+
+// Start probes the URIs periodically until Stop is called.
+func (hc *healthChecker) Start() error {
+	go func() {
+		ticker := time.NewTicker(hc.check.Interval)
+		defer ticker.Stop()
+
+		for {
+			hc.probeAll()
+			select {
+			case <-ticker.C:
+			case <-hc.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops probing.
+func (hc *healthChecker) Stop() error {
+	hc.stopOnce.Do(func() { close(hc.stop) })
+	return nil
+}
+
+// up returns whether the last probe for uri succeeded. URIs that have not been probed yet are considered up.
+func (hc *healthChecker) up(uri string) bool {
+	probe, ok := hc.probes[uri]
+	if !ok {
+		return true
+	}
+
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	return !hc.down[probe]
+}
+
+// status returns whether the URIs were up at their last probe. URIs that have not been probed yet are considered up.
+func (hc *healthChecker) status() map[string]bool {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	status := make(map[string]bool, len(hc.uris))
+	for _, uri := range hc.uris {
+		status[uri] = !hc.down[uri]
+	}
+	return status
+}
+
+// probedUp returns whether all URIs have been probed and at least one of them was up.
+func (hc *healthChecker) probedUp() bool {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	if len(hc.uris) == 0 {
+		return true
+	}
+	if len(hc.down) < len(hc.uris) {
+		return false
+	}
+	for _, down := range hc.down {
+		if !down {
+			return true
+		}
+	}
+	return false
+}
+
+// order returns uris in the order they should be tried in according to the policy and health of backend.
+func (backend *Backend) order(uris []string) []string {
+	if backend == nil {
+		return uris
+	}
+	return backend.byHealth(backend.balancer.order(uris))
+}
+
+// byHealth returns uris with those that are down moved to the end, keeping the order otherwise.
+func (backend *Backend) byHealth(uris []string) []string {
+	if backend == nil || backend.health == nil || len(uris) < 2 {
+		return uris
+	}
+
+	sorted := make([]string, 0, len(uris))
+	var down []string
+	for _, uri := range uris {
+		if backend.health.up(uri) {
+			sorted = append(sorted, uri)
+		} else {
+			down = append(down, uri)
+		}
+	}
+	return append(sorted, down...)
+}
+
+func (hc *healthChecker) probeAll() {
+	for _, uri := range hc.uris {
+		err := hc.probe(uri)
+
+		hc.mu.Lock()
+		wasDown := hc.down[uri]
+		hc.down[uri] = err != nil
+		hc.mu.Unlock()
+
+		switch {
+		case err != nil && !wasDown:
+			log.Warningf("Backend %s is down: %v", uri, err)
+		case err == nil && wasDown:
+			log.Infof("Backend %s is up again", uri)
+		}
+		if err != nil {
+			BackendUp.WithLabelValues(uri).Set(0)
+		} else {
+			BackendUp.WithLabelValues(uri).Set(1)
+		}
+	}
+}
+
+// probe requests uri and returns an error if the backend did not respond or responded with a server error. Other
+// responses, e.g. 404 for a name without records, show that the backend is up.
+func (hc *healthChecker) probe(uri string) error {
+	timeout := hc.check.Interval
+	if timeout > MaxHealthCheckTimeout {
+		timeout = MaxHealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	method := hc.check.Method
+	if method == "" {
+		method = http.MethodHead
+	}
+	req, err := http.NewRequestWithContext(ctx, method, uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	for key, values := range hc.backend.Header {
+		req.Header[key] = values
+	}
+	if hc.backend.HMAC != nil {
+		hc.backend.HMAC.Sign(req, time.Now())
+	}
+
+	transport, done := transportFor(hc.backend)
+	defer done()
+	response, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, MaxHTTPBodySize))
+	response.Body.Close()
+
+	if response.StatusCode >= 500 {
+		return fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+	return nil
+}
+
+// healthStatus describes the health of the backends as it is served by healthHandler.
+type healthStatus struct {
+	Healthy bool `json:"healthy"`
+	// Backends maps the probed URIs to whether they were up.
+	Backends map[string]bool `json:"backends"`
+}
+
+// healthHandler serves the health of the backends, so that load balancers can drain instances that cannot reach them.
+// It responds with 503 Service Unavailable if all URIs of a backend with a health check are down.
+type healthHandler struct {
+	h HTTPRecord
+}
+
+func (hh healthHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := healthStatus{Healthy: true, Backends: map[string]bool{}}
+	for _, backend := range hh.h.backends() {
+		if backend.health == nil {
+			continue
+		}
+		up := false
+		for uri, uriUp := range backend.health.status() {
+			status.Backends[uri] = uriUp
+			up = up || uriUp
+		}
+		status.Healthy = status.Healthy && (up || len(backend.health.uris) == 0)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if !status.Healthy {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(rw).Encode(status)
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthChecker(t *testing.T) {
+	var status int32 = 200
+	var method, authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		method, authorization = r.Method, r.Header.Get("Authorization")
+		rw.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	backend := &Backend{
+		Header:      http.Header{"Authorization": {"Bearer s3cret"}},
+		HealthCheck: &HealthCheck{Interval: time.Second},
+	}
+	hc := newHealthChecker(backend, map[string]string{server.URL + "/%(fqdn)": server.URL})
+
+	tests := []struct {
+		status int32
+		up     bool
+	}{
+		{200, true},
+		// The backend is up, there just are no records.
+		{404, true},
+		{503, false},
+		{200, true},
+	}
+
+	for i, test := range tests {
+		atomic.StoreInt32(&status, test.status)
+		hc.probeAll()
+		if up := hc.up(server.URL + "/%(fqdn)"); up != test.up {
+			t.Errorf("Test %d expected up: %v, got %v", i, test.up, up)
+		}
+		if method != http.MethodHead || authorization != "Bearer s3cret" {
+			t.Errorf("Test %d expected a HEAD request with the backend's headers, got %s with %q", i, method,
+				authorization)
+		}
+	}
+
+	server.Close()
+	hc.probeAll()
+	if hc.up(server.URL + "/%(fqdn)") {
+		t.Errorf("Expected an unreachable backend to be down")
+	}
+}
+
+func TestHTTPRecord_HealthCheckProbes(t *testing.T) {
+	backend := &Backend{HealthCheck: &HealthCheck{Interval: time.Second}}
+	h := HTTPRecord{
+		Zones: []Zone{
+			{Origin: "example.com.", URI: "https://a.example.com/%(fqdn)", Backend: backend},
+			{Origin: "example.org.", URI: "https://a.example.com/%(fqdn)", Backend: backend},
+			{Origin: "example.net.", URI: "https://example.net/%(fqdn)"},
+		},
+		Records: []Record{{
+			Name:      "foo.example.com.",
+			Type:      "A",
+			URI:       "https://a.example.com/static/%(qtype)",
+			Fallbacks: []string{"https://b.example.com/static"},
+			Backend:   backend,
+		}},
+	}
+
+	expected := map[string]string{
+		"https://a.example.com/%(fqdn)":         "https://a.example.com/example.com.",
+		"https://a.example.com/static/%(qtype)": "https://a.example.com/static/A",
+		"https://b.example.com/static":          "https://b.example.com/static",
+	}
+	if probes := h.healthCheckProbes(backend); !reflect.DeepEqual(probes, expected) {
+		t.Errorf("Expected %v, got %v", expected, probes)
+	}
+
+	backend.HealthCheck.URI = "/health"
+	expected = map[string]string{
+		"https://a.example.com/%(fqdn)":         "https://a.example.com/health",
+		"https://a.example.com/static/%(qtype)": "https://a.example.com/health",
+		"https://b.example.com/static":          "https://b.example.com/health",
+	}
+	if probes := h.healthCheckProbes(backend); !reflect.DeepEqual(probes, expected) {
+		t.Errorf("Expected %v, got %v", expected, probes)
+	}
+}
+
+func TestBackend_ByHealth(t *testing.T) {
+	backend := &Backend{HealthCheck: &HealthCheck{Interval: time.Second}}
+	backend.health = newHealthChecker(backend, map[string]string{"https://a": "https://a", "https://b": "https://b"})
+	backend.health.down["https://a"] = true
+
+	uris := []string{"https://a", "https://b", "https://c"}
+	expected := []string{"https://b", "https://c", "https://a"}
+	if sorted := backend.byHealth(uris); !reflect.DeepEqual(sorted, expected) {
+		t.Errorf("Expected %v, got %v", expected, sorted)
+	}
+
+	var none *Backend
+	if sorted := none.byHealth(uris); !reflect.DeepEqual(sorted, uris) {
+		t.Errorf("Expected %v, got %v", uris, sorted)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	backend := &Backend{HealthCheck: &HealthCheck{Interval: time.Second}}
+	backend.health = newHealthChecker(backend, map[string]string{"https://a/": "https://a/", "https://b/": "https://b/"})
+	h := HTTPRecord{Zones: []Zone{{Origin: "example.com.", URI: "https://a/", Backend: backend}}}
+
+	tests := []struct {
+		method string
+		down   map[string]bool
+		status int
+		body   string
+	}{
+		{"GET", map[string]bool{}, 200, `{"healthy":true,"backends":{"https://a/":true,"https://b/":true}}`},
+		{"GET", map[string]bool{"https://a/": true}, 200,
+			`{"healthy":true,"backends":{"https://a/":false,"https://b/":true}}`},
+		{"GET", map[string]bool{"https://a/": true, "https://b/": true}, 503,
+			`{"healthy":false,"backends":{"https://a/":false,"https://b/":false}}`},
+		{"POST", map[string]bool{}, 405, ""},
+	}
+
+	for i, test := range tests {
+		backend.health.down = test.down
+		rec := httptest.NewRecorder()
+		healthHandler{h: h}.ServeHTTP(rec, httptest.NewRequest(test.method, "/health", nil))
+
+		if rec.Code != test.status {
+			t.Errorf("Test %d expected status %d, got %d", i, test.status, rec.Code)
+		}
+		if body := strings.TrimSpace(rec.Body.String()); test.body != "" && body != test.body {
+			t.Errorf("Test %d expected %s, got %s", i, test.body, body)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HMACKey signs requests with HMAC-SHA256 so backends can authenticate them with a shared secret.
+type HMACKey struct {
+	ID     string
+	Secret string
+}
+
+// Sign sets the Authorization header of req to
+//
+//	HMAC-SHA256 KeyId="ID", Timestamp="TIMESTAMP", Signature="SIGNATURE"
+//
+// where TIMESTAMP is now in seconds since the Unix epoch and SIGNATURE is the base64 encoded HMAC-SHA256 of the
+// method, the path including the query and TIMESTAMP, each followed by a newline.
+func (k *HMACKey) Sign(req *http.Request, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(k.Secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", req.Method, req.URL.RequestURI(), timestamp)
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	req.Header.Set("Authorization", fmt.Sprintf(`HMAC-SHA256 KeyId=%q, Timestamp=%q, Signature=%q`, k.ID, timestamp,
+		signature))
+}
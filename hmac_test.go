@@ -0,0 +1,38 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHMACKey_Sign(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://example.com/records?name=foo.example.com.", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := &HMACKey{ID: "key1", Secret: "s3cret"}
+	key.Sign(req, time.Unix(1600000000, 0))
+
+	// echo -ne 'GET\n/records?name=foo.example.com.\n1600000000\n' | openssl dgst -sha256 -hmac s3cret -binary | base64
+	expected := `HMAC-SHA256 KeyId="key1", Timestamp="1600000000", ` +
+		`Signature="hxtmWLacVQKKS3TpUMqsA8h2KAISDNb8k6o3Ua558rA="`
+	if got := req.Header.Get("Authorization"); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
@@ -15,20 +15,37 @@
 package httprecord
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/pkg/cache"
 	"github.com/coredns/coredns/plugin/pkg/fall"
 	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/plugin/pkg/singleflight"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
 	"hash/fnv"
 	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net"
 	"net/http"
-	"regexp"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -37,44 +54,483 @@ type HTTPRecord struct {
 	Records             []Record
 	Zones               []Zone
 	Timeout             time.Duration
+	Accept              []string
+	Strict              bool
+	Retries             int
+	RetryBackoff        time.Duration
 	MaxTTL              uint32
 	ReturnCachedOnError bool
-	Cache               *cache.Cache
-	Fall                fall.F
+	// ErrorRcodes, if set, are the rcodes lookups failing in some ways are answered with instead of SERVFAIL or
+	// NXDOMAIN, tried in order.
+	ErrorRcodes []ErrorRcode
+	// MaxStale, if set, limits how long after expiring responses are returned if the backend fails.
+	MaxStale time.Duration
+	// CacheResponses serves successful responses from Cache until their TTL expires.
+	CacheResponses bool
+	// NegativeTTL, if set, is how many seconds NXDOMAIN and NODATA responses of the backend are kept in Cache for
+	// unless the backend gave their lifetime.
+	NegativeTTL uint32
+	// ServeStale, if set, is how long after expiring responses in Cache are returned while they are refreshed in the
+	// background, unless the backend gave a different time with stale-while-revalidate.
+	ServeStale time.Duration
+	// Prefetch, if set, is the number of lookups answered from a response in Cache after which it is refreshed in the
+	// background if it expires within PrefetchWindow, or the last tenth of its TTL if that is not set.
+	Prefetch       int
+	PrefetchWindow time.Duration
+	// CacheSize is the number of responses kept in Cache, or in each of the caches of the zones if CachePerZone is
+	// set. It defaults to DefaultCacheSize.
+	CacheSize    int
+	CachePerZone bool
+	// PersistPath, if set, is the file the responses kept in Cache are written to every PersistInterval, or
+	// DefaultPersistInterval if it is not set, and loaded from at startup.
+	PersistPath     string
+	PersistInterval time.Duration
+	// SharedCache, if set, is the URI of a Redis or memcached server responses are shared through with other
+	// instances, in addition to keeping them in Cache.
+	SharedCache string
+	// AdminAddress, if set, is the address of the admin endpoint, which requires AdminToken as bearer token if it is
+	// set.
+	AdminAddress string
+	AdminToken   string
+	// InvalidationAddress, if set, is the address backends can invalidate responses at with requests signed with
+	// InvalidationSecret.
+	InvalidationAddress string
+	InvalidationSecret  string
+	// TTLJitter, if set, is the percentage by which the TTLs of answers are randomly reduced and the prefetch window
+	// randomly widened, so that clients and prefetches do not all ask again at once.
+	TTLJitter int
+	// AnswerOrder, if set, is how address records in answers are reordered for every response, i.e. OrderRotate or
+	// OrderShuffle, so that clients only using the first one are spread across them.
+	AnswerOrder string
+	// MaxAnswers, if set, is the maximum number of address records in answers. Which ones are returned follows
+	// AnswerOrder or the weights of the records and is random otherwise.
+	MaxAnswers int
+	// Warmup, if set, is a file or an http(s) URI listing lookups made at startup to fill Cache.
+	Warmup string
+	// ReadyTimeout, if set, is how long after startup the plugin reports being ready even if backends were not probed
+	// successfully yet.
+	ReadyTimeout time.Duration
+	// KeepCacheOnReload carries the responses kept in the caches over to the instance replacing this one when CoreDNS
+	// reloads, unless the size of the caches changed.
+	KeepCacheOnReload bool
+	// HealthAddress, if set, is the address the health of the backends is served at.
+	HealthAddress string
+	// QueryLog, if set, is the fraction of lookups a structured line is logged for.
+	QueryLog float64
+	// DebugNetworks, if set, are the networks of clients that can query the runtime state in DebugZone.
+	DebugNetworks []*net.IPNet
+	Cache         *cache.Cache
+	Fall          fall.F
+	// MaxConcurrent, if set, limits the requests in flight to all backends. Requests wait for up to QueueTimeout, or
+	// the timeout of the lookup if it is not set, for others to finish.
+	MaxConcurrent int
+	QueueTimeout  time.Duration
+	// Upstream looks up the targets of CNAME records in answers to A and AAAA queries and of MX and SRV records
+	// through the plugin chain, so that clients get their addresses along with them.
+	Upstream bool
+	// Delegations answers queries for names below NS records of zones and records with referrals to them.
+	Delegations bool
+	// Delegated are the names below zones whose NS records are looked up for Delegations, in addition to the names of
+	// records of type NS.
+	Delegated []string
+	// NonAuthoritative clears the AA bit of responses, which is set by default.
+	NonAuthoritative bool
+	// RecursionAvailable sets the RA bit of responses, e.g. if other plugins resolve names the plugin does not answer.
+	RecursionAvailable bool
+
+	// inFlight is created at setup time if MaxConcurrent is set.
+	inFlight semaphore
+	// flights is created at setup time to share requests between concurrent identical lookups.
+	flights *singleflight.Group
+	// origins are set at setup time to the zones of the server block, which records belong to unless they are in
+	// one of Zones.
+	origins []string
+	// zoneCaches are created at setup time for the zones of the server block and Zones if CachePerZone is set.
+	zoneCaches map[string]*cache.Cache
+	// cacheMu is created at setup time if Cache is set. It is held for reading while responses are added to the
+	// caches, as walking them must not race with that.
+	cacheMu *sync.RWMutex
+	// persister is created at setup time if PersistPath is set.
+	persister *cachePersister
+	// shared is created at setup time if SharedCache is set.
+	shared sharedStore
+	// readiness is created at setup time to report when the plugin is ready.
+	readiness *readiness
+	// sharedFlights is created at setup time with shared to share lookups in it between concurrent identical lookups.
+	sharedFlights *singleflight.Group
+	// lifecycle is created at setup time to drain requests to backends at shutdown.
+	lifecycle *lifecycle
+	// syncer is created at setup time if the exports of zones are polled.
+	syncer *zoneSyncer
+	// taps is created at setup time and connected to the dnstap plugin at startup if it is enabled.
+	taps *taps
+	// signer is created at setup time if backends have DNSSEC keys.
+	signer *zoneSigner
+	// upstream is created at setup time if Upstream is set.
+	upstream resolver
+	// index is created at setup time to find the records and zones for names.
+	index *lookupIndex
 }
 
 type Zone struct {
 	Origin string
 	URI    string
+	// Fallbacks are tried in order if requests to URI fail.
+	Fallbacks []string
+	Backend   *Backend
 }
 
 type Record struct {
 	Name string
 	Type string
 	URI  string
+	// Fallbacks are tried in order if requests to URI fail.
+	Fallbacks []string
+	Backend   *Backend
+}
+
+// Backend holds the settings for the backend of the zones and records of a config block. It is nil if the block
+// did not configure any.
+type Backend struct {
+	// Template, if set, is used to parse responses instead of selecting a parser by Content-Type.
+	Template *ResponseTemplate
+	// Header is sent along with every request after replacing placeholders in its values, replacing any header set
+	// by default.
+	Header http.Header
+	// TLSConfig is used for HTTPS requests instead of the default configuration.
+	TLSConfig *tls.Config
+	// TLSSessionCacheSize is the number of TLS sessions kept to resume connections with. Zero disables resumption.
+	TLSSessionCacheSize int
+	// MaxIdleConns and IdleConnTimeout limit the connections kept open for reuse.
+	MaxIdleConns    int
+	IdleConnTimeout time.Duration
+	// Proxy is used for requests instead of the proxy configured by the HTTP_PROXY and HTTPS_PROXY environment
+	// variables.
+	Proxy *url.URL
+	// Method is the HTTP method used for requests, GET by default.
+	Method string
+	// Body is sent along with every request after replacing placeholders.
+	Body string
+
+	// HTTPVersion forces requests to use HTTPVersion1 or HTTPVersion2.
+	HTTPVersion string
+	// Allowlist, if set, restricts the hosts requests are sent to.
+	Allowlist *Allowlist
+	// RequestIDHeader replaces DefaultRequestIDHeader for the request ID, which is not sent if it is "off".
+	RequestIDHeader string
+	// HealthCheck, if set, enables probing the backend periodically.
+	HealthCheck *HealthCheck
+	// Policy is the order in which the URIs of zones and records are tried, PolicySequential by default.
+	Policy string
+	// MaxQPS, if set, limits the requests per second, allowing up to Burst at once. Lookups exceeding the limit fail
+	// with RateLimitRcode.
+	MaxQPS         float64
+	Burst          int
+	RateLimitRcode int
+	// PreferIP is the address family connections are attempted with first. Either IPv4, IPv6 or empty for the
+	// family of the first resolved address.
+	PreferIP string
+	// FallbackDelay is how long to wait before connecting with the other address family in parallel.
+	FallbackDelay time.Duration
+	// SourceAddresses are the local addresses connections are made from, at most one per address family.
+	SourceAddresses []net.IP
+	// HMAC, if set, signs every request.
+	HMAC *HMACKey
+	// ProtocolURIs replace the URIs of the zones and records for queries received with a protocol, i.e. udp, tcp,
+	// tls or https.
+	ProtocolURIs map[string][]string
+	// RawPlaceholders disables percent-encoding the values of placeholders in URIs.
+	RawPlaceholders bool
+	// DoH forwards queries to the backend with DNS-over-HTTPS (RFC 8484) and relays its responses.
+	DoH bool
+	// MaxConcurrent, if set, limits the requests in flight like HTTPRecord.MaxConcurrent, but for this backend only.
+	MaxConcurrent int
+	QueueTimeout  time.Duration
+	// MinTTL, if set, is the number of seconds the lifetime of responses given by the backend is raised to, so that
+	// very short lifetimes do not defeat caching.
+	MinTTL uint32
+	// ExportURI, if set, returns all records of a zone of the backend as CSV, which zone transfers are answered with.
+	// %(zone) is replaced with the origin of the zone.
+	ExportURI string
+	// ExportInterval, if set, is how often the export is polled to answer zone transfers from and to notify secondaries
+	// of changes.
+	ExportInterval time.Duration
+	// SOA, if set, is used to synthesize the SOA records of the zones of the backend.
+	SOA *SOAParameters
+	// DNSSECKeys are the paths of the keys answers for the zones of their owner names are signed with, without the
+	// .key and .private extensions of the files.
+	DNSSECKeys []string
+	// ECS sends the EDNS Client Subnet of queries to the backend in ECSHeader, keeps responses per client subnet and
+	// returns the client subnet in responses with the scope the backend responded with in ECSScopeHeader.
+	ECS bool
+	// BlackLies denies names that do not exist in signed zones with NODATA responses and an NSEC record for the name
+	// itself instead of NXDOMAIN.
+	BlackLies bool
+	// NXDOMAIN answers queries for names in the zones of records of the backend that are neither the name of a record
+	// nor in a zone with NXDOMAIN, instead of NODATA.
+	NXDOMAIN bool
+	// Clients, if set, restricts the zones and records of the backend to queries from these networks, so that other
+	// blocks can answer the same names differently for other clients.
+	Clients []*net.IPNet
+	// Flatten answers A and AAAA queries for names the backend responds to with a CNAME record with the records of
+	// its target instead.
+	Flatten bool
+
+	// transport is created at setup time and shared by all requests to the backend.
+	transport roundTripper
+	// health is created at setup time if HealthCheck is set.
+	health *healthChecker
+	// balancer is created at setup time if a Policy other than PolicySequential is set.
+	balancer *balancer
+	// limiter is created at setup time if MaxQPS is set.
+	limiter *rateLimiter
+	// inFlight is created at setup time if MaxConcurrent is set.
+	inFlight semaphore
+	// id is set at setup time to tell backends apart in lookup keys, which stay the same across restarts unlike the
+	// address of the backend.
+	id int
+}
+
+// serves returns whether the zones and records of the backend answer queries from ip, which is the case unless
+// Clients is set and does not contain it.
+func (b *Backend) serves(ip net.IP) bool {
+	if b == nil || len(b.Clients) == 0 {
+		return true
+	}
+	for _, network := range b.Clients {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// backends returns the distinct backends configured for zones and records.
+func (h HTTPRecord) backends() []*Backend {
+	var backends []*Backend
+	seen := make(map[*Backend]bool)
+	for _, zone := range h.Zones {
+		if zone.Backend != nil && !seen[zone.Backend] {
+			seen[zone.Backend] = true
+			backends = append(backends, zone.Backend)
+		}
+	}
+	for _, record := range h.Records {
+		if record.Backend != nil && !seen[record.Backend] {
+			seen[record.Backend] = true
+			backends = append(backends, record.Backend)
+		}
+	}
+	return backends
 }
 
 type BackendIndicatedError struct {
 	HTTPResponseCode int
 	DNSResponseCode  int
+	// ExtendedError is attached to the response if the client supports EDNS.
+	ExtendedError *dns.EDNS0_EDE
+	// RetryAfter is the time the backend asked us to wait before asking again.
+	RetryAfter time.Duration
+	// TTL is how many seconds an NXDOMAIN response can be kept for.
+	TTL uint32
+}
+
+type backendResponse struct {
+	// URI is the URI the response was received from.
+	URI         string
+	Payload     []byte
+	ContentType string
+	TTL         uint32
+	// ETag and LastModified are the validators used to revalidate the response.
+	ETag         string
+	LastModified string
+	// Fetched is the time the response was received or last revalidated.
+	Fetched time.Time
+	// StaleIfError, if set, limits how long after expiring the response is returned if the backend fails.
+	StaleIfError time.Duration
+	// StaleWhileRevalidate, if set, is how long after expiring the response is returned while it is refreshed.
+	StaleWhileRevalidate time.Duration
+	// NoStore is set if the backend asked for the response not to be kept, not even to return it on error.
+	NoStore bool
+	// Hits counts the lookups answered from the response while it is kept in Cache.
+	Hits *uint32
+	// Error, if set, is the negative response kept instead of records.
+	Error *BackendIndicatedError
+	// NoData is set for responses without records of the queried type, which are kept for NegativeTTL like negative
+	// responses.
+	NoData bool
+	// Name and Type are the lookup the response is kept for.
+	Name string
+	Type string
+	// ECSScope, if set, is the prefix length of the client subnets the response applies to.
+	ECSScope *uint8
+	// parsed, if set, keeps the records parsed from Payload while the response is kept in a cache.
+	parsed *parsedRecords
+}
+
+// parsedRecords are the records parsed from a cached response for a lookup of name and rtype, without TTL limit.
+type parsedRecords struct {
+	once        sync.Once
+	name, rtype string
+	response    ParsedResponse
+	err         error
+}
+
+// records parses the records of the response to a lookup of name and rtype with parser. Responses kept in a cache are
+// only parsed once and their records copied with their TTLs limited to the remaining TTL.
+func (r backendResponse) records(name, rtype string, parser ResponseParser) (ParsedResponse, error) {
+	if r.parsed == nil {
+		return parseRecords(name, rtype, r.TTL, r.Payload, parser)
+	}
+
+	p := r.parsed
+	p.once.Do(func() {
+		p.name, p.rtype = name, rtype
+		p.response, p.err = parseRecords(name, rtype, math.MaxUint32, r.Payload, parser)
+	})
+	if p.name != name || p.rtype != rtype {
+		return parseRecords(name, rtype, r.TTL, r.Payload, parser)
+	}
+	if p.err != nil {
+		return ParsedResponse{}, p.err
+	}
+	return ParsedResponse{
+		Answer:  copyWithTTL(p.response.Answer, r.TTL),
+		Ns:      copyWithTTL(p.response.Ns, r.TTL),
+		Extra:   copyWithTTL(p.response.Extra, r.TTL),
+		Errors:  p.response.Errors,
+		Weights: p.response.Weights,
+	}, nil
+}
+
+// parseRecords parses body with parser and converts internationalized names in the records to ASCII.
+func parseRecords(name, rtype string, ttl uint32, body []byte, parser ResponseParser) (ParsedResponse, error) {
+	parsed, err := parser.Parse(name, rtype, ttl, body)
+	if err != nil {
+		return parsed, err
+	}
+
+	var errs []error
+	parsed.Answer, errs = toASCIISection(parsed.Answer)
+	parsed.Errors = append(parsed.Errors, errs...)
+	parsed.Ns, errs = toASCIISection(parsed.Ns)
+	parsed.Errors = append(parsed.Errors, errs...)
+	parsed.Extra, errs = toASCIISection(parsed.Extra)
+	parsed.Errors = append(parsed.Errors, errs...)
+	return parsed, nil
+}
+
+// copyWithTTL returns copies of rrs with their TTLs limited to ttl.
+func copyWithTTL(rrs []dns.RR, ttl uint32) []dns.RR {
+	if rrs == nil {
+		return nil
+	}
+	copied := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		copied[i] = capTTL(dns.Copy(rr), ttl)
+	}
+	return copied
+}
+
+// aged returns the response with its TTL reduced by the time since it was fetched.
+func (r backendResponse) aged(now time.Time) backendResponse {
+	age := now.Sub(r.Fetched) / time.Second
+	switch {
+	case age <= 0:
+	case age >= time.Duration(r.TTL):
+		r.TTL = 0
+	default:
+		r.TTL -= uint32(age)
+	}
+	return r
+}
+
+// fresh returns whether the response can be returned at now without asking the backend again.
+func (r backendResponse) fresh(now time.Time) bool {
+	return now.Before(r.Fetched.Add(time.Duration(r.TTL) * time.Second))
+}
+
+// servableStale returns whether the expired response can be returned at now while it is refreshed in the background,
+// which is the case for window after it expired unless the backend gave a different time.
+func (r backendResponse) servableStale(now time.Time, window time.Duration) bool {
+	if r.StaleWhileRevalidate > 0 {
+		window = r.StaleWhileRevalidate
+	}
+	ttl := time.Duration(r.TTL) * time.Second
+	return r.TTL > 0 && window > 0 && now.Before(r.Fetched.Add(ttl+window))
 }
 
-type cacheItem struct {
-	Payload string
-	TTL     uint32
+// onError returns the response as it is returned if the backend fails at now. Its TTL is reduced by the time since
+// it was fetched, but expired responses are returned with StaleTTL, so that clients do not ask again at once.
+func (r backendResponse) onError(now time.Time) backendResponse {
+	if r.TTL > 0 && !r.fresh(now) {
+		r.TTL = StaleTTL
+		return r
+	}
+	return r.aged(now)
+}
+
+// usableOnError returns whether the response can still be returned at now if the backend fails, which is limited by
+// stale-if-error and maxStale, if set.
+func (r backendResponse) usableOnError(now time.Time, maxStale time.Duration) bool {
+	stale := r.StaleIfError
+	if maxStale > 0 && (stale == 0 || maxStale < stale) {
+		stale = maxStale
+	}
+	if stale == 0 {
+		return true
+	}
+	ttl := time.Duration(r.TTL) * time.Second
+	return now.Before(r.Fetched.Add(ttl + stale))
 }
 
 func (e BackendIndicatedError) Error() string {
+	if e.ExtendedError != nil {
+		return fmt.Sprintf("dns error: %d (%s) from http error %d", e.DNSResponseCode, e.ExtendedError,
+			e.HTTPResponseCode)
+	}
 	return fmt.Sprintf("dns error: %d from http error %d", e.DNSResponseCode, e.HTTPResponseCode)
 }
 
 const MaxHTTPBodySize = 4096
 
-var cacheControlRegex = regexp.MustCompile(`max-age:[\s]*([\d]+)`)
-var responseToRR = map[string]func(name string, ttl uint32, response string) ([]dns.RR, error){
-	"TXT":  parseTXT,
-	"A":    parseA,
-	"AAAA": parseAAAA,
+// UserAgent is sent with requests unless a different one is configured with a header.
+const UserAgent = "CoreDNS-httprecord (+https://github.com/mensi/httprecord)"
+
+// DefaultRequestIDHeader is the header carrying a unique ID for every lookup, which is kept for retries.
+const DefaultRequestIDHeader = "X-Request-ID"
+
+// AcceptEncoding lists the content encodings of responses that can be decompressed.
+const AcceptEncoding = "gzip, deflate"
+
+// DefaultRetryBackoff is the time to wait before the first retry. It doubles with every further retry.
+const DefaultRetryBackoff = 50 * time.Millisecond
+
+// DefaultServeStale is how long after expiring responses are returned while they are refreshed if serve_stale is
+// given without a duration.
+const DefaultServeStale = time.Hour
+
+// DefaultCacheSize is the number of responses kept unless a different size is configured.
+const DefaultCacheSize = 100
+
+// StaleTTL is the TTL in seconds of expired responses returned while they are refreshed in the background or because
+// the backend failed.
+const StaleTTL = 30
+
+// RcodeHeader is the HTTP response header a backend can use to request a specific rcode, e.g. NXDOMAIN, independent of
+// the HTTP status code.
+const RcodeHeader = "X-DNS-Rcode"
+
+var responseToRR = map[string]entryParser{
+	"TXT":   parseTXT,
+	"A":     parseA,
+	"AAAA":  parseAAAA,
+	"CNAME": parseGeneric("CNAME"),
+	"MX":    parseGeneric("MX"),
+	"NS":    parseGeneric("NS"),
+	"PTR":   parseGeneric("PTR"),
+	"SRV":   parseGeneric("SRV"),
+	"CAA":   parseGeneric("CAA"),
 }
 
 func (h HTTPRecord) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
@@ -82,178 +538,1090 @@ func (h HTTPRecord) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.M
 
 	log.Debugf("Lookup type %s for %s", state.Type(), state.Name())
 
-	if _, ok := responseToRR[state.Type()]; !ok {
+	// Responses are truncated to fit the buffer size of the client once they are complete, so that other writers
+	// see what the client receives. The next plugin writes to the original writer.
+	next := w
+	w = request.NewScrubWriter(r, w)
+
+	if h.debugQuery(state) {
+		return h.serveDebug(w, r, state)
+	}
+
+	w = h.flagsWriter(w, state)
+	// Responses are signed before the case of the query name is restored, as names are signed in lowercase anyway.
+	w = caseWriter(w, state)
+	w = h.signWriter(w, state)
+
+	// Zones and records can be restricted to some clients, the first one serving the client is used.
+	ip := net.ParseIP(state.IP())
+
+	if h.Delegations {
+		ns, err := h.delegation(ctx, w, state, ip)
+		if err != nil {
+			return dns.RcodeServerFailure, err
+		}
+		if ns != nil {
+			return h.refer(ctx, w, r, state, ns)
+		}
+	}
+
+	if _, ok := responseToRR[state.Type()]; !ok && !h.forwards(state.Name()) {
+		soa := h.soa(state.Name())
+		if soa != nil && state.QType() == dns.TypeSOA && soa.Hdr.Name == state.Name() {
+			return answer(w, r, []dns.RR{soa})
+		}
+		if state.QType() == dns.TypeDNSKEY && h.signer.zone(state.Name()) == state.Name() {
+			return answer(w, r, h.signer.dnskeys(state.Name()))
+		}
 		// As this type is not something we support, there is not going to be a result anyways.
 		if h.Fall.Through(state.Name()) {
-			return plugin.NextOrFailure(state.Name(), h.Next, ctx, w, r)
+			return plugin.NextOrFailure(state.Name(), h.Next, ctx, next, r)
 		}
-		return nodata(w, r)
+		if h.nxdomain(state.Name()) {
+			return writeError(w, r, dns.RcodeNameError, nil, soa, nil)
+		}
+		return nodata(w, r, soa)
 	}
 
 	// First, let's see if we can find an exact match for the name being queried.
-	for _, record := range h.Records {
-		if record.Name == state.Name() && record.Type == state.Type() {
-			return h.fetchAndWrite(w, r, state.Type(), state.Name(), record.URI)
-		}
+	if record := h.lookups().record(state.Name(), state.Type(), ip); record != nil {
+		values := queryPlaceholders(ctx, state, h.origin(record.Name))
+		return h.fetchAndWrite(ctx, w, r, state, values, append([]string{record.URI}, record.Fallbacks...),
+			record.Backend)
 	}
 
-	// Let's find a zone for this name.
-	var origins []string
-	for _, zone := range h.Zones {
-		origins = append(origins, zone.Origin)
-	}
-	zone := plugin.Zones(origins).Matches(state.Name())
-	if zone != "" {
-		log.Debugf("Found matching zone: %s", zone)
-		for _, zone := range h.Zones {
-			return h.fetchAndWrite(w, r, state.Type(), state.Name(), zone.URI)
-		}
+	// Let's find the most specific zone for this name.
+	if zone := h.zoneFor(state.Name(), ip); zone != nil {
+		log.Debugf("Found matching zone: %s", zone.Origin)
+		values := queryPlaceholders(ctx, state, zone.Origin)
+		return h.fetchAndWrite(ctx, w, r, state, values, append([]string{zone.URI}, zone.Fallbacks...),
+			zone.Backend)
 	}
 
 	if h.Fall.Through(state.Name()) {
-		return plugin.NextOrFailure(state.Name(), h.Next, ctx, w, r)
+		return plugin.NextOrFailure(state.Name(), h.Next, ctx, next, r)
 	}
 
-	// At this point, we don't have anything to return - but we don't know that it is NXDOMAIN as other records might
-	// exist. As such, we will do a NODATA response
-	return nodata(w, r)
+	// At this point, we don't have anything to return - but unless the records of the zone are known to be all there
+	// are, we don't know that it is NXDOMAIN as other records might exist. As such, we will do a NODATA response
+	if h.nxdomain(state.Name()) {
+		return writeError(w, r, dns.RcodeNameError, nil, h.soa(state.Name()), nil)
+	}
+	return nodata(w, r, h.soa(state.Name()))
+}
+
+// nxdomain returns whether name does not exist, which is known if it is in the zone of a record whose backend has
+// NXDOMAIN set, but neither the name of a record nor one of their ancestors (RFC 8020), nor in one of Zones.
+func (h HTTPRecord) nxdomain(name string) bool {
+	return h.lookups().nxdomain(name)
+}
+
+// zoneFor returns the zone with the longest origin name is in of those serving queries from ip, or nil if there is
+// none. Of several zones with that origin, the first one is used.
+func (h HTTPRecord) zoneFor(name string, ip net.IP) *Zone {
+	return h.lookups().zone(name, ip)
+}
+
+// origin returns the origin of the zone name belongs to, which is the most specific of Zones and the zones of the
+// server block.
+func (h HTTPRecord) origin(name string) string {
+	return h.lookups().origin(name)
+}
+
+// lookups returns the index of Records and Zones created at setup time, or a new one if the plugin was not set up.
+func (h HTTPRecord) lookups() *lookupIndex {
+	if h.index != nil {
+		return h.index
+	}
+	return newLookupIndex(h.Zones, h.Records, h.origins, h.Delegated)
 }
 
 func (h HTTPRecord) Name() string {
 	return "httprecord"
 }
 
-func nodata(w dns.ResponseWriter, r *dns.Msg) (int, error) {
+// nodata responds without records, with the SOA record of the zone in the authority section if it is known.
+func nodata(w dns.ResponseWriter, r *dns.Msg, soa *dns.SOA) (int, error) {
 	m := new(dns.Msg)
 	m.SetReply(r)
-	m.Authoritative, m.RecursionAvailable = true, true
+	m.Authoritative = true
 	m.Answer = []dns.RR{}
+	if soa != nil {
+		m.Ns = []dns.RR{soa}
+	}
 
 	w.WriteMsg(m)
 	return dns.RcodeSuccess, nil
 }
 
-func (h HTTPRecord) fetch(name string, uri string) (string, uint32, error) {
-	uri = strings.Replace(uri, "%(fqdn)", name, -1)
+// writeError responds with rcode and, if the client supports EDNS, the extended error ede. NXDOMAIN responses carry
+// the SOA record of the zone in the authority section if it is known. Error responses without extended error that
+// CoreDNS writes by itself are left to it. err is returned to be logged by CoreDNS.
+func writeError(w dns.ResponseWriter, r *dns.Msg, rcode int, ede *dns.EDNS0_EDE, soa *dns.SOA, err error) (int,
+	error) {
+	opt := r.IsEdns0()
+	if !plugin.ClientWrite(rcode) && (ede == nil || opt == nil) {
+		return rcode, err
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	m.Authoritative = true
+	if soa != nil && rcode == dns.RcodeNameError {
+		m.Ns = []dns.RR{soa}
+	}
+	if ede != nil && opt != nil {
+		m.SetEdns0(opt.UDPSize(), opt.Do())
+		m.IsEdns0().Option = append(m.IsEdns0().Option, ede)
+	}
+
+	w.WriteMsg(m)
+
+	if !plugin.ClientWrite(rcode) {
+		// The response has been written, which CoreDNS only recognizes for some rcodes.
+		return dns.RcodeSuccess, err
+	}
+	return rcode, err
+}
+
+// backendRequest is the request sent to a backend for a query.
+type backendRequest struct {
+	// Template is the URI before placeholders were replaced.
+	Template string
+	// Name and Type are the query.
+	Name string
+	Type string
+	// Zone is the origin of the zone of the queried name.
+	Zone   string
+	Method string
+	URI    string
+	Body   []byte
+	// ContentType is the type of Body.
+	ContentType string
+	// Cached is an earlier response that is revalidated instead of fetched again if it has validators.
+	Cached *backendResponse
+	// ID identifies the request, including its retries, to the backend.
+	ID string
+	// Header describes the query to the backend.
+	Header http.Header
+	// BackendHeader are the headers of the backend with their placeholders replaced.
+	BackendHeader http.Header
+	// Span is the span of the lookup if the trace plugin is enabled. Requests to backends are traced as its children.
+	Span ot.Span
+	// Stats, if set, records the requests to backends for the query log.
+	Stats *fetchStats
+	// CacheResult is set on the first request of a lookup to how it was answered from the caches, i.e. hit, stale or
+	// miss. It is empty if caching is disabled.
+	CacheResult string
+	// Expired is set on the first request of a lookup that failed while the response kept for it was too old to be
+	// returned instead.
+	Expired bool
+}
+
+// newBackendRequest creates the request for the query in state to uri, replacing placeholders with values.
+func newBackendRequest(state request.Request, values placeholders, uri string, backend *Backend) backendRequest {
+	req := backendRequest{
+		Template: uri,
+		Name:     state.Name(),
+		Type:     state.Type(),
+		Zone:     values["zone"],
+		Method:   http.MethodGet,
+		URI:      values.expand(uri, uriEscaper(backend)),
+		Header: http.Header{
+			"X-Dns-Qname":     {state.Name()},
+			"X-Dns-Qtype":     {state.Type()},
+			"X-Dns-Protocol":  {queryProtocol(state)},
+			"X-Dns-Client-Ip": {state.IP()},
+		},
+	}
+	if backend != nil {
+		req.BackendHeader = values.expandHeader(backend.Header)
+	}
+	// The client subnet is sent with the backend headers, so that responses are kept per client subnet.
+	if subnet := clientSubnet(state.Req); backend != nil && backend.ECS && subnet != "" {
+		if req.BackendHeader == nil {
+			req.BackendHeader = http.Header{}
+		}
+		req.BackendHeader.Set(ECSHeader, subnet)
+	}
+	if backend != nil && backend.Method != "" {
+		req.Method = backend.Method
+	}
+	if backend != nil && backend.Body != "" {
+		req.Body = []byte(values.expand(backend.Body, verbatim))
+		req.ContentType = "application/json"
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err == nil {
+		req.ID = hex.EncodeToString(id)
+	}
+	return req
+}
+
+// urisFor returns the URIs to query for state, which are uris unless they are replaced for its protocol.
+func (backend *Backend) urisFor(state request.Request, uris []string) []string {
+	if backend == nil {
+		return uris
+	}
+	if replaced, ok := backend.ProtocolURIs[queryProtocol(state)]; ok {
+		return replaced
+	}
+	return uris
+}
+
+// queryProtocol returns the protocol the query was received with: udp, tcp, tls or https.
+func queryProtocol(state request.Request) string {
+	switch w := state.W.(type) {
+	case *dnsserver.DoHWriter:
+		return "https"
+	case dns.ConnectionStater:
+		if w.ConnectionState() != nil {
+			return "tls"
+		}
+	}
+	return state.Proto()
+}
+
+// requestIDHeader returns the header identifying requests to backend, if any.
+func requestIDHeader(backend *Backend) string {
+	switch {
+	case backend == nil || backend.RequestIDHeader == "":
+		return DefaultRequestIDHeader
+	case backend.RequestIDHeader == "off":
+		return ""
+	default:
+		return backend.RequestIDHeader
+	}
+}
+
+// uriEscaper returns the function encoding values substituted into the URIs of backend.
+func uriEscaper(backend *Backend) func(string) string {
+	if backend != nil && backend.RawPlaceholders {
+		return verbatim
+	}
+	return escapeValue
+}
+
+// escapeValue percent-encodes everything but unreserved characters in value so it cannot change the structure of a
+// URI it is substituted into.
+func escapeValue(value string) string {
+	return strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+}
+
+func (h HTTPRecord) fetch(req backendRequest, backend *Backend) (backendResponse, error) {
+	if backend != nil && backend.Allowlist != nil {
+		if err := backend.Allowlist.checkURI(req.URI); err != nil {
+			return backendResponse{}, err
+		}
+	}
 
 	timeout := h.Timeout
 	if timeout == 0 {
 		// A timeout of 0 means infinite - let's restrict it to avoid having undying HTTP clients.
 		timeout = time.Second * 5
 	}
+	// The timeout applies to all attempts together.
+	done, err := h.lifecycle.begin()
+	if err != nil {
+		return backendResponse{}, err
+	}
+	defer done()
+	ctx, cancel := context.WithTimeout(h.lifecycle.context(), timeout)
+	defer cancel()
+
+	backoff := h.RetryBackoff
+	if backoff == 0 {
+		backoff = DefaultRetryBackoff
+	}
+
+	log.Debugf("Fetching: %s %s with a timeout of %s", req.Method, req.URI, timeout)
+	for attempt := 0; ; attempt++ {
+		response, err := h.fetchOnce(ctx, req, backend)
+		if err == nil {
+			response.URI = req.URI
+			return response, nil
+		}
+		if attempt >= h.Retries || !retryable(err) {
+			return response, err
+		}
+
+		wait := backoff << attempt
+		if wait <= 0 || wait > timeout {
+			wait = timeout
+		}
+		if bie, ok := err.(BackendIndicatedError); ok && bie.RetryAfter > 0 {
+			wait = bie.RetryAfter
+		}
+		if deadline, _ := ctx.Deadline(); time.Now().Add(wait).After(deadline) {
+			return response, err
+		}
+
+		log.Debugf("Retrying %s in %s after: %v", req.URI, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return response, err
+		}
+	}
+}
+
+// retryable returns whether a failed request might succeed when tried again.
+func retryable(err error) bool {
+	var bie BackendIndicatedError
+	if errors.As(err, &bie) {
+		return bie.HTTPResponseCode >= 500 && bie.DNSResponseCode == dns.RcodeServerFailure
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (h HTTPRecord) fetchOnce(ctx context.Context, r backendRequest, backend *Backend) (backendResponse, error) {
+	if backend != nil && !backend.limiter.allow(time.Now()) {
+		return backendResponse{}, BackendIndicatedError{DNSResponseCode: backend.RateLimitRcode}
+	}
+
+	if err := h.inFlight.acquire(ctx, h.QueueTimeout); err != nil {
+		return backendResponse{}, err
+	}
+	defer h.inFlight.release()
+	if backend != nil {
+		if err := backend.inFlight.acquire(ctx, backend.QueueTimeout); err != nil {
+			return backendResponse{}, err
+		}
+		defer backend.inFlight.release()
+	}
+
+	transport, done := transportFor(backend)
+	defer done()
 	client := &http.Client{
-		Timeout: timeout,
+		Transport: transport,
 	}
 
-	log.Debugf("Fetching: %s with a timeout of %s", uri, timeout)
-	response, err := client.Get(uri)
+	var payload io.Reader
+	if r.Body != nil {
+		payload = bytes.NewReader(r.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, r.Method, r.URI, payload)
 	if err != nil {
-		return "", 0, err
+		return backendResponse{}, err
+	}
+	if r.Body != nil {
+		req.Header.Set("Content-Type", r.ContentType)
 	}
 
-	// Deliberately do not read all. A broken upstream could give us a lot of data that we could not return to the
-	// client anyways. As such, just read part of it and discard the rest.
-	body := make([]byte, MaxHTTPBodySize)
-	read, err := response.Body.Read(body)
-	if err != nil && err != io.EOF {
+	accept := h.Accept
+	switch {
+	case backend != nil && backend.DoH:
+		accept = []string{DNSMessageContentType}
+	case len(accept) == 0:
+		accept = registeredContentTypes()
+	}
+	req.Header.Set("Accept", strings.Join(accept, ", "))
+	req.Header.Set("Accept-Encoding", AcceptEncoding)
+	req.Header.Set("User-Agent", UserAgent)
+	for key, values := range r.Header {
+		req.Header[key] = values
+	}
+	if header := requestIDHeader(backend); header != "" && r.ID != "" {
+		req.Header.Set(header, r.ID)
+	}
+	if r.Cached != nil && r.Cached.ETag != "" {
+		req.Header.Set("If-None-Match", r.Cached.ETag)
+	}
+	if r.Cached != nil && r.Cached.LastModified != "" {
+		req.Header.Set("If-Modified-Since", r.Cached.LastModified)
+	}
+	for key, values := range r.BackendHeader {
+		req.Header[key] = values
+	}
+	span := startFetchSpan(r, req.Header)
+	if backend != nil && backend.HMAC != nil {
+		backend.HMAC.Sign(req, time.Now())
+	}
+
+	start := time.Now()
+	response, err := client.Do(req)
+	finishFetchSpan(span, response, err)
+	r.Stats.record(r.URI, response, time.Since(start))
+	BackendRequestDuration.WithLabelValues(r.Zone).Observe(time.Since(start).Seconds())
+	if err != nil {
+		BackendRequests.WithLabelValues(r.Zone, "error").Inc()
+		return backendResponse{}, err
+	}
+	BackendRequests.WithLabelValues(r.Zone, strconv.Itoa(response.StatusCode)).Inc()
+
+	digest, err := newDigestVerifier(response.Header)
+	if err != nil {
 		response.Body.Close()
-		return "", 0, err
+		return backendResponse{}, err
+	}
+	if digest != nil {
+		response.Body = digest.wrap(response.Body)
+	}
+
+	reader, err := decompress(response)
+	if err != nil {
+		response.Body.Close()
+		return backendResponse{}, err
 	}
-	response.Body.Close()
 
-	if read == MaxHTTPBodySize {
-		return string(body), 0, fmt.Errorf("backend returned a body longer than %d bytes", MaxHTTPBodySize-1)
+	var body []byte
+	if response.StatusCode == 200 && isCSV(response.Header) && (backend == nil || backend.Template == nil) {
+		// CSV responses can describe a whole zone, so only the records for the queried name are kept.
+		body, err = filterCSV(reader, r.Name)
+	} else {
+		// Deliberately do not read all. A broken upstream could give us a lot of data that we could not return to
+		// the client anyways. As such, just read part of it and discard the rest. Reading small bodies up to EOF
+		// allows the connection to be reused.
+		body, err = ioutil.ReadAll(io.LimitReader(reader, MaxHTTPBodySize))
+		if err == nil && len(body) == MaxHTTPBodySize {
+			err = fmt.Errorf("backend returned a body longer than %d bytes", MaxHTTPBodySize-1)
+		}
+	}
+	if err == nil && digest != nil {
+		err = digest.verify(response.Body)
 	}
+	response.Body.Close()
+	if err != nil {
+		return backendResponse{}, err
+	}
+	read := len(body)
 
-	ttl := h.extractTTL(response.Header)
+	ttl := h.extractTTL(response.Header, backend)
+	cc := parseCacheControl(response.Header)
+	rcode, hasRcode := backendRcode(response.Header)
 
 	switch {
+	case hasRcode && rcode == dns.RcodeNameError:
+		return backendResponse{}, BackendIndicatedError{
+			HTTPResponseCode: response.StatusCode,
+			DNSResponseCode:  rcode,
+			TTL:              h.negativeTTL(response.Header, backend)}
+	case hasRcode && rcode != dns.RcodeSuccess:
+		return backendResponse{}, BackendIndicatedError{
+			HTTPResponseCode: response.StatusCode,
+			DNSResponseCode:  rcode}
+	case hasRcode && response.StatusCode != 200:
+		// The backend explicitly asked for NOERROR, so the body of the error response is not record data.
+		if h.NegativeTTL > 0 {
+			return backendResponse{ContentType: DefaultContentType, TTL: h.negativeTTL(response.Header, backend),
+				Fetched: time.Now(), NoStore: cc.NoStore, NoData: true}, nil
+		}
+		return backendResponse{ContentType: DefaultContentType, TTL: ttl, NoStore: cc.NoStore}, nil
 	case response.StatusCode == 200:
-		return string(body[:read]), ttl, nil
+		return h.classify(r, backendResponse{
+			Payload:              body[:read],
+			ContentType:          response.Header.Get("Content-Type"),
+			TTL:                  ttl,
+			ETag:                 response.Header.Get("ETag"),
+			LastModified:         response.Header.Get("Last-Modified"),
+			Fetched:              time.Now(),
+			StaleIfError:         cc.StaleIfError,
+			StaleWhileRevalidate: cc.StaleWhileRevalidate,
+			NoStore:              cc.NoStore,
+			ECSScope:             ecsScope(response.Header, r.URI),
+		}, response.Header, backend)
+	case response.StatusCode == 304 && r.Cached != nil:
+		// The cached response is still valid and only needs to be renewed.
+		renewed := *r.Cached
+		renewed.TTL = ttl
+		if renewed.NoData {
+			renewed.TTL = h.negativeTTL(response.Header, backend)
+		}
+		renewed.Fetched = time.Now()
+		renewed.StaleIfError = cc.StaleIfError
+		renewed.StaleWhileRevalidate = cc.StaleWhileRevalidate
+		renewed.NoStore = cc.NoStore
+		if etag := response.Header.Get("ETag"); etag != "" {
+			renewed.ETag = etag
+		}
+		if lastModified := response.Header.Get("Last-Modified"); lastModified != "" {
+			renewed.LastModified = lastModified
+		}
+		if scope := ecsScope(response.Header, r.URI); scope != nil {
+			renewed.ECSScope = scope
+		}
+		return renewed, nil
+	case isProblem(response.Header):
+		bie := BackendIndicatedError{
+			HTTPResponseCode: response.StatusCode,
+			DNSResponseCode:  dns.RcodeServerFailure,
+			RetryAfter:       retryAfter(response.Header)}
+		if response.StatusCode == 404 {
+			bie.DNSResponseCode = dns.RcodeNameError
+			bie.TTL = h.negativeTTL(response.Header, backend)
+		}
+		bie, err := applyProblem(bie, body[:read])
+		if err != nil {
+			log.Warningf("Unable to parse problem details from %s: %v", r.URI, err)
+		}
+		return backendResponse{}, bie
 	case response.StatusCode == 404:
-		return "", 0, BackendIndicatedError{
+		return backendResponse{}, BackendIndicatedError{
 			HTTPResponseCode: response.StatusCode,
-			DNSResponseCode:  dns.RcodeNameError}
+			DNSResponseCode:  dns.RcodeNameError,
+			TTL:              h.negativeTTL(response.Header, backend)}
 	case response.StatusCode >= 500:
-		return "", 0, BackendIndicatedError{
+		return backendResponse{}, BackendIndicatedError{
 			HTTPResponseCode: response.StatusCode,
-			DNSResponseCode:  dns.RcodeServerFailure}
+			DNSResponseCode:  dns.RcodeServerFailure,
+			RetryAfter:       retryAfter(response.Header)}
 	default:
-		return "", 0, fmt.Errorf("unexpected status code: %d", response.StatusCode)
+		return backendResponse{}, statusError(response.StatusCode)
 	}
 }
 
-func (h HTTPRecord) maybeFetchCached(name string, uri string) (string, uint32, error) {
-	if !h.ReturnCachedOnError {
-		return h.fetch(name, uri)
+// classify returns the response to r with hdr, or the negative response it carries if NegativeTTL is set: NXDOMAIN
+// given in the body, e.g. by a DNS message, is returned as error and responses without records of the queried type
+// are marked NoData, both with the TTL of negative responses.
+func (h HTTPRecord) classify(r backendRequest, response backendResponse, hdr http.Header,
+	backend *Backend) (backendResponse, error) {
+	if h.NegativeTTL == 0 || r.Type == "" || (backend != nil && backend.DoH) {
+		return response, nil
+	}
+
+	parsed, err := parseRecords(r.Name, r.Type, response.TTL, response.Payload, responseParser(response, backend))
+	if bie, ok := err.(BackendIndicatedError); ok && bie.DNSResponseCode == dns.RcodeNameError {
+		bie.TTL = h.negativeTTL(hdr, backend)
+		return backendResponse{}, bie
 	}
+	if err == nil && len(parsed.Answer) == 0 {
+		response.NoData = true
+		response.TTL = h.negativeTTL(hdr, backend)
+	}
+	return response, nil
+}
 
+// responseParser returns the parser for response of backend, which is its template if it has one.
+func responseParser(response backendResponse, backend *Backend) ResponseParser {
+	if backend != nil && backend.Template != nil {
+		return backend.Template
+	}
+	return responseParserFor(response.ContentType)
+}
+
+// isCSV returns whether the response with hdr is in the CSV format.
+func isCSV(hdr http.Header) bool {
+	mediatype, _, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	return err == nil && mediatype == "text/csv"
+}
+
+// decompress returns a reader for the body of response, decoding it according to its Content-Encoding. As the size
+// of the body is checked once decoded, compressed responses cannot exceed MaxHTTPBodySize either.
+func decompress(response *http.Response) (io.Reader, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return response.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(response.Body)
+	case "deflate":
+		return zlib.NewReader(response.Body)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+}
+
+// backendRcode returns the rcode requested by the backend in the RcodeHeader, if any.
+func backendRcode(hdr http.Header) (int, bool) {
+	value := strings.TrimSpace(hdr.Get(RcodeHeader))
+	if value == "" {
+		return 0, false
+	}
+
+	rcode, err := parseRcode(value)
+	if err != nil {
+		log.Warningf("Ignoring %s header: %s", RcodeHeader, err)
+		return 0, false
+	}
+	return rcode, true
+}
+
+// parseRcode parses rcodes given either by name, e.g. NXDOMAIN, or numerically.
+func parseRcode(value string) (int, error) {
+	if rcode, ok := dns.StringToRcode[strings.ToUpper(value)]; ok {
+		return rcode, nil
+	}
+	if rcode, err := strconv.Atoi(value); err == nil && rcode >= 0 && rcode <= 0xFFF {
+		return rcode, nil
+	}
+	return 0, fmt.Errorf("unknown rcode: %s", value)
+}
+
+// fetchAny sends reqs in order until one of them succeeds or fails in a way that another backend would not change.
+func (h HTTPRecord) fetchAny(reqs []backendRequest, backend *Backend) (backendResponse, error) {
+	var response backendResponse
+	var err error
+	var b *balancer
+	if backend != nil {
+		b = backend.balancer
+	}
+
+	for i, req := range reqs {
+		done := b.start(req.Template)
+		response, err = h.fetch(req, backend)
+		done(err != nil && retryable(err))
+		if err == nil || !retryable(err) {
+			return response, err
+		}
+		if i+1 < len(reqs) {
+			log.Debugf("Failing over from %s to %s after: %v", req.URI, reqs[i+1].URI, err)
+		}
+	}
+	return response, err
+}
+
+// lookupKey identifies the lookup of name and rtype with reqs, which are alternatives for the same lookup, to backend.
+func (h HTTPRecord) lookupKey(name, rtype string, reqs []backendRequest, backend *Backend) uint64 {
 	hasher := fnv.New64()
-	hasher.Write([]byte(name))
-	hasher.Write([]byte(uri))
-	cachekey := hasher.Sum64()
+	// The same response is parsed differently for other types, e.g. when a URI serves all types of a name.
+	fmt.Fprintf(hasher, "%s %s\n", name, rtype)
+	// Backends could respond in other formats to other Accept headers.
+	fmt.Fprintf(hasher, "%q\n", h.Accept)
+	hasher.Write([]byte(reqs[0].Method))
+	hasher.Write([]byte(reqs[0].URI))
+	hasher.Write(reqs[0].Body)
+	// Headers can contain placeholders for the client.
+	keys := make([]string, 0, len(reqs[0].BackendHeader))
+	for key := range reqs[0].BackendHeader {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(hasher, "%s: %q\n", key, reqs[0].BackendHeader[key])
+	}
+	// Backends with different settings could respond differently.
+	if backend != nil {
+		fmt.Fprintf(hasher, "%d", backend.id)
+	}
+	return hasher.Sum64()
+}
 
-	payload, ttl, err := h.fetch(name, uri)
-	if err == nil {
-		h.Cache.Add(cachekey, cacheItem{payload, ttl})
-		return payload, ttl, err
+// fetchShared is fetchAny, but concurrent lookups with the same key share a single request.
+func (h HTTPRecord) fetchShared(key uint64, reqs []backendRequest, backend *Backend) (backendResponse, error) {
+	if h.flights == nil {
+		return h.fetchAny(reqs, backend)
 	}
 
-	if entry, ok := h.Cache.Get(cachekey); ok {
-		if item, ok := entry.(cacheItem); ok {
-			return item.Payload, item.TTL, nil
+	response, err := h.flights.Do(key, func() (interface{}, error) {
+		return h.fetchAny(reqs, backend)
+	})
+	return response.(backendResponse), err
+}
+
+// maybeFetchCached fetches the response for reqs, which are alternatives for the same lookup, unless the response
+// cached for the first one is still fresh. If enabled, it falls back to the cached response if fetching fails.
+func (h HTTPRecord) maybeFetchCached(name, rtype string, reqs []backendRequest, backend *Backend) (backendResponse,
+	error) {
+	cachekey := h.lookupKey(name, rtype, reqs, backend)
+	if !h.ReturnCachedOnError && !h.CacheResponses && h.NegativeTTL == 0 {
+		return h.fetchShared(cachekey, reqs, backend)
+	}
+
+	var cached *backendResponse
+	zone := h.cacheZone(name)
+	slot := cacheSlot{zone: zone, store: h.Cache, key: cachekey, name: name, rtype: rtype}
+	if zone != "" {
+		slot.store = h.zoneCaches[zone]
+	}
+	if entry, ok := slot.store.Get(cachekey); ok {
+		if item, ok := entry.(backendResponse); ok {
+			cached = &item
+		}
+	}
+	now := time.Now()
+	switch {
+	case cached != nil && cached.Error != nil && cached.fresh(now):
+		CacheHits.WithLabelValues(zone).Inc()
+		setCacheResult(reqs, "hit")
+		return backendResponse{}, *cached.Error
+	case cached != nil && cached.Error != nil:
+		// Expired negative responses are neither revalidated nor returned on error.
+		cached = nil
+	case cached != nil && (h.CacheResponses || cached.NoData) && cached.fresh(now):
+		if h.prefetches(*cached, now) {
+			for i := range reqs {
+				reqs[i].Cached = cached
+			}
+			go h.refresh(slot, reqs, backend)
+		}
+		CacheHits.WithLabelValues(zone).Inc()
+		setCacheResult(reqs, "hit")
+		return cached.aged(now), nil
+	}
+	if shared := h.fromSharedCache(cachekey, now); shared != nil {
+		h.add(slot, *shared)
+		CacheHits.WithLabelValues(zone).Inc()
+		setCacheResult(reqs, "hit")
+		if shared.Error != nil {
+			return backendResponse{}, *shared.Error
 		}
+		return shared.aged(now), nil
+	}
+	for i := range reqs {
+		reqs[i].Cached = cached
+	}
+
+	if h.CacheResponses && cached != nil && cached.servableStale(now, h.ServeStale) {
+		go h.refresh(slot, reqs, backend)
+		CacheStaleHits.WithLabelValues(zone).Inc()
+		setCacheResult(reqs, "stale")
+		stale := *cached
+		stale.TTL = StaleTTL
+		return stale, nil
+	}
+
+	CacheMisses.WithLabelValues(zone).Inc()
+	setCacheResult(reqs, "miss")
+	response, err := h.fetchShared(cachekey, reqs, backend)
+	now = time.Now()
+	if err != nil && h.ReturnCachedOnError && cached != nil {
+		if cached.usableOnError(now, h.MaxStale) {
+			CacheStaleHits.WithLabelValues(zone).Inc()
+			setCacheResult(reqs, "stale")
+			return cached.onError(now), nil
+		}
+		// Responses that are too old to be returned on error are of no further use.
+		h.remove(slot)
+		reqs[0].Expired = true
+	}
+	h.keep(slot, response, err)
+	return response, err
+}
+
+// setCacheResult records how the lookup for reqs was answered from the caches and tags its span with it.
+func setCacheResult(reqs []backendRequest, result string) {
+	if len(reqs) == 0 {
+		return
+	}
+	reqs[0].CacheResult = result
+	if reqs[0].Span != nil {
+		reqs[0].Span.SetTag("httprecord.cache", result)
 	}
-	return payload, ttl, err
 }
 
-func (h HTTPRecord) extractTTL(hdr http.Header) uint32 {
-	var ttl uint32 = 0
+// cacheSlot is where the response for a lookup is kept.
+type cacheSlot struct {
+	// zone is the origin of the zone of store, or empty for Cache.
+	zone  string
+	store *cache.Cache
+	key   uint64
+	// name and rtype are the lookup the response is kept for.
+	name, rtype string
+}
+
+// cacheFor returns the cache for responses for name, which is the one of its zone if CachePerZone is set.
+func (h HTTPRecord) cacheFor(name string) *cache.Cache {
+	if store, ok := h.zoneCaches[h.cacheZone(name)]; ok {
+		return store
+	}
+	return h.Cache
+}
+
+// cacheZone returns the origin of the zone with the cache for responses for name, or the empty origin of Cache.
+func (h HTTPRecord) cacheZone(name string) string {
+	if origin := h.origin(name); h.zoneCaches[origin] != nil {
+		return origin
+	}
+	return ""
+}
+
+// caches returns the caches by the origins of their zones, with Cache as the one of the empty origin.
+func (h HTTPRecord) caches() map[string]*cache.Cache {
+	caches := map[string]*cache.Cache{"": h.Cache}
+	for origin, store := range h.zoneCaches {
+		caches[origin] = store
+	}
+	return caches
+}
+
+// walkCaches runs f for all responses kept in the caches and removes those it returns true for.
+func (h HTTPRecord) walkCaches(f func(zone string, key uint64, response backendResponse) bool) {
+	if h.cacheMu != nil {
+		h.cacheMu.Lock()
+		defer h.cacheMu.Unlock()
+	}
+	for zone, store := range h.caches() {
+		store.Walk(func(items map[uint64]interface{}, key uint64) bool {
+			if response, ok := items[key].(backendResponse); ok && f(zone, key, response) {
+				delete(items, key)
+			}
+			return true
+		})
+		CacheEntries.WithLabelValues(zone).Set(float64(store.Len()))
+	}
+}
+
+// add keeps response in slot.
+func (h HTTPRecord) add(slot cacheSlot, response backendResponse) {
+	response.Name, response.Type = slot.name, slot.rtype
+	if response.parsed == nil {
+		response.parsed = new(parsedRecords)
+	}
+	if h.cacheMu != nil {
+		h.cacheMu.RLock()
+		defer h.cacheMu.RUnlock()
+	}
+	if slot.store.Add(slot.key, response) {
+		CacheEvictions.WithLabelValues(slot.zone).Inc()
+	}
+	CacheEntries.WithLabelValues(slot.zone).Set(float64(slot.store.Len()))
+}
+
+// remove removes the response kept in slot, if any.
+func (h HTTPRecord) remove(slot cacheSlot) {
+	if h.cacheMu != nil {
+		h.cacheMu.RLock()
+		defer h.cacheMu.RUnlock()
+	}
+	slot.store.Remove(slot.key)
+	CacheEntries.WithLabelValues(slot.zone).Set(float64(slot.store.Len()))
+}
 
-	cc := hdr.Get("Cache-Control")
-	m := cacheControlRegex.FindStringSubmatch(cc)
-	if len(m) == 2 {
-		if n, err := strconv.Atoi(m[1]); err == nil {
-			ttl = uint32(n)
+// newZoneCaches creates a cache for each of the zones of the server block and Zones.
+func (h HTTPRecord) newZoneCaches() map[string]*cache.Cache {
+	caches := map[string]*cache.Cache{}
+	for _, origin := range h.origins {
+		caches[origin] = cache.New(h.cacheSize())
+	}
+	for _, zone := range h.Zones {
+		caches[zone.Origin] = cache.New(h.cacheSize())
+	}
+	return caches
+}
+
+// cacheSize returns the number of responses kept in each cache.
+func (h HTTPRecord) cacheSize() int {
+	if h.CacheSize > 0 {
+		return h.CacheSize
+	}
+	return DefaultCacheSize
+}
+
+// prefetches counts a lookup answered from the fresh response r and returns whether r is to be refreshed before it
+// expires.
+func (h HTTPRecord) prefetches(r backendResponse, now time.Time) bool {
+	if h.Prefetch == 0 || r.Hits == nil || atomic.AddUint32(r.Hits, 1) < uint32(h.Prefetch) {
+		return false
+	}
+
+	ttl := time.Duration(r.TTL) * time.Second
+	window := h.PrefetchWindow
+	if window == 0 {
+		window = ttl / 10
+	}
+	if h.TTLJitter > 0 {
+		window = jitterWindow(window, ttl, h.TTLJitter)
+	}
+	return !now.Before(r.Fetched.Add(ttl - window))
+}
+
+// refresh fetches the response for reqs in the background to replace the one in slot.
+func (h HTTPRecord) refresh(slot cacheSlot, reqs []backendRequest, backend *Backend) {
+	if h.lifecycle.isStopping() {
+		return
+	}
+	response, err := h.fetchShared(slot.key, reqs, backend)
+	if err != nil {
+		log.Debugf("Unable to refresh expired response from %s: %v", reqs[0].URI, err)
+	}
+	h.keep(slot, response, err)
+}
+
+// keep adds the result of a lookup to slot if it is to be reused.
+func (h HTTPRecord) keep(slot cacheSlot, response backendResponse, err error) {
+	if err == nil {
+		switch {
+		case response.NoStore:
+			// Responses kept before are outdated and may not be returned on error either.
+			h.remove(slot)
+		case h.ReturnCachedOnError || h.CacheResponses || (response.NoData && response.TTL > 0):
+			response.Hits = new(uint32)
+			h.add(slot, response)
+			h.share(slot.key, response)
 		}
+		return
 	}
-	if cc != "" && ttl == 0 {
-		log.Warningf("Unable to parse Cache-Control header: %s", cc)
+
+	if bie, ok := err.(BackendIndicatedError); ok && h.NegativeTTL > 0 && bie.DNSResponseCode == dns.RcodeNameError &&
+		bie.TTL > 0 {
+		negative := backendResponse{TTL: bie.TTL, Fetched: time.Now(), Error: &bie}
+		h.add(slot, negative)
+		h.share(slot.key, negative)
 	}
+}
+
+// extractTTL returns the lifetime of a response of backend with hdr, which is at least the MinTTL of backend unless the
+// backend forbade reusing the response.
+func (h HTTPRecord) extractTTL(hdr http.Header, backend *Backend) uint32 {
+	cc := parseCacheControl(hdr)
 
 	switch {
-	case ttl > 0 && (h.MaxTTL == 0 || h.MaxTTL > ttl):
-		return ttl
-	case h.MaxTTL > 0:
+	case cc.NoStore || cc.NoCache:
+		// Clients are not supposed to reuse the response either.
+		return 0
+	case !cc.HasMaxAge && h.MaxTTL > 0:
 		return h.MaxTTL
-	default:
+	case !cc.HasMaxAge:
 		return 3600
 	}
+
+	// The response may have been cached for a while before, e.g. by a CDN.
+	if age, err := parseDeltaSeconds(strings.TrimSpace(hdr.Get("Age"))); err == nil {
+		cc.MaxAge -= age
+	}
+	if cc.MaxAge < 0 {
+		cc.MaxAge = 0
+	}
+
+	ttl := cc.MaxAge / time.Second
+	if backend != nil && ttl < time.Duration(backend.MinTTL) {
+		ttl = time.Duration(backend.MinTTL)
+	}
+	if h.MaxTTL > 0 && ttl > time.Duration(h.MaxTTL) {
+		return h.MaxTTL
+	}
+	return uint32(ttl)
 }
 
-func (h HTTPRecord) fetchAndWrite(w dns.ResponseWriter, r *dns.Msg, rtype string, name string, uri string) (int, error) {
-	payload, ttl, err := h.maybeFetchCached(name, uri)
+// negativeTTL returns the TTL of an NXDOMAIN response of backend with hdr, which is NegativeTTL unless the backend gave
+// one.
+func (h HTTPRecord) negativeTTL(hdr http.Header, backend *Backend) uint32 {
+	if cc := parseCacheControl(hdr); cc.HasMaxAge || cc.NoStore || cc.NoCache {
+		return h.extractTTL(hdr, backend)
+	}
+	return h.NegativeTTL
+}
+
+func (h HTTPRecord) fetchAndWrite(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, state request.Request,
+	values placeholders, uris []string, backend *Backend) (rcode int, err error) {
+	start := time.Now()
+	logged, md := h.logsQuery(), metadataFrom(ctx)
+	var stats *fetchStats
+	if logged || md != nil {
+		stats = new(fetchStats)
+	}
+	name, rtype := state.Name(), state.Type()
+	uris = backend.order(backend.urisFor(state, uris))
+	reqs := make([]backendRequest, len(uris))
+	// failed is the rcode of error responses, which CoreDNS is told are successful once they are written.
+	failed := -1
+	defer func() {
+		responded := rcode
+		if failed >= 0 {
+			responded = failed
+		}
+		Responses.WithLabelValues(values["zone"], dns.RcodeToString[responded]).Inc()
+		if logged {
+			logQuery(state, reqs, stats, time.Since(start), responded, err)
+		}
+		if md != nil {
+			md.set(reqs, stats)
+		}
+	}()
+	fail := func(code int, ede *dns.EDNS0_EDE, soa *dns.SOA, err error) (int, error) {
+		failed = code
+		return writeError(w, r, code, ede, soa, err)
+	}
+
+	for i, uri := range uris {
+		reqs[i] = newBackendRequest(state, values, uri, backend)
+		reqs[i].Span = ot.SpanFromContext(ctx)
+		reqs[i].Stats = stats
+		if backend != nil && backend.DoH {
+			var err error
+			if reqs[i], err = dohRequest(reqs[i], r); err != nil {
+				return dns.RcodeServerFailure, err
+			}
+		}
+	}
+
+	w = h.tapWriter(w, r, start, values["zone"], reqs)
+	response, err := h.maybeFetchCached(name, rtype, reqs, backend)
 	if err != nil {
+		if rcode, ede, ok := h.errorRcode(err); ok {
+			return fail(rcode, ede, h.soa(name), err)
+		}
 		if bie, ok := err.(BackendIndicatedError); ok {
-			return bie.DNSResponseCode, err
+			ede := bie.ExtendedError
+			if ede == nil && bie.DNSResponseCode == dns.RcodeServerFailure {
+				ede = failureError(err, reqs)
+			}
+			return fail(bie.DNSResponseCode, ede, h.soa(name), err)
 		}
-		return dns.RcodeServerFailure, err
+		return fail(dns.RcodeServerFailure, failureError(err, reqs), nil, err)
 	}
+	uri := response.URI
 
-	parser, ok := responseToRR[rtype]
-	if !ok {
-		return dns.RcodeServerFailure, fmt.Errorf("unable to find response parser for: %s", rtype)
+	if backend != nil && backend.DoH {
+		return relay(w, r, response)
 	}
 
-	rrs, err := parser(name, ttl, payload)
+	parser := responseParser(response, backend)
+	parsed, err := response.records(name, rtype, parser)
 	if err != nil {
-		return dns.RcodeServerFailure, err
+		if bie, ok := err.(BackendIndicatedError); ok {
+			return fail(bie.DNSResponseCode, bie.ExtendedError, h.soa(name), err)
+		}
+		ParseFailures.WithLabelValues(values["zone"]).Inc()
+		return fail(dns.RcodeServerFailure, invalidResponseError(), nil, err)
+	}
+
+	if len(parsed.Errors) > 0 {
+		ParseFailures.WithLabelValues(values["zone"]).Inc()
+	}
+	for _, err := range parsed.Errors {
+		if h.Strict {
+			return fail(dns.RcodeServerFailure, invalidResponseError(), nil,
+				fmt.Errorf("invalid record in response from %s: %v", uri, err))
+		}
+		log.Debugf("Skipping invalid record in response from %s: %v", uri, err)
+	}
+
+	if err := validate(name, parsed); err != nil {
+		return fail(dns.RcodeServerFailure, invalidResponseError(), nil,
+			fmt.Errorf("invalid response from %s: %v", uri, err))
+	}
+
+	qtype, flatten := state.QType(), backend != nil && backend.Flatten
+	if (flatten || h.upstream != nil) && len(parsed.Answer) == 0 && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
+		if parsed.Answer, err = h.chase(ctx, w, state, response, parser, flatten); err != nil {
+			return fail(dns.RcodeServerFailure, nil, nil, err)
+		}
+	}
+	if h.upstream != nil && (qtype == dns.TypeMX || qtype == dns.TypeSRV) {
+		parsed.Extra = append(parsed.Extra, h.additionalAddresses(ctx, w, state, parsed.Answer)...)
 	}
 
 	m := new(dns.Msg)
 	m.SetReply(r)
-	m.Authoritative, m.RecursionAvailable = true, true
-	m.Answer = rrs
+	m.Authoritative = true
+	m.Answer = parsed.Answer
+	m.Ns = parsed.Ns
+	m.Extra = parsed.Extra
+	if len(m.Answer) == 0 && len(m.Ns) == 0 {
+		if soa := h.soa(name); soa != nil {
+			m.Ns = []dns.RR{soa}
+		}
+	}
+	if h.TTLJitter > 0 {
+		jitterTTLs(h.TTLJitter, m.Answer, m.Ns, m.Extra)
+	}
+	switch {
+	case parsed.Weights != nil:
+		m.Answer = weighAnswers(parsed.Weights, r.Id, m.Answer)
+	case h.AnswerOrder != "":
+		orderAnswers(h.AnswerOrder, r.Id, m.Answer)
+	case h.MaxAnswers > 0 && len(addressPositions(m.Answer)) > h.MaxAnswers:
+		orderAnswers(OrderShuffle, r.Id, m.Answer)
+	}
+	if h.MaxAnswers > 0 {
+		m.Answer = limitAnswers(h.MaxAnswers, m.Answer)
+	}
+	if backend != nil && backend.ECS {
+		setClientSubnet(m, state, response.ECSScope)
+	}
 
 	w.WriteMsg(m)
 	return dns.RcodeSuccess, nil
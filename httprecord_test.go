@@ -15,15 +15,36 @@
 package httprecord
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/coredns/coredns/plugin/metadata"
 	"github.com/coredns/coredns/plugin/pkg/cache"
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/plugin/pkg/singleflight"
 	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -34,6 +55,8 @@ type testCase struct {
 	tc                  test.Case
 	shouldErr           bool
 	doesNotCauseRequest bool
+	// timeout replaces the default timeout of 5ms for cases with large responses.
+	timeout time.Duration
 }
 
 func TestHTTPRecord_ServeDNS(t *testing.T) {
@@ -164,84 +187,2878 @@ func TestHTTPRecord_ServeDNS(t *testing.T) {
 			Answer: []dns.RR{},
 		},
 		shouldErr: true,
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+			rw.Write([]byte(`{"answer": [{"type": "A", "ttl": 600, "data": "1.2.3.4"}, {"data": "::1"}]}`))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("foo.example.com. 600	IN	A 1.2.3.4"),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			m := new(dns.Msg)
+			m.SetQuestion("foo.example.com.", dns.TypeAAAA)
+			m.Answer = []dns.RR{
+				test.AAAA("foo.example.com. 7200	IN	AAAA ::1"),
+				test.A("foo.example.com. 7200	IN	A 1.2.3.4"),
+			}
+			wire, _ := m.Pack()
+
+			rw.Header().Set("Content-Type", "application/dns-message")
+			rw.Write(wire)
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeAAAA,
+			Answer: []dns.RR{
+				test.AAAA("foo.example.com. 3600	IN	AAAA ::1"),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "application/x-test-reversed")
+			rw.Write([]byte("4.3.2.1"))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("foo.example.com. 3600	IN	A 1.2.3.4"),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "text/csv")
+			rw.Write([]byte("name,type,ttl,value\n" +
+				"foo.example.com.,TXT,60,\"hello, world\"\n" +
+				"bar.example.com.,TXT,60,other\n" +
+				"Foo.example.com,A,,1.2.3.4\n"))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{
+				test.TXT("foo.example.com. 60	IN	TXT \"hello, world\""),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "text/csv")
+			rw.Write([]byte("\xef\xbb\xbfname,type,ttl,value\r\n" +
+				"foo.example.com., TXT, 60, hello \r\n\r\n"))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{
+				test.TXT("foo.example.com. 60	IN	TXT hello"),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			// Rows with invalid TTLs are skipped rather than given a TTL of 0 or a wrapped one.
+			rw.Header().Set("Content-Type", "text/csv")
+			rw.Write([]byte("foo.example.com.,A,-1,1.2.3.4\n" +
+				"foo.example.com.,A,soon,1.2.3.5\n" +
+				"foo.example.com.,A,4294967296,1.2.3.6\n" +
+				"foo.example.com.,A,30,1.2.3.7\n"))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("foo.example.com. 30	IN	A 1.2.3.7"),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			// Zone exports are filtered while they are read and may exceed MaxHTTPBodySize.
+			rw.Header().Set("Content-Type", "text/csv")
+			for i := 0; i < 10000; i++ {
+				fmt.Fprintf(rw, "host%d.example.com.,A,60,10.0.%d.%d\n", i, i/256, i%256)
+			}
+		}),
+		tc: test.Case{
+			Qname: "host1234.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("host1234.example.com. 60	IN	A 10.0.4.210"),
+			},
+		},
+		timeout: time.Second,
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Digest", "sha-256=:ZpT4PJ9HbaMfXfa8xSADTn5X1CHSR7nTT0ntv8hKdkw=:")
+			rw.Write([]byte("1.2.3.4"))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("foo.example.com. 3600	IN	A 1.2.3.4"),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			// The body was truncated and does not match its digest.
+			rw.Header().Set("Content-Digest", "sha-256=:ZpT4PJ9HbaMfXfa8xSADTn5X1CHSR7nTT0ntv8hKdkw=:")
+			rw.Write([]byte("1.2.3."))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{},
+		},
+		shouldErr: true,
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("\xef\xbb\xbfv=spf1 -all\r\n"))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{
+				test.TXT("foo.example.com. 3600	IN	TXT \"v=spf1 -all\""),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Write([]byte("\xef\xbb\xbf{\"answer\": [{\"data\": \"1.2.3.4\"}]}\r\n"))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("foo.example.com. 3600	IN	A 1.2.3.4"),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+			Accept: []string{"application/json"},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Accept") != "application/json" {
+				rw.WriteHeader(406)
+				return
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Write([]byte(`{"answer": [{"data": "1.2.3.4"}]}`))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("foo.example.com. 3600	IN	A 1.2.3.4"),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if !strings.HasSuffix(r.Header.Get("Accept"), ", text/plain") {
+				rw.WriteHeader(406)
+				return
+			}
+			rw.Write([]byte("1.2.3.4"))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("foo.example.com. 3600	IN	A 1.2.3.4"),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Records: []Record{{
+				URI:  "-replace-",
+				Name: "example.com.",
+				Type: "TXT",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte(`TXT "v=DKIM1; k=rsa; " "p=\"MIG\\f\065"` + "\n" + strings.Repeat("a", 300)))
+		}),
+		tc: test.Case{
+			Qname: "example.com.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{
+				test.TXT(`example.com. 3600	IN	TXT "` + strings.Repeat("a", 255) + `" "` + strings.Repeat("a", 45) + `"`),
+				test.TXT(`example.com. 3600	IN	TXT "v=DKIM1; k=rsa; " "p=\"MIG\\fA"`),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(404)
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeA,
+			Rcode: dns.RcodeNameError,
+		},
+		shouldErr: true,
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("X-DNS-Rcode", "REFUSED")
+			rw.Write([]byte("1.2.3.4"))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeA,
+			Rcode: dns.RcodeRefused,
+		},
+		shouldErr: true,
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("X-DNS-Rcode", "noerror")
+			rw.WriteHeader(404)
+			rw.Write([]byte("<html>Not Found</html>"))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Write([]byte(`{"rcode": "NXDOMAIN"}`))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeA,
+			Rcode: dns.RcodeNameError,
+		},
+		shouldErr: true,
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Write([]byte(`{
+				"authority": [
+					{"name": "example.com.", "type": "SOA", "ttl": 300,
+					 "data": "ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"},
+					{"name": "example.com.", "type": "NS", "data": "ns.example.com."}
+				],
+				"additional": [{"name": "ns.example.com.", "type": "A", "data": "1.2.3.4"}]
+			}`))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{},
+			Ns: []dns.RR{
+				test.SOA("example.com. 300	IN	SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"),
+				test.NS("example.com. 3600	IN	NS ns.example.com."),
+			},
+			Extra: []dns.RR{
+				test.A("ns.example.com. 3600	IN	A 1.2.3.4"),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			m := new(dns.Msg)
+			m.SetQuestion("example.com.", dns.TypeTXT)
+			m.Answer = []dns.RR{test.TXT("example.com. 60	IN	TXT hello")}
+			m.Ns = []dns.RR{test.NS("example.com. 60	IN	NS ns.example.com.")}
+			m.Extra = []dns.RR{test.AAAA("ns.example.com. 60	IN	AAAA ::1")}
+			m.SetEdns0(4096, false)
+			wire, _ := m.Pack()
+
+			rw.Header().Set("Content-Type", "application/dns-message")
+			rw.Write(wire)
+		}),
+		tc: test.Case{
+			Qname: "example.com.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{test.TXT("example.com. 60	IN	TXT hello")},
+			Ns:     []dns.RR{test.NS("example.com. 60	IN	NS ns.example.com.")},
+			Extra:  []dns.RR{test.AAAA("ns.example.com. 60	IN	AAAA ::1")},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("; maintained by hand\n" +
+				"$TTL 300\n" +
+				"# web servers\n" +
+				"A 1.2.3.4\n" +
+				"A 60 1.2.3.5\n"))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("foo.example.com. 300	IN	A 1.2.3.4"),
+				test.A("foo.example.com. 60	IN	A 1.2.3.5"),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("A 1.2.3.4\nA 1.2.3.999\nnot-an-ip\n::1"))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("foo.example.com. 3600	IN	A 1.2.3.4"),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+			Strict: true,
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("A 1.2.3.4\nA 1.2.3.999"))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeA,
+			Rcode: dns.RcodeServerFailure,
+		},
+		shouldErr: true,
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+			Strict: true,
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("1.2.3.4\n::1"))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeAAAA,
+			Answer: []dns.RR{
+				test.AAAA("foo.example.com. 3600	IN	AAAA ::1"),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Records: []Record{{
+				URI:  "-replace-",
+				Name: "example.com.",
+				Type: "TXT",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("TXT 120 some value\nTXT\t60  tabbed\nTXT 300\nA thing"))
+		}),
+		tc: test.Case{
+			Qname: "example.com.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{
+				test.TXT("example.com. 120	IN	TXT \"some value\""),
+				test.TXT("example.com. 3600	IN	TXT \"300\""),
+				test.TXT("example.com. 60	IN	TXT tabbed"),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("MX 300 10 mail.example.com.\n20 mail2.example.com.\n1.2.3.4\nA 1.2.3.4"))
+		}),
+		tc: test.Case{
+			Qname: "example.com.", Qtype: dns.TypeMX,
+			Answer: []dns.RR{
+				test.MX("example.com. 300	IN	MX 10 mail.example.com."),
+				test.MX("example.com. 3600	IN	MX 20 mail2.example.com."),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("SRV 10 5 5060 _sip.Bücher.example.\nSRV 10 5 5060 sip.example.com."))
+		}),
+		tc: test.Case{
+			Qname: "_sip._udp.example.com.", Qtype: dns.TypeSRV,
+			Answer: []dns.RR{
+				test.SRV("_sip._udp.example.com. 3600	IN	SRV 10 5 5060 _sip.xn--bcher-kva.example."),
+				test.SRV("_sip._udp.example.com. 3600	IN	SRV 10 5 5060 sip.example.com."),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			m := new(dns.Msg)
+			m.SetQuestion("foo.example.com.", dns.TypeA)
+			m.Answer = []dns.RR{test.A("bar.example.com. 60	IN	A 1.2.3.4")}
+			wire, _ := m.Pack()
+
+			rw.Header().Set("Content-Type", "application/dns-message")
+			rw.Write(wire)
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeA,
+			Rcode: dns.RcodeServerFailure,
+		},
+		shouldErr: true,
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "application/x-test-nil-a")
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeA,
+			Rcode: dns.RcodeServerFailure,
+		},
+		shouldErr: true,
+	}, {
+		config: HTTPRecord{
+			Zones: []Zone{{
+				URI:    "-replace-",
+				Origin: "example.com.",
+				Backend: &Backend{Template: &ResponseTemplate{
+					Regexp: regexp.MustCompile(`<td>(\d+\.\d+\.\d+\.\d+)</td><td>up</td>`),
+					Format: "A $1",
+				}},
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "text/html")
+			rw.Write([]byte("<table><tr><td>1.2.3.4</td><td>up</td></tr><tr><td>1.2.3.5</td><td>down</td></tr></table>"))
+		}),
+		tc: test.Case{
+			Qname: "foo.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("foo.example.com. 3600	IN	A 1.2.3.4"),
+			},
+		},
+	}, {
+		config: HTTPRecord{
+			Records: []Record{{
+				URI:  "-replace-",
+				Name: "example.com.",
+				Type: "TXT",
+				Backend: &Backend{Header: http.Header{
+					"Authorization": {"ApiKey secret"},
+					"Accept":        {"text/plain"},
+				}},
+			}},
+		},
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "ApiKey secret" || r.Header.Get("Accept") != "text/plain" {
+				rw.WriteHeader(403)
+				return
+			}
+			rw.Write([]byte("Hello"))
+		}),
+		tc: test.Case{
+			Qname: "example.com.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{
+				test.TXT("example.com. 3600	IN	TXT Hello"),
+			},
+		},
 	}}
 
-	log.D.Set()
+	RegisterResponseParser("application/x-test-nil-a", ResponseParserFunc(
+		func(name string, rtype string, ttl uint32, body []byte) (ParsedResponse, error) {
+			return ParsedResponse{Answer: []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}}}}, nil
+		}))
+	RegisterResponseParser("application/x-test-reversed", ResponseParserFunc(
+		func(name string, rtype string, ttl uint32, body []byte) (ParsedResponse, error) {
+			reversed := make([]byte, len(body))
+			for i, b := range body {
+				reversed[len(body)-1-i] = b
+			}
+			return parseText(name, rtype, ttl, reversed)
+		}))
+
+	log.D.Set()
+	for i, c := range tests {
+		runTestCase(t, c, i)
+		runTestCaseCached(t, c, i)
+	}
+}
+
+func runTestCase(t *testing.T, c testCase, testnum int) {
+	server := httptest.NewServer(c.handler)
+	defer server.Close()
+
+	config := c.config
+	config.Timeout = 5 * time.Millisecond
+	if c.timeout > 0 {
+		config.Timeout = c.timeout
+	}
+
+	config.Records = make([]Record, len(c.config.Records))
+	copy(config.Records, c.config.Records)
+	config.Zones = make([]Zone, len(c.config.Zones))
+	copy(config.Zones, c.config.Zones)
+	for i, r := range config.Records {
+		config.Records[i].URI = strings.Replace(r.URI, "-replace-", server.URL, -1)
+	}
+	for i, z := range config.Zones {
+		config.Zones[i].URI = strings.Replace(z.URI, "-replace-", server.URL, -1)
+	}
+
+	doRequest(t, &config, &c.tc, testnum, c.shouldErr, "")
+
+	// Without caching, everything should fail when the server is down
+	server.Close()
+	down := c.tc
+	down.Rcode = dns.RcodeSuccess
+	doRequest(t, &config, &down, testnum, !c.doesNotCauseRequest, "[ServerDown] ")
+}
+
+func runTestCaseCached(t *testing.T, c testCase, testnum int) {
+	server := httptest.NewServer(c.handler)
+	defer server.Close()
+
+	config := c.config
+	config.ReturnCachedOnError = true
+	config.Cache = cache.New(100)
+	config.Timeout = 5 * time.Millisecond
+	if c.timeout > 0 {
+		config.Timeout = c.timeout
+	}
+
+	config.Records = make([]Record, len(c.config.Records))
+	copy(config.Records, c.config.Records)
+	config.Zones = make([]Zone, len(c.config.Zones))
+	copy(config.Zones, c.config.Zones)
+	for i, r := range config.Records {
+		config.Records[i].URI = strings.Replace(r.URI, "-replace-", server.URL, -1)
+	}
+	for i, z := range config.Zones {
+		config.Zones[i].URI = strings.Replace(z.URI, "-replace-", server.URL, -1)
+	}
+
+	doRequest(t, &config, &c.tc, testnum, c.shouldErr, "")
+
+	// Close the server and run the case again - with caching, it should still pass
+	server.Close()
+	cached := c.tc
+	if c.shouldErr {
+		// Nothing was cached, so the backend-indicated rcode is gone as well.
+		cached.Rcode = dns.RcodeSuccess
+	}
+	doRequest(t, &config, &cached, testnum, c.shouldErr, "[Cached] ")
+}
+
+func doRequest(t *testing.T, c *HTTPRecord, tc *test.Case, testnum int, shouldErr bool, msgPrefix string) {
+	ctx := context.TODO()
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	rcode, err := c.ServeDNS(ctx, rec, tc.Msg())
+
+	if rec.Msg != nil {
+		rcode = rec.Msg.Rcode
+	}
+	if err != nil && shouldErr && tc.Rcode != dns.RcodeSuccess && rcode != tc.Rcode {
+		t.Errorf(msgPrefix+"Test %d expected rcode %s, got %s\n", testnum, dns.RcodeToString[tc.Rcode],
+			dns.RcodeToString[rcode])
+	}
+
+	if err != nil && !shouldErr {
+		t.Errorf(msgPrefix+"Test %d expected no error, got %v\n", testnum, err)
+		return
+	} else if err == nil && shouldErr {
+		t.Errorf(msgPrefix+"Test %d expected an error but didn't get one. Answer:\n %v\n", testnum, rec.Msg)
+		return
+	}
+
+	if err == nil {
+		resp := rec.Msg
+		if err := test.SortAndCheck(resp, *tc); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestHTTPRecord_ProblemDetails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/problem+json")
+		rw.WriteHeader(403)
+		rw.Write([]byte(`{"title": "Forbidden", "detail": "tenant suspended", "rcode": "REFUSED",
+			"extended_error": 18, "retry_after": 30}`))
+	}))
+	defer server.Close()
+
+	config := HTTPRecord{
+		Zones:   []Zone{{URI: server.URL, Origin: "example.com."}},
+		Timeout: 5 * time.Millisecond,
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("foo.example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	rcode, err := config.ServeDNS(context.TODO(), rec, req)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if bie, ok := err.(BackendIndicatedError); !ok || bie.RetryAfter != 30*time.Second {
+		t.Errorf("Expected a BackendIndicatedError with a retry after of 30s, got %v", err)
+	}
+	if rec.Msg == nil {
+		t.Fatalf("Expected a response to be written, got rcode %d", rcode)
+	}
+	if rec.Msg.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected REFUSED, got %s", dns.RcodeToString[rec.Msg.Rcode])
+	}
+
+	opt := rec.Msg.IsEdns0()
+	if opt == nil || len(opt.Option) != 1 {
+		t.Fatalf("Expected an OPT record with an extended error, got %v", rec.Msg)
+	}
+	if ede, ok := opt.Option[0].(*dns.EDNS0_EDE); !ok || ede.InfoCode != 18 || ede.ExtraText != "tenant suspended" {
+		t.Errorf("Expected extended error 18 with extra text, got %v", opt.Option[0])
+	}
+}
+
+func TestHTTPRecord_TLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	tc := test.Case{
+		Qname: "example.com.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.A("example.com. 3600	IN	A 1.2.3.4"),
+		},
+	}
+
+	tests := []struct {
+		tlsConfig *tls.Config
+		shouldErr bool
+	}{
+		{nil, true},
+		{&tls.Config{RootCAs: roots}, false},
+		{&tls.Config{RootCAs: roots, ServerName: "example.com"}, false},
+		{&tls.Config{RootCAs: roots, ServerName: "records.internal"}, true},
+		{&tls.Config{InsecureSkipVerify: true}, false},
+	}
+
+	for i, test := range tests {
+		config := HTTPRecord{
+			Records: []Record{{
+				URI:     server.URL,
+				Name:    "example.com.",
+				Type:    "A",
+				Backend: &Backend{TLSConfig: test.tlsConfig},
+			}},
+			Timeout: time.Second,
+		}
+
+		doRequest(t, &config, &tc, i, test.shouldErr, "[TLS] ")
+	}
+}
+
+func TestHTTPRecord_ConnectionReuse(t *testing.T) {
+	var connections int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	backend := &Backend{MaxIdleConns: 1}
+	backend.transport = newTransport(backend)
+	defer backend.transport.CloseIdleConnections()
+
+	config := HTTPRecord{
+		Records: []Record{{URI: server.URL, Name: "example.com.", Type: "A", Backend: backend}},
+		Timeout: time.Second,
+	}
+	tc := test.Case{
+		Qname: "example.com.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.A("example.com. 3600	IN	A 1.2.3.4"),
+		},
+	}
+
+	for i := 0; i < 5; i++ {
+		doRequest(t, &config, &tc, i, false, "[Reuse] ")
+	}
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Errorf("Expected a single connection to be reused, got %d connections", n)
+	}
+}
+
+func TestHTTPRecord_Retries(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			rw.WriteHeader(503)
+			return
+		}
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+
+	tc := test.Case{
+		Qname: "example.com.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.A("example.com. 3600	IN	A 1.2.3.4"),
+		},
+	}
+
+	tests := []struct {
+		retries   int
+		timeout   time.Duration
+		shouldErr bool
+		requests  int32
+	}{
+		{0, time.Second, true, 1},
+		{1, time.Second, true, 2},
+		{2, time.Second, false, 3},
+		{5, time.Second, false, 3},
+		// The backoff of 1ms and 2ms does not fit into the timeout.
+		{2, 2 * time.Millisecond, true, 2},
+	}
+
+	for i, test := range tests {
+		atomic.StoreInt32(&requests, 0)
+		config := HTTPRecord{
+			Records:      []Record{{URI: server.URL, Name: "example.com.", Type: "A"}},
+			Timeout:      test.timeout,
+			Retries:      test.retries,
+			RetryBackoff: time.Millisecond,
+		}
+
+		doRequest(t, &config, &tc, i, test.shouldErr, "[Retries] ")
+		if n := atomic.LoadInt32(&requests); n != test.requests {
+			t.Errorf("Test %d expected %d requests, got %d", i, test.requests, n)
+		}
+	}
+}
+
+func TestHTTPRecord_Proxy(t *testing.T) {
+	var requested string
+	proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requested = r.URL.String()
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := HTTPRecord{
+		Records: []Record{{
+			URI:     "http://backend.invalid/%(fqdn)",
+			Name:    "example.com.",
+			Type:    "A",
+			Backend: &Backend{Proxy: proxyURL},
+		}},
+		Timeout: time.Second,
+	}
+	tc := test.Case{
+		Qname: "example.com.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.A("example.com. 3600	IN	A 1.2.3.4"),
+		},
+	}
+
+	doRequest(t, &config, &tc, 0, false, "[Proxy] ")
+	if requested != "http://backend.invalid/example.com." {
+		t.Errorf("Expected the request to go through the proxy, got %q", requested)
+	}
+}
+
+func TestHTTPRecord_Method(t *testing.T) {
+	var method, contentType, body string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		method, contentType = r.Method, r.Header.Get("Content-Type")
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+
+	tc := test.Case{
+		Qname: "example.com.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.A("example.com. 3600	IN	A 1.2.3.4"),
+		},
+	}
+
+	tests := []struct {
+		backend     *Backend
+		method      string
+		contentType string
+		body        string
+	}{
+		{nil, "GET", "", ""},
+		{&Backend{Method: "POST"}, "POST", "", ""},
+		{
+			&Backend{Method: "POST", Body: `{"name": "%(fqdn)", "type": "%(qtype)", "client": "%(client_ip)"}`},
+			"POST", "application/json",
+			`{"name": "example.com.", "type": "A", "client": "10.240.0.1"}`,
+		},
+		{
+			&Backend{Method: "PUT", Body: "%(fqdn)", Header: http.Header{"Content-Type": {"text/plain"}}},
+			"PUT", "text/plain", "example.com.",
+		},
+	}
+
+	for i, test := range tests {
+		config := HTTPRecord{
+			Records: []Record{{URI: server.URL, Name: "example.com.", Type: "A", Backend: test.backend}},
+			Timeout: time.Second,
+		}
+
+		doRequest(t, &config, &tc, i, false, "[Method] ")
+		if method != test.method || contentType != test.contentType || body != test.body {
+			t.Errorf("Test %d expected %s request with %q body of type %q, got %s request with %q body of type %q",
+				i, test.method, test.body, test.contentType, method, body, contentType)
+		}
+	}
+}
+
+func TestHTTPRecord_HTTPVersion(t *testing.T) {
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// Respond with the version used for the request.
+		rw.Write([]byte(fmt.Sprintf("1.2.3.%d", r.ProtoMajor)))
+	})
+
+	tlsServer := httptest.NewUnstartedServer(handler)
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+
+	h2cServer := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer h2cServer.Close()
+
+	http1Server := httptest.NewServer(handler)
+	defer http1Server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsServer.Certificate())
+
+	tests := []struct {
+		uri         string
+		httpVersion string
+		shouldErr   bool
+		answer      []dns.RR
+	}{
+		{tlsServer.URL, "", false, []dns.RR{test.A("example.com. 3600	IN	A 1.2.3.2")}},
+		{tlsServer.URL, HTTPVersion1, false, []dns.RR{test.A("example.com. 3600	IN	A 1.2.3.1")}},
+		{tlsServer.URL, HTTPVersion2, false, []dns.RR{test.A("example.com. 3600	IN	A 1.2.3.2")}},
+		{h2cServer.URL, "", false, []dns.RR{test.A("example.com. 3600	IN	A 1.2.3.1")}},
+		{h2cServer.URL, HTTPVersion2, false, []dns.RR{test.A("example.com. 3600	IN	A 1.2.3.2")}},
+		{http1Server.URL, HTTPVersion2, true, nil},
+	}
+
+	for i, c := range tests {
+		config := HTTPRecord{
+			Records: []Record{{
+				URI:     c.uri,
+				Name:    "example.com.",
+				Type:    "A",
+				Backend: &Backend{TLSConfig: &tls.Config{RootCAs: roots}, HTTPVersion: c.httpVersion},
+			}},
+			Timeout: time.Second,
+		}
+		tc := test.Case{
+			Qname: "example.com.", Qtype: dns.TypeA,
+			Answer: c.answer,
+		}
+
+		doRequest(t, &config, &tc, i, c.shouldErr, "[HTTPVersion] ")
+	}
+}
+
+func TestHTTPRecord_AllowedBackends(t *testing.T) {
+	var path, proxied string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		path = r.URL.RawPath
+		if path == "" {
+			path = r.URL.Path
+		}
+		// Requests through a proxy carry the host they are for.
+		proxied = r.URL.Host
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		uri       string
+		allowed   []string
+		qname     string
+		shouldErr bool
+		path      string
+		// proxy sends the request through the server as proxy.
+		proxy bool
+	}{
+		{server.URL + "/%(fqdn)", nil, "example.com.", false, "/example.com.", false},
+		// Characters with a meaning in URIs are escaped.
+		{server.URL + "/%(fqdn)", nil, "a/b?c&d.example.com.", false, "/a%2Fb%3Fc%26d.example.com.", false},
+		// The query name cannot steer requests to hosts that are not allowed.
+		{"http://%(fqdn):" + port + "/", []string{"127.0.0.1"}, "example.com.", true, "", false},
+		{server.URL + "/", []string{"127.0.0.1"}, "example.com.", false, "/", false},
+		{server.URL + "/", []string{"10.0.0.0/8"}, "example.com.", true, "", false},
+		{server.URL + "/", []string{"records.example.com"}, "example.com.", true, "", false},
+		{"http://localhost:" + port + "/", []string{"localhost"}, "example.com.", false, "/", false},
+		{"http://localhost:" + port + "/", []string{"127.0.0.0/8"}, "example.com.", false, "/", false},
+		{"http://localhost:" + port + "/", []string{"10.0.0.0/8"}, "example.com.", true, "", false},
+		// Hosts are checked before the request is sent through a proxy, which is all the dialer sees.
+		{"http://backend.invalid/", []string{"localhost", "10.0.0.0/8"}, "example.com.", true, "", true},
+		{"http://localhost:" + port + "/", []string{"127.0.0.0/8", "::1"}, "example.com.", false, "/", true},
+	}
+
+	for i, c := range tests {
+		path, proxied = "", ""
+		backend := &Backend{}
+		if c.proxy {
+			backend.Proxy, _ = url.Parse("http://localhost:" + port)
+		}
+		if c.allowed != nil {
+			backend.Allowlist = &Allowlist{}
+			for _, allowed := range c.allowed {
+				if err := backend.Allowlist.Add(allowed); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		config := HTTPRecord{
+			Zones:   []Zone{{Origin: "example.com.", URI: c.uri, Backend: backend}},
+			Timeout: time.Second,
+		}
+		tc := test.Case{
+			Qname: c.qname, Qtype: dns.TypeA,
+		}
+		if !c.shouldErr {
+			tc.Answer = []dns.RR{test.A(c.qname + " 3600	IN	A 1.2.3.4")}
+		}
+
+		doRequest(t, &config, &tc, i, c.shouldErr, "[AllowedBackends] ")
+		if path != c.path {
+			t.Errorf("Test %d expected a request for %q, got %q", i, c.path, path)
+		}
+		if c.proxy && !c.shouldErr && proxied == "" {
+			t.Errorf("Test %d expected the request to be sent through the proxy", i)
+		}
+	}
+}
+
+func TestHTTPRecord_Compression(t *testing.T) {
+	var acceptEncoding string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+
+		encoding := r.URL.Query().Get("encoding")
+		rw.Header().Set("Content-Encoding", encoding)
+
+		var w io.WriteCloser
+		switch encoding {
+		case "gzip":
+			w = gzip.NewWriter(rw)
+		case "deflate":
+			w = zlib.NewWriter(rw)
+		default:
+			rw.Write([]byte("1.2.3.4"))
+			return
+		}
+		if r.URL.Query().Get("large") != "" {
+			// Compresses well below MaxHTTPBodySize, but is too large once decompressed.
+			w.Write(bytes.Repeat([]byte("1.2.3.4\n"), MaxHTTPBodySize))
+		} else {
+			w.Write([]byte("1.2.3.4"))
+		}
+		w.Close()
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		query     string
+		shouldErr bool
+	}{
+		{"", false},
+		{"encoding=identity", false},
+		{"encoding=gzip", false},
+		{"encoding=deflate", false},
+		{"encoding=br", true},
+		{"encoding=gzip&large=1", true},
+	}
+
+	for i, c := range tests {
+		config := HTTPRecord{
+			Records: []Record{{URI: server.URL + "/?" + c.query, Name: "example.com.", Type: "A"}},
+			Timeout: time.Second,
+		}
+		tc := test.Case{
+			Qname: "example.com.", Qtype: dns.TypeA,
+		}
+		if !c.shouldErr {
+			tc.Answer = []dns.RR{test.A("example.com. 3600	IN	A 1.2.3.4")}
+		}
+
+		doRequest(t, &config, &tc, i, c.shouldErr, "[Compression] ")
+		if acceptEncoding != AcceptEncoding {
+			t.Errorf("Test %d expected Accept-Encoding %q, got %q", i, AcceptEncoding, acceptEncoding)
+		}
+	}
+}
+
+func TestHTTPRecord_ConditionalRequests(t *testing.T) {
+	var requests, notModified int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/etag":
+			rw.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				atomic.AddInt32(&notModified, 1)
+				rw.WriteHeader(304)
+				return
+			}
+		case "/last-modified":
+			rw.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+			if r.Header.Get("If-Modified-Since") == "Mon, 02 Jan 2006 15:04:05 GMT" {
+				atomic.AddInt32(&notModified, 1)
+				rw.WriteHeader(304)
+				return
+			}
+		}
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+
+	tc := test.Case{
+		Qname: "example.com.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.A("example.com. 3600	IN	A 1.2.3.4"),
+		},
+	}
+
+	tests := []struct {
+		path        string
+		cached      bool
+		notModified int32
+	}{
+		{"/etag", true, 2},
+		{"/last-modified", true, 2},
+		{"/none", true, 0},
+		// Without cache, there is nothing to revalidate.
+		{"/etag", false, 0},
+	}
+
+	for i, c := range tests {
+		atomic.StoreInt32(&requests, 0)
+		atomic.StoreInt32(&notModified, 0)
+		config := HTTPRecord{
+			Records: []Record{{URI: server.URL + c.path, Name: "example.com.", Type: "A"}},
+			Timeout: time.Second,
+		}
+		if c.cached {
+			config.ReturnCachedOnError = true
+			config.Cache = cache.New(100)
+		}
+
+		for j := 0; j < 3; j++ {
+			doRequest(t, &config, &tc, i, false, "[Conditional] ")
+		}
+		if n := atomic.LoadInt32(&requests); n != 3 {
+			t.Errorf("Test %d expected 3 requests, got %d", i, n)
+		}
+		if n := atomic.LoadInt32(&notModified); n != c.notModified {
+			t.Errorf("Test %d expected %d revalidated responses, got %d", i, c.notModified, n)
+		}
+	}
+}
+
+func TestHTTPRecord_RequestIdentification(t *testing.T) {
+	var userAgents, ids []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		ids = append(ids, r.Header.Get("X-Request-ID")+r.Header.Get("X-Correlation-ID"))
+		if r.URL.Query().Get("fail") != "" && len(ids)%2 == 1 {
+			rw.WriteHeader(503)
+			return
+		}
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+
+	tc := test.Case{
+		Qname: "example.com.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.A("example.com. 3600	IN	A 1.2.3.4"),
+		},
+	}
+
+	tests := []struct {
+		query     string
+		backend   *Backend
+		userAgent string
+		// sameID is whether both requests should carry the same ID.
+		sameID bool
+		hasID  bool
+	}{
+		{"", nil, UserAgent, false, true},
+		// Retries of a lookup are sent with the same ID.
+		{"fail=1", nil, UserAgent, true, true},
+		{"", &Backend{RequestIDHeader: "X-Correlation-ID"}, UserAgent, false, true},
+		{"", &Backend{RequestIDHeader: "off"}, UserAgent, true, false},
+		{"", &Backend{Header: http.Header{"User-Agent": {"dns-42"}}}, "dns-42", false, true},
+	}
+
+	for i, c := range tests {
+		userAgents, ids = nil, nil
+		config := HTTPRecord{
+			Records: []Record{{URI: server.URL + "/?" + c.query, Name: "example.com.", Type: "A", Backend: c.backend}},
+			Timeout: time.Second,
+			Retries: 1,
+		}
+
+		doRequest(t, &config, &tc, i, false, "[RequestIdentification] ")
+		if c.query == "" {
+			doRequest(t, &config, &tc, i, false, "[RequestIdentification] ")
+		}
+
+		if len(ids) != 2 {
+			t.Fatalf("Test %d expected 2 requests, got %d", i, len(ids))
+		}
+		for _, userAgent := range userAgents {
+			if userAgent != c.userAgent {
+				t.Errorf("Test %d expected User-Agent %q, got %q", i, c.userAgent, userAgent)
+			}
+		}
+		if hasID := ids[0] != ""; hasID != c.hasID {
+			t.Errorf("Test %d expected request ID: %v, got %q", i, c.hasID, ids[0])
+		}
+		if sameID := ids[0] == ids[1]; sameID != c.sameID {
+			t.Errorf("Test %d expected same request IDs: %v, got %q", i, c.sameID, ids)
+		}
+	}
+}
+
+func TestHTTPRecord_Failover(t *testing.T) {
+	handler := func(status int, body string) http.HandlerFunc {
+		return func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(status)
+			rw.Write([]byte(body))
+		}
+	}
+	up := httptest.NewServer(handler(200, "1.2.3.4"))
+	defer up.Close()
+	up2 := httptest.NewServer(handler(200, "1.2.3.5"))
+	defer up2.Close()
+	failing := httptest.NewServer(handler(503, ""))
+	defer failing.Close()
+	notFound := httptest.NewServer(handler(404, ""))
+	defer notFound.Close()
+	down := httptest.NewServer(handler(200, ""))
+	down.Close()
+
+	tests := []struct {
+		uris      []string
+		rcode     int
+		shouldErr bool
+		answer    []dns.RR
+	}{
+		{[]string{up.URL, up2.URL}, dns.RcodeSuccess, false, []dns.RR{test.A("example.com. 3600	IN	A 1.2.3.4")}},
+		{[]string{failing.URL, up.URL}, dns.RcodeSuccess, false, []dns.RR{test.A("example.com. 3600	IN	A 1.2.3.4")}},
+		{[]string{down.URL, failing.URL, up2.URL}, dns.RcodeSuccess, false,
+			[]dns.RR{test.A("example.com. 3600	IN	A 1.2.3.5")}},
+		// NXDOMAIN is an answer, which other backends are not asked about.
+		{[]string{notFound.URL, up.URL}, dns.RcodeNameError, true, nil},
+		{[]string{down.URL, failing.URL}, dns.RcodeServerFailure, true, nil},
+	}
+
+	for i, c := range tests {
+		config := HTTPRecord{
+			Records: []Record{{URI: c.uris[0], Fallbacks: c.uris[1:], Name: "example.com.", Type: "A"}},
+			Timeout: time.Second,
+		}
+		tc := test.Case{
+			Qname: "example.com.", Qtype: dns.TypeA,
+			Rcode:  c.rcode,
+			Answer: c.answer,
+		}
+
+		doRequest(t, &config, &tc, i, c.shouldErr, "[Failover] ")
+	}
+}
+
+func TestHTTPRecord_Policy(t *testing.T) {
+	var requests [2]int32
+	servers := make([]*httptest.Server, 2)
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests[i], 1)
+			rw.Write([]byte("1.2.3.4"))
+		}))
+		defer servers[i].Close()
+	}
+
+	backend := &Backend{Policy: PolicyRoundRobin, balancer: newBalancer(PolicyRoundRobin)}
+	config := HTTPRecord{
+		Records: []Record{{
+			URI:       servers[0].URL,
+			Fallbacks: []string{servers[1].URL},
+			Name:      "example.com.",
+			Type:      "A",
+			Backend:   backend,
+		}},
+		Timeout: time.Second,
+	}
+	tc := test.Case{
+		Qname: "example.com.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.A("example.com. 3600	IN	A 1.2.3.4"),
+		},
+	}
+
+	for i := 0; i < 4; i++ {
+		doRequest(t, &config, &tc, i, false, "[Policy] ")
+	}
+	for i := range requests {
+		if n := atomic.LoadInt32(&requests[i]); n != 2 {
+			t.Errorf("Expected 2 requests to backend %d, got %d", i, n)
+		}
+	}
+}
+
+func TestHTTPRecord_RateLimit(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+
+	answer := []dns.RR{test.A("example.com. 3600	IN	A 1.2.3.4")}
+	tests := []struct {
+		rcode     int
+		cached    bool
+		shouldErr bool
+		answer    []dns.RR
+	}{
+		{dns.RcodeServerFailure, false, true, nil},
+		{dns.RcodeRefused, false, true, nil},
+		// Lookups exceeding the limit are answered from cache instead.
+		{dns.RcodeServerFailure, true, false, answer},
+	}
+
+	for i, c := range tests {
+		atomic.StoreInt32(&requests, 0)
+		backend := &Backend{MaxQPS: 0.001, Burst: 1, RateLimitRcode: c.rcode}
+		backend.limiter = newRateLimiter(backend.MaxQPS, backend.Burst)
+		config := HTTPRecord{
+			Records: []Record{{URI: server.URL, Name: "example.com.", Type: "A", Backend: backend}},
+			Timeout: time.Second,
+		}
+		if c.cached {
+			config.ReturnCachedOnError = true
+			config.Cache = cache.New(100)
+		}
+
+		tc := test.Case{Qname: "example.com.", Qtype: dns.TypeA, Answer: answer}
+		doRequest(t, &config, &tc, i, false, "[RateLimit] ")
+
+		tc = test.Case{Qname: "example.com.", Qtype: dns.TypeA, Rcode: c.rcode, Answer: c.answer}
+		if !c.shouldErr {
+			tc.Rcode = dns.RcodeSuccess
+		}
+		doRequest(t, &config, &tc, i, c.shouldErr, "[RateLimit] ")
+
+		if n := atomic.LoadInt32(&requests); n != 1 {
+			t.Errorf("Test %d expected 1 request, got %d", i, n)
+		}
+	}
+}
+
+func TestHTTPRecord_MaxConcurrent(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	backend := &Backend{MaxConcurrent: 1, QueueTimeout: 10 * time.Millisecond}
+	backend.inFlight = newSemaphore(backend.MaxConcurrent)
+	config := HTTPRecord{
+		Records: []Record{
+			{URI: server.URL + "/slow", Name: "slow.example.com.", Type: "A", Backend: backend},
+			{URI: server.URL + "/fast", Name: "fast.example.com.", Type: "A", Backend: backend},
+			{URI: server.URL + "/fast", Name: "other.example.com.", Type: "A"},
+		},
+		Timeout: time.Second,
+	}
+
+	go func() {
+		config.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter{}),
+			(&test.Case{Qname: "slow.example.com.", Qtype: dns.TypeA}).Msg())
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The backend is busy with the slow request, but others are not.
+	tc := test.Case{Qname: "fast.example.com.", Qtype: dns.TypeA}
+	doRequest(t, &config, &tc, 0, true, "[MaxConcurrent] ")
+
+	tc = test.Case{
+		Qname: "other.example.com.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.A("other.example.com. 3600	IN	A 1.2.3.4"),
+		},
+	}
+	doRequest(t, &config, &tc, 1, false, "[MaxConcurrent] ")
+}
+
+func TestHTTPRecord_Coalescing(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+
+	config := HTTPRecord{
+		Records: []Record{{URI: server.URL, Name: "example.com.", Type: "A"}},
+		Timeout: time.Second,
+		flights: new(singleflight.Group),
+	}
+	tc := test.Case{
+		Qname: "example.com.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.A("example.com. 3600	IN	A 1.2.3.4"),
+		},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			doRequest(t, &config, &tc, i, false, "[Coalescing] ")
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected concurrent lookups to share 1 request, got %d", n)
+	}
+}
+
+func TestHTTPRecord_DoH(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		query := new(dns.Msg)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != DNSMessageContentType ||
+			r.Header.Get("Accept") != DNSMessageContentType || query.Unpack(body) != nil || query.Id != 0 {
+			rw.WriteHeader(400)
+			return
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(query)
+		switch query.Question[0].Qtype {
+		case dns.TypeMX:
+			m.Answer = []dns.RR{
+				test.CNAME("example.com. 300	IN	CNAME mail.example.org."),
+				test.MX("mail.example.org. 300	IN	MX 10 mx.example.org."),
+			}
+		case dns.TypeHINFO:
+			m.Rcode = dns.RcodeNameError
+			m.Ns = []dns.RR{test.SOA("example.com. 300	IN	SOA ns.example.com. admin.example.com. 1 7200 3600 86400 300")}
+		default:
+			// A response to a different query.
+			m.Question[0].Name = "example.org."
+		}
+
+		rw.Header().Set("Content-Type", DNSMessageContentType)
+		packed, _ := m.Pack()
+		rw.Write(packed)
+	}))
+	defer server.Close()
+
+	config := HTTPRecord{
+		Zones:   []Zone{{Origin: "example.com.", URI: server.URL, Backend: &Backend{DoH: true}}},
+		Timeout: time.Second,
+	}
+
+	tests := []struct {
+		tc        test.Case
+		shouldErr bool
+	}{
+		{test.Case{
+			Qname: "example.com.", Qtype: dns.TypeMX,
+			Answer: []dns.RR{
+				test.CNAME("example.com. 300	IN	CNAME mail.example.org."),
+				test.MX("mail.example.org. 300	IN	MX 10 mx.example.org."),
+			},
+		}, false},
+		// Types that are not supported otherwise are forwarded as well.
+		{test.Case{
+			Qname: "example.com.", Qtype: dns.TypeHINFO,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA("example.com. 300	IN	SOA ns.example.com. admin.example.com. 1 7200 3600 86400 300"),
+			},
+		}, false},
+		{test.Case{
+			Qname: "example.com.", Qtype: dns.TypeA,
+			Rcode: dns.RcodeServerFailure,
+		}, true},
+	}
+
+	for i, c := range tests {
+		doRequest(t, &config, &c.tc, i, c.shouldErr, "[DoH] ")
+	}
+}
+
+func TestHTTPRecord_QueryHeaders(t *testing.T) {
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		tcp    bool
+		header http.Header
+	}{
+		{false, http.Header{
+			"X-Dns-Qname":     {"example.com."},
+			"X-Dns-Qtype":     {"A"},
+			"X-Dns-Protocol":  {"udp"},
+			"X-Dns-Client-Ip": {"10.240.0.1"},
+		}},
+		{true, http.Header{"X-Dns-Protocol": {"tcp"}}},
+	}
+
+	for i, c := range tests {
+		config := HTTPRecord{
+			Records: []Record{{URI: server.URL, Name: "example.com.", Type: "A"}},
+			Timeout: time.Second,
+		}
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{TCP: c.tcp})
+		tc := test.Case{Qname: "example.com.", Qtype: dns.TypeA}
+		if _, err := config.ServeDNS(context.TODO(), rec, tc.Msg()); err != nil {
+			t.Fatalf("Test %d expected no error, got %v", i, err)
+		}
+
+		for key := range c.header {
+			if got := header.Get(key); got != c.header.Get(key) {
+				t.Errorf("Test %d expected %s: %q, got %q", i, key, c.header.Get(key), got)
+			}
+		}
+	}
+}
+
+func TestHTTPRecord_Placeholders(t *testing.T) {
+	var requestURI string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requestURI = r.RequestURI
+		rw.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		uri        string
+		raw        bool
+		qname      string
+		qtype      uint16
+		requestURI string
+	}{
+		{"/records/%(fqdn)/%(qtype)", false, "foo.example.com.", dns.TypeTXT, "/records/foo.example.com./TXT"},
+		{"/records/%(fqdn)/%(qtype)", false, "foo.example.com.", dns.TypeMX, "/records/foo.example.com./MX"},
+		{"/records?type=%(qtype)", false, "foo.example.com.", dns.TypeCAA, "/records?type=CAA"},
+		{"/zones/%(zone)/hosts/%(name)", false, "a.b.example.com.", dns.TypeA, "/zones/example.com./hosts/a.b"},
+		{"/zones/%(zone)/hosts/%(name)", false, "example.com.", dns.TypeA, "/zones/example.com./hosts/%40"},
+		{"/zones/%(zone)/hosts/%(name)", true, "example.com.", dns.TypeA, "/zones/example.com./hosts/@"},
+		// Records belong to the most specific zone of the server block.
+		{"/zones/%(zone)/hosts/%(name)", false, "host.sub.example.org.", dns.TypeTXT,
+			"/zones/sub.example.org./hosts/host"},
+		{"/geo?client=%(client_ip)&ecs=%(ecs)", false, "foo.example.com.", dns.TypeA, "/geo?client=10.240.0.1&ecs="},
+		{"/records/%(fqdn)", false, "a*b.example.com.", dns.TypeA, "/records/a%2Ab.example.com."},
+		{"/records/%(fqdn)", true, "a*b.example.com.", dns.TypeA, "/records/a*b.example.com."},
+		{"/records/%(fqdn)?via=%(protocol)", false, "foo.example.com.", dns.TypeA, "/records/foo.example.com.?via=udp"},
+		{"/customers/%(label2)/vms/%(label1)", false, "vm-1234.customer42.dyn.example.com.", dns.TypeA,
+			"/customers/customer42/vms/vm-1234"},
+	}
+
+	for i, c := range tests {
+		config := HTTPRecord{
+			Zones: []Zone{{
+				URI:     server.URL + c.uri,
+				Origin:  "example.com.",
+				Backend: &Backend{RawPlaceholders: c.raw},
+			}},
+			Records: []Record{{
+				URI:  server.URL + c.uri,
+				Name: "host.sub.example.org.",
+				Type: "TXT",
+			}},
+			Timeout: time.Second,
+			origins: []string{"example.org.", "sub.example.org."},
+		}
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		tc := test.Case{Qname: c.qname, Qtype: c.qtype}
+		if _, err := config.ServeDNS(context.TODO(), rec, tc.Msg()); err != nil {
+			t.Errorf("Test %d expected no error, got %v", i, err)
+		}
+		if requestURI != c.requestURI {
+			t.Errorf("Test %d expected a request for %s, got %s", i, c.requestURI, requestURI)
+		}
+	}
+}
+
+func TestHTTPRecord_ClientPlaceholders(t *testing.T) {
+	var requestURI, client string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requestURI, client = r.RequestURI, r.Header.Get("X-Client")
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+
+	config := HTTPRecord{
+		Zones: []Zone{{
+			URI:     server.URL + "/geo?ecs=%(ecs)",
+			Origin:  "example.com.",
+			Backend: &Backend{Header: http.Header{"X-Client": {"%(client_ip),%(ecs)"}}},
+		}},
+		Timeout: time.Second,
+	}
+
+	tests := []struct {
+		subnet     *dns.EDNS0_SUBNET
+		requestURI string
+		client     string
+	}{
+		{nil, "/geo?ecs=", "10.240.0.1,"},
+		{
+			&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0")},
+			"/geo?ecs=192.0.2.0%2F24", "10.240.0.1,192.0.2.0/24",
+		},
+		{
+			&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 2, SourceNetmask: 56, Address: net.ParseIP("2001:db8::")},
+			"/geo?ecs=2001%3Adb8%3A%3A%2F56", "10.240.0.1,2001:db8::/56",
+		},
+	}
+
+	for i, c := range tests {
+		m := test.Case{Qname: "foo.example.com.", Qtype: dns.TypeA}.Msg()
+		if c.subnet != nil {
+			m.SetEdns0(4096, false)
+			m.IsEdns0().Option = append(m.IsEdns0().Option, c.subnet)
+		}
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := config.ServeDNS(context.TODO(), rec, m); err != nil {
+			t.Errorf("Test %d expected no error, got %v", i, err)
+		}
+		if requestURI != c.requestURI || client != c.client {
+			t.Errorf("Test %d expected a request for %s from %q, got %s from %q", i, c.requestURI, c.client,
+				requestURI, client)
+		}
+	}
+}
+
+func TestHTTPRecord_ProtocolURIs(t *testing.T) {
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+
+	config := HTTPRecord{
+		Zones: []Zone{{
+			URI:     server.URL + "/plain",
+			Origin:  "example.com.",
+			Backend: &Backend{ProtocolURIs: map[string][]string{"tcp": {server.URL + "/tcp"}}},
+		}},
+		Timeout: time.Second,
+	}
+
+	tests := []struct {
+		tcp  bool
+		path string
+	}{
+		{false, "/plain"},
+		{true, "/tcp"},
+	}
+
+	for i, c := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{TCP: c.tcp})
+		tc := test.Case{Qname: "foo.example.com.", Qtype: dns.TypeA}
+		if _, err := config.ServeDNS(context.TODO(), rec, tc.Msg()); err != nil {
+			t.Errorf("Test %d expected no error, got %v", i, err)
+		}
+		if path != c.path {
+			t.Errorf("Test %d expected a request for %s, got %s", i, c.path, path)
+		}
+	}
+}
+
+func TestHTTPRecord_Metadata(t *testing.T) {
+	var requestURI, view string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requestURI, view = r.RequestURI, r.Header.Get("X-View")
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+
+	config := HTTPRecord{
+		Zones: []Zone{{
+			URI:     server.URL + "/records?country=%(metadata/geoip/country/code)&missing=%(metadata/foo/bar)",
+			Origin:  "example.com.",
+			Backend: &Backend{Header: http.Header{"X-View": {"%(metadata/view/name)"}}},
+		}},
+		Timeout: time.Second,
+	}
+
+	ctx := metadata.ContextWithMetadata(context.TODO())
+	metadata.SetValueFunc(ctx, "geoip/country/code", func() string { return "CH" })
+	metadata.SetValueFunc(ctx, "view/name", func() string { return "internal" })
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	tc := test.Case{Qname: "foo.example.com.", Qtype: dns.TypeA}
+	if _, err := config.ServeDNS(ctx, rec, tc.Msg()); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if expected := "/records?country=CH&missing="; requestURI != expected {
+		t.Errorf("Expected a request for %s, got %s", expected, requestURI)
+	}
+	if view != "internal" {
+		t.Errorf("Expected X-View: internal, got %q", view)
+	}
+}
+
+func TestHTTPRecord_Cache(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		requests     int
+	}{
+		{"max-age=60", 1},
+		{"no-store", 3},
+		{"max-age=0", 3},
+	}
+
+	for i, c := range tests {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			requests++
+			rw.Header().Set("Cache-Control", c.cacheControl)
+			rw.Write([]byte("1.2.3.4"))
+		}))
+
+		config := HTTPRecord{
+			Zones:          []Zone{{URI: server.URL + "/%(fqdn)", Origin: "example.com."}},
+			CacheResponses: true,
+			Cache:          cache.New(100),
+			Timeout:        time.Second,
+		}
+		for j := 0; j < 3; j++ {
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			msg := new(dns.Msg)
+			msg.SetQuestion("foo.example.com.", dns.TypeA)
+			if _, err := config.ServeDNS(context.TODO(), rec, msg); err != nil {
+				t.Errorf("Test %d: expected no error, got %v", i, err)
+			}
+			if len(rec.Msg.Answer) != 1 {
+				t.Errorf("Test %d: expected 1 answer, got %v", i, rec.Msg.Answer)
+			}
+		}
+		server.Close()
+
+		if requests != c.requests {
+			t.Errorf("Test %d: expected %d requests, got %d", i, c.requests, requests)
+		}
+	}
+}
+
+func TestHTTPRecord_NegativeCache(t *testing.T) {
+	nxdomain, err := new(dns.Msg).SetRcode(new(dns.Msg).SetQuestion("foo.example.com.", dns.TypeA),
+		dns.RcodeNameError).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodata, err := new(dns.Msg).SetReply(new(dns.Msg).SetQuestion("foo.example.com.", dns.TypeA)).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		status       int
+		rcode        string
+		cacheControl string
+		contentType  string
+		body         string
+		expected     int
+		requests     int
+	}{
+		{404, "", "", "", "", dns.RcodeNameError, 1},
+		{404, "", "max-age=60", "", "", dns.RcodeNameError, 1},
+		{404, "", "no-store", "", "", dns.RcodeNameError, 3},
+		{404, "", "max-age=0", "", "", dns.RcodeNameError, 3},
+		{200, "NXDOMAIN", "", "", "", dns.RcodeNameError, 1},
+		{500, "", "", "", "", dns.RcodeServerFailure, 3},
+		// NXDOMAIN in the body.
+		{200, "", "", "application/json", `{"rcode": "NXDOMAIN"}`, dns.RcodeNameError, 1},
+		{200, "", "", DNSMessageContentType, string(nxdomain), dns.RcodeNameError, 1},
+		// NODATA.
+		{200, "", "", "", "", dns.RcodeSuccess, 1},
+		{200, "", "", "application/json", `{"answer": []}`, dns.RcodeSuccess, 1},
+		{200, "", "", DNSMessageContentType, string(nodata), dns.RcodeSuccess, 1},
+		{200, "", "no-store", "", "", dns.RcodeSuccess, 3},
+		{200, "", "", "", "1.2.3.4", dns.RcodeSuccess, 3},
+	}
+
+	for i, c := range tests {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			requests++
+			if c.rcode != "" {
+				rw.Header().Set(RcodeHeader, c.rcode)
+			}
+			if c.cacheControl != "" {
+				rw.Header().Set("Cache-Control", c.cacheControl)
+			}
+			if c.contentType != "" {
+				rw.Header().Set("Content-Type", c.contentType)
+			}
+			rw.WriteHeader(c.status)
+			rw.Write([]byte(c.body))
+		}))
+
+		config := HTTPRecord{
+			Zones:       []Zone{{URI: server.URL + "/%(fqdn)", Origin: "example.com."}},
+			NegativeTTL: 30,
+			Cache:       cache.New(100),
+			Timeout:     time.Second,
+		}
+		for j := 0; j < 3; j++ {
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			msg := new(dns.Msg)
+			msg.SetQuestion("foo.example.com.", dns.TypeA)
+			rcode, _ := config.ServeDNS(context.TODO(), rec, msg)
+			if rec.Msg != nil {
+				rcode = rec.Rcode
+			}
+			if rcode != c.expected {
+				t.Errorf("Test %d: expected %s, got %s", i, dns.RcodeToString[c.expected], dns.RcodeToString[rcode])
+			}
+		}
+		server.Close()
+
+		if requests != c.requests {
+			t.Errorf("Test %d: expected %d requests, got %d", i, c.requests, requests)
+		}
+	}
+}
+
+func TestHTTPRecord_ServeStale(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=1")
+		if atomic.AddInt32(&requests, 1) == 1 {
+			rw.Write([]byte("1.2.3.4"))
+		} else {
+			rw.Write([]byte("5.6.7.8"))
+		}
+	}))
+	defer server.Close()
+
+	config := HTTPRecord{
+		Zones:          []Zone{{URI: server.URL + "/%(fqdn)", Origin: "example.com."}},
+		CacheResponses: true,
+		ServeStale:     time.Minute,
+		Cache:          cache.New(100),
+		Timeout:        time.Second,
+	}
+	lookup := func() *dns.A {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		tc := test.Case{Qname: "foo.example.com.", Qtype: dns.TypeA}
+		if _, err := config.ServeDNS(context.TODO(), rec, tc.Msg()); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(rec.Msg.Answer) != 1 {
+			t.Fatalf("Expected 1 answer, got %v", rec.Msg.Answer)
+		}
+		return rec.Msg.Answer[0].(*dns.A)
+	}
+
+	if a := lookup(); a.A.String() != "1.2.3.4" {
+		t.Fatalf("Expected 1.2.3.4, got %s", a.A)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	// The expired response is returned at once and refreshed in the background.
+	if a := lookup(); a.A.String() != "1.2.3.4" || a.Hdr.Ttl != StaleTTL {
+		t.Errorf("Expected 1.2.3.4 with TTL %d, got %s with TTL %d", StaleTTL, a.A, a.Hdr.Ttl)
+	}
+	deadline := time.Now().Add(time.Second)
+	for lookup().A.String() != "5.6.7.8" {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the response to be refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHTTPRecord_Prefetch(t *testing.T) {
+	tests := []struct {
+		window   time.Duration
+		requests int32
+	}{
+		{time.Hour, 2}, // Because the response always expires within the window.
+		{time.Second, 1},
+		{0, 1}, // Because the response does not expire within a tenth of its TTL.
+	}
+
+	for i, c := range tests {
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			rw.Header().Set("Cache-Control", "max-age=60")
+			rw.Write([]byte("1.2.3.4"))
+		}))
+
+		config := HTTPRecord{
+			Zones:          []Zone{{URI: server.URL + "/%(fqdn)", Origin: "example.com."}},
+			CacheResponses: true,
+			Prefetch:       2,
+			PrefetchWindow: c.window,
+			Cache:          cache.New(100),
+			Timeout:        time.Second,
+		}
+		for j := 0; j < 3; j++ {
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			tc := test.Case{Qname: "foo.example.com.", Qtype: dns.TypeA}
+			if _, err := config.ServeDNS(context.TODO(), rec, tc.Msg()); err != nil {
+				t.Errorf("Test %d: expected no error, got %v", i, err)
+			}
+		}
+
+		// Prefetching happens in the background.
+		deadline := time.Now().Add(200 * time.Millisecond)
+		for atomic.LoadInt32(&requests) < c.requests && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(20 * time.Millisecond)
+		server.Close()
+
+		if n := atomic.LoadInt32(&requests); n != c.requests {
+			t.Errorf("Test %d: expected %d requests, got %d", i, c.requests, n)
+		}
+	}
+}
+
+func TestHTTPRecord_CacheFor(t *testing.T) {
+	config := HTTPRecord{
+		Zones: []Zone{
+			{URI: "https://example.com/%(fqdn)", Origin: "example.com."},
+			{URI: "https://example.com/%(fqdn)", Origin: "sub.example.com."},
+		},
+		CachePerZone: true,
+		Cache:        cache.New(100),
+		origins:      []string{"example.org."},
+	}
+	config.zoneCaches = config.newZoneCaches()
+
+	tests := []struct {
+		name     string
+		expected *cache.Cache
+	}{
+		{"www.example.com.", config.zoneCaches["example.com."]},
+		{"www.sub.example.com.", config.zoneCaches["sub.example.com."]},
+		{"example.org.", config.zoneCaches["example.org."]},
+		{"www.example.net.", config.Cache},
+	}
+
+	if len(config.zoneCaches) != 3 {
+		t.Fatalf("Expected 3 zone caches, got %d", len(config.zoneCaches))
+	}
+	for i, c := range tests {
+		if store := config.cacheFor(c.name); store != c.expected {
+			t.Errorf("Test %d: expected a different cache for %s", i, c.name)
+		}
+	}
+}
+
+func TestHTTPRecord_SharedCache(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+	redis := newFakeSharedServer(t, serveRedis)
+	defer redis.listener.Close()
+
+	// Two instances with their own caches share responses through Redis.
+	instances := make([]HTTPRecord, 2)
+	for i := range instances {
+		shared, err := newSharedStore("redis://" + redis.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		instances[i] = HTTPRecord{
+			Zones:          []Zone{{URI: server.URL + "/%(fqdn)", Origin: "example.com."}},
+			CacheResponses: true,
+			SharedCache:    "redis://" + redis.listener.Addr().String(),
+			Cache:          cache.New(100),
+			Timeout:        time.Second,
+			shared:         shared,
+		}
+	}
+
+	lookup := func(h HTTPRecord) {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		tc := test.Case{Qname: "foo.example.com.", Qtype: dns.TypeA}
+		if _, err := h.ServeDNS(context.TODO(), rec, tc.Msg()); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(rec.Msg.Answer) != 1 {
+			t.Fatalf("Expected 1 answer, got %v", rec.Msg.Answer)
+		}
+	}
+
+	lookup(instances[0])
+	// Responses are stored in the background.
+	deadline := time.Now().Add(time.Second)
+	for {
+		redis.mu.Lock()
+		stored := len(redis.values)
+		redis.mu.Unlock()
+		if stored > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the response to be stored in the shared cache")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lookup(instances[1])
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected 1 request, got %d", n)
+	}
+}
+
+func TestHTTPRecord_CacheMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+
+	config := HTTPRecord{
+		Zones:          []Zone{{URI: server.URL + "/%(fqdn)", Origin: "metrics.example.com."}},
+		CacheResponses: true,
+		Cache:          cache.New(100),
+		zoneCaches:     map[string]*cache.Cache{"metrics.example.com.": cache.New(100)},
+		Timeout:        time.Second,
+	}
+	zone := "metrics.example.com."
+	hits, misses := testutil.ToFloat64(CacheHits.WithLabelValues(zone)),
+		testutil.ToFloat64(CacheMisses.WithLabelValues(zone))
+	for i := 0; i < 3; i++ {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		msg := new(dns.Msg)
+		msg.SetQuestion("foo.metrics.example.com.", dns.TypeA)
+		if _, err := config.ServeDNS(context.TODO(), rec, msg); err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	}
+
+	if got := testutil.ToFloat64(CacheHits.WithLabelValues(zone)) - hits; got != 2 {
+		t.Errorf("Expected 2 hits, got %v", got)
+	}
+	if got := testutil.ToFloat64(CacheMisses.WithLabelValues(zone)) - misses; got != 1 {
+		t.Errorf("Expected 1 miss, got %v", got)
+	}
+	if got := testutil.ToFloat64(CacheEntries.WithLabelValues(zone)); got != 1 {
+		t.Errorf("Expected 1 entry, got %v", got)
+	}
+
+	// Keys of the same shard, which holds at most 4 responses.
+	evictions := testutil.ToFloat64(CacheEvictions.WithLabelValues(zone))
+	for key := uint64(1); key <= 5; key++ {
+		config.add(cacheSlot{zone: zone, store: config.zoneCaches[zone], key: key << 8}, backendResponse{})
+	}
+	if got := testutil.ToFloat64(CacheEvictions.WithLabelValues(zone)) - evictions; got != 1 {
+		t.Errorf("Expected 1 eviction, got %v", got)
+	}
+}
+
+func TestBackendResponse_Records(t *testing.T) {
+	parses := 0
+	parser := ResponseParserFunc(func(name string, rtype string, ttl uint32, body []byte) (ParsedResponse, error) {
+		parses++
+		return parseText(name, rtype, ttl, body)
+	})
+
+	cached := backendResponse{Payload: []byte("A 300 1.2.3.4\nA 5.6.7.8"), TTL: 600, parsed: new(parsedRecords)}
+	tests := []struct {
+		name     string
+		ttl      uint32
+		expected []string
+		parses   int
+	}{
+		{"foo.example.com.", 600, []string{"foo.example.com.\t300\tIN\tA\t1.2.3.4", "foo.example.com.\t600\tIN\tA\t5.6.7.8"},
+			1},
+		{"foo.example.com.", 100, []string{"foo.example.com.\t100\tIN\tA\t1.2.3.4", "foo.example.com.\t100\tIN\tA\t5.6.7.8"},
+			1},
+		{"foo.example.com.", 0, []string{"foo.example.com.\t0\tIN\tA\t1.2.3.4", "foo.example.com.\t0\tIN\tA\t5.6.7.8"}, 1},
+		// Lookups of other names sharing the response are parsed every time.
+		{"bar.example.com.", 500, []string{"bar.example.com.\t300\tIN\tA\t1.2.3.4", "bar.example.com.\t500\tIN\tA\t5.6.7.8"},
+			2},
+	}
+
 	for i, c := range tests {
-		runTestCase(t, c, i)
-		runTestCaseCached(t, c, i)
+		response := cached
+		response.TTL = c.ttl
+		parsed, err := response.records(c.name, "A", parser)
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+		var records []string
+		for _, rr := range parsed.Answer {
+			records = append(records, rr.String())
+			// Modifying the records must not affect those kept.
+			rr.Header().Ttl = 1
+		}
+		if strings.Join(records, "\n") != strings.Join(c.expected, "\n") {
+			t.Errorf("Test %d: expected %v, got %v", i, c.expected, records)
+		}
+		if parses != c.parses {
+			t.Errorf("Test %d: expected %d parses, got %d", i, c.parses, parses)
+		}
 	}
 }
 
-func runTestCase(t *testing.T, c testCase, testnum int) {
-	server := httptest.NewServer(c.handler)
+func TestHTTPRecord_NoStore(t *testing.T) {
+	tests := []struct {
+		cacheControl []string
+		answered     bool
+	}{
+		{[]string{"no-store"}, false},
+		{[]string{"no-cache"}, true},
+		{[]string{"max-age=0"}, true},
+		// Responses kept before are removed by one that must not be kept.
+		{[]string{"max-age=0", "no-store"}, false},
+	}
+
+	for i, c := range tests {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			defer func() { requests++ }()
+			if requests >= len(c.cacheControl) {
+				rw.WriteHeader(500)
+				return
+			}
+			rw.Header().Set("Cache-Control", c.cacheControl[requests])
+			rw.Write([]byte("1.2.3.4"))
+		}))
+
+		config := HTTPRecord{
+			Zones:               []Zone{{URI: server.URL + "/%(fqdn)", Origin: "example.com."}},
+			ReturnCachedOnError: true,
+			Cache:               cache.New(100),
+			Timeout:             time.Second,
+		}
+		var err error
+		for j := 0; j <= len(c.cacheControl); j++ {
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			msg := new(dns.Msg)
+			msg.SetQuestion("foo.example.com.", dns.TypeA)
+			_, err = config.ServeDNS(context.TODO(), rec, msg)
+		}
+		server.Close()
+
+		if answered := err == nil; answered != c.answered {
+			t.Errorf("Test %d: expected answered to be %v, got error %v", i, c.answered, err)
+		}
+	}
+}
+
+func TestHTTPRecord_CacheTypes(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests++
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Write([]byte("A 1.2.3.4\nAAAA 2001:db8::1"))
+	}))
 	defer server.Close()
 
-	config := c.config
-	config.Timeout = 5 * time.Millisecond
+	config := HTTPRecord{
+		Zones:          []Zone{{URI: server.URL + "/%(fqdn)", Origin: "example.com."}},
+		CacheResponses: true,
+		Cache:          cache.New(100),
+		Timeout:        time.Second,
+	}
+	tests := []test.Case{
+		{Qname: "foo.example.com.", Qtype: dns.TypeA, Answer: []dns.RR{test.A("foo.example.com. 60 IN A 1.2.3.4")}},
+		{Qname: "foo.example.com.", Qtype: dns.TypeAAAA,
+			Answer: []dns.RR{test.AAAA("foo.example.com. 60 IN AAAA 2001:db8::1")}},
+	}
+	for j := 0; j < 2; j++ {
+		for i, c := range tests {
+			doRequest(t, &config, &c, i, false, "[CacheTypes] ")
+		}
+	}
 
-	config.Records = make([]Record, len(c.config.Records))
-	copy(config.Records, c.config.Records)
-	config.Zones = make([]Zone, len(c.config.Zones))
-	copy(config.Zones, c.config.Zones)
-	for i, r := range config.Records {
-		config.Records[i].URI = strings.Replace(r.URI, "-replace-", server.URL, -1)
+	// Lookups of each type are kept apart, although they share a URI.
+	if requests != 2 {
+		t.Errorf("Expected 2 requests, got %d", requests)
 	}
-	for i, z := range config.Zones {
-		config.Zones[i].URI = strings.Replace(z.URI, "-replace-", server.URL, -1)
+	if config.Cache.Len() != 2 {
+		t.Errorf("Expected 2 cached responses, got %d", config.Cache.Len())
 	}
+}
 
-	doRequest(t, &config, &c.tc, testnum, c.shouldErr, "")
+func TestHTTPRecord_OnErrorExpiry(t *testing.T) {
+	tests := []struct {
+		age      time.Duration
+		answered bool
+		ttl      uint32
+	}{
+		{30 * time.Second, true, 30},
+		{2 * time.Minute, true, StaleTTL},
+		// Responses past max_stale are no longer returned and removed.
+		{time.Hour, false, 0},
+	}
 
-	// Without caching, everything should fail when the server is down
-	server.Close()
-	doRequest(t, &config, &c.tc, testnum, !c.doesNotCauseRequest, "[ServerDown] ")
+	for i, c := range tests {
+		up := true
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if !up {
+				rw.WriteHeader(500)
+				return
+			}
+			rw.Header().Set("Cache-Control", "max-age=60")
+			rw.Write([]byte("1.2.3.4"))
+		}))
+
+		config := HTTPRecord{
+			Zones:               []Zone{{URI: server.URL + "/%(fqdn)", Origin: "example.com."}},
+			ReturnCachedOnError: true,
+			MaxStale:            10 * time.Minute,
+			Cache:               cache.New(100),
+			Timeout:             time.Second,
+		}
+		lookup := func() (*dns.Msg, error) {
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			msg := new(dns.Msg)
+			msg.SetQuestion("foo.example.com.", dns.TypeA)
+			_, err := config.ServeDNS(context.TODO(), rec, msg)
+			return rec.Msg, err
+		}
+		if _, err := lookup(); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		// Age the kept response and fail the backend.
+		config.Cache.Walk(func(items map[uint64]interface{}, key uint64) bool {
+			response := items[key].(backendResponse)
+			response.Fetched = response.Fetched.Add(-c.age)
+			items[key] = response
+			return true
+		})
+		up = false
+		msg, err := lookup()
+		server.Close()
+
+		if answered := err == nil; answered != c.answered {
+			t.Errorf("Test %d: expected answered to be %v, got error %v", i, c.answered, err)
+		}
+		if c.answered && (len(msg.Answer) != 1 || msg.Answer[0].Header().Ttl != c.ttl) {
+			t.Errorf("Test %d: expected an answer with TTL %d, got %v", i, c.ttl, msg.Answer)
+		}
+		if !c.answered && config.Cache.Len() != 0 {
+			t.Errorf("Test %d: expected the response to be removed, got %d responses", i, config.Cache.Len())
+		}
+	}
 }
 
-func runTestCaseCached(t *testing.T, c testCase, testnum int) {
-	server := httptest.NewServer(c.handler)
+func TestHTTPRecord_Metrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			rw.Write([]byte("1.2.3.4"))
+		case "/invalid":
+			rw.Write([]byte("1.2.3.4\nnot-an-address"))
+		default:
+			rw.WriteHeader(404)
+		}
+	}))
 	defer server.Close()
 
-	config := c.config
-	config.ReturnCachedOnError = true
-	config.Cache = cache.New(100)
-	config.Timeout = 5 * time.Millisecond
+	zone := "requests.example.org."
+	config := HTTPRecord{
+		Records: []Record{
+			{Name: "ok." + zone, Type: "A", URI: server.URL + "/ok"},
+			{Name: "invalid." + zone, Type: "A", URI: server.URL + "/invalid"},
+			{Name: "missing." + zone, Type: "A", URI: server.URL + "/missing"},
+		},
+		Timeout: time.Second,
+		origins: []string{zone},
+	}
+	counters := []struct {
+		counter  prometheus.Counter
+		expected float64
+	}{
+		{BackendRequests.WithLabelValues(zone, "200"), 2},
+		{BackendRequests.WithLabelValues(zone, "404"), 1},
+		{ParseFailures.WithLabelValues(zone), 1},
+		{Responses.WithLabelValues(zone, "NOERROR"), 2},
+		{Responses.WithLabelValues(zone, "NXDOMAIN"), 1},
+	}
+	before := make([]float64, len(counters))
+	for i, c := range counters {
+		before[i] = testutil.ToFloat64(c.counter)
+	}
 
-	config.Records = make([]Record, len(c.config.Records))
-	copy(config.Records, c.config.Records)
-	config.Zones = make([]Zone, len(c.config.Zones))
-	copy(config.Zones, c.config.Zones)
-	for i, r := range config.Records {
-		config.Records[i].URI = strings.Replace(r.URI, "-replace-", server.URL, -1)
+	for _, record := range config.Records {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		msg := new(dns.Msg)
+		msg.SetQuestion(record.Name, dns.TypeA)
+		config.ServeDNS(context.TODO(), rec, msg)
 	}
-	for i, z := range config.Zones {
-		config.Zones[i].URI = strings.Replace(z.URI, "-replace-", server.URL, -1)
+
+	for i, c := range counters {
+		if got := testutil.ToFloat64(c.counter) - before[i]; got != c.expected {
+			t.Errorf("Test %d: expected %v, got %v", i, c.expected, got)
+		}
 	}
+}
 
-	doRequest(t, &config, &c.tc, testnum, c.shouldErr, "")
+func TestHTTPRecord_NXDOMAIN(t *testing.T) {
+	backend := &Backend{
+		NXDOMAIN: true,
+		SOA: &SOAParameters{Ns: "ns", Mbox: "hostmaster", Serial: 1, Refresh: 7200, Retry: 1800, Expire: 1209600,
+			MinTTL: 60},
+	}
+	config := HTTPRecord{
+		Records: []Record{
+			{Name: "www.example.com.", Type: "A", URI: "https://example.com/www", Backend: backend},
+			{Name: "a.b.example.com.", Type: "A", URI: "https://example.com/a", Backend: backend},
+			{Name: "www.example.org.", Type: "A", URI: "https://example.org/www"},
+		},
+		Zones:   []Zone{{Origin: "dynamic.example.com.", URI: "https://example.com/%(fqdn)"}},
+		origins: []string{"example.com.", "example.org."},
+	}
 
-	// Close the server and run the case again - with caching, it should still pass
-	server.Close()
-	doRequest(t, &config, &c.tc, testnum, c.shouldErr, "[Cached] ")
+	tests := []struct {
+		qname string
+		qtype uint16
+		rcode int
+	}{
+		// Names of records exist even without records of the queried type.
+		{"www.example.com.", dns.TypeAAAA, dns.RcodeSuccess},
+		{"www.example.com.", dns.TypeHINFO, dns.RcodeSuccess},
+		// Empty non-terminals exist as well.
+		{"b.example.com.", dns.TypeA, dns.RcodeSuccess},
+		{"missing.example.com.", dns.TypeA, dns.RcodeNameError},
+		{"missing.example.com.", dns.TypeHINFO, dns.RcodeNameError},
+		// Records without NXDOMAIN do not tell whether other names exist.
+		{"missing.example.org.", dns.TypeA, dns.RcodeSuccess},
+	}
+
+	for i, c := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		msg := new(dns.Msg)
+		msg.SetQuestion(c.qname, c.qtype)
+		config.ServeDNS(context.TODO(), rec, msg)
+		if rec.Msg == nil {
+			t.Errorf("Test %d: expected a response", i)
+			continue
+		}
+		if rec.Msg.Rcode != c.rcode {
+			t.Errorf("Test %d: expected rcode %s, got %s", i, dns.RcodeToString[c.rcode], dns.RcodeToString[rec.Msg.Rcode])
+		}
+		if len(rec.Msg.Answer) != 0 {
+			t.Errorf("Test %d: expected no answer, got %v", i, rec.Msg.Answer)
+		}
+		hasSOA := len(rec.Msg.Ns) == 1 && rec.Msg.Ns[0].Header().Rrtype == dns.TypeSOA
+		if config.origin(c.qname) == "example.com." && !hasSOA {
+			t.Errorf("Test %d: expected SOA in authority section, got %v", i, rec.Msg.Ns)
+		}
+	}
 }
 
-func doRequest(t *testing.T, c *HTTPRecord, tc *test.Case, testnum int, shouldErr bool, msgPrefix string) {
-	ctx := context.TODO()
+func TestHTTPRecord_Truncate(t *testing.T) {
+	var answers []string
+	for i := 0; i < 20; i++ {
+		answers = append(answers, fmt.Sprintf(`{"name": "txt.example.com.", "type": "TXT", "data": "%s"}`,
+			strings.Repeat("x", 100)))
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{"answer": [` + strings.Join(answers, ",") + `]}`))
+	}))
+	defer server.Close()
+
+	config := HTTPRecord{
+		Records: []Record{{Name: "txt.example.com.", Type: "TXT", URI: server.URL}},
+		Timeout: time.Second,
+	}
+
+	tests := []struct {
+		tcp       bool
+		size      uint16
+		truncated bool
+	}{
+		{false, 0, true},
+		{false, 1232, true},
+		{false, 8192, false},
+		{true, 0, false},
+	}
+
+	for i, c := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{TCP: c.tcp})
+		msg := new(dns.Msg).SetQuestion("txt.example.com.", dns.TypeTXT)
+		if c.size > 0 {
+			msg.SetEdns0(c.size, false)
+		}
+		config.ServeDNS(context.TODO(), rec, msg)
+		if rec.Msg == nil {
+			t.Errorf("Test %d: expected a response", i)
+			continue
+		}
+		if rec.Msg.Truncated != c.truncated {
+			t.Errorf("Test %d: expected truncated %v, got %v", i, c.truncated, rec.Msg.Truncated)
+		}
+		if !c.truncated && len(rec.Msg.Answer) != len(answers) {
+			t.Errorf("Test %d: expected %d answers, got %d", i, len(answers), len(rec.Msg.Answer))
+		}
+		if c.size > 0 && c.size < 8192 && rec.Msg.Len() > int(c.size) {
+			t.Errorf("Test %d: expected response to fit %d bytes, got %d", i, c.size, rec.Msg.Len())
+		}
+		if opt := rec.Msg.IsEdns0(); (opt != nil) != (c.size > 0) {
+			t.Errorf("Test %d: expected OPT record only if the query had one, got %v", i, opt)
+		}
+	}
+}
+
+func TestHTTPRecord_MaxAnswers(t *testing.T) {
+	var lines []string
+	for i := 0; i < 200; i++ {
+		lines = append(lines, fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(strings.Join(lines, "\n")))
+	}))
+	defer server.Close()
+
+	config := HTTPRecord{
+		Records:    []Record{{Name: "pods.example.com.", Type: "A", URI: server.URL}},
+		Timeout:    time.Second,
+		MaxAnswers: 8,
+	}
+	query := func(id uint16, tcp bool) []string {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{TCP: tcp})
+		msg := new(dns.Msg).SetQuestion("pods.example.com.", dns.TypeA)
+		msg.Id = id
+		config.ServeDNS(context.TODO(), rec, msg)
+		if rec.Msg == nil {
+			t.Fatalf("Expected a response")
+		}
+		if rec.Msg.Truncated {
+			t.Errorf("Expected the limited answer to fit without truncation")
+		}
+		var addresses []string
+		for _, rr := range rec.Msg.Answer {
+			addresses = append(addresses, rr.(*dns.A).A.String())
+		}
+		return addresses
+	}
+
+	udp := query(42, false)
+	if len(udp) != config.MaxAnswers {
+		t.Fatalf("Expected %d answers, got %v", config.MaxAnswers, udp)
+	}
+	// A client retrying over TCP after a truncated response gets the same records.
+	if tcp := query(42, true); !reflect.DeepEqual(udp, tcp) {
+		t.Errorf("Expected the same answers over TCP, got %v and %v", udp, tcp)
+	}
+	if other := query(43, false); reflect.DeepEqual(udp, other) {
+		t.Errorf("Expected different answers for another query, got %v", other)
+	}
+}
+
+func TestHTTPRecord_Clients(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/internal":
+			rw.Write([]byte("10.0.0.1"))
+		case "/external":
+			rw.Write([]byte("192.0.2.1"))
+		}
+	}))
+	defer server.Close()
+
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+	config := HTTPRecord{
+		Records: []Record{
+			{Name: "www.example.com.", Type: "A", URI: server.URL + "/internal",
+				Backend: &Backend{Clients: []*net.IPNet{internal}}},
+			{Name: "www.example.com.", Type: "A", URI: server.URL + "/external"},
+		},
+		Zones: []Zone{
+			{Origin: "internal.example.com.", URI: server.URL + "/internal",
+				Backend: &Backend{Clients: []*net.IPNet{internal}}},
+		},
+		Timeout: time.Second,
+	}
+
+	tests := []struct {
+		client string
+		name   string
+		answer string
+	}{
+		{"10.240.0.1", "www.example.com.", "10.0.0.1"},
+		{"198.51.100.1", "www.example.com.", "192.0.2.1"},
+		{"10.240.0.1", "db.internal.example.com.", "10.0.0.1"},
+		{"198.51.100.1", "db.internal.example.com.", ""},
+	}
+
+	for i, c := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: c.client})
+		config.ServeDNS(context.TODO(), rec, new(dns.Msg).SetQuestion(c.name, dns.TypeA))
+		if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeSuccess {
+			t.Errorf("Test %d: expected NOERROR, got %v", i, rec.Msg)
+			continue
+		}
+		var answer string
+		if len(rec.Msg.Answer) > 0 {
+			answer = rec.Msg.Answer[0].(*dns.A).A.String()
+		}
+		if answer != c.answer {
+			t.Errorf("Test %d: expected answer %q, got %q", i, c.answer, answer)
+		}
+	}
+}
+
+func TestHTTPRecord_Flatten(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/apex":
+			rw.Write([]byte("CNAME lb.example.net."))
+		case "/lb":
+			rw.Write([]byte("A 192.0.2.1\nA 192.0.2.2"))
+		case "/loop":
+			rw.Write([]byte("CNAME loop.example.com."))
+		}
+	}))
+	defer server.Close()
+
+	flatten := &Backend{Flatten: true}
+	config := HTTPRecord{
+		Records: []Record{
+			{Name: "example.com.", Type: "A", URI: server.URL + "/apex", Backend: flatten},
+			{Name: "example.com.", Type: "AAAA", URI: server.URL + "/apex", Backend: flatten},
+			{Name: "lb.example.net.", Type: "A", URI: server.URL + "/lb"},
+			{Name: "loop.example.com.", Type: "A", URI: server.URL + "/loop", Backend: flatten},
+		},
+		Timeout: time.Second,
+	}
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer []dns.RR
+	}{
+		{"example.com.", dns.TypeA, dns.RcodeSuccess, []dns.RR{
+			test.A("example.com. 3600 IN A 192.0.2.1"),
+			test.A("example.com. 3600 IN A 192.0.2.2"),
+		}},
+		{"example.com.", dns.TypeAAAA, dns.RcodeSuccess, nil},
+		{"loop.example.com.", dns.TypeA, dns.RcodeServerFailure, nil},
+	}
+
+	for i, c := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, _ := config.ServeDNS(context.TODO(), rec, new(dns.Msg).SetQuestion(c.name, c.qtype))
+		if rcode != c.rcode {
+			t.Errorf("Test %d: expected rcode %d, got %d", i, c.rcode, rcode)
+			continue
+		}
+		if c.rcode != dns.RcodeSuccess {
+			continue
+		}
+		if rec.Msg == nil || len(rec.Msg.Answer) != len(c.answer) {
+			t.Errorf("Test %d: expected answer %v, got %v", i, c.answer, rec.Msg)
+			continue
+		}
+		for j, rr := range rec.Msg.Answer {
+			if rr.String() != c.answer[j].String() {
+				t.Errorf("Test %d: expected %v, got %v", i, c.answer[j], rr)
+			}
+		}
+	}
+}
+
+// testResolver answers lookups with the records in zone of the queried name and type.
+type testResolver []dns.RR
+
+func (r testResolver) Lookup(ctx context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, typ)
+	for _, rr := range r {
+		if rr.Header().Name == name && rr.Header().Rrtype == typ {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	return m, nil
+}
+
+func TestHTTPRecord_Upstream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/www":
+			rw.Write([]byte("CNAME lb.example.net."))
+		case "/mx":
+			rw.Write([]byte("MX 10 mail.example.net."))
+		}
+	}))
+	defer server.Close()
+
+	config := HTTPRecord{
+		Records: []Record{
+			{Name: "www.example.com.", Type: "A", URI: server.URL + "/www"},
+			{Name: "example.com.", Type: "MX", URI: server.URL + "/mx"},
+		},
+		Timeout: time.Second,
+		upstream: testResolver{
+			test.A("lb.example.net. 300 IN A 192.0.2.1"),
+			test.A("mail.example.net. 300 IN A 192.0.2.25"),
+			test.AAAA("mail.example.net. 300 IN AAAA 2001:db8::25"),
+		},
+	}
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		answer []string
+		extra  []string
+	}{
+		{"www.example.com.", dns.TypeA, []string{
+			"www.example.com.\t3600\tIN\tCNAME\tlb.example.net.",
+			"lb.example.net.\t300\tIN\tA\t192.0.2.1",
+		}, nil},
+		{"example.com.", dns.TypeMX, []string{
+			"example.com.\t3600\tIN\tMX\t10 mail.example.net.",
+		}, []string{
+			"mail.example.net.\t300\tIN\tA\t192.0.2.25",
+			"mail.example.net.\t300\tIN\tAAAA\t2001:db8::25",
+		}},
+	}
+
+	for i, c := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		config.ServeDNS(context.TODO(), rec, new(dns.Msg).SetQuestion(c.name, c.qtype))
+		if rec.Msg == nil {
+			t.Errorf("Test %d: expected a response", i)
+			continue
+		}
+		var answer, extra []string
+		for _, rr := range rec.Msg.Answer {
+			answer = append(answer, rr.String())
+		}
+		for _, rr := range rec.Msg.Extra {
+			extra = append(extra, rr.String())
+		}
+		if !reflect.DeepEqual(answer, c.answer) || !reflect.DeepEqual(extra, c.extra) {
+			t.Errorf("Test %d: expected %v and %v, got %v and %v", i, c.answer, c.extra, answer, extra)
+		}
+	}
+}
+
+func TestHTTPRecord_Case(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Write([]byte("192.0.2.1"))
+	}))
+	defer server.Close()
+
+	soa := &SOAParameters{Ns: "ns1.example.com.", Mbox: "hostmaster.example.com.", Serial: 1, Refresh: 7200,
+		Retry: 1800, Expire: 1209600, MinTTL: 300}
+	config := HTTPRecord{
+		Records: []Record{
+			{Name: "www.example.com.", Type: "A", URI: server.URL, Backend: &Backend{SOA: soa}},
+			{Name: "missing.example.com.", Type: "A", URI: server.URL + "/missing", Backend: &Backend{SOA: soa}},
+		},
+		Zones:   []Zone{{Origin: "zone.example.org.", URI: server.URL + "/%(fqdn)"}},
+		Timeout: time.Second,
+		origins: []string{"example.com."},
+	}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		owner string
+	}{
+		{"WwW.ExAmPlE.cOm.", dns.TypeA, dns.RcodeSuccess, "WwW.ExAmPlE.cOm."},
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, "www.example.com."},
+		{"HOST.Zone.Example.ORG.", dns.TypeA, dns.RcodeSuccess, "HOST.Zone.Example.ORG."},
+		{"Example.COM.", dns.TypeSOA, dns.RcodeSuccess, "Example.COM."},
+		{"Missing.Example.COM.", dns.TypeA, dns.RcodeNameError, "example.com."},
+	}
+
+	for i, c := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		config.ServeDNS(context.TODO(), rec, new(dns.Msg).SetQuestion(c.name, c.qtype))
+		if rec.Msg == nil || rec.Msg.Rcode != c.rcode {
+			t.Errorf("Test %d: expected rcode %d, got %v", i, c.rcode, rec.Msg)
+			continue
+		}
+		if rec.Msg.Question[0].Name != c.name {
+			t.Errorf("Test %d: expected question for %s, got %s", i, c.name, rec.Msg.Question[0].Name)
+		}
+		records := append(rec.Msg.Answer, rec.Msg.Ns...)
+		if len(records) == 0 || records[0].Header().Name != c.owner {
+			t.Errorf("Test %d: expected a record for %s, got %v", i, c.owner, records)
+		}
+	}
+}
+
+func TestHTTPRecord_Zones(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("TXT " + strings.TrimPrefix(r.URL.Path, "/")))
+	}))
+	defer server.Close()
+
+	config := HTTPRecord{
+		Zones: []Zone{
+			{Origin: "example.com.", URI: server.URL + "/example.com"},
+			{Origin: "sub.example.com.", URI: server.URL + "/sub.example.com"},
+			{Origin: "example.org.", URI: server.URL + "/example.org"},
+		},
+		Timeout: time.Second,
+	}
+
+	tests := []struct {
+		name string
+		zone string
+	}{
+		{"example.com.", "example.com"},
+		{"www.example.com.", "example.com"},
+		{"sub.example.com.", "sub.example.com"},
+		{"www.sub.example.com.", "sub.example.com"},
+		{"www.example.org.", "example.org"},
+	}
+
+	for i, c := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		config.ServeDNS(context.TODO(), rec, new(dns.Msg).SetQuestion(c.name, dns.TypeTXT))
+		if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+			t.Errorf("Test %d: expected a TXT record, got %v", i, rec.Msg)
+			continue
+		}
+		if txt := rec.Msg.Answer[0].(*dns.TXT).Txt; len(txt) != 1 || txt[0] != c.zone {
+			t.Errorf("Test %d: expected the URI of %s, got %v", i, c.zone, txt)
+		}
+	}
+
 	rec := dnstest.NewRecorder(&test.ResponseWriter{})
-	_, err := c.ServeDNS(ctx, rec, tc.Msg())
+	config.ServeDNS(context.TODO(), rec, new(dns.Msg).SetQuestion("www.example.net.", dns.TypeTXT))
+	if rec.Msg == nil || len(rec.Msg.Answer) != 0 {
+		t.Errorf("Expected no records outside of the zones, got %v", rec.Msg)
+	}
+}
 
-	if err != nil && !shouldErr {
-		t.Errorf(msgPrefix+"Test %d expected no error, got %v\n", testnum, err)
-		return
-	} else if err == nil && shouldErr {
-		t.Errorf(msgPrefix+"Test %d expected an error but didn't get one. Answer:\n %v\n", testnum, rec.Msg)
-		return
+func TestHTTPRecord_Flags(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("192.0.2.1"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		nonAuthoritative   bool
+		recursionAvailable bool
+		cd                 bool
+	}{
+		{false, false, false},
+		{false, false, true},
+		{true, false, false},
+		{false, true, false},
 	}
 
-	if err == nil {
-		resp := rec.Msg
-		if err := test.SortAndCheck(resp, *tc); err != nil {
-			t.Error(err)
+	for i, c := range tests {
+		config := HTTPRecord{
+			Records:            []Record{{Name: "www.example.com.", Type: "A", URI: server.URL}},
+			Timeout:            time.Second,
+			NonAuthoritative:   c.nonAuthoritative,
+			RecursionAvailable: c.recursionAvailable,
+		}
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		msg := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+		msg.AuthenticatedData, msg.CheckingDisabled = true, c.cd
+		config.ServeDNS(context.TODO(), rec, msg)
+		if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+			t.Errorf("Test %d: expected an answer, got %v", i, rec.Msg)
+			continue
+		}
+		if rec.Msg.Authoritative == c.nonAuthoritative {
+			t.Errorf("Test %d: expected AA %v, got %v", i, !c.nonAuthoritative, rec.Msg.Authoritative)
+		}
+		if rec.Msg.RecursionAvailable != c.recursionAvailable {
+			t.Errorf("Test %d: expected RA %v, got %v", i, c.recursionAvailable, rec.Msg.RecursionAvailable)
+		}
+		if rec.Msg.AuthenticatedData {
+			t.Errorf("Test %d: expected AD to be cleared", i)
+		}
+		if rec.Msg.CheckingDisabled != c.cd {
+			t.Errorf("Test %d: expected CD %v, got %v", i, c.cd, rec.Msg.CheckingDisabled)
 		}
 	}
 }
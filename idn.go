@@ -0,0 +1,75 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
+)
+
+// idnaProfile converts unicode names into A-labels. Unlike idna.Lookup, it allows underscores as used by SRV and
+// similar records.
+var idnaProfile = idna.New(idna.MapForLookup(), idna.StrictDomainName(false), idna.Transitional(false))
+
+// toASCII converts a domain name containing unicode labels into its punycode form. ASCII names are returned as is.
+func toASCII(name string) (string, error) {
+	for i := 0; i < len(name); i++ {
+		if name[i] >= 0x80 {
+			return idnaProfile.ToASCII(name)
+		}
+	}
+	return name, nil
+}
+
+// toASCIIRR converts the owner name and any hostnames in the data of rr into punycode.
+func toASCIIRR(rr dns.RR) error {
+	var err error
+	hdr := rr.Header()
+	if hdr.Name, err = toASCII(hdr.Name); err != nil {
+		return err
+	}
+
+	switch rr := rr.(type) {
+	case *dns.CNAME:
+		rr.Target, err = toASCII(rr.Target)
+	case *dns.MX:
+		rr.Mx, err = toASCII(rr.Mx)
+	case *dns.NS:
+		rr.Ns, err = toASCII(rr.Ns)
+	case *dns.PTR:
+		rr.Ptr, err = toASCII(rr.Ptr)
+	case *dns.SRV:
+		rr.Target, err = toASCII(rr.Target)
+	case *dns.SOA:
+		if rr.Ns, err = toASCII(rr.Ns); err == nil {
+			rr.Mbox, err = toASCII(rr.Mbox)
+		}
+	}
+	return err
+}
+
+// toASCIISection converts all records of a section into punycode, dropping and reporting the ones that fail.
+func toASCIISection(rrs []dns.RR) ([]dns.RR, []error) {
+	var result []dns.RR
+	var errs []error
+	for _, rr := range rrs {
+		if err := toASCIIRR(rr); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		result = append(result, rr)
+	}
+	return result, errs
+}
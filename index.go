@@ -0,0 +1,218 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// lookupIndex finds the records and zones for names without going through all of them, so that configurations with
+// many records and zones stay fast.
+type lookupIndex struct {
+	// records are the records by name and type in the order they are configured.
+	records map[recordKey][]*Record
+	// root is the node of the root zone in a tree of the labels of the names of zones and records.
+	root *nameNode
+	// nxdomainOrigins are the origins of zones with records whose backend has NXDOMAIN set.
+	nxdomainOrigins map[string]bool
+	// soas are the SOA parameters of the zones by origin, those of zones before those of records.
+	soas map[string]*SOAParameters
+}
+
+type recordKey struct {
+	name, rtype string
+}
+
+// nameNode is a name in the tree of a lookupIndex, whose children are the names one label longer.
+type nameNode struct {
+	name     string
+	children map[string]*nameNode
+	// zones are the zones with the name as origin in the order they are configured.
+	zones []*Zone
+	// origin is set if the name is a zone of the server block.
+	origin bool
+	// records is set if the name is the name of a record or one of their ancestors.
+	records bool
+	// cut is set if the name may have NS records, as it is the name of a record of type NS or delegated.
+	cut bool
+}
+
+// newLookupIndex indexes zones, records, the zones of the server block given by origins and the names delegated below
+// zones. The zones and records are referenced, not copied.
+func newLookupIndex(zones []Zone, records []Record, origins, delegated []string) *lookupIndex {
+	x := &lookupIndex{
+		records:         make(map[recordKey][]*Record),
+		root:            &nameNode{name: "."},
+		nxdomainOrigins: make(map[string]bool),
+		soas:            make(map[string]*SOAParameters),
+	}
+	for i, zone := range zones {
+		node := x.root.add(zone.Origin)
+		node.zones = append(node.zones, &zones[i])
+	}
+	for _, origin := range origins {
+		x.root.add(origin).origin = true
+	}
+	for i, record := range records {
+		key := recordKey{name: record.Name, rtype: record.Type}
+		x.records[key] = append(x.records[key], &records[i])
+
+		if node := x.root.add(record.Name); record.Type == "NS" {
+			node.cut = true
+		}
+		for _, node := range x.path(record.Name) {
+			node.records = true
+		}
+	}
+	for _, name := range delegated {
+		x.root.add(name).cut = true
+	}
+	// Origins depend on all zones, so they are only known once all are added.
+	for _, record := range records {
+		if record.Backend != nil && record.Backend.NXDOMAIN {
+			x.nxdomainOrigins[x.origin(record.Name)] = true
+		}
+	}
+	for _, zone := range zones {
+		if _, ok := x.soas[zone.Origin]; !ok && zone.Backend != nil && zone.Backend.SOA != nil {
+			x.soas[zone.Origin] = zone.Backend.SOA
+		}
+	}
+	for _, record := range records {
+		origin := x.origin(record.Name)
+		if _, ok := x.soas[origin]; !ok && record.Backend != nil && record.Backend.SOA != nil {
+			x.soas[origin] = record.Backend.SOA
+		}
+	}
+	return x
+}
+
+// add returns the node of name below n, adding it and its ancestors if they are missing.
+func (n *nameNode) add(name string) *nameNode {
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := n.children[labels[i]]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*nameNode)
+			}
+			child = &nameNode{name: dns.Fqdn(strings.Join(labels[i:], "."))}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	return n
+}
+
+// path returns the nodes of name and its ancestors that exist, starting at the root. The last one is the node of
+// name if there are as many as name has labels plus one.
+func (x *lookupIndex) path(name string) []*nameNode {
+	labels := dns.SplitDomainName(name)
+	path := []*nameNode{x.root}
+	for i := len(labels) - 1; i >= 0; i-- {
+		node := path[len(path)-1].children[labels[i]]
+		if node == nil {
+			break
+		}
+		path = append(path, node)
+	}
+	return path
+}
+
+// record returns the first record for name and rtype serving queries from ip, or nil if there is none.
+func (x *lookupIndex) record(name, rtype string, ip net.IP) *Record {
+	for _, record := range x.records[recordKey{name: name, rtype: rtype}] {
+		if record.Backend.serves(ip) {
+			return record
+		}
+	}
+	return nil
+}
+
+// zone returns the zone with the longest origin name is in of those serving queries from ip, or nil if there is
+// none. Of several zones with that origin, the first one is used.
+func (x *lookupIndex) zone(name string, ip net.IP) *Zone {
+	path := x.path(name)
+	for i := len(path) - 1; i >= 0; i-- {
+		for _, zone := range path[i].zones {
+			if zone.Backend.serves(ip) {
+				return zone
+			}
+		}
+	}
+	return nil
+}
+
+// origin returns the origin of the zone name belongs to, which is the longest of the origins of the zones and the
+// zones of the server block name is in.
+func (x *lookupIndex) origin(name string) string {
+	path := x.path(name)
+	for i := len(path) - 1; i > 0; i-- {
+		if path[i].origin || len(path[i].zones) > 0 {
+			return path[i].name
+		}
+	}
+	return "."
+}
+
+// cuts returns the names that may have NS records of name and its ancestors, starting with the shortest.
+func (x *lookupIndex) cuts(name string) []string {
+	var cuts []string
+	for _, node := range x.path(name) {
+		if node.cut {
+			cuts = append(cuts, node.name)
+		}
+	}
+	return cuts
+}
+
+// forwards returns whether the zones with the longest origin name is in forward queries with DNS-over-HTTPS.
+func (x *lookupIndex) forwards(name string) bool {
+	path := x.path(name)
+	for i := len(path) - 1; i >= 0; i-- {
+		if len(path[i].zones) == 0 {
+			continue
+		}
+		for _, zone := range path[i].zones {
+			if zone.Backend != nil && zone.Backend.DoH {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// soa returns the SOA parameters of the zone with origin, or nil if neither its zones nor its records have any.
+func (x *lookupIndex) soa(origin string) *SOAParameters {
+	return x.soas[origin]
+}
+
+// nxdomain returns whether name does not exist, which is known if it is in the zone of a record whose backend has
+// NXDOMAIN set, but neither the name of a record nor one of their ancestors (RFC 8020), nor in one of the zones.
+func (x *lookupIndex) nxdomain(name string) bool {
+	path := x.path(name)
+	for _, node := range path {
+		if len(node.zones) > 0 {
+			return false
+		}
+	}
+	if len(path) == dns.CountLabel(name)+1 && path[len(path)-1].records {
+		return false
+	}
+	return x.nxdomainOrigins[x.origin(name)]
+}
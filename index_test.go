@@ -0,0 +1,123 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestLookupIndex(t *testing.T) {
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+	zones := []Zone{
+		{Origin: "example.com.", URI: "https://example.com/zone", Backend: &Backend{SOA: &SOAParameters{Ns: "ns1"}}},
+		{Origin: "sub.example.com.", URI: "https://example.com/internal",
+			Backend: &Backend{Clients: []*net.IPNet{internal}}},
+		{Origin: "sub.example.com.", URI: "https://example.com/sub", Backend: &Backend{DoH: true}},
+	}
+	var records []Record
+	for i := 0; i < 20000; i++ {
+		records = append(records, Record{Name: fmt.Sprintf("host%d.example.org.", i), Type: "A",
+			URI: fmt.Sprintf("https://example.org/%d", i)})
+	}
+	records = append(records, Record{Name: "www.example.net.", Type: "A", URI: "https://example.net/www",
+		Backend: &Backend{NXDOMAIN: true, SOA: &SOAParameters{Ns: "ns2"}}})
+	x := newLookupIndex(zones, records, []string{"example.net.", "example.org."}, nil)
+
+	if record := x.record("host12345.example.org.", "A", nil); record == nil || record.URI != "https://example.org/12345" {
+		t.Errorf("Expected the record of host12345.example.org., got %v", record)
+	}
+	if record := x.record("host12345.example.org.", "AAAA", nil); record != nil {
+		t.Errorf("Expected no AAAA record, got %v", record)
+	}
+
+	zoneTests := []struct {
+		name string
+		ip   string
+		uri  string
+	}{
+		{"www.example.com.", "192.0.2.1", "https://example.com/zone"},
+		{"www.sub.example.com.", "192.0.2.1", "https://example.com/sub"},
+		{"www.sub.example.com.", "10.0.0.1", "https://example.com/internal"},
+		{"sub.example.com.", "192.0.2.1", "https://example.com/sub"},
+		{"www.example.org.", "192.0.2.1", ""},
+	}
+	for i, c := range zoneTests {
+		var uri string
+		if zone := x.zone(c.name, net.ParseIP(c.ip)); zone != nil {
+			uri = zone.URI
+		}
+		if uri != c.uri {
+			t.Errorf("Test %d: expected zone %q, got %q", i, c.uri, uri)
+		}
+	}
+
+	originTests := map[string]string{
+		"www.sub.example.com.":   "sub.example.com.",
+		"example.com.":           "example.com.",
+		"host1.example.org.":     "example.org.",
+		"www.example.net.":       "example.net.",
+		"www.example.info.":      ".",
+		"a.b.host1.example.org.": "example.org.",
+	}
+	for name, expected := range originTests {
+		if origin := x.origin(name); origin != expected {
+			t.Errorf("Expected origin %s for %s, got %s", expected, name, origin)
+		}
+	}
+
+	nxdomainTests := map[string]bool{
+		"www.example.net.":     false,
+		"example.net.":         false,
+		"missing.example.net.": true,
+		"a.www.example.net.":   true,
+		"missing.example.org.": false,
+		"missing.example.com.": false,
+	}
+	for name, expected := range nxdomainTests {
+		if nxdomain := x.nxdomain(name); nxdomain != expected {
+			t.Errorf("Expected nxdomain %v for %s, got %v", expected, name, nxdomain)
+		}
+	}
+
+	forwardsTests := map[string]bool{
+		"www.sub.example.com.": true,
+		"sub.example.com.":     true,
+		"www.example.com.":     false,
+		"www.example.org.":     false,
+	}
+	for name, expected := range forwardsTests {
+		if forwards := x.forwards(name); forwards != expected {
+			t.Errorf("Expected forwards %v for %s, got %v", expected, name, forwards)
+		}
+	}
+
+	soaTests := map[string]string{
+		"example.com.":     "ns1",
+		"example.net.":     "ns2",
+		"sub.example.com.": "",
+		"example.org.":     "",
+	}
+	for origin, expected := range soaTests {
+		var ns string
+		if soa := x.soa(origin); soa != nil {
+			ns = soa.Ns
+		}
+		if ns != expected {
+			t.Errorf("Expected SOA with name server %q for %s, got %q", expected, origin, ns)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InvalidationSignatureHeader carries the signature of invalidation requests as sha256=HEX, where HEX is the
+// HMAC-SHA256 of the timestamp in InvalidationTimestampHeader and the body, separated by a newline, with the
+// invalidation secret.
+const InvalidationSignatureHeader = "X-Signature-256"
+
+// InvalidationTimestampHeader carries the time invalidation requests were signed at in seconds since the Unix epoch.
+const InvalidationTimestampHeader = "X-Signature-Timestamp"
+
+// MaxInvalidationAge limits how far the timestamp of invalidation requests may be from now, so that captured requests
+// cannot be replayed later. Requests are only accepted once within it.
+const MaxInvalidationAge = 5 * time.Minute
+
+// MaxInvalidationBodySize limits the size of invalidation requests.
+const MaxInvalidationBodySize = 1 << 20
+
+// invalidationRequest lists the names and zones the responses of which are to be invalidated.
+type invalidationRequest struct {
+	Names []string `json:"names"`
+	Zones []string `json:"zones"`
+}
+
+// invalidationHandler lets backends invalidate responses kept in the caches by posting an invalidationRequest.
+type invalidationHandler struct {
+	h      HTTPRecord
+	secret string
+
+	mu sync.Mutex
+	// seen are the signatures of the requests accepted within MaxInvalidationAge with their timestamps.
+	seen map[string]time.Time
+}
+
+func newInvalidationHandler(h HTTPRecord, secret string) *invalidationHandler {
+	return &invalidationHandler{h: h, secret: secret, seen: make(map[string]time.Time)}
+}
+
+func (i *invalidationHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxInvalidationBodySize))
+	if err != nil {
+		http.Error(rw, "unable to read body", http.StatusBadRequest)
+		return
+	}
+	signature, timestamp := r.Header.Get(InvalidationSignatureHeader), r.Header.Get(InvalidationTimestampHeader)
+	if !i.verify(timestamp, body, signature) {
+		http.Error(rw, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	if !i.fresh(timestamp, signature, time.Now()) {
+		http.Error(rw, "stale or replayed request", http.StatusUnauthorized)
+		return
+	}
+
+	var req invalidationRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(rw, "invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	names := make(map[string]bool, len(req.Names))
+	for _, name := range req.Names {
+		names[plugin.Name(name).Normalize()] = true
+	}
+	zones := make([]string, len(req.Zones))
+	for n, zone := range req.Zones {
+		zones[n] = plugin.Name(zone).Normalize()
+	}
+
+	purged := i.h.purge(func(response backendResponse) bool {
+		return names[response.Name] || plugin.Zones(zones).Matches(response.Name) != ""
+	})
+	log.Infof("Invalidated %d cached responses for %d names and %d zones", purged, len(names), len(zones))
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]int{"purged": purged})
+}
+
+// verify returns whether signature is the one of timestamp and body.
+func (i *invalidationHandler) verify(timestamp string, body []byte, signature string) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	given, err := hex.DecodeString(signature[len("sha256="):])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(i.secret))
+	fmt.Fprintf(mac, "%s\n", timestamp)
+	mac.Write(body)
+	return hmac.Equal(given, mac.Sum(nil))
+}
+
+// fresh returns whether the request signed with signature at timestamp is within MaxInvalidationAge of now and was
+// not accepted before, and remembers it if so.
+func (i *invalidationHandler) fresh(timestamp, signature string, now time.Time) bool {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	signed := time.Unix(seconds, 0)
+	if now.Sub(signed) > MaxInvalidationAge || signed.Sub(now) > MaxInvalidationAge {
+		return false
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for seen, at := range i.seen {
+		if now.Sub(at) > MaxInvalidationAge {
+			delete(i.seen, seen)
+		}
+	}
+	if _, ok := i.seen[signature]; ok {
+		return false
+	}
+	i.seen[signature] = signed
+	return true
+}
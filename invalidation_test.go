@@ -0,0 +1,107 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signInvalidation returns the signature of an invalidation request with body at timestamp.
+func signInvalidation(timestamp, body string) string {
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	fmt.Fprintf(mac, "%s\n%s", timestamp, body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestInvalidationHandler(t *testing.T) {
+	body := `{"names": ["WWW.example.com"], "zones": ["example.org."]}`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-2*MaxInvalidationAge).Unix(), 10)
+	tests := []struct {
+		method    string
+		body      string
+		timestamp string
+		signature string
+		status    int
+		remaining []string
+	}{
+		{"POST", body, now, signInvalidation(now, body), 200, []string{"mail.example.com."}},
+		{"POST", body, now, "sha256=00", 401, nil},
+		{"POST", body, now, "", 401, nil},
+		{"POST", body, stale, signInvalidation(stale, body), 401, nil},
+		// The signature covers the timestamp.
+		{"POST", body, now, signInvalidation(stale, body), 401, nil},
+		{"POST", body, "", signInvalidation("", body), 401, nil},
+		{"GET", body, now, signInvalidation(now, body), 405, nil},
+	}
+
+	for i, test := range tests {
+		h := HTTPRecord{Cache: cache.New(100)}
+		for key, name := range []string{"www.example.com.", "mail.example.com.", "www.example.org.", "example.org."} {
+			h.add(cacheSlot{store: h.Cache, key: uint64(key), name: name, rtype: "A"}, backendResponse{})
+		}
+
+		req := httptest.NewRequest(test.method, "/", strings.NewReader(test.body))
+		req.Header.Set(InvalidationTimestampHeader, test.timestamp)
+		req.Header.Set(InvalidationSignatureHeader, test.signature)
+		rec := httptest.NewRecorder()
+		newInvalidationHandler(h, "s3cret").ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("Test %d: expected status %d, got %d: %s", i, test.status, rec.Code, rec.Body)
+		}
+		if rec.Code != 200 {
+			continue
+		}
+
+		var remaining []string
+		h.walkCaches(func(zone string, key uint64, response backendResponse) bool {
+			remaining = append(remaining, response.Name)
+			return false
+		})
+		sort.Strings(remaining)
+		if strings.Join(remaining, ", ") != strings.Join(test.remaining, ", ") {
+			t.Errorf("Test %d: expected %v to remain, got %v", i, test.remaining, remaining)
+		}
+	}
+}
+
+func TestInvalidationHandler_Replay(t *testing.T) {
+	body := `{"names": ["www.example.com."]}`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	handler := newInvalidationHandler(HTTPRecord{Cache: cache.New(100)}, "s3cret")
+
+	for i, status := range []int{200, 401} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set(InvalidationTimestampHeader, now)
+		req.Header.Set(InvalidationSignatureHeader, signInvalidation(now, body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != status {
+			t.Errorf("Request %d: expected status %d, got %d: %s", i, status, rec.Code, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"github.com/miekg/dns"
+	"math/rand"
+	"time"
+)
+
+// jitterTTLs reduces the TTLs of the records in sections by the same random fraction of up to percent, so that
+// clients that received them at the same time do not all ask again at once.
+func jitterTTLs(percent int, sections ...[]dns.RR) {
+	fraction := rand.Float64() * float64(percent) / 100
+	for _, rrs := range sections {
+		for _, rr := range rrs {
+			// The TTL of OPT records holds flags.
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rr.Header().Ttl -= uint32(float64(rr.Header().Ttl) * fraction)
+		}
+	}
+}
+
+// jitterWindow widens window by a random amount of up to percent of ttl.
+func jitterWindow(window, ttl time.Duration, percent int) time.Duration {
+	return window + time.Duration(rand.Int63n(int64(ttl)*int64(percent)/100+1))
+}
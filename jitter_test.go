@@ -0,0 +1,48 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+func TestJitterTTLs(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		answer := []dns.RR{test.A("example.com. 1000 IN A 1.2.3.4"), test.A("example.com. 1000 IN A 5.6.7.8")}
+		extra := []dns.RR{&dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Ttl: 0x8000}}}
+		jitterTTLs(10, answer, extra)
+
+		if ttl := answer[0].Header().Ttl; ttl < 900 || ttl > 1000 {
+			t.Fatalf("Expected a TTL from 900 to 1000, got %d", ttl)
+		}
+		if answer[0].Header().Ttl != answer[1].Header().Ttl {
+			t.Fatalf("Expected the same TTLs, got %d and %d", answer[0].Header().Ttl, answer[1].Header().Ttl)
+		}
+		if extra[0].Header().Ttl != 0x8000 {
+			t.Fatalf("Expected the OPT record to be kept, got TTL %d", extra[0].Header().Ttl)
+		}
+	}
+}
+
+func TestJitterWindow(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if window := jitterWindow(time.Second, time.Minute, 10); window < time.Second || window > 7*time.Second {
+			t.Fatalf("Expected a window from 1s to 7s, got %v", window)
+		}
+	}
+}
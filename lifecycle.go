@@ -0,0 +1,178 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"errors"
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"sync"
+	"time"
+)
+
+// errStopping is returned for requests to backends that would start once shutdown began.
+var errStopping = errors.New("shutting down")
+
+// DrainTimeout limits how long shutdown waits for requests to backends in flight to finish before they are canceled.
+const DrainTimeout = 5 * time.Second
+
+// lifecycle tracks the requests to backends in flight, so that they are drained at shutdown, and stops refreshing
+// responses in the background once it began.
+type lifecycle struct {
+	// ctx is the parent of the contexts of requests, which is canceled once they were drained.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	inFlight int
+	stopping bool
+	// drained is closed once the requests in flight finished after shutdown began.
+	drained   chan struct{}
+	drainOnce sync.Once
+}
+
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &lifecycle{ctx: ctx, cancel: cancel, drained: make(chan struct{})}
+}
+
+// context returns the parent of the contexts of requests.
+func (l *lifecycle) context() context.Context {
+	if l == nil {
+		return context.Background()
+	}
+	return l.ctx
+}
+
+// begin tracks a request in flight until the returned function is called. Once shutdown began, new requests are
+// refused with errStopping.
+func (l *lifecycle) begin() (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopping {
+		return nil, errStopping
+	}
+	l.inFlight++
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.inFlight--
+		if l.stopping && l.inFlight == 0 {
+			l.drain()
+		}
+	}, nil
+}
+
+// drain marks the requests in flight as finished, which it does only once.
+func (l *lifecycle) drain() {
+	l.drainOnce.Do(func() {
+		close(l.drained)
+	})
+}
+
+// isStopping returns whether shutdown began, after which responses are no longer refreshed in the background.
+func (l *lifecycle) isStopping() bool {
+	if l == nil {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stopping
+}
+
+// Stop waits up to timeout for the requests in flight to finish and cancels those that did not.
+func (l *lifecycle) Stop(timeout time.Duration) {
+	l.mu.Lock()
+	if l.stopping {
+		l.mu.Unlock()
+		return
+	}
+	l.stopping = true
+	if l.inFlight == 0 {
+		l.drain()
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-l.drained:
+	case <-time.After(timeout):
+		log.Warningf("Canceling requests to backends still in flight after %s", timeout)
+	}
+	l.cancel()
+}
+
+// carriedCaches are the caches of instances that keep them on reload, by the server block they were set up for, until
+// the instance replacing them takes them over.
+var (
+	carriedMu     sync.Mutex
+	carriedCaches = map[string]carriedCache{}
+)
+
+// carriedCache are the caches of an instance that is reloaded.
+type carriedCache struct {
+	// size and perZone tell whether the caches fit the configuration of the instance replacing it.
+	size    int
+	perZone bool
+
+	cache      *cache.Cache
+	zoneCaches map[string]*cache.Cache
+	cacheMu    *sync.RWMutex
+}
+
+// carryCaches hands the caches over to the instance set up for the server block with key when CoreDNS reloads.
+func (h HTTPRecord) carryCaches(key string) {
+	carriedMu.Lock()
+	defer carriedMu.Unlock()
+	carriedCaches[key] = carriedCache{
+		size:       h.cacheSize(),
+		perZone:    h.CachePerZone,
+		cache:      h.Cache,
+		zoneCaches: h.zoneCaches,
+		cacheMu:    h.cacheMu,
+	}
+}
+
+// dropCarriedCaches forgets the caches carried for the server block with key, e.g. because the reload failed.
+func dropCarriedCaches(key string) {
+	carriedMu.Lock()
+	defer carriedMu.Unlock()
+	delete(carriedCaches, key)
+}
+
+// takeCarriedCaches takes over the caches carried for the server block with key if they fit the configuration, and
+// returns whether there were. The caches of zones that were added are new, those of zones that were removed dropped.
+func (h *HTTPRecord) takeCarriedCaches(key string) bool {
+	carriedMu.Lock()
+	carried, ok := carriedCaches[key]
+	delete(carriedCaches, key)
+	carriedMu.Unlock()
+	if !ok || carried.size != h.cacheSize() || carried.perZone != h.CachePerZone {
+		return false
+	}
+
+	h.Cache, h.cacheMu = carried.cache, carried.cacheMu
+	for origin := range h.zoneCaches {
+		if store, ok := carried.zoneCaches[origin]; ok {
+			h.zoneCaches[origin] = store
+		}
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLifecycle_Stop(t *testing.T) {
+	tests := []struct {
+		delay   time.Duration
+		timeout time.Duration
+		drained bool
+	}{
+		{50 * time.Millisecond, time.Second, true},
+		// Requests that take too long are canceled.
+		{time.Second, 50 * time.Millisecond, false},
+	}
+
+	for i, c := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(c.delay):
+				rw.Write([]byte("1.2.3.4"))
+			case <-r.Context().Done():
+			}
+		}))
+
+		h := HTTPRecord{Timeout: 5 * time.Second, lifecycle: newLifecycle()}
+		errs := make(chan error)
+		go func() {
+			_, err := h.fetch(backendRequest{Method: http.MethodGet, URI: server.URL}, nil)
+			errs <- err
+		}()
+		// Let the request start.
+		time.Sleep(10 * time.Millisecond)
+		h.lifecycle.Stop(c.timeout)
+
+		if err := <-errs; (err == nil) != c.drained {
+			t.Errorf("Test %d: expected drained to be %v, got error %v", i, c.drained, err)
+		}
+		if !h.lifecycle.isStopping() {
+			t.Errorf("Test %d: expected lifecycle to be stopping", i)
+		}
+		server.Close()
+	}
+}
+
+func TestLifecycle_BeginAfterStop(t *testing.T) {
+	l := newLifecycle()
+	done, err := l.begin()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		l.Stop(time.Second)
+		close(stopped)
+	}()
+	// Let shutdown begin while the request is in flight.
+	time.Sleep(10 * time.Millisecond)
+
+	// Requests starting once shutdown began are refused rather than drained again.
+	if _, err := l.begin(); err != errStopping {
+		t.Errorf("Expected errStopping, got %v", err)
+	}
+	done()
+	<-stopped
+	if _, err := l.begin(); err != errStopping {
+		t.Errorf("Expected errStopping after Stop, got %v", err)
+	}
+
+	h := HTTPRecord{lifecycle: l}
+	if _, err := h.fetch(backendRequest{Method: http.MethodGet, URI: "http://127.0.0.1:1"}, nil); err != errStopping {
+		t.Errorf("Expected fetch to be refused, got %v", err)
+	}
+}
+
+func TestHTTPRecord_CarryCaches(t *testing.T) {
+	old := HTTPRecord{CacheSize: 10, CachePerZone: true, origins: []string{"example.com.", "example.org."}}
+	old.Cache, old.zoneCaches = cache.New(10), old.newZoneCaches()
+	old.carryCaches("test")
+
+	// The cache of a zone that was removed is dropped and one for a zone that was added is new.
+	replacement := HTTPRecord{CacheSize: 10, CachePerZone: true, origins: []string{"example.com.", "example.net."}}
+	replacement.Cache, replacement.zoneCaches = cache.New(10), replacement.newZoneCaches()
+	if !replacement.takeCarriedCaches("test") {
+		t.Fatalf("Expected caches to be carried over")
+	}
+	if replacement.Cache != old.Cache || replacement.zoneCaches["example.com."] != old.zoneCaches["example.com."] {
+		t.Errorf("Expected caches to be taken over")
+	}
+	if replacement.zoneCaches["example.net."] == nil || len(replacement.zoneCaches) != 2 {
+		t.Errorf("Expected caches for example.com. and example.net., got %v", replacement.zoneCaches)
+	}
+
+	// Caches are only taken over once and not if their size changed.
+	if replacement.takeCarriedCaches("test") {
+		t.Errorf("Expected caches to be taken over only once")
+	}
+	old.carryCaches("test")
+	resized := HTTPRecord{CacheSize: 20, Cache: cache.New(20)}
+	if resized.takeCarriedCaches("test") {
+		t.Errorf("Expected caches of a different size not to be taken over")
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// httpListener serves a handler on an address between Start and Stop.
+type httpListener struct {
+	addr    string
+	handler http.Handler
+
+	mu     sync.Mutex
+	server *http.Server
+}
+
+// listenHTTP serves handler on addr while the configuration being set up by c is running. The address is released
+// before a reloaded configuration starts listening on it.
+func listenHTTP(c *caddy.Controller, addr string, handler http.Handler) {
+	l := &httpListener{addr: addr, handler: handler}
+	c.OnStartup(l.Start)
+	c.OnRestart(l.Stop)
+	c.OnRestartFailed(l.Start)
+	c.OnFinalShutdown(l.Stop)
+}
+
+// Start starts listening on the address.
+func (l *httpListener) Start() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.server != nil {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", l.addr)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: l.handler}
+	l.server = server
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Serving on %s failed: %v", l.addr, err)
+		}
+	}()
+	return nil
+}
+
+// Stop stops listening.
+func (l *httpListener) Stop() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.server == nil {
+		return nil
+	}
+
+	err := l.server.Close()
+	l.server = nil
+	return err
+}
@@ -0,0 +1,59 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestHTTPListener(t *testing.T) {
+	// Find a free address to listen on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	l := &httpListener{addr: addr, handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("ok"))
+	})}
+
+	// A reloaded configuration stops listening and starts again on the same address.
+	for i := 0; i < 2; i++ {
+		if err := l.Start(); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		resp, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "ok" {
+			t.Errorf("Expected ok, got %q", body)
+		}
+		if err := l.Stop(); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	if _, err := http.Get("http://" + addr + "/"); err == nil {
+		t.Error("Expected an error after stopping")
+	}
+}
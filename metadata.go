@@ -0,0 +1,80 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/request"
+	"strconv"
+	"sync"
+)
+
+// queryMetadata is what the plugin publishes about a lookup to the metadata plugin, which other plugins read once the
+// lookup was answered.
+type queryMetadata struct {
+	mu sync.Mutex
+	// backend is the URI of the last request to a backend, if any.
+	backend string
+	// cacheStatus is how the lookup was answered from the caches, i.e. hit, stale or miss, if caching is enabled.
+	cacheStatus string
+	// fetchMS is the time spent waiting for backends in milliseconds.
+	fetchMS int64
+}
+
+type metadataKey struct{}
+
+// Metadata implements the metadata.Provider interface, publishing httprecord/backend, httprecord/cache-status and
+// httprecord/fetch-ms.
+func (h HTTPRecord) Metadata(ctx context.Context, state request.Request) context.Context {
+	md := new(queryMetadata)
+	metadata.SetValueFunc(ctx, "httprecord/backend", func() string {
+		md.mu.Lock()
+		defer md.mu.Unlock()
+		return md.backend
+	})
+	metadata.SetValueFunc(ctx, "httprecord/cache-status", func() string {
+		md.mu.Lock()
+		defer md.mu.Unlock()
+		return md.cacheStatus
+	})
+	metadata.SetValueFunc(ctx, "httprecord/fetch-ms", func() string {
+		md.mu.Lock()
+		defer md.mu.Unlock()
+		return strconv.FormatInt(md.fetchMS, 10)
+	})
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// metadataFrom returns the metadata to publish about the lookup with ctx, or nil if the metadata plugin is not
+// enabled.
+func metadataFrom(ctx context.Context) *queryMetadata {
+	md, _ := ctx.Value(metadataKey{}).(*queryMetadata)
+	return md
+}
+
+// set publishes the lookup for reqs, which sent the requests in stats.
+func (md *queryMetadata) set(reqs []backendRequest, stats *fetchStats) {
+	stats.mu.Lock()
+	backend, fetchMS := stats.uri, stats.duration.Milliseconds()
+	stats.mu.Unlock()
+
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	md.backend, md.fetchMS = backend, fetchMS
+	if len(reqs) > 0 {
+		md.cacheStatus = reqs[0].CacheResult
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHTTPRecord_PublishMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+
+	config := HTTPRecord{
+		Zones:          []Zone{{URI: server.URL + "/%(fqdn)", Origin: "example.com."}},
+		CacheResponses: true,
+		Cache:          cache.New(100),
+		Timeout:        time.Second,
+	}
+	tests := []struct {
+		backend     string
+		cacheStatus string
+	}{
+		{server.URL + "/foo.example.com.", "miss"},
+		{"", "hit"},
+	}
+
+	for i, c := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		msg := new(dns.Msg)
+		msg.SetQuestion("foo.example.com.", dns.TypeA)
+		ctx := metadata.ContextWithMetadata(context.TODO())
+		ctx = config.Metadata(ctx, request.Request{W: rec, Req: msg})
+		if _, err := config.ServeDNS(ctx, rec, msg); err != nil {
+			t.Fatalf("Test %d: unexpected error %v", i, err)
+		}
+
+		if backend := metadata.ValueFunc(ctx, "httprecord/backend")(); backend != c.backend {
+			t.Errorf("Test %d: expected backend %q, got %q", i, c.backend, backend)
+		}
+		if status := metadata.ValueFunc(ctx, "httprecord/cache-status")(); status != c.cacheStatus {
+			t.Errorf("Test %d: expected cache status %q, got %q", i, c.cacheStatus, status)
+		}
+		if _, err := strconv.Atoi(metadata.ValueFunc(ctx, "httprecord/fetch-ms")()); err != nil {
+			t.Errorf("Test %d: expected fetch-ms to be a number: %v", i, err)
+		}
+	}
+}
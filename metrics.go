@@ -0,0 +1,86 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"github.com/coredns/coredns/plugin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Variables declared for monitoring.
+var (
+	BackendUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "httprecord",
+		Name:      "backend_up",
+		Help:      "Gauge of whether the last health check of a backend succeeded.",
+	}, []string{"uri"})
+	CacheEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "httprecord",
+		Name:      "cache_entries",
+		Help:      "Gauge of the number of responses kept in a cache.",
+	}, []string{"zone"})
+	CacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "httprecord",
+		Name:      "cache_hits_total",
+		Help:      "Counter of lookups answered with a fresh response from a cache.",
+	}, []string{"zone"})
+	CacheStaleHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "httprecord",
+		Name:      "cache_stale_hits_total",
+		Help:      "Counter of lookups answered with an expired response from a cache.",
+	}, []string{"zone"})
+	CacheMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "httprecord",
+		Name:      "cache_misses_total",
+		Help:      "Counter of lookups that could not be answered from a cache.",
+	}, []string{"zone"})
+	BackendRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "httprecord",
+		Name:      "backend_requests_total",
+		Help:      "Counter of requests to backends by the HTTP status code of their response, or error if there was none.",
+	}, []string{"zone", "code"})
+	BackendRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "httprecord",
+		Name:      "backend_request_duration_seconds",
+		Buckets:   plugin.TimeBuckets,
+		Help:      "Histogram of the time until backends responded.",
+	}, []string{"zone"})
+	ParseFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "httprecord",
+		Name:      "parse_failures_total",
+		Help:      "Counter of backend responses that could not be parsed or contained records that could not be parsed.",
+	}, []string{"zone"})
+	Responses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "httprecord",
+		Name:      "responses_total",
+		Help:      "Counter of lookups answered from backends by the rcode of the response.",
+	}, []string{"zone", "rcode"})
+	CacheEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "httprecord",
+		Name:      "cache_evictions_total",
+		Help:      "Counter of responses removed from a cache to make room for others.",
+	}, []string{"zone"})
+)
@@ -0,0 +1,218 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"github.com/miekg/dns"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Orders of the address records in answers.
+const (
+	// OrderRotate rotates the records by an offset taken from the query ID.
+	OrderRotate = "rotate"
+	// OrderShuffle shuffles the records randomly, seeded with the query ID.
+	OrderShuffle = "shuffle"
+)
+
+// addressPositions returns the positions of the A and AAAA records in answer.
+func addressPositions(answer []dns.RR) []int {
+	var positions []int
+	for i, rr := range answer {
+		if rtype := rr.Header().Rrtype; rtype == dns.TypeA || rtype == dns.TypeAAAA {
+			positions = append(positions, i)
+		}
+	}
+	return positions
+}
+
+// orderAnswers reorders the A and AAAA records in answer according to order for the query with id, keeping other
+// records, e.g. CNAMEs leading to them, in place. Retransmissions of a query get the same order.
+func orderAnswers(order string, id uint16, answer []dns.RR) {
+	positions := addressPositions(answer)
+	if len(positions) < 2 {
+		return
+	}
+
+	records := make([]dns.RR, len(positions))
+	for i, position := range positions {
+		records[i] = answer[position]
+	}
+	switch order {
+	case OrderRotate:
+		offset := int(id) % len(records)
+		records = append(records[offset:], records[:offset]...)
+	case OrderShuffle:
+		random := rand.New(rand.NewSource(int64(id)))
+		random.Shuffle(len(records), func(i, j int) { records[i], records[j] = records[j], records[i] })
+	}
+	for i, position := range positions {
+		answer[position] = records[i]
+	}
+}
+
+// DefaultWeight is the weight of address records the backend did not assign one to while it did to others.
+const DefaultWeight = 1
+
+// weightToken prefixes the weight at the end of lines of text and CSV responses, e.g. 192.0.2.1 weight=10.
+const weightToken = "weight="
+
+// weightedEntry is implemented by entries the backend can assign a weight to.
+type weightedEntry interface {
+	responseEntry
+	Weight() (uint32, bool)
+}
+
+// weightEntry is an entry whose weight was split off its payload.
+type weightEntry struct {
+	typedEntry
+	weight uint32
+}
+
+func (e weightEntry) Weight() (uint32, bool) {
+	return e.weight, true
+}
+
+// weightedEntries splits the weight=N token off the end of entries for address records. Other records could have
+// data ending like that.
+func weightedEntries(rtype string, entries []responseEntry) []responseEntry {
+	if rtype != "A" && rtype != "AAAA" {
+		return entries
+	}
+
+	for i, entry := range entries {
+		payload := entry.Payload()
+		j := strings.LastIndexAny(payload, " \t")
+		if j < 0 || !strings.HasPrefix(payload[j+1:], weightToken) {
+			continue
+		}
+		weight, err := strconv.ParseUint(strings.TrimPrefix(payload[j+1:], weightToken), 10, 32)
+		if err != nil {
+			continue
+		}
+		entries[i] = weightEntry{
+			typedEntry: typedEntry{rtype: entry.Type(), ttl: entry.TTL(), payload: strings.TrimSpace(payload[:j])},
+			weight:     uint32(weight),
+		}
+	}
+	return entries
+}
+
+// weights returns the weights of the address records parser converts entries into, keyed by their data, or nil if
+// the backend did not assign any.
+func weights(name string, ttl uint32, parser entryParser, entries []responseEntry) map[string]uint32 {
+	var weights map[string]uint32
+	for _, entry := range entries {
+		weighted, ok := entry.(weightedEntry)
+		if !ok {
+			continue
+		}
+		weight, ok := weighted.Weight()
+		if !ok {
+			continue
+		}
+
+		rrs, _ := parser(name, ttl, []responseEntry{entry})
+		for _, rr := range rrs {
+			if rtype := rr.Header().Rrtype; rtype != dns.TypeA && rtype != dns.TypeAAAA {
+				continue
+			}
+			if weights == nil {
+				weights = make(map[string]uint32)
+			}
+			weights[recordData(rr)] = weight
+		}
+	}
+	return weights
+}
+
+// recordData returns the data of rr in zone file syntax.
+func recordData(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// weighAnswers orders the A and AAAA records in answer randomly by weights, seeded with the query ID, such that the
+// chance of a record coming first is proportional to its weight. Records with weight 0 are removed unless all have
+// weight 0. Other records, e.g. CNAMEs leading to them, stay in place.
+func weighAnswers(weights map[string]uint32, id uint16, answer []dns.RR) []dns.RR {
+	positions := addressPositions(answer)
+	if len(positions) == 0 {
+		return answer
+	}
+
+	// Weighted random sampling without replacement (Efraimidis and Spirakis): every record is keyed with u^(1/w) for a
+	// uniformly distributed u and the records are ordered by their keys, highest first.
+	type weighted struct {
+		rr  dns.RR
+		key float64
+	}
+	random := rand.New(rand.NewSource(int64(id)))
+	var records, drained []weighted
+	for _, position := range positions {
+		rr := answer[position]
+		weight, ok := weights[recordData(rr)]
+		if !ok {
+			weight = DefaultWeight
+		}
+		if weight == 0 {
+			drained = append(drained, weighted{rr: rr, key: random.Float64()})
+			continue
+		}
+		records = append(records, weighted{rr: rr, key: math.Pow(random.Float64(), 1/float64(weight))})
+	}
+	if len(records) == 0 {
+		records = drained
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].key > records[j].key })
+
+	// The records take the positions of the first address records, the positions of removed ones are dropped.
+	weighed := make([]dns.RR, 0, len(answer)-len(positions)+len(records))
+	next := 0
+	for i, rr := range answer {
+		if rtype := rr.Header().Rrtype; rtype != dns.TypeA && rtype != dns.TypeAAAA {
+			weighed = append(weighed, answer[i])
+			continue
+		}
+		if next < len(records) {
+			weighed = append(weighed, records[next].rr)
+			next++
+		}
+	}
+	return weighed
+}
+
+// limitAnswers removes all but the first max A and AAAA records from answer. Other records, e.g. CNAMEs leading to
+// them, are kept.
+func limitAnswers(max int, answer []dns.RR) []dns.RR {
+	positions := addressPositions(answer)
+	if len(positions) <= max {
+		return answer
+	}
+
+	limited := make([]dns.RR, 0, len(answer)-len(positions)+max)
+	for i, rr := range answer {
+		if i > positions[max-1] {
+			if rtype := rr.Header().Rrtype; rtype == dns.TypeA || rtype == dns.TypeAAAA {
+				continue
+			}
+		}
+		limited = append(limited, rr)
+	}
+	return limited
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"fmt"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"reflect"
+	"testing"
+)
+
+func TestOrderAnswers(t *testing.T) {
+	answer := func() []dns.RR {
+		return []dns.RR{
+			test.CNAME("www.example.com. 300 IN CNAME lb.example.com."),
+			test.A("lb.example.com. 300 IN A 192.0.2.1"),
+			test.A("lb.example.com. 300 IN A 192.0.2.2"),
+			test.A("lb.example.com. 300 IN A 192.0.2.3"),
+		}
+	}
+	addresses := func(rrs []dns.RR) []string {
+		var addresses []string
+		for _, rr := range rrs[1:] {
+			addresses = append(addresses, rr.(*dns.A).A.String())
+		}
+		return addresses
+	}
+
+	rotated := answer()
+	orderAnswers(OrderRotate, 4, rotated)
+	if _, ok := rotated[0].(*dns.CNAME); !ok {
+		t.Errorf("Expected CNAME to stay first, got %v", rotated[0])
+	}
+	if expected := []string{"192.0.2.2", "192.0.2.3", "192.0.2.1"}; !reflect.DeepEqual(addresses(rotated), expected) {
+		t.Errorf("Expected %v, got %v", expected, addresses(rotated))
+	}
+
+	// Shuffles are the same for the same query ID, and differ for some others.
+	first, second := answer(), answer()
+	orderAnswers(OrderShuffle, 42, first)
+	orderAnswers(OrderShuffle, 42, second)
+	if !reflect.DeepEqual(addresses(first), addresses(second)) {
+		t.Errorf("Expected the same order for the same query, got %v and %v", addresses(first), addresses(second))
+	}
+	orders := make(map[string]bool)
+	for id := uint16(0); id < 100; id++ {
+		shuffled := answer()
+		orderAnswers(OrderShuffle, id, shuffled)
+		orders[fmt.Sprint(addresses(shuffled))] = true
+	}
+	if len(orders) < 2 {
+		t.Errorf("Expected different orders, got %v", orders)
+	}
+}
+
+func TestWeighAnswers(t *testing.T) {
+	answer := func() []dns.RR {
+		return []dns.RR{
+			test.CNAME("www.example.com. 300 IN CNAME lb.example.com."),
+			test.A("lb.example.com. 300 IN A 192.0.2.1"),
+			test.A("lb.example.com. 300 IN A 192.0.2.2"),
+			test.A("lb.example.com. 300 IN A 192.0.2.3"),
+		}
+	}
+	weights := map[string]uint32{"192.0.2.1": 8, "192.0.2.2": 0}
+
+	// 192.0.2.1 comes first with a chance of 8/9, 192.0.2.3 with its default weight otherwise.
+	first := make(map[string]int)
+	for id := uint16(0); id < 900; id++ {
+		weighed := weighAnswers(weights, id, answer())
+		if len(weighed) != 3 {
+			t.Fatalf("Expected the record with weight 0 to be removed, got %v", weighed)
+		}
+		if _, ok := weighed[0].(*dns.CNAME); !ok {
+			t.Fatalf("Expected CNAME to stay first, got %v", weighed[0])
+		}
+		first[weighed[1].(*dns.A).A.String()]++
+	}
+	if first["192.0.2.1"] < 700 || first["192.0.2.3"] < 50 || first["192.0.2.2"] != 0 {
+		t.Errorf("Expected records to come first by weight, got %v", first)
+	}
+
+	drained := map[string]uint32{"192.0.2.1": 0, "192.0.2.2": 0, "192.0.2.3": 0}
+	if weighed := weighAnswers(drained, 1, answer()); len(weighed) != 4 {
+		t.Errorf("Expected all records if all have weight 0, got %v", weighed)
+	}
+}
+
+func TestParseWeights(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain", "192.0.2.1 weight=3\n192.0.2.2\n"},
+		{"application/json", `{"answer":[{"data":"192.0.2.1","weight":3},{"data":"192.0.2.2"}]}`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.contentType, func(t *testing.T) {
+			parsed, err := responseParserFor(tc.contentType).Parse("www.example.com.", "A", 300, []byte(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parsed.Answer) != 2 || len(parsed.Errors) != 0 {
+				t.Fatalf("Expected 2 records, got %v and errors %v", parsed.Answer, parsed.Errors)
+			}
+			if expected := map[string]uint32{"192.0.2.1": 3}; !reflect.DeepEqual(parsed.Weights, expected) {
+				t.Errorf("Expected weights %v, got %v", expected, parsed.Weights)
+			}
+		})
+	}
+}
+
+func TestLimitAnswers(t *testing.T) {
+	answer := []dns.RR{
+		test.CNAME("www.example.com. 300 IN CNAME lb.example.com."),
+		test.A("lb.example.com. 300 IN A 192.0.2.1"),
+		test.AAAA("lb.example.com. 300 IN AAAA 2001:db8::1"),
+		test.A("lb.example.com. 300 IN A 192.0.2.2"),
+	}
+
+	if limited := limitAnswers(2, answer); !reflect.DeepEqual(limited, answer[:3]) {
+		t.Errorf("Expected %v, got %v", answer[:3], limited)
+	}
+	if limited := limitAnswers(3, answer); !reflect.DeepEqual(limited, answer) {
+		t.Errorf("Expected %v, got %v", answer, limited)
+	}
+}
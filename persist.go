@@ -0,0 +1,162 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"encoding/json"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultPersistInterval is how often the cache is written to disk unless a different interval is configured.
+const DefaultPersistInterval = time.Minute
+
+// persistedResponse is a response kept in a cache as it is written to disk.
+type persistedResponse struct {
+	// Zone is the origin of the zone the response is kept for if caches are kept per zone.
+	Zone     string          `json:"zone,omitempty"`
+	Key      uint64          `json:"key"`
+	Response backendResponse `json:"response"`
+}
+
+// cachePersister periodically writes the responses kept in the caches to a file and loads them at startup, so that
+// they survive restarts.
+type cachePersister struct {
+	h        HTTPRecord
+	path     string
+	interval time.Duration
+	// carried is set if the caches were carried over from the instance before a reload, which saved them last, so
+	// that they are not loaded again.
+	carried bool
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newCachePersister(h HTTPRecord) *cachePersister {
+	interval := h.PersistInterval
+	if interval == 0 {
+		interval = DefaultPersistInterval
+	}
+
+	return &cachePersister{
+		h:        h,
+		path:     h.PersistPath,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start loads the responses written before and starts writing them periodically.
+func (p *cachePersister) Start() error {
+	if !p.carried {
+		if err := p.load(); err != nil {
+			log.Warningf("Unable to load cache from %s: %v", p.path, err)
+		}
+	}
+
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.save(); err != nil {
+					log.Warningf("Unable to save cache to %s: %v", p.path, err)
+				}
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops writing periodically and writes the responses a last time.
+func (p *cachePersister) Stop() error {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+		<-p.done
+	})
+	return p.save()
+}
+
+// save writes the responses kept in the caches to the file, replacing it at once so that it is never incomplete.
+func (p *cachePersister) save() error {
+	var responses []persistedResponse
+	p.h.walkCaches(func(zone string, key uint64, response backendResponse) bool {
+		responses = append(responses, persistedResponse{Zone: zone, Key: key, Response: response})
+		return false
+	})
+
+	data, err := json.Marshal(responses)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p.path), filepath.Base(p.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.path)
+}
+
+// load adds the responses in the file to the caches. Responses for zones that no longer have a cache of their own are
+// skipped. A missing file is not an error, as there is none before the first start.
+func (p *cachePersister) load() error {
+	data, err := ioutil.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var responses []persistedResponse
+	if err := json.Unmarshal(data, &responses); err != nil {
+		return err
+	}
+
+	caches := p.h.caches()
+	for _, persisted := range responses {
+		store, ok := caches[persisted.Zone]
+		if !ok {
+			continue
+		}
+		response := persisted.Response
+		response.Hits = new(uint32)
+		slot := cacheSlot{zone: persisted.Zone, store: store, key: persisted.Key, name: response.Name,
+			rtype: response.Type}
+		p.h.add(slot, response)
+	}
+	log.Infof("Loaded %d cached responses from %s", len(responses), p.path)
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCachePersister(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httprecord")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newConfig := func() HTTPRecord {
+		return HTTPRecord{
+			Cache:       cache.New(100),
+			PersistPath: filepath.Join(dir, "cache.json"),
+			zoneCaches:  map[string]*cache.Cache{"example.com.": cache.New(100)},
+		}
+	}
+
+	fetched := time.Unix(1600000000, 0)
+	shared := backendResponse{URI: "https://example.org/", Payload: []byte("1.2.3.4"), ContentType: "text/plain",
+		TTL: 60, ETag: `"v1"`, Fetched: fetched, Hits: new(uint32), Name: "foo.example.org.", Type: "A",
+		parsed: new(parsedRecords)}
+	negative := backendResponse{TTL: 30, Fetched: fetched, Hits: new(uint32), Name: "bar.example.com.", Type: "A",
+		Error: &BackendIndicatedError{HTTPResponseCode: 404, DNSResponseCode: 3, TTL: 30}, parsed: new(parsedRecords)}
+
+	config := newConfig()
+	persister := newCachePersister(config)
+	// Without a file, nothing is loaded.
+	if err := persister.load(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	config.add(cacheSlot{store: config.Cache, key: 1, name: "foo.example.org.", rtype: "A"}, shared)
+	config.add(cacheSlot{store: config.zoneCaches["example.com."], key: 2, name: "bar.example.com.", rtype: "A"},
+		negative)
+	if err := persister.save(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	restarted := newConfig()
+	if err := newCachePersister(restarted).load(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	loaded := func(store *cache.Cache, key uint64) backendResponse {
+		entry, ok := store.Get(key)
+		if !ok {
+			t.Fatalf("Expected a response for key %d", key)
+		}
+		response := entry.(backendResponse)
+		// Times lose their location when written.
+		if response.Fetched.Equal(fetched) {
+			response.Fetched = fetched
+		}
+		return response
+	}
+	if response := loaded(restarted.Cache, 1); !reflect.DeepEqual(response, shared) {
+		t.Errorf("Expected %+v, got %+v", shared, response)
+	}
+	if response := loaded(restarted.zoneCaches["example.com."], 2); !reflect.DeepEqual(response, negative) {
+		t.Errorf("Expected %+v, got %+v", negative, response)
+	}
+
+	// Responses of zones without a cache of their own are skipped.
+	unzoned := newConfig()
+	unzoned.zoneCaches = nil
+	if err := newCachePersister(unzoned).load(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if unzoned.Cache.Len() != 1 {
+		t.Errorf("Expected 1 response, got %d", unzoned.Cache.Len())
+	}
+}
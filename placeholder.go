@@ -0,0 +1,170 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"fmt"
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ApexName is the value of the %(name) placeholder for the origin of a zone itself.
+const ApexName = "@"
+
+// placeholders are the values of the %(NAME) placeholders in URIs and request bodies.
+type placeholders map[string]string
+
+// queryPlaceholders returns the placeholders for the query in state to the zone with the given origin. Values that
+// other plugins published with the metadata plugin in ctx are available as %(metadata/LABEL).
+func queryPlaceholders(ctx context.Context, state request.Request, origin string) placeholders {
+	p := placeholders{
+		"fqdn":      state.Name(),
+		"name":      relativeName(state.Name(), origin),
+		"zone":      origin,
+		"qtype":     state.Type(),
+		"protocol":  queryProtocol(state),
+		"client_ip": state.IP(),
+		"ecs":       clientSubnet(state.Req),
+	}
+	for label, value := range metadata.ValueFuncs(ctx) {
+		p["metadata/"+label] = value()
+	}
+	return p
+}
+
+// clientSubnet returns the EDNS Client Subnet of r as ADDRESS/PREFIX, or an empty string if it has none.
+func clientSubnet(r *dns.Msg) string {
+	if subnet := subnetOption(r); subnet != nil {
+		return fmt.Sprintf("%s/%d", subnet.Address, subnet.SourceNetmask)
+	}
+	return ""
+}
+
+// relativeName returns name relative to origin, or ApexName for origin itself.
+func relativeName(name, origin string) string {
+	switch {
+	case name == origin:
+		return ApexName
+	case origin == ".":
+		return strings.TrimSuffix(name, ".")
+	default:
+		return strings.TrimSuffix(strings.TrimSuffix(name, origin), ".")
+	}
+}
+
+// isLookupPlaceholder returns whether name is a placeholder that is replaced for every lookup.
+func isLookupPlaceholder(name string) bool {
+	_, ok := placeholders{
+		"fqdn": "", "name": "", "zone": "", "qtype": "", "protocol": "", "client_ip": "", "ecs": "",
+	}.value(name)
+	return ok
+}
+
+// value returns the value of the placeholder name. Besides the fixed placeholders, %(labelN) is the Nth label of the
+// queried name from the left, or empty if it has fewer labels. Metadata that was not published is empty.
+// %(timebucket:SECONDS) is the current Unix time rounded down to a multiple of SECONDS.
+func (p placeholders) value(name string) (string, bool) {
+	if value, ok := p[name]; ok {
+		return value, ok
+	}
+
+	if strings.HasPrefix(name, "timebucket:") {
+		seconds, err := strconv.ParseInt(strings.TrimPrefix(name, "timebucket:"), 10, 64)
+		if err != nil || seconds < 1 {
+			return "", false
+		}
+		now := time.Now().Unix()
+		return strconv.FormatInt(now-now%seconds, 10), true
+	}
+
+	if strings.HasPrefix(name, "metadata/") {
+		return "", true
+	}
+
+	if strings.HasPrefix(name, "label") {
+		n, err := strconv.Atoi(strings.TrimPrefix(name, "label"))
+		if err != nil || n < 1 {
+			return "", false
+		}
+		if labels := dns.SplitDomainName(p["fqdn"]); n <= len(labels) {
+			return labels[n-1], true
+		}
+		return "", true
+	}
+	return "", false
+}
+
+// expand replaces the placeholders in s with their values encoded by escape. Unknown placeholders are kept as they
+// are.
+func (p placeholders) expand(s string, escape func(string) string) string {
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "%(")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(s[start:], ')')
+		if end < 0 {
+			break
+		}
+		end += start
+
+		b.WriteString(s[:start])
+		if value, ok := p.value(s[start+2 : end]); ok {
+			b.WriteString(escape(value))
+		} else {
+			b.WriteString(s[start : end+1])
+		}
+		s = s[end+1:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// expandAll replaces the placeholders in uri and fallbacks without encoding their values.
+func (p placeholders) expandAll(uri string, fallbacks []string) (string, []string) {
+	var expanded []string
+	for _, fallback := range fallbacks {
+		expanded = append(expanded, p.expand(fallback, verbatim))
+	}
+	return p.expand(uri, verbatim), expanded
+}
+
+// expandHeader returns a copy of header with the placeholders in its values replaced.
+func (p placeholders) expandHeader(header http.Header) http.Header {
+	if header == nil {
+		return nil
+	}
+
+	expanded := make(http.Header, len(header))
+	for key, values := range header {
+		expanded[key] = make([]string, len(values))
+		for i, value := range values {
+			expanded[key][i] = p.expand(value, verbatim)
+		}
+	}
+	return expanded
+}
+
+// verbatim is an escape function that leaves values unchanged.
+func verbatim(value string) string {
+	return value
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPlaceholders_Expand(t *testing.T) {
+	values := placeholders{"fqdn": "a b.example.com.", "qtype": "TXT"}
+
+	tests := []struct {
+		template string
+		escape   func(string) string
+		expected string
+	}{
+		{"https://example.com/%(fqdn)/%(qtype)", escapeValue, "https://example.com/a%20b.example.com./TXT"},
+		{"%(fqdn)%(fqdn)", verbatim, "a b.example.com.a b.example.com."},
+		// Unknown and unterminated placeholders are kept.
+		{"/%(unknown)/%(qtype)", escapeValue, "/%(unknown)/TXT"},
+		{"/%(qtype)/%(fqdn", escapeValue, "/TXT/%(fqdn"},
+		{"100%", escapeValue, "100%"},
+		{"/%(label2)/%(label1)", escapeValue, "/example/a%20b"},
+		{"/%(label4)", escapeValue, "/"},
+		{"/%(label0)/%(labelx)", escapeValue, "/%(label0)/%(labelx)"},
+	}
+
+	for i, test := range tests {
+		if expanded := values.expand(test.template, test.escape); expanded != test.expected {
+			t.Errorf("Test %d expected %q, got %q", i, test.expected, expanded)
+		}
+	}
+}
+
+func TestPlaceholders_TimeBucket(t *testing.T) {
+	before := time.Now().Unix()
+	expanded := placeholders{}.expand("/%(timebucket:300)/%(timebucket:0)", verbatim)
+	after := time.Now().Unix()
+
+	// The bucket could have changed in between.
+	expected := []string{
+		fmt.Sprintf("/%d/%%(timebucket:0)", before-before%300),
+		fmt.Sprintf("/%d/%%(timebucket:0)", after-after%300),
+	}
+	if expanded != expected[0] && expanded != expected[1] {
+		t.Errorf("Expected one of %q, got %q", expected, expanded)
+	}
+}
+
+func TestRelativeName(t *testing.T) {
+	tests := []struct {
+		name     string
+		origin   string
+		expected string
+	}{
+		{"foo.example.com.", "example.com.", "foo"},
+		{"a.b.example.com.", "example.com.", "a.b"},
+		{"example.com.", "example.com.", ApexName},
+		{"example.com.", ".", "example.com"},
+		{".", ".", ApexName},
+	}
+
+	for i, test := range tests {
+		if name := relativeName(test.name, test.origin); name != test.expected {
+			t.Errorf("Test %d expected %q, got %q", i, test.expected, name)
+		}
+	}
+}
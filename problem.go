@@ -0,0 +1,93 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProblemContentType is the content type of RFC 7807 problem details, which backends can use on error responses to
+// control the DNS error returned to the client.
+const ProblemContentType = "application/problem+json"
+
+// problemDetails is an RFC 7807 problem with the extension members understood by httprecord.
+type problemDetails struct {
+	Title  string `json:"title,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	// Rcode overrides the rcode derived from the HTTP status code.
+	Rcode string `json:"rcode,omitempty"`
+	// ExtendedError is an RFC 8914 extended DNS error code to attach to the response.
+	ExtendedError *uint16 `json:"extended_error,omitempty"`
+	// RetryAfter is the number of seconds after which the backend should be asked again.
+	RetryAfter uint32 `json:"retry_after,omitempty"`
+}
+
+// isProblem returns whether a response carries problem details.
+func isProblem(hdr http.Header) bool {
+	mediatype, _, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	return err == nil && mediatype == ProblemContentType
+}
+
+// applyProblem updates the error for a non-200 response with the problem details in its body.
+func applyProblem(bie BackendIndicatedError, body []byte) (BackendIndicatedError, error) {
+	var problem problemDetails
+	if err := json.Unmarshal(body, &problem); err != nil {
+		return bie, err
+	}
+
+	if problem.Rcode != "" {
+		rcode, err := parseRcode(problem.Rcode)
+		if err != nil {
+			return bie, err
+		}
+		bie.DNSResponseCode = rcode
+	}
+
+	if problem.ExtendedError != nil {
+		text := problem.Detail
+		if text == "" {
+			text = problem.Title
+		}
+		bie.ExtendedError = &dns.EDNS0_EDE{InfoCode: *problem.ExtendedError, ExtraText: text}
+	}
+
+	if problem.RetryAfter != 0 {
+		bie.RetryAfter = time.Duration(problem.RetryAfter) * time.Second
+	}
+
+	return bie, nil
+}
+
+// retryAfter parses a Retry-After header given either in seconds or as HTTP date.
+func retryAfter(hdr http.Header) time.Duration {
+	value := strings.TrimSpace(hdr.Get("Retry-After"))
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(time.Now()) {
+		return time.Until(date)
+	}
+	return 0
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func init() { RegisterResponseParser("application/x-protobuf", ResponseParserFunc(parseProtobuf)) }
+
+// parseProtobuf parses responses encoded as the Response message of httprecord.proto. The schema is small enough to be
+// decoded by hand, which avoids generated code.
+func parseProtobuf(name string, rtype string, ttl uint32, body []byte) (ParsedResponse, error) {
+	parser, ok := responseToRR[rtype]
+	if !ok {
+		return ParsedResponse{}, fmt.Errorf("unable to find response parser for: %s", rtype)
+	}
+
+	response, err := unmarshalProtoResponse(body)
+	if err != nil {
+		return ParsedResponse{}, err
+	}
+
+	return response.parse(name, ttl, parser)
+}
+
+func unmarshalProtoResponse(b []byte) (jsonResponse, error) {
+	var response jsonResponse
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return response, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ != protowire.BytesType || num < 1 || num > 4 {
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return response, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return response, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if num == 1 {
+			response.Rcode = string(v)
+			continue
+		}
+
+		record, err := unmarshalProtoRecord(v)
+		if err != nil {
+			return response, err
+		}
+		switch num {
+		case 2:
+			response.Answer = append(response.Answer, record)
+		case 3:
+			response.Authority = append(response.Authority, record)
+		case 4:
+			response.Additional = append(response.Additional, record)
+		}
+	}
+
+	return response, nil
+}
+
+func unmarshalProtoRecord(b []byte) (jsonRecord, error) {
+	var record jsonRecord
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return record, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return record, protowire.ParseError(n)
+			}
+			record.RecordTTL = uint32(v)
+			b = b[n:]
+		case num >= 1 && num <= 4 && num != 3 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return record, protowire.ParseError(n)
+			}
+			switch num {
+			case 1:
+				record.Name = v
+			case 2:
+				record.RecordType = v
+			case 4:
+				record.Data = v
+			}
+			b = b[n:]
+		default:
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return record, protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+
+	return record, nil
+}
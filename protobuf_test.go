@@ -0,0 +1,80 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/encoding/protowire"
+	"testing"
+)
+
+func appendProtoRecord(b []byte, field protowire.Number, name, rtype string, ttl uint32, data string) []byte {
+	var record []byte
+	if name != "" {
+		record = protowire.AppendTag(record, 1, protowire.BytesType)
+		record = protowire.AppendString(record, name)
+	}
+	if rtype != "" {
+		record = protowire.AppendTag(record, 2, protowire.BytesType)
+		record = protowire.AppendString(record, rtype)
+	}
+	if ttl != 0 {
+		record = protowire.AppendTag(record, 3, protowire.VarintType)
+		record = protowire.AppendVarint(record, uint64(ttl))
+	}
+	record = protowire.AppendTag(record, 4, protowire.BytesType)
+	record = protowire.AppendString(record, data)
+
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendBytes(b, record)
+}
+
+func TestParseProtobuf(t *testing.T) {
+	var body []byte
+	body = appendProtoRecord(body, 2, "", "A", 60, "1.2.3.4")
+	body = appendProtoRecord(body, 2, "", "", 0, "::1")
+	body = appendProtoRecord(body, 3, "example.com.", "NS", 0, "ns.example.com.")
+	body = appendProtoRecord(body, 4, "ns.example.com.", "A", 0, "1.2.3.5")
+	// Unknown fields are skipped.
+	body = protowire.AppendTag(body, 15, protowire.VarintType)
+	body = protowire.AppendVarint(body, 42)
+
+	parsed, err := responseParserFor("application/x-protobuf").Parse("foo.example.com.", "A", 3600, body)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	err = test.SortAndCheck(&dns.Msg{Answer: parsed.Answer, Ns: parsed.Ns, Extra: parsed.Extra}, test.Case{
+		Answer: []dns.RR{test.A("foo.example.com. 60	IN	A 1.2.3.4")},
+		Ns:     []dns.RR{test.NS("example.com. 3600	IN	NS ns.example.com.")},
+		Extra:  []dns.RR{test.A("ns.example.com. 3600	IN	A 1.2.3.5")},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	var rcode []byte
+	rcode = protowire.AppendTag(rcode, 1, protowire.BytesType)
+	rcode = protowire.AppendString(rcode, "NXDOMAIN")
+	_, err = parseProtobuf("foo.example.com.", "A", 3600, rcode)
+	if bie, ok := err.(BackendIndicatedError); !ok || bie.DNSResponseCode != dns.RcodeNameError {
+		t.Errorf("Expected NXDOMAIN, got %v", err)
+	}
+
+	if _, err := parseProtobuf("foo.example.com.", "A", 3600, []byte{0x12, 0xff}); err == nil {
+		t.Error("Expected an error for a truncated message")
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"encoding/json"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// fetchStats records the requests to backends for a lookup.
+type fetchStats struct {
+	mu sync.Mutex
+	// uri and status describe the last request, where status is 0 if it failed without a response.
+	uri      string
+	status   int
+	requests int
+	// duration is the time spent waiting for all requests.
+	duration time.Duration
+}
+
+// record adds the request to uri, which was answered with response after duration.
+func (s *fetchStats) record(uri string, response *http.Response, duration time.Duration) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uri, s.status = uri, 0
+	if response != nil {
+		s.status = response.StatusCode
+	}
+	s.requests++
+	s.duration += duration
+}
+
+// queryLogEntry is the line logged for a lookup.
+type queryLogEntry struct {
+	Name  string `json:"qname"`
+	Type  string `json:"qtype"`
+	Rcode string `json:"rcode"`
+	// Cache is how the lookup was answered from the caches, i.e. hit, stale or miss, if caching is enabled.
+	Cache    string  `json:"cache,omitempty"`
+	Backend  string  `json:"backend,omitempty"`
+	Status   int     `json:"status,omitempty"`
+	Requests int     `json:"requests"`
+	FetchMS  float64 `json:"fetch_ms"`
+	TotalMS  float64 `json:"total_ms"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// logsQuery returns whether a line is logged for a lookup, sampling QueryLog of them.
+func (h HTTPRecord) logsQuery() bool {
+	return h.QueryLog >= 1 || (h.QueryLog > 0 && rand.Float64() < h.QueryLog)
+}
+
+// logQuery logs the lookup for state, which was answered with rcode after duration.
+func logQuery(state request.Request, reqs []backendRequest, stats *fetchStats, duration time.Duration, rcode int,
+	err error) {
+	stats.mu.Lock()
+	entry := queryLogEntry{
+		Name:     state.Name(),
+		Type:     state.Type(),
+		Rcode:    dns.RcodeToString[rcode],
+		Backend:  stats.uri,
+		Status:   stats.status,
+		Requests: stats.requests,
+		FetchMS:  milliseconds(stats.duration),
+		TotalMS:  milliseconds(duration),
+	}
+	stats.mu.Unlock()
+	if len(reqs) > 0 {
+		entry.Cache = reqs[0].CacheResult
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	log.Infof("Query %s", line)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
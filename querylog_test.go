@@ -0,0 +1,72 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	golog "log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPRecord_QueryLog(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(500)
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	defer golog.SetOutput(os.Stderr)
+
+	config := HTTPRecord{
+		Zones:    []Zone{{URI: server.URL + "/%(fqdn)", Origin: "example.com."}},
+		Timeout:  time.Second,
+		QueryLog: 1,
+	}
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	msg := new(dns.Msg)
+	msg.SetQuestion("foo.example.com.", dns.TypeA)
+	config.ServeDNS(context.TODO(), rec, msg)
+
+	line := buf.String()
+	start := strings.Index(line, "Query {")
+	if start < 0 {
+		t.Fatalf("Expected query log line, got %q", line)
+	}
+	line = strings.SplitN(line[start+len("Query "):], "\n", 2)[0]
+	var entry queryLogEntry
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatalf("Unable to parse query log line %q: %v", line, err)
+	}
+	if entry.Name != "foo.example.com." || entry.Type != "A" || entry.Rcode != "SERVFAIL" {
+		t.Errorf("Expected SERVFAIL for foo.example.com. A, got %+v", entry)
+	}
+	if entry.Backend != server.URL+"/foo.example.com." || entry.Status != 500 || entry.Requests != 1 {
+		t.Errorf("Expected 1 request to %s answered with 500, got %+v", server.URL+"/foo.example.com.", entry)
+	}
+	if entry.Error == "" || entry.Cache != "" {
+		t.Errorf("Expected error without cache result, got %+v", entry)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket allowing qps requests per second on average and up to burst at once.
+type rateLimiter struct {
+	qps   float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(qps float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{qps: qps, burst: float64(burst), tokens: float64(burst)}
+}
+
+// allow takes a token at now and returns whether there was one.
+func (l *rateLimiter) allow(now time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.last.IsZero() && now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.qps
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
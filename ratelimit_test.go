@@ -0,0 +1,55 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 3)
+	now := time.Now()
+
+	tests := []struct {
+		elapsed time.Duration
+		allowed bool
+	}{
+		// The burst is available right away.
+		{0, true},
+		{0, true},
+		{0, true},
+		{0, false},
+		{100 * time.Millisecond, false},
+		{500 * time.Millisecond, true},
+		{500 * time.Millisecond, false},
+		// The bucket does not fill beyond the burst.
+		{time.Hour, true},
+		{time.Hour, true},
+		{time.Hour, true},
+		{time.Hour, false},
+	}
+
+	for i, test := range tests {
+		if allowed := l.allow(now.Add(test.elapsed)); allowed != test.allowed {
+			t.Errorf("Test %d expected allowed: %v, got %v", i, test.allowed, allowed)
+		}
+	}
+
+	var unlimited *rateLimiter
+	if !unlimited.allow(now) {
+		t.Errorf("Expected no limit without limiter")
+	}
+}
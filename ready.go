@@ -0,0 +1,71 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"sync"
+	"time"
+)
+
+// readiness tracks whether the plugin became ready since startup.
+type readiness struct {
+	timeout time.Duration
+
+	mu       sync.Mutex
+	deadline time.Time
+	ready    bool
+}
+
+func newReadiness(timeout time.Duration) *readiness {
+	return &readiness{timeout: timeout}
+}
+
+// Start starts waiting for the backends.
+func (r *readiness) Start() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deadline = time.Now().Add(r.timeout)
+	return nil
+}
+
+// Ready implements ready.Readiness of the ready plugin. The plugin is ready once every backend with a health check
+// was probed and at least one of its URIs was up, or ReadyTimeout after startup, if it is set. Backends without health
+// checks are not waited for.
+func (h HTTPRecord) Ready() bool {
+	if h.readiness == nil {
+		return true
+	}
+	return h.readiness.check(h.backends())
+}
+
+// check returns whether the plugin is ready with backends. Once it is, it stays ready.
+func (r *readiness) check(backends []*Backend) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ready {
+		return true
+	}
+
+	r.ready = true
+	for _, backend := range backends {
+		if backend.health != nil && !backend.health.probedUp() {
+			r.ready = false
+		}
+	}
+	if r.timeout > 0 && !r.deadline.IsZero() && !time.Now().Before(r.deadline) {
+		r.ready = true
+	}
+	return r.ready
+}
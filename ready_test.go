@@ -0,0 +1,72 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHTTPRecord_Ready(t *testing.T) {
+	newBackend := func(down ...bool) *Backend {
+		backend := &Backend{HealthCheck: &HealthCheck{Interval: time.Second}}
+		backend.health = newHealthChecker(backend, map[string]string{"https://a/": "https://a/", "https://b/": "https://b/"})
+		uris := []string{"https://a/", "https://b/"}
+		for i, d := range down {
+			backend.health.down[uris[i]] = d
+		}
+		return backend
+	}
+
+	tests := []struct {
+		backend  *Backend
+		timeout  time.Duration
+		expected bool
+	}{
+		{&Backend{}, 0, true},
+		{newBackend(), 0, false},
+		{newBackend(false), 0, false},
+		{newBackend(true, true), 0, false},
+		{newBackend(true, false), 0, true},
+		{newBackend(), time.Nanosecond, true},
+		{newBackend(), time.Hour, false},
+	}
+
+	for i, test := range tests {
+		h := HTTPRecord{
+			Zones:     []Zone{{Origin: "example.com.", URI: "https://a/", Backend: test.backend}},
+			readiness: newReadiness(test.timeout),
+		}
+		h.readiness.Start()
+		time.Sleep(time.Millisecond)
+		if ready := h.Ready(); ready != test.expected {
+			t.Errorf("Test %d expected ready: %v, got %v", i, test.expected, ready)
+		}
+	}
+
+	// Once ready, the plugin stays ready.
+	backend := newBackend(false, false)
+	h := HTTPRecord{
+		Zones:     []Zone{{Origin: "example.com.", URI: "https://a/", Backend: backend}},
+		readiness: newReadiness(0),
+	}
+	if !h.Ready() {
+		t.Fatal("Expected to be ready")
+	}
+	backend.health.down["https://a/"], backend.health.down["https://b/"] = true, true
+	if !h.Ready() {
+		t.Error("Expected to stay ready")
+	}
+}
@@ -15,48 +15,178 @@
 package httprecord
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
 	"github.com/miekg/dns"
+	"io"
+	"mime"
 	"net"
+	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 )
 
+// ResponseParser converts the body of a backend response into resource records answering a query for name and rtype.
+// ttl is the TTL derived from the HTTP response and acts as an upper bound for the TTLs of the returned records.
+// Parse must not modify body as it may be cached and parsed again later on.
+type ResponseParser interface {
+	Parse(name string, rtype string, ttl uint32, body []byte) (ParsedResponse, error)
+}
+
+// ResponseParserFunc is an adapter to allow the use of ordinary functions as a ResponseParser.
+type ResponseParserFunc func(name string, rtype string, ttl uint32, body []byte) (ParsedResponse, error)
+
+func (f ResponseParserFunc) Parse(name string, rtype string, ttl uint32, body []byte) (ParsedResponse, error) {
+	return f(name, rtype, ttl, body)
+}
+
+// ParsedResponse holds the records extracted from a backend response for the sections of the DNS reply.
+type ParsedResponse struct {
+	Answer []dns.RR
+	Ns     []dns.RR
+	Extra  []dns.RR
+	// Errors describes records of the response that could not be parsed and were skipped. Unless the plugin is
+	// configured to be strict, the remaining records are served regardless.
+	Errors []error
+	// Weights, if set, are the weights the backend assigned to address records in Answer, keyed by their data in zone
+	// file syntax, e.g. 192.0.2.1. Address records without weight have DefaultWeight.
+	Weights map[string]uint32
+}
+
+// DefaultContentType is the content type assumed for responses that do not specify one or specify one without a
+// registered parser.
+const DefaultContentType = "text/plain"
+
+var (
+	responseParsersMu sync.RWMutex
+	responseParsers   = map[string]ResponseParser{
+		"text/plain":              ResponseParserFunc(parseText),
+		"text/csv":                ResponseParserFunc(parseCSV),
+		"application/json":        ResponseParserFunc(parseJSON),
+		"application/dns-message": ResponseParserFunc(parseDNSMessage),
+	}
+)
+
+// RegisterResponseParser registers parser for backend responses with the given content type, replacing any parser
+// previously registered for it. It is meant to be called from init functions of packages extending httprecord.
+func RegisterResponseParser(contentType string, parser ResponseParser) {
+	responseParsersMu.Lock()
+	defer responseParsersMu.Unlock()
+
+	responseParsers[strings.ToLower(contentType)] = parser
+}
+
+// registeredContentTypes returns the content types a parser is registered for, ordered such that the
+// DefaultContentType comes last.
+func registeredContentTypes() []string {
+	responseParsersMu.RLock()
+	defer responseParsersMu.RUnlock()
+
+	var types []string
+	for contentType := range responseParsers {
+		if contentType != DefaultContentType {
+			types = append(types, contentType)
+		}
+	}
+	sort.Strings(types)
+
+	return append(types, DefaultContentType)
+}
+
+func hasResponseParser(contentType string) bool {
+	responseParsersMu.RLock()
+	defer responseParsersMu.RUnlock()
+
+	_, ok := responseParsers[strings.ToLower(contentType)]
+	return ok
+}
+
+// responseParserFor returns the parser for a Content-Type header value, falling back to the parser for
+// DefaultContentType.
+func responseParserFor(contentType string) ResponseParser {
+	responseParsersMu.RLock()
+	defer responseParsersMu.RUnlock()
+
+	if mediatype, _, err := mime.ParseMediaType(contentType); err == nil {
+		if parser, ok := responseParsers[mediatype]; ok {
+			return parser
+		}
+	}
+	return responseParsers[DefaultContentType]
+}
+
+// entryParser converts the entries of a response into resource records of one type. Entries that are meant for the
+// type but cannot be converted are skipped and reported in the returned errors.
+type entryParser func(name string, ttl uint32, entries []responseEntry) ([]dns.RR, []error)
+
+// responseEntry is a single record of a backend response before it has been converted into a resource record.
+type responseEntry interface {
+	Type() string
+	TTL() uint32
+	Payload() string
+}
+
+// recordLine is a line of a text response in the format [TYPE [TTL]] DATA. TYPE is a record type in upper case, TTL a
+// decimal number and DATA the rest of the line. TYPE and TTL are only recognized as such if they are followed by DATA,
+// so "TXT 120" is a TXT record with the data "120".
 type recordLine string
 
 func (r recordLine) Type() string {
-	p := strings.Split(string(r), " ")
-	if len(p) >= 2 && isType(p[0]) {
-		return p[0]
-	} else {
-		return ""
-	}
+	rtype, _, _ := r.split()
+	return rtype
 }
 
 func (r recordLine) TTL() uint32 {
-	p := strings.Split(string(r), " ")
-	if len(p) >= 3 && isType(p[0]) {
-		ttl, _ := strconv.Atoi(p[1])
-		return uint32(ttl)
-	} else {
-		return 0
-	}
+	_, ttl, _ := r.split()
+	return ttl
 }
 
 func (r recordLine) Payload() string {
-	p := strings.Split(string(r), " ")
+	_, _, payload := r.split()
+	return payload
+}
 
-	if len(p) > 1 && isType(p[0]) {
-		p = p[1:]
+// WithoutTTL returns the line with what was recognized as TTL being treated as the first field of DATA instead.
+func (r recordLine) WithoutTTL() responseEntry {
+	rtype, _, payload := r.split()
+	if rtype == "" {
+		return r
+	}
+	_, payload = nextField(string(r))
+	return typedEntry{rtype: rtype, payload: payload}
+}
 
-		if len(p) > 1 {
-			_, err := strconv.Atoi(p[0])
-			if err == nil {
-				p = p[1:]
-			}
+func (r recordLine) split() (rtype string, ttl uint32, payload string) {
+	payload = string(r)
+
+	token, rest := nextField(payload)
+	if rest == "" || !isType(token) {
+		return "", 0, payload
+	}
+	rtype, payload = token, rest
+
+	token, rest = nextField(payload)
+	if rest != "" {
+		if n, err := strconv.ParseUint(token, 10, 32); err == nil {
+			ttl, payload = uint32(n), rest
 		}
 	}
 
-	return strings.Join(p, " ")
+	return rtype, ttl, payload
+}
+
+// nextField splits s into its first whitespace separated field and the remainder following the whitespace.
+func nextField(s string) (string, string) {
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimLeft(s[i:], " \t")
 }
 
 func isType(t string) bool {
@@ -64,25 +194,88 @@ func isType(t string) bool {
 	return ok
 }
 
-func parseLines(response string) []recordLine {
-	var result []recordLine
+// ambiguousEntry is implemented by entries for which a TTL might also have been the first field of the data, e.g.
+// the preference of MX 10 mail.example.com.
+type ambiguousEntry interface {
+	responseEntry
+	WithoutTTL() responseEntry
+}
+
+type typedEntry struct {
+	rtype   string
+	ttl     uint32
+	payload string
+}
+
+func (e typedEntry) Type() string {
+	return e.rtype
+}
+
+func (e typedEntry) TTL() uint32 {
+	return e.ttl
+}
+
+func (e typedEntry) Payload() string {
+	return e.payload
+}
+
+// defaultTTLEntry is an entry following a $TTL directive, which sets the TTL for entries without an explicit one.
+type defaultTTLEntry struct {
+	responseEntry
+	ttl uint32
+}
+
+func (e defaultTTLEntry) TTL() uint32 {
+	if ttl := e.responseEntry.TTL(); ttl != 0 {
+		return ttl
+	}
+	return e.ttl
+}
+
+func (e defaultTTLEntry) WithoutTTL() responseEntry {
+	if a, ok := e.responseEntry.(ambiguousEntry); ok {
+		return defaultTTLEntry{a.WithoutTTL(), e.ttl}
+	}
+	return e
+}
+
+// parseLines splits a text response into entries. Empty lines and lines starting with ; or # are ignored and a
+// $TTL directive sets the TTL of the lines following it.
+func parseLines(response string) []responseEntry {
+	var result []responseEntry
+	var defaultTTL uint32
 
 	for _, line := range strings.Split(response, "\n") {
 		line = strings.TrimSpace(line)
-		if line == "" {
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '$' {
+			directive := strings.Fields(line)
+			if len(directive) == 2 && strings.ToUpper(directive[0]) == "$TTL" {
+				if ttl, err := strconv.ParseUint(directive[1], 10, 32); err == nil {
+					defaultTTL = uint32(ttl)
+				}
+			}
 			continue
 		}
 
-		result = append(result, recordLine(line))
+		if defaultTTL != 0 {
+			result = append(result, defaultTTLEntry{recordLine(line), defaultTTL})
+		} else {
+			result = append(result, recordLine(line))
+		}
 	}
 
 	return result
 }
 
-func parseTXT(name string, ttl uint32, response string) ([]dns.RR, error) {
+func parseTXT(name string, ttl uint32, entries []responseEntry) ([]dns.RR, []error) {
 	var rrs []dns.RR
+	var errs []error
 
-	for _, l := range parseLines(response) {
+	for _, l := range entries {
 		t := l.Type()
 		rttl := l.TTL()
 		if rttl == 0 || rttl > ttl {
@@ -90,22 +283,137 @@ func parseTXT(name string, ttl uint32, response string) ([]dns.RR, error) {
 		}
 
 		if t == "" || t == "TXT" {
+			txt, err := txtStrings(l.Payload())
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
 			rr := new(dns.TXT)
 			rr.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeTXT,
 				Class: dns.ClassINET, Ttl: rttl}
-			rr.Txt = []string{l.Payload()}
+			rr.Txt = txt
 
 			rrs = append(rrs, rr)
 		}
 	}
 
-	return rrs, nil
+	return rrs, errs
+}
+
+// maxCharacterString is the maximum length of a single character-string as defined by RFC 1035.
+const maxCharacterString = 255
+
+// txtStrings converts a TXT payload into character-strings. A payload starting with a quote is interpreted as a
+// sequence of character-strings in zone file syntax, e.g. "v=DKIM1; k=rsa; " "p=MIGf...", while any other payload is
+// used verbatim. Strings exceeding 255 bytes are split into several character-strings, which are returned escaped as
+// expected by dns.TXT.
+func txtStrings(payload string) ([]string, error) {
+	strs := []string{payload}
+	if strings.HasPrefix(payload, `"`) {
+		var err error
+		if strs, err = unquoteCharacterStrings(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	var result []string
+	for _, str := range strs {
+		for len(str) > maxCharacterString {
+			result = append(result, escapeCharacterString(str[:maxCharacterString]))
+			str = str[maxCharacterString:]
+		}
+		result = append(result, escapeCharacterString(str))
+	}
+	return result, nil
+}
+
+// escapeCharacterString escapes s the way dns.TXT expects its strings to be escaped.
+func escapeCharacterString(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unquoteCharacterStrings splits s into whitespace separated, optionally quoted character-strings and resolves
+// \X and \DDD escapes.
+func unquoteCharacterStrings(s string) ([]string, error) {
+	var result []string
+
+	for i := 0; i < len(s); {
+		if s[i] == ' ' || s[i] == '\t' {
+			i++
+			continue
+		}
+
+		quoted := s[i] == '"'
+		if quoted {
+			i++
+		}
+
+		var str []byte
+		terminated := !quoted
+	loop:
+		for ; i < len(s); i++ {
+			switch c := s[i]; {
+			case c == '\\':
+				if i+3 < len(s) && isDigits(s[i+1:i+4]) {
+					n, _ := strconv.Atoi(s[i+1 : i+4])
+					if n > 255 {
+						return nil, fmt.Errorf("invalid escape in TXT payload: \\%s", s[i+1:i+4])
+					}
+					str = append(str, byte(n))
+					i += 3
+				} else if i+1 < len(s) {
+					str = append(str, s[i+1])
+					i++
+				} else {
+					return nil, fmt.Errorf("TXT payload ends with an escape: %s", s)
+				}
+			case quoted && c == '"':
+				terminated = true
+				i++
+				break loop
+			case !quoted && (c == ' ' || c == '\t'):
+				break loop
+			default:
+				str = append(str, c)
+			}
+		}
+
+		if !terminated {
+			return nil, fmt.Errorf("unterminated quoted string in TXT payload: %s", s)
+		}
+		result = append(result, string(str))
+	}
+
+	return result, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
 }
 
-func parseA(name string, ttl uint32, response string) ([]dns.RR, error) {
+func parseA(name string, ttl uint32, entries []responseEntry) ([]dns.RR, []error) {
 	var rrs []dns.RR
+	var errs []error
 
-	for _, l := range parseLines(response) {
+	for _, l := range entries {
 		t := l.Type()
 		rttl := l.TTL()
 		if rttl == 0 || rttl > ttl {
@@ -114,8 +422,12 @@ func parseA(name string, ttl uint32, response string) ([]dns.RR, error) {
 
 		if t == "" || t == "A" {
 			ip := net.ParseIP(l.Payload())
-			if t == "" && ip.To4() == nil {
-				// If the record type was unspecified and this is not a v4 address, ignore it.
+			if t == "" && ip != nil && ip.To4() == nil {
+				// If the record type was unspecified and this is a v6 address, ignore it.
+				continue
+			}
+			if ip.To4() == nil {
+				errs = append(errs, fmt.Errorf("invalid IPv4 address: %s", l.Payload()))
 				continue
 			}
 
@@ -128,13 +440,14 @@ func parseA(name string, ttl uint32, response string) ([]dns.RR, error) {
 		}
 	}
 
-	return rrs, nil
+	return rrs, errs
 }
 
-func parseAAAA(name string, ttl uint32, response string) ([]dns.RR, error) {
+func parseAAAA(name string, ttl uint32, entries []responseEntry) ([]dns.RR, []error) {
 	var rrs []dns.RR
+	var errs []error
 
-	for _, l := range parseLines(response) {
+	for _, l := range entries {
 		t := l.Type()
 		rttl := l.TTL()
 		if rttl == 0 || rttl > ttl {
@@ -147,6 +460,10 @@ func parseAAAA(name string, ttl uint32, response string) ([]dns.RR, error) {
 				// If the record type was unspecified and this is a v4 address, ignore it.
 				continue
 			}
+			if ip == nil {
+				errs = append(errs, fmt.Errorf("invalid IPv6 address: %s", l.Payload()))
+				continue
+			}
 
 			rr := new(dns.AAAA)
 			rr.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA,
@@ -157,5 +474,321 @@ func parseAAAA(name string, ttl uint32, response string) ([]dns.RR, error) {
 		}
 	}
 
-	return rrs, nil
+	return rrs, errs
+}
+
+// parseGeneric returns a parser for rtype that reads the data of entries in zone file syntax. Untyped entries that are
+// not valid data for rtype are ignored as they are likely meant for other types.
+func parseGeneric(rtype string) entryParser {
+	return func(name string, ttl uint32, entries []responseEntry) ([]dns.RR, []error) {
+		var rrs []dns.RR
+		var errs []error
+
+		for _, l := range entries {
+			t := l.Type()
+			if t != "" && t != rtype {
+				continue
+			}
+
+			rr, err := newGenericRR(name, ttl, rtype, l)
+			if err != nil && l.TTL() != 0 {
+				if a, ok := l.(ambiguousEntry); ok {
+					rr, err = newGenericRR(name, ttl, rtype, a.WithoutTTL())
+				}
+			}
+			if err != nil {
+				if t != "" {
+					errs = append(errs, err)
+				}
+				continue
+			}
+
+			rrs = append(rrs, rr)
+		}
+
+		return rrs, errs
+	}
+}
+
+func newGenericRR(name string, ttl uint32, rtype string, l responseEntry) (dns.RR, error) {
+	rttl := l.TTL()
+	if rttl == 0 || rttl > ttl {
+		rttl = ttl
+	}
+
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, rttl, rtype, l.Payload()))
+	if err != nil || rr == nil {
+		return nil, fmt.Errorf("invalid %s record: %s", rtype, l.Payload())
+	}
+	return rr, nil
+}
+
+// utf8BOM is the byte order mark some backends prefix text with.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// normalizeText strips a UTF-8 byte order mark, CRLF line endings and surrounding whitespace from a text body, so
+// bodies written on Windows parse the same.
+func normalizeText(body []byte) []byte {
+	body = bytes.TrimPrefix(body, utf8BOM)
+	body = bytes.Replace(body, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.TrimSpace(body)
+}
+
+func parseText(name string, rtype string, ttl uint32, body []byte) (ParsedResponse, error) {
+	parser, ok := responseToRR[rtype]
+	if !ok {
+		return ParsedResponse{}, fmt.Errorf("unable to find response parser for: %s", rtype)
+	}
+
+	entries := weightedEntries(rtype, parseLines(string(normalizeText(body))))
+	rrs, errs := parser(name, ttl, entries)
+	return ParsedResponse{Answer: rrs, Errors: errs, Weights: weights(name, ttl, parser, entries)}, nil
+}
+
+type jsonResponse struct {
+	Rcode      string       `json:"rcode,omitempty"`
+	Answer     []jsonRecord `json:"answer"`
+	Authority  []jsonRecord `json:"authority,omitempty"`
+	Additional []jsonRecord `json:"additional,omitempty"`
+}
+
+type jsonRecord struct {
+	// Name is only used for records of the authority and additional sections. Answers are always for the query name.
+	Name       string `json:"name,omitempty"`
+	RecordType string `json:"type,omitempty"`
+	RecordTTL  uint32 `json:"ttl,omitempty"`
+	Data       string `json:"data"`
+	// RecordWeight is the weight of address records in the answer section.
+	RecordWeight *uint32 `json:"weight,omitempty"`
+}
+
+func (r jsonRecord) Type() string {
+	return strings.ToUpper(r.RecordType)
+}
+
+func (r jsonRecord) TTL() uint32 {
+	return r.RecordTTL
+}
+
+func (r jsonRecord) Payload() string {
+	return r.Data
+}
+
+func (r jsonRecord) Weight() (uint32, bool) {
+	if r.RecordWeight == nil {
+		return 0, false
+	}
+	return *r.RecordWeight, true
+}
+
+// RR converts the record into a resource record in the zone file syntax of its type, defaulting to name as owner.
+func (r jsonRecord) RR(name string, ttl uint32) (dns.RR, error) {
+	if r.Name != "" {
+		name = dns.Fqdn(r.Name)
+	}
+	if r.RecordTTL != 0 && r.RecordTTL < ttl {
+		ttl = r.RecordTTL
+	}
+	return dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, ttl, r.Type(), r.Data))
+}
+
+func parseJSON(name string, rtype string, ttl uint32, body []byte) (ParsedResponse, error) {
+	parser, ok := responseToRR[rtype]
+	if !ok {
+		return ParsedResponse{}, fmt.Errorf("unable to find response parser for: %s", rtype)
+	}
+
+	var response jsonResponse
+	if err := json.Unmarshal(normalizeText(body), &response); err != nil {
+		return ParsedResponse{}, err
+	}
+
+	return response.parse(name, ttl, parser)
+}
+
+// parse converts a structured response into the sections of the reply. It is shared by all formats with the structure
+// of jsonResponse.
+func (response jsonResponse) parse(name string, ttl uint32, parser entryParser) (ParsedResponse, error) {
+	if response.Rcode != "" {
+		rcode, err := parseRcode(response.Rcode)
+		if err != nil {
+			return ParsedResponse{}, err
+		}
+		if rcode != dns.RcodeSuccess {
+			return ParsedResponse{}, BackendIndicatedError{HTTPResponseCode: http.StatusOK, DNSResponseCode: rcode}
+		}
+	}
+
+	entries := make([]responseEntry, len(response.Answer))
+	for i, record := range response.Answer {
+		entries[i] = record
+	}
+
+	var result ParsedResponse
+	var errs []error
+	result.Answer, result.Errors = parser(name, ttl, entries)
+	result.Weights = weights(name, ttl, parser, entries)
+	result.Ns, errs = jsonSection(name, ttl, response.Authority)
+	result.Errors = append(result.Errors, errs...)
+	result.Extra, errs = jsonSection(name, ttl, response.Additional)
+	result.Errors = append(result.Errors, errs...)
+	return result, nil
+}
+
+func jsonSection(name string, ttl uint32, records []jsonRecord) ([]dns.RR, []error) {
+	var rrs []dns.RR
+	var errs []error
+	for _, record := range records {
+		rr, err := record.RR(name, ttl)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, errs
+}
+
+var csvHeader = []string{"name", "type", "ttl", "value"}
+
+type csvRecord []string
+
+func (r csvRecord) Type() string {
+	return strings.ToUpper(strings.TrimSpace(r[1]))
+}
+
+func (r csvRecord) TTL() uint32 {
+	ttl, _ := r.ttl()
+	return ttl
+}
+
+// ttl returns the TTL of the record, which is 0 if it is empty.
+func (r csvRecord) ttl() (uint32, error) {
+	field := strings.TrimSpace(r[2])
+	if field == "" {
+		return 0, nil
+	}
+	ttl, err := strconv.ParseUint(field, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid TTL: %s", field)
+	}
+	return uint32(ttl), nil
+}
+
+func (r csvRecord) Payload() string {
+	return strings.TrimSpace(r[3])
+}
+
+// parseCSV parses responses with one name,type,ttl,value record per line. As the owner name is part of each record, a
+// single response can describe records for several names and only the records for name are returned.
+func parseCSV(name string, rtype string, ttl uint32, body []byte) (ParsedResponse, error) {
+	parser, ok := responseToRR[rtype]
+	if !ok {
+		return ParsedResponse{}, fmt.Errorf("unable to find response parser for: %s", rtype)
+	}
+
+	reader := csv.NewReader(bytes.NewReader(normalizeText(body)))
+	reader.FieldsPerRecord = len(csvHeader)
+	reader.TrimLeadingSpace = true
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return ParsedResponse{}, err
+	}
+
+	var entries []responseEntry
+	var invalid []error
+	for i, row := range rows {
+		if i == 0 && strings.EqualFold(strings.Join(row, ","), strings.Join(csvHeader, ",")) {
+			continue
+		}
+		if !strings.EqualFold(dns.Fqdn(strings.TrimSpace(row[0])), name) {
+			continue
+		}
+
+		if _, err := csvRecord(row).ttl(); err != nil {
+			invalid = append(invalid, err)
+			continue
+		}
+		entries = append(entries, csvRecord(row))
+	}
+
+	entries = weightedEntries(rtype, entries)
+	rrs, errs := parser(name, ttl, entries)
+	return ParsedResponse{Answer: rrs, Errors: append(invalid, errs...), Weights: weights(name, ttl, parser, entries)},
+		nil
+}
+
+// filterCSV reads a CSV response record by record and returns only the records for name. Responses describing a whole
+// zone are filtered this way while they are received, so only the records for name have to fit into
+// MaxHTTPBodySize.
+func filterCSV(r io.Reader, name string) ([]byte, error) {
+	buffered := bufio.NewReader(r)
+	if bom, err := buffered.Peek(len(utf8BOM)); err == nil && bytes.Equal(bom, utf8BOM) {
+		buffered.Discard(len(utf8BOM))
+	}
+
+	reader := csv.NewReader(buffered)
+	reader.FieldsPerRecord = len(csvHeader)
+	reader.TrimLeadingSpace = true
+	reader.ReuseRecord = true
+
+	var filtered bytes.Buffer
+	writer := csv.NewWriter(&filtered)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(dns.Fqdn(strings.TrimSpace(row[0])), name) {
+			continue
+		}
+
+		writer.Write(row)
+		writer.Flush()
+		if filtered.Len() >= MaxHTTPBodySize {
+			return nil, fmt.Errorf("backend returned records for %s longer than %d bytes", name, MaxHTTPBodySize-1)
+		}
+	}
+	return filtered.Bytes(), writer.Error()
+}
+
+func parseDNSMessage(name string, rtype string, ttl uint32, body []byte) (ParsedResponse, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(body); err != nil {
+		return ParsedResponse{}, err
+	}
+
+	if m.Rcode != dns.RcodeSuccess {
+		return ParsedResponse{}, BackendIndicatedError{HTTPResponseCode: http.StatusOK, DNSResponseCode: m.Rcode}
+	}
+
+	qtype := dns.StringToType[rtype]
+
+	var result ParsedResponse
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == qtype {
+			result.Answer = append(result.Answer, capTTL(rr, ttl))
+		}
+	}
+	for _, rr := range m.Ns {
+		result.Ns = append(result.Ns, capTTL(rr, ttl))
+	}
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			result.Extra = append(result.Extra, capTTL(rr, ttl))
+		}
+	}
+
+	return result, nil
+}
+
+func capTTL(rr dns.RR, ttl uint32) dns.RR {
+	if rr.Header().Ttl == 0 || rr.Header().Ttl > ttl {
+		rr.Header().Ttl = ttl
+	}
+	return rr
 }
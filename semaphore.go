@@ -0,0 +1,66 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errTooManyRequests is returned if a request could not be sent because too many requests were in flight.
+var errTooManyRequests = errors.New("too many requests in flight")
+
+// semaphore limits the number of requests in flight. A nil semaphore does not limit them.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// acquire waits for a free slot for up to timeout, or until ctx is done if timeout is 0.
+func (s semaphore) acquire(ctx context.Context, timeout time.Duration) error {
+	if s == nil {
+		return nil
+	}
+
+	select {
+	case s <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return errTooManyRequests
+	}
+}
+
+// release frees the slot taken by acquire.
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
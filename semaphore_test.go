@@ -0,0 +1,59 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSemaphore(t *testing.T) {
+	ctx := context.Background()
+	s := newSemaphore(2)
+
+	for i := 0; i < 2; i++ {
+		if err := s.acquire(ctx, time.Millisecond); err != nil {
+			t.Fatalf("Expected slot %d to be free, got %v", i, err)
+		}
+	}
+	if err := s.acquire(ctx, time.Millisecond); err != errTooManyRequests {
+		t.Errorf("Expected %v, got %v", errTooManyRequests, err)
+	}
+
+	// Requests wait for others to finish.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.release()
+	}()
+	if err := s.acquire(ctx, time.Second); err != nil {
+		t.Errorf("Expected a slot to be freed, got %v", err)
+	}
+
+	// Without timeout, the context limits waiting.
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	if err := s.acquire(ctx, 0); err != errTooManyRequests {
+		t.Errorf("Expected %v, got %v", errTooManyRequests, err)
+	}
+
+	var unlimited semaphore
+	for i := 0; i < 10; i++ {
+		if err := unlimited.acquire(ctx, 0); err != nil {
+			t.Errorf("Expected no limit without semaphore, got %v", err)
+		}
+	}
+	unlimited.release()
+}
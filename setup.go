@@ -15,25 +15,159 @@
 package httprecord
 
 import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/dnstap"
 	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/coredns/coredns/plugin/pkg/singleflight"
+	ctls "github.com/coredns/coredns/plugin/pkg/tls"
+	"github.com/coredns/coredns/plugin/pkg/upstream"
+	"github.com/coredns/coredns/plugin/transfer"
 	"github.com/miekg/dns"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 func init() { plugin.Register("httprecord", setup) }
 
+// macroName matches the names of macros that can be set.
+var macroName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
 func setup(c *caddy.Controller) error {
 	httprecord, err := parseConfig(c)
 	if err != nil {
 		return plugin.Error("httprecord", err)
 	}
 
-	log.Printf("Parsed config: %v", httprecord)
+	log.Printf("Parsed config: %v", httprecord.redacted())
+
+	httprecord.inFlight = newSemaphore(httprecord.MaxConcurrent)
+	httprecord.flights = new(singleflight.Group)
+	httprecord.origins = serverBlockZones(c)
+	httprecord.index = newLookupIndex(httprecord.Zones, httprecord.Records, httprecord.origins,
+		httprecord.Delegated)
+	if httprecord.Cache != nil && httprecord.CachePerZone {
+		httprecord.zoneCaches = httprecord.newZoneCaches()
+	}
+	if httprecord.Cache != nil {
+		httprecord.cacheMu = new(sync.RWMutex)
+	}
+	carried := false
+	if httprecord.Cache != nil && httprecord.KeepCacheOnReload {
+		key := fmt.Sprintf("%s#%d", strings.Join(c.ServerBlockKeys, " "), c.ServerBlockKeyIndex)
+		carried = httprecord.takeCarriedCaches(key)
+		c.OnRestart(func() error {
+			httprecord.carryCaches(key)
+			return nil
+		})
+		c.OnRestartFailed(func() error {
+			dropCarriedCaches(key)
+			return nil
+		})
+	}
+	serial := uint32(time.Now().Unix())
+	for _, backend := range httprecord.backends() {
+		if backend.SOA != nil && backend.SOA.Serial == 0 {
+			backend.SOA.Serial = serial
+		}
+	}
+	if httprecord.signer, err = newZoneSigner(httprecord.backends()); err != nil {
+		return plugin.Error("httprecord", err)
+	}
+	if httprecord.Upstream {
+		httprecord.upstream = upstream.New()
+	}
+	httprecord.lifecycle = newLifecycle()
+	c.OnShutdown(func() error {
+		httprecord.lifecycle.Stop(DrainTimeout)
+		for _, backend := range httprecord.backends() {
+			backend.transport.CloseIdleConnections()
+		}
+		return nil
+	})
+	if httprecord.Cache != nil && httprecord.SharedCache != "" {
+		if httprecord.shared, err = newSharedStore(httprecord.SharedCache); err != nil {
+			return plugin.Error("httprecord", err)
+		}
+		httprecord.sharedFlights = new(singleflight.Group)
+	}
+	if httprecord.Cache != nil && httprecord.AdminAddress != "" {
+		listenHTTP(c, httprecord.AdminAddress, newAdminServer(httprecord).handler())
+	}
+	if httprecord.Cache != nil && httprecord.InvalidationAddress != "" {
+		listenHTTP(c, httprecord.InvalidationAddress,
+			newInvalidationHandler(httprecord, httprecord.InvalidationSecret))
+	}
+	if httprecord.Cache != nil && httprecord.PersistPath != "" {
+		httprecord.persister = newCachePersister(httprecord)
+		httprecord.persister.carried = carried
+		c.OnStartup(httprecord.persister.Start)
+		c.OnShutdown(httprecord.persister.Stop)
+	}
+	for i, backend := range httprecord.backends() {
+		backend.id = i + 1
+		backend.transport = newTransport(backend)
+		if backend.Policy != "" && backend.Policy != PolicySequential {
+			backend.balancer = newBalancer(backend.Policy)
+		}
+		if backend.MaxQPS > 0 {
+			backend.limiter = newRateLimiter(backend.MaxQPS, backend.Burst)
+		}
+		backend.inFlight = newSemaphore(backend.MaxConcurrent)
+		if backend.HealthCheck != nil {
+			backend.health = newHealthChecker(backend, httprecord.healthCheckProbes(backend))
+			c.OnStartup(backend.health.Start)
+			c.OnShutdown(backend.health.Stop)
+		}
+	}
+
+	if httprecord.HealthAddress != "" {
+		listenHTTP(c, httprecord.HealthAddress, healthHandler{h: httprecord})
+	}
+	httprecord.readiness = newReadiness(httprecord.ReadyTimeout)
+	c.OnStartup(httprecord.readiness.Start)
+	if httprecord.Warmup != "" {
+		// Next is only set once the plugin chain is built.
+		c.OnStartup(func() error {
+			return httprecord.warmupFrom(httprecord.Warmup)
+		})
+	}
+
+	if syncer := newZoneSyncer(httprecord); len(syncer.histories) > 0 {
+		httprecord.syncer = syncer
+		c.OnStartup(func() error {
+			if handler := dnsserver.GetConfig(c).Handler("transfer"); handler != nil {
+				if transferPlugin, ok := handler.(*transfer.Transfer); ok {
+					syncer.notifier = transferPlugin
+				}
+			}
+			return syncer.Start()
+		})
+		c.OnShutdown(syncer.Stop)
+	}
+	httprecord.taps = new(taps)
+	c.OnStartup(func() error {
+		if handler := dnsserver.GetConfig(c).Handler("dnstap"); handler != nil {
+			if tapPlugin, ok := handler.(dnstap.Dnstap); ok {
+				httprecord.taps.tapper, httprecord.taps.raw = tapPlugin, tapPlugin.IncludeRawMessage
+			}
+		}
+		return nil
+	})
 
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		httprecord.Next = next
@@ -43,124 +177,1120 @@ func setup(c *caddy.Controller) error {
 	return nil
 }
 
+// serverBlockZones returns the origins of the zones of the server block being set up.
+func serverBlockZones(c *caddy.Controller) []string {
+	origins := make([]string, len(c.ServerBlockKeys))
+	for i := range origins {
+		origins[i] = plugin.Host(c.ServerBlockKeys[i]).NormalizeExact()[0]
+	}
+	return origins
+}
+
 func parseConfig(c *caddy.Controller) (HTTPRecord, error) {
 	var h = HTTPRecord{}
 
-	serverBlockOrigins := make([]string, len(c.ServerBlockKeys))
-	for i := range serverBlockOrigins {
-		serverBlockOrigins[i] = plugin.Host(c.ServerBlockKeys[i]).NormalizeExact()[0]
-	}
+	serverBlockOrigins := serverBlockZones(c)
 
 	for c.Next() {
 		args := c.RemainingArgs()
+		zonesFrom, recordsFrom := len(h.Zones), len(h.Records)
+		macros := placeholders{}
+		var backend *Backend
+		var err error
 
 		if len(args) == 0 {
 			// Format: httprecord { block }
-			if err := parseConfigBlock(c, &h, serverBlockOrigins, ""); err != nil {
+			if backend, err = parseConfigBlock(c, &h, serverBlockOrigins, nil, macros); err != nil {
 				return h, err
 			}
 		} else {
-			// Format: httprecord [ORIGIN...] [ORIGIN_OR_URI] { block }
-			uri := ""
+			// Format: httprecord [ORIGIN...] [ORIGIN_OR_URI...] { block }
+			var uris []string
 
-			if strings.ToLower(args[len(args)-1])[:len("http")] == "http" {
-				uri = args[len(args)-1]
+			for len(args) > 0 && isURI(args[len(args)-1]) {
+				uris = append([]string{args[len(args)-1]}, uris...)
 				args = args[:len(args)-1]
 			}
 
 			// The rest of the args now are origins -> normalize them.
 			for i, origin := range args {
-				args[i] = plugin.Name(origin).Normalize()
+				normalized, err := toASCII(plugin.Name(origin).Normalize())
+				if err != nil {
+					return h, c.Errf("invalid origin %s: %v", origin, err)
+				}
+				args[i] = normalized
 			}
 
-			if uri != "" {
+			if len(uris) > 0 {
 				for _, origin := range args {
 					h.Zones = append(h.Zones, Zone{
-						Origin: origin,
-						URI:    uri,
+						Origin:    origin,
+						URI:       uris[0],
+						Fallbacks: fallbacks(uris),
 					})
 				}
 			}
 
 			if len(args) == 0 {
-				if err := parseConfigBlock(c, &h, serverBlockOrigins, uri); err != nil {
+				if backend, err = parseConfigBlock(c, &h, serverBlockOrigins, uris, macros); err != nil {
 					return h, err
 				}
 			} else {
-				if err := parseConfigBlock(c, &h, args, uri); err != nil {
+				if backend, err = parseConfigBlock(c, &h, args, uris, macros); err != nil {
 					return h, err
 				}
 			}
 		}
+
+		// Macros apply to everything configured by the directive, regardless of where they are set in the block.
+		if len(macros) > 0 {
+			for i := zonesFrom; i < len(h.Zones); i++ {
+				h.Zones[i].URI, h.Zones[i].Fallbacks = macros.expandAll(h.Zones[i].URI, h.Zones[i].Fallbacks)
+			}
+			for i := recordsFrom; i < len(h.Records); i++ {
+				h.Records[i].URI, h.Records[i].Fallbacks = macros.expandAll(h.Records[i].URI, h.Records[i].Fallbacks)
+			}
+			if backend != nil {
+				for protocol, uris := range backend.ProtocolURIs {
+					uri, fallbacks := macros.expandAll(uris[0], uris[1:])
+					backend.ProtocolURIs[protocol] = append([]string{uri}, fallbacks...)
+				}
+				backend.Header = macros.expandHeader(backend.Header)
+				backend.Body = macros.expand(backend.Body, verbatim)
+				backend.ExportURI = macros.expand(backend.ExportURI, verbatim)
+			}
+		}
+
+		if backend != nil && backend.DNSSECKeys != nil && backend.SOA == nil {
+			return HTTPRecord{}, c.Err("dnssec requires soa")
+		}
+		if backend != nil && backend.BlackLies && backend.DNSSECKeys == nil {
+			return HTTPRecord{}, c.Err("black_lies requires dnssec")
+		}
+
+		// Backend settings apply to everything configured by the directive, regardless of their order in the block.
+		if backend != nil {
+			for i := zonesFrom; i < len(h.Zones); i++ {
+				h.Zones[i].Backend = backend
+			}
+			for i := recordsFrom; i < len(h.Records); i++ {
+				h.Records[i].Backend = backend
+			}
+		}
+	}
+
+	if h.ReturnCachedOnError || h.CacheResponses || h.NegativeTTL > 0 {
+		h.Cache = cache.New(h.cacheSize())
+	}
+	if h.Warmup != "" && h.Cache == nil {
+		return HTTPRecord{}, c.Err("warmup requires cache, negative_ttl or onerror cached")
+	}
+	if h.KeepCacheOnReload && h.Cache == nil {
+		return HTTPRecord{}, c.Err("keep_cache_on_reload requires cache, negative_ttl or onerror cached")
+	}
+	if h.InvalidationAddress != "" && h.Cache == nil {
+		return HTTPRecord{}, c.Err("invalidation_listen requires cache, negative_ttl or onerror cached")
+	}
+	if h.AdminAddress != "" && h.Cache == nil {
+		return HTTPRecord{}, c.Err("admin requires cache, negative_ttl or onerror cached")
+	}
+	if h.SharedCache != "" && h.Cache == nil {
+		return HTTPRecord{}, c.Err("shared_cache requires cache, negative_ttl or onerror cached")
+	}
+	if h.PersistPath != "" && h.Cache == nil {
+		return HTTPRecord{}, c.Err("persist requires cache, negative_ttl or onerror cached")
 	}
 
 	return h, nil
 }
 
-func parseConfigBlock(c *caddy.Controller, h *HTTPRecord, origins []string, blockuri string) error {
+// isURI returns whether the argument of a directive is a URI rather than an origin. URIs can start with a macro.
+func isURI(arg string) bool {
+	return strings.HasPrefix(strings.ToLower(arg), "http") || strings.HasPrefix(arg, "%(")
+}
+
+// parseConfigBlock parses the block of a directive into h. Settings for the backend of the directive are returned
+// separately and nil if there were none. Macros set in the block are added to macros.
+func parseConfigBlock(c *caddy.Controller, h *HTTPRecord, origins []string, blockuris []string,
+	macros placeholders) (*Backend, error) {
+	var backend *Backend
+	getBackend := func() *Backend {
+		if backend == nil {
+			backend = &Backend{}
+		}
+		return backend
+	}
+
 	for c.NextBlock() {
 		switch c.Val() {
 		case "onerror":
 			args := c.RemainingArgs()
 
+			if len(args) == 2 || len(args) == 3 {
+				if !validErrorCondition(args[0]) {
+					return nil, c.Errf("invalid onerror condition: %s", args[0])
+				}
+				rcode, err := parseRcode(args[1])
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				mapped := ErrorRcode{Condition: args[0], Rcode: rcode}
+				if len(args) == 3 {
+					code, err := strconv.ParseUint(args[2], 10, 16)
+					if err != nil {
+						return nil, c.Errf("invalid onerror extended error: %s", args[2])
+					}
+					ede := uint16(code)
+					mapped.ExtendedError = &ede
+				}
+				h.ErrorRcodes = append(h.ErrorRcodes, mapped)
+				continue
+			}
+
 			if len(args) != 1 || (args[0] != "servfail" && args[0] != "cached") {
-				return c.Err("unknown value for onerror. Expected one of: servfail, cached")
+				return nil, c.Err("unknown value for onerror. Expected one of: servfail, cached")
 			}
 
 			h.ReturnCachedOnError = args[0] == "cached"
-			if h.ReturnCachedOnError {
-				h.Cache = cache.New(100)
+		case "max_stale":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.Err("unknown value for max_stale. Expected a duration")
+			}
+
+			maxStale, err := time.ParseDuration(args[0])
+			if err != nil {
+				return nil, c.Err("unable to parse max_stale: " + err.Error())
+			}
+			if maxStale <= 0 {
+				return nil, c.Err("max_stale must be positive")
+			}
+			h.MaxStale = maxStale
+		case "cache":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+
+			h.CacheResponses = true
+		case "serve_stale":
+			args := c.RemainingArgs()
+
+			if len(args) > 1 {
+				return nil, c.Err("unknown value for serve_stale. Expected a duration")
+			}
+
+			window := DefaultServeStale
+			if len(args) == 1 {
+				var err error
+				if window, err = time.ParseDuration(args[0]); err != nil {
+					return nil, c.Err("unable to parse serve_stale: " + err.Error())
+				}
+				if window <= 0 {
+					return nil, c.Err("serve_stale must be positive")
+				}
+			}
+			h.ServeStale = window
+
+			h.CacheResponses = true
+		case "prefetch":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 && len(args) != 2 {
+				return nil, c.ArgErr()
+			}
+
+			amount, err := strconv.Atoi(args[0])
+			if err != nil || amount < 1 {
+				return nil, c.Errf("invalid prefetch amount: %s", args[0])
+			}
+
+			var window time.Duration
+			if len(args) == 2 {
+				if window, err = time.ParseDuration(args[1]); err != nil {
+					return nil, c.Err("unable to parse prefetch window: " + err.Error())
+				}
+				if window <= 0 {
+					return nil, c.Err("prefetch window must be positive")
+				}
+			}
+
+			h.Prefetch, h.PrefetchWindow = amount, window
+			h.CacheResponses = true
+		case "negative_ttl":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.Err("unknown value for negative_ttl. Expected a duration")
 			}
+
+			ttl, err := time.ParseDuration(args[0])
+			if err != nil {
+				return nil, c.Err("unable to parse negative_ttl: " + err.Error())
+			}
+			if ttl < time.Second {
+				return nil, c.Err("negative_ttl must be at least 1s")
+			}
+
+			h.NegativeTTL = uint32(ttl / time.Second)
+		case "min_ttl":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.Err("unknown value for min_ttl. Expected a duration")
+			}
+
+			ttl, err := time.ParseDuration(args[0])
+			if err != nil {
+				return nil, c.Err("unable to parse min_ttl: " + err.Error())
+			}
+			if ttl < time.Second {
+				return nil, c.Err("min_ttl must be at least 1s")
+			}
+
+			getBackend().MinTTL = uint32(ttl / time.Second)
+		case "persist":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 && len(args) != 2 {
+				return nil, c.ArgErr()
+			}
+
+			var interval time.Duration
+			if len(args) == 2 {
+				var err error
+				if interval, err = time.ParseDuration(args[1]); err != nil {
+					return nil, c.Err("unable to parse persist interval: " + err.Error())
+				}
+				if interval <= 0 {
+					return nil, c.Err("persist interval must be positive")
+				}
+			}
+
+			h.PersistPath, h.PersistInterval = args[0], interval
+		case "admin":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 && len(args) != 2 {
+				return nil, c.ArgErr()
+			}
+			if _, _, err := net.SplitHostPort(args[0]); err != nil {
+				return nil, c.Errf("invalid admin address: %v", err)
+			}
+
+			h.AdminAddress, h.AdminToken = args[0], ""
+			if len(args) == 2 {
+				token, err := loadSecret(args[1])
+				if err != nil {
+					return nil, c.Errf("unable to load admin token: %v", err)
+				}
+				h.AdminToken = token
+			}
+		case "invalidation_listen":
+			args := c.RemainingArgs()
+
+			if len(args) != 2 {
+				return nil, c.ArgErr()
+			}
+			if _, _, err := net.SplitHostPort(args[0]); err != nil {
+				return nil, c.Errf("invalid invalidation_listen address: %v", err)
+			}
+
+			secret, err := loadSecret(args[1])
+			if err != nil {
+				return nil, c.Errf("unable to load invalidation secret: %v", err)
+			}
+			h.InvalidationAddress, h.InvalidationSecret = args[0], secret
+		case "ttl_jitter":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+
+			percent, err := strconv.Atoi(strings.TrimSuffix(args[0], "%"))
+			if err != nil || percent < 1 || percent > 50 {
+				return nil, c.Errf("invalid ttl_jitter: %s. Expected a percentage from 1 to 50", args[0])
+			}
+			h.TTLJitter = percent
+		case "answer_order":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			if args[0] != OrderRotate && args[0] != OrderShuffle {
+				return nil, c.Err("unknown value for answer_order. Expected rotate or shuffle")
+			}
+			h.AnswerOrder = args[0]
+		case "max_answers":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.Err("unknown value for max_answers. Expected a number")
+			}
+
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n <= 0 {
+				return nil, c.Errf("invalid max_answers: %s", args[0])
+			}
+			h.MaxAnswers = n
+		case "health_listen":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			if _, _, err := net.SplitHostPort(args[0]); err != nil {
+				return nil, c.Errf("invalid health_listen address: %v", err)
+			}
+			h.HealthAddress = args[0]
+		case "upstream":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			h.Upstream = true
+		case "delegations":
+			for _, name := range c.RemainingArgs() {
+				normalized, err := toASCII(plugin.Name(name).Normalize())
+				if err != nil {
+					return nil, c.Errf("invalid delegation %s: %v", name, err)
+				}
+				h.Delegated = append(h.Delegated, normalized)
+			}
+			h.Delegations = true
+		case "non_authoritative":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			h.NonAuthoritative = true
+		case "recursion_available":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			h.RecursionAvailable = true
+		case "keep_cache_on_reload":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			h.KeepCacheOnReload = true
+		case "debug_queries":
+			args := c.RemainingArgs()
+
+			if len(args) == 0 {
+				return nil, c.Err("unknown value for debug_queries. Expected networks")
+			}
+			var networks []*net.IPNet
+			for _, arg := range args {
+				allowed := &Allowlist{}
+				if err := allowed.Add(arg); err != nil || len(allowed.Networks) == 0 {
+					return nil, c.Errf("invalid debug_queries network: %s", arg)
+				}
+				networks = append(networks, allowed.Networks...)
+			}
+			h.DebugNetworks = append(h.DebugNetworks, networks...)
+		case "query_log":
+			args := c.RemainingArgs()
+
+			if len(args) > 1 {
+				return nil, c.ArgErr()
+			}
+
+			rate := 1.0
+			if len(args) == 1 {
+				var err error
+				rate, err = strconv.ParseFloat(strings.TrimSuffix(args[0], "%"), 64)
+				if strings.HasSuffix(args[0], "%") {
+					rate /= 100
+				}
+				if err != nil || rate <= 0 || rate > 1 {
+					return nil, c.Errf("invalid query_log rate: %s. Expected a fraction or percentage of queries", args[0])
+				}
+			}
+			h.QueryLog = rate
+		case "ready_timeout":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.Err("unknown value for ready_timeout. Expected a duration")
+			}
+
+			timeout, err := time.ParseDuration(args[0])
+			if err != nil {
+				return nil, c.Err("unable to parse ready_timeout: " + err.Error())
+			}
+			if timeout <= 0 {
+				return nil, c.Err("ready_timeout must be positive")
+			}
+			h.ReadyTimeout = timeout
+		case "warmup":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			h.Warmup = args[0]
+		case "shared_cache":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			if _, err := newSharedStore(args[0]); err != nil {
+				return nil, c.Errf("invalid shared_cache: %v", err)
+			}
+			h.SharedCache = args[0]
+		case "cache_size":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 && (len(args) != 2 || args[1] != "per_zone") {
+				return nil, c.ArgErr()
+			}
+
+			size, err := strconv.Atoi(args[0])
+			if err != nil || size < 1 {
+				return nil, c.Errf("invalid cache_size: %s", args[0])
+			}
+
+			h.CacheSize, h.CachePerZone = size, len(args) == 2
 		case "timeout":
 			args := c.RemainingArgs()
 
 			if len(args) != 1 {
-				return c.Err("unknown value for timeout. Expected a duration")
+				return nil, c.Err("unknown value for timeout. Expected a duration")
 			}
 
 			if timeout, err := time.ParseDuration(args[0]); err != nil {
-				return c.Err("unable to parse timeout: " + err.Error())
+				return nil, c.Err("unable to parse timeout: " + err.Error())
 			} else {
 				h.Timeout = timeout
 			}
+		case "accept":
+			args := c.RemainingArgs()
+
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+
+			for _, contentType := range args {
+				if !hasResponseParser(contentType) {
+					return nil, c.Errf("no response parser for content type: %s", contentType)
+				}
+				h.Accept = append(h.Accept, strings.ToLower(contentType))
+			}
+		case "strict":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+
+			h.Strict = true
+		case "template":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 && len(args) != 2 {
+				return nil, c.ArgErr()
+			}
+
+			re, err := regexp.Compile(args[0])
+			if err != nil {
+				return nil, c.Errf("unable to parse template regexp: %v", err)
+			}
+
+			template := &ResponseTemplate{Regexp: re, Format: "$0"}
+			if len(args) == 2 {
+				template.Format = args[1]
+			}
+			getBackend().Template = template
+		case "header":
+			args := c.RemainingArgs()
+
+			if len(args) != 2 {
+				return nil, c.ArgErr()
+			}
+
+			b := getBackend()
+			if b.Header == nil {
+				b.Header = http.Header{}
+			}
+			b.Header.Add(args[0], args[1])
+		case "auth":
+			args := c.RemainingArgs()
+
+			var authorization string
+			var key *HMACKey
+			switch {
+			case len(args) == 3 && strings.ToLower(args[0]) == "basic":
+				password, err := loadSecret(args[2])
+				if err != nil {
+					return nil, c.Errf("unable to load password: %v", err)
+				}
+				authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(args[1]+":"+password))
+			case len(args) == 2 && strings.ToLower(args[0]) == "bearer":
+				token, err := loadSecret(args[1])
+				if err != nil {
+					return nil, c.Errf("unable to load token: %v", err)
+				}
+				authorization = "Bearer " + token
+			case len(args) == 3 && strings.ToLower(args[0]) == "hmac":
+				secret, err := loadSecret(args[2])
+				if err != nil {
+					return nil, c.Errf("unable to load secret: %v", err)
+				}
+				key = &HMACKey{ID: args[1], Secret: secret}
+			default:
+				return nil, c.Err("unknown value for auth. Expected one of: basic USER PASSWORD, bearer TOKEN, " +
+					"hmac KEY_ID SECRET")
+			}
+
+			b := getBackend()
+			b.HMAC = key
+			if key != nil {
+				b.Header.Del("Authorization")
+				continue
+			}
+			if b.Header == nil {
+				b.Header = http.Header{}
+			}
+			b.Header.Set("Authorization", authorization)
+		case "tls":
+			args := c.RemainingArgs()
+
+			if len(args) > 3 {
+				return nil, c.ArgErr()
+			}
+
+			tlsConfig, err := ctls.NewTLSConfigFromArgs(args...)
+			if err != nil {
+				return nil, c.Errf("unable to load TLS config: %v", err)
+			}
+
+			b := getBackend()
+			if b.TLSConfig != nil {
+				tlsConfig.ServerName = b.TLSConfig.ServerName
+				tlsConfig.InsecureSkipVerify = b.TLSConfig.InsecureSkipVerify
+			}
+			b.TLSConfig = tlsConfig
+		case "tls_servername":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+
+			b := getBackend()
+			if b.TLSConfig == nil {
+				b.TLSConfig = &tls.Config{}
+			}
+			b.TLSConfig.ServerName = args[0]
+		case "tls_insecure_skip_verify":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+
+			log.Printf("[WARNING] TLS certificates of backends will not be verified")
+			b := getBackend()
+			if b.TLSConfig == nil {
+				b.TLSConfig = &tls.Config{}
+			}
+			b.TLSConfig.InsecureSkipVerify = true
+		case "tls_session_cache":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.Err("unknown value for tls_session_cache. Expected a number")
+			}
+
+			size, err := strconv.Atoi(args[0])
+			if err != nil || size <= 0 {
+				return nil, c.Errf("invalid tls_session_cache: %s", args[0])
+			}
+			getBackend().TLSSessionCacheSize = size
+		case "max_idle_conns":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.Err("unknown value for max_idle_conns. Expected a number")
+			}
+
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n <= 0 {
+				return nil, c.Errf("invalid max_idle_conns: %s", args[0])
+			}
+			getBackend().MaxIdleConns = n
+		case "idle_conn_timeout":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.Err("unknown value for idle_conn_timeout. Expected a duration")
+			}
+
+			timeout, err := time.ParseDuration(args[0])
+			if err != nil {
+				return nil, c.Err("unable to parse idle_conn_timeout: " + err.Error())
+			}
+			getBackend().IdleConnTimeout = timeout
+		case "prefer_ip":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.Err("unknown value for prefer_ip. Expected ipv4 or ipv6")
+			}
+
+			switch family := strings.ToLower(args[0]); family {
+			case IPv4, IPv6:
+				getBackend().PreferIP = family
+			default:
+				return nil, c.Errf("unknown address family: %s", args[0])
+			}
+		case "fallback_delay":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.Err("unknown value for fallback_delay. Expected a duration")
+			}
+
+			delay, err := time.ParseDuration(args[0])
+			if err != nil {
+				return nil, c.Err("unable to parse fallback_delay: " + err.Error())
+			}
+			if delay <= 0 {
+				return nil, c.Err("fallback_delay must be positive")
+			}
+			getBackend().FallbackDelay = delay
+		case "source_address":
+			args := c.RemainingArgs()
+
+			if len(args) == 0 {
+				return nil, c.Err("unknown value for source_address. Expected addresses or an interface")
+			}
+
+			var ips []net.IP
+			for _, arg := range args {
+				if ip := net.ParseIP(arg); ip != nil {
+					ips = append(ips, ip)
+					continue
+				}
+				addrs, err := sourceAddresses(arg)
+				if err != nil {
+					return nil, c.Errf("invalid source address: %v", err)
+				}
+				ips = append(ips, addrs...)
+			}
+
+			families := map[bool]bool{}
+			for _, ip := range ips {
+				if families[ip.To4() != nil] {
+					return nil, c.Err("source_address accepts at most one address per address family")
+				}
+				families[ip.To4() != nil] = true
+			}
+			getBackend().SourceAddresses = ips
+		case "proxy":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.Err("unknown value for proxy. Expected a URL")
+			}
+
+			proxy, err := url.Parse(args[0])
+			if err != nil || proxy.Host == "" {
+				return nil, c.Errf("invalid proxy: %s", args[0])
+			}
+			switch proxy.Scheme {
+			case "http", "https", "socks5":
+			default:
+				return nil, c.Errf("unsupported proxy scheme: %s", proxy.Scheme)
+			}
+			getBackend().Proxy = proxy
+		case "http_version":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.Err("unknown value for http_version. Expected 1.1 or 2")
+			}
+
+			switch args[0] {
+			case HTTPVersion1, HTTPVersion2:
+				getBackend().HTTPVersion = args[0]
+			case "3":
+				return nil, c.Err("HTTP/3 is not supported")
+			default:
+				return nil, c.Errf("unknown HTTP version: %s", args[0])
+			}
+		case "method":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 && len(args) != 2 {
+				return nil, c.Err("unknown value for method. Expected a method and an optional body")
+			}
+
+			method := strings.ToUpper(args[0])
+			switch method {
+			case http.MethodGet, http.MethodPost, http.MethodPut:
+			default:
+				return nil, c.Errf("unsupported method: %s", args[0])
+			}
+			getBackend().Method = method
+			if len(args) == 2 {
+				getBackend().Body = args[1]
+			}
+		case "export":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 && len(args) != 2 {
+				return nil, c.ArgErr()
+			}
+			if !isURI(args[0]) {
+				return nil, c.Errf("invalid export URI: %s", args[0])
+			}
+			var interval time.Duration
+			if len(args) == 2 {
+				var err error
+				if interval, err = time.ParseDuration(args[1]); err != nil {
+					return nil, c.Err("unable to parse export interval: " + err.Error())
+				}
+				if interval < time.Second {
+					return nil, c.Err("export interval must be at least 1s")
+				}
+			}
+			getBackend().ExportURI, getBackend().ExportInterval = args[0], interval
+		case "soa":
+			args := c.RemainingArgs()
+
+			if len(args) != 2 && len(args) != 3 && len(args) != 6 && len(args) != 7 {
+				return nil, c.ArgErr()
+			}
+			soa := &SOAParameters{
+				Ns:      args[0],
+				Mbox:    args[1],
+				Refresh: uint32(DefaultSOARefresh / time.Second),
+				Retry:   uint32(DefaultSOARetry / time.Second),
+				Expire:  uint32(DefaultSOAExpire / time.Second),
+				MinTTL:  uint32(DefaultSOAMinTTL / time.Second),
+			}
+			if _, ok := dns.IsDomainName(soa.Ns); !ok {
+				return nil, c.Errf("invalid SOA name server: %s", soa.Ns)
+			}
+			if _, ok := dns.IsDomainName(soa.Mbox); !ok {
+				return nil, c.Errf("invalid SOA mailbox: %s", soa.Mbox)
+			}
+			timers := args[2:]
+			if len(timers)%2 == 1 {
+				serial, err := strconv.ParseUint(timers[0], 10, 32)
+				if err != nil {
+					return nil, c.Err("unable to parse SOA serial: " + err.Error())
+				}
+				soa.Serial = uint32(serial)
+				timers = timers[1:]
+			}
+			if len(timers) == 4 {
+				for i, timer := range []*uint32{&soa.Refresh, &soa.Retry, &soa.Expire, &soa.MinTTL} {
+					d, err := time.ParseDuration(timers[i])
+					if err != nil {
+						return nil, c.Err("unable to parse SOA timer: " + err.Error())
+					}
+					if d < time.Second {
+						return nil, c.Errf("invalid SOA timer: %s", timers[i])
+					}
+					*timer = uint32(d / time.Second)
+				}
+			}
+			getBackend().SOA = soa
+		case "allowed_backends":
+			args := c.RemainingArgs()
+
+			if len(args) == 0 {
+				return nil, c.Err("unknown value for allowed_backends. Expected hosts or networks")
+			}
+
+			backend := getBackend()
+			if backend.Allowlist == nil {
+				backend.Allowlist = &Allowlist{}
+			}
+			for _, arg := range args {
+				if err := backend.Allowlist.Add(arg); err != nil {
+					return nil, c.Err(err.Error())
+				}
+			}
+		case "request_id_header":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.Err("unknown value for request_id_header. Expected a header name or off")
+			}
+			header := args[0]
+			if header != "off" {
+				header = http.CanonicalHeaderKey(header)
+			}
+			getBackend().RequestIDHeader = header
+		case "health_check":
+			args := c.RemainingArgs()
+
+			if len(args) < 1 || len(args) > 3 {
+				return nil, c.Err("unknown value for health_check. Expected an interval, an optional method and URI")
+			}
+
+			interval, err := time.ParseDuration(args[0])
+			if err != nil || interval <= 0 {
+				return nil, c.Errf("invalid health check interval: %s", args[0])
+			}
+			check := &HealthCheck{Interval: interval}
+			for _, arg := range args[1:] {
+				switch method := strings.ToUpper(arg); {
+				case method == http.MethodHead || method == http.MethodGet:
+					check.Method = method
+				case check.URI == "":
+					check.URI = arg
+				default:
+					return nil, c.Errf("unknown health check method or URI: %s", arg)
+				}
+			}
+			getBackend().HealthCheck = check
+		case "policy":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 {
+				return nil, c.Err("unknown value for policy. Expected a policy")
+			}
+
+			switch args[0] {
+			case PolicySequential, PolicyRoundRobin, PolicyLeastFailed, PolicyLeastRequests:
+				getBackend().Policy = args[0]
+			default:
+				return nil, c.Errf("unknown policy: %s", args[0])
+			}
+		case "max_qps":
+			args := c.RemainingArgs()
+
+			if len(args) < 1 || len(args) > 3 {
+				return nil, c.Err("unknown value for max_qps. Expected a rate, an optional burst and rcode")
+			}
+
+			qps, err := strconv.ParseFloat(args[0], 64)
+			if err != nil || qps <= 0 {
+				return nil, c.Errf("invalid max_qps: %s", args[0])
+			}
+			backend := getBackend()
+			backend.MaxQPS, backend.Burst, backend.RateLimitRcode = qps, int(math.Ceil(qps)), dns.RcodeServerFailure
+
+			for _, arg := range args[1:] {
+				if burst, err := strconv.Atoi(arg); err == nil && burst > 0 {
+					backend.Burst = burst
+					continue
+				}
+				switch rcode := dns.StringToRcode[strings.ToUpper(arg)]; rcode {
+				case dns.RcodeServerFailure, dns.RcodeRefused:
+					backend.RateLimitRcode = rcode
+				default:
+					return nil, c.Errf("invalid burst or rcode: %s", arg)
+				}
+			}
+		case "max_concurrent", "max_concurrent_backend":
+			directive, args := c.Val(), c.RemainingArgs()
+
+			if len(args) != 1 && len(args) != 2 {
+				return nil, c.Errf("unknown value for %s. Expected a number and an optional duration", directive)
+			}
+
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n <= 0 {
+				return nil, c.Errf("invalid %s: %s", directive, args[0])
+			}
+			var timeout time.Duration
+			if len(args) == 2 {
+				if timeout, err = time.ParseDuration(args[1]); err != nil || timeout <= 0 {
+					return nil, c.Errf("invalid queue timeout: %s", args[1])
+				}
+			}
+
+			if directive == "max_concurrent" {
+				h.MaxConcurrent, h.QueueTimeout = n, timeout
+			} else {
+				getBackend().MaxConcurrent, getBackend().QueueTimeout = n, timeout
+			}
+		case "protocol_uri":
+			args := c.RemainingArgs()
+
+			if len(args) < 2 {
+				return nil, c.Err("unknown value for protocol_uri. Expected a protocol and URIs")
+			}
+
+			switch protocol := strings.ToLower(args[0]); protocol {
+			case "udp", "tcp", "tls", "https":
+				b := getBackend()
+				if b.ProtocolURIs == nil {
+					b.ProtocolURIs = make(map[string][]string)
+				}
+				b.ProtocolURIs[protocol] = args[1:]
+			default:
+				return nil, c.Errf("unknown protocol: %s", args[0])
+			}
+		case "raw_placeholders":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			getBackend().RawPlaceholders = true
+		case "doh":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			getBackend().DoH = true
+		case "dnssec":
+			args := c.RemainingArgs()
+
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			getBackend().DNSSECKeys = append(getBackend().DNSSECKeys, args...)
+		case "black_lies":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			getBackend().BlackLies = true
+		case "ecs":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			getBackend().ECS = true
+		case "flatten":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			getBackend().Flatten = true
+		case "clients":
+			args := c.RemainingArgs()
+
+			if len(args) == 0 {
+				return nil, c.Err("unknown value for clients. Expected networks")
+			}
+			backend := getBackend()
+			for _, arg := range args {
+				allowed := &Allowlist{}
+				if err := allowed.Add(arg); err != nil || len(allowed.Networks) == 0 {
+					return nil, c.Errf("invalid clients network: %s", arg)
+				}
+				backend.Clients = append(backend.Clients, allowed.Networks...)
+			}
+		case "nxdomain":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			getBackend().NXDOMAIN = true
+		case "retries":
+			args := c.RemainingArgs()
+
+			if len(args) != 1 && len(args) != 2 {
+				return nil, c.Err("unknown value for retries. Expected a number and an optional duration")
+			}
+
+			retries, err := strconv.Atoi(args[0])
+			if err != nil || retries < 0 {
+				return nil, c.Errf("invalid number of retries: %s", args[0])
+			}
+			h.Retries = retries
+
+			if len(args) == 2 {
+				if h.RetryBackoff, err = time.ParseDuration(args[1]); err != nil || h.RetryBackoff <= 0 {
+					return nil, c.Errf("invalid retry backoff: %s", args[1])
+				}
+			}
 		case "fallthrough":
 			h.Fall.SetZonesFromArgs(c.RemainingArgs())
+		case "set":
+			args := c.RemainingArgs()
+
+			if len(args) != 2 {
+				return nil, c.Err("unknown value for set. Expected a name and a value")
+			}
+			if !macroName.MatchString(args[0]) {
+				return nil, c.Errf("invalid macro name: %s", args[0])
+			}
+			if isLookupPlaceholder(args[0]) {
+				return nil, c.Errf("%s is a placeholder and cannot be set", args[0])
+			}
+			// Macros can refer to the macros set before them.
+			macros[args[0]] = macros.expand(args[1], verbatim)
 		default:
 			rtype := strings.ToUpper(c.Val())
 			args := c.RemainingArgs()
 
 			if !isType(rtype) {
-				return c.Errf("unknown record type: %s", rtype)
+				return nil, c.Errf("unknown record type: %s", rtype)
 			}
 
-			if len(args) == 2 || (len(args) == 1 && blockuri != "") {
-				name := strings.ToLower(args[0])
+			if len(args) >= 2 || (len(args) == 1 && len(blockuris) > 0) {
+				name, err := toASCII(strings.ToLower(args[0]))
+				if err != nil {
+					return nil, c.Errf("invalid name %s: %v", args[0], err)
+				}
 
-				uri := blockuri
-				if len(args) == 2 {
-					uri = args[1]
+				uris := blockuris
+				if len(args) >= 2 {
+					uris = args[1:]
 				}
 
 				if dns.IsFqdn(name) {
 					h.Records = append(h.Records, Record{
-						Type: rtype,
-						Name: name,
-						URI:  uri,
+						Type:      rtype,
+						Name:      name,
+						URI:       uris[0],
+						Fallbacks: fallbacks(uris),
 					})
 				} else {
 					for _, origin := range origins {
 						h.Records = append(h.Records, Record{
-							Type: rtype,
-							Name: name + "." + origin,
-							URI:  uri,
+							Type:      rtype,
+							Name:      name + "." + origin,
+							URI:       uris[0],
+							Fallbacks: fallbacks(uris),
 						})
 					}
 				}
 			} else {
-				return c.ArgErr()
+				return nil, c.ArgErr()
 			}
 		}
 	}
 
-	return nil
+	return backend, nil
+}
+
+// fallbacks returns the URIs following the first one, if any.
+func fallbacks(uris []string) []string {
+	if len(uris) < 2 {
+		return nil
+	}
+	return append([]string(nil), uris[1:]...)
+}
+
+// redacted returns a copy of h to log, with the secrets it holds replaced.
+func (h HTTPRecord) redacted() HTTPRecord {
+	if h.AdminToken != "" {
+		h.AdminToken = "REDACTED"
+	}
+	if h.InvalidationSecret != "" {
+		h.InvalidationSecret = "REDACTED"
+	}
+	return h
+}
+
+// loadSecret resolves a secret given in the config. Secrets of the form env:NAME are read from the environment variable
+// NAME and those of the form file:PATH from the file at PATH. Anything else is used verbatim.
+func loadSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		secret, ok := os.LookupEnv(value[len("env:"):])
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", value[len("env:"):])
+		}
+		return secret, nil
+	case strings.HasPrefix(value, "file:"):
+		secret, err := ioutil.ReadFile(value[len("file:"):])
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(secret)), nil
+	default:
+		return value, nil
+	}
 }
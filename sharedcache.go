@@ -0,0 +1,399 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SharedCacheTimeout limits how long a lookup waits for the shared cache.
+const SharedCacheTimeout = 250 * time.Millisecond
+
+// SharedCacheKeyPrefix is prepended to the keys of responses in the shared cache.
+const SharedCacheKeyPrefix = "httprecord:"
+
+// MaxSharedCacheValueSize limits the size of values read from the shared cache. Responses are limited to
+// MaxHTTPBodySize, so anything much larger was not stored by this plugin.
+const MaxSharedCacheValueSize = 4 * MaxHTTPBodySize
+
+// maxIdleSharedCacheConns limits the connections to the shared cache kept open between lookups.
+const maxIdleSharedCacheConns = 16
+
+// sharedStore is a cache shared by several instances, e.g. Redis or memcached.
+type sharedStore interface {
+	// get returns the value stored for key, or nil if there is none.
+	get(key string) ([]byte, error)
+	// set stores value for key, which expires after ttl.
+	set(key string, value []byte, ttl time.Duration) error
+	// delete removes the value stored for key, if any.
+	delete(key string) error
+}
+
+// newSharedStore returns the shared cache at uri, e.g. redis://:password@redis.internal:6379/2 or
+// memcached://memcached.internal:11211.
+func newSharedStore(uri string) (sharedStore, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in %s", uri)
+	}
+
+	switch u.Scheme {
+	case "redis":
+		db := 0
+		if path := strings.Trim(u.Path, "/"); path != "" {
+			if db, err = strconv.Atoi(path); err != nil || db < 0 {
+				return nil, fmt.Errorf("invalid database in %s", uri)
+			}
+		}
+		store := &redisStore{pool: newConnPool(withDefaultPort(u.Host, "6379")), user: u.User, db: db}
+		store.pool.init = store.init
+		return store, nil
+	case "memcached":
+		return &memcachedStore{pool: newConnPool(withDefaultPort(u.Host, "11211"))}, nil
+	default:
+		return nil, fmt.Errorf("unsupported shared cache %s, expected redis:// or memcached://", uri)
+	}
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// sharedCacheKey returns the key of the response for the lookup with key in the shared cache.
+func sharedCacheKey(key uint64) string {
+	return SharedCacheKeyPrefix + strconv.FormatUint(key, 16)
+}
+
+// fromSharedCache returns the response for the lookup with key from the shared cache if it is fresh at now and can
+// be returned without asking the backend, or nil otherwise.
+func (h HTTPRecord) fromSharedCache(key uint64, now time.Time) *backendResponse {
+	if h.shared == nil {
+		return nil
+	}
+
+	value, err := h.getShared(key)
+	if err != nil {
+		log.Warningf("Unable to get response from shared cache: %v", err)
+		return nil
+	}
+	if value == nil {
+		return nil
+	}
+
+	var response backendResponse
+	if err := json.Unmarshal(value, &response); err != nil {
+		log.Warningf("Unable to parse response from shared cache: %v", err)
+		return nil
+	}
+	if !response.fresh(now) || (response.Error == nil && !response.NoData && !h.CacheResponses) {
+		return nil
+	}
+	response.Hits = new(uint32)
+	return &response
+}
+
+// getShared returns the value for the lookup with key from the shared cache. Concurrent lookups with the same key
+// share a single request, so that a popular response missing from Cache is promoted from the shared cache at once.
+func (h HTTPRecord) getShared(key uint64) ([]byte, error) {
+	if h.sharedFlights == nil {
+		return h.shared.get(sharedCacheKey(key))
+	}
+
+	value, err := h.sharedFlights.Do(key, func() (interface{}, error) {
+		return h.shared.get(sharedCacheKey(key))
+	})
+	return value.([]byte), err
+}
+
+// share stores response for the lookup with key in the shared cache in the background until it expires.
+func (h HTTPRecord) share(key uint64, response backendResponse) {
+	if h.shared == nil || response.TTL == 0 {
+		return
+	}
+
+	value, err := json.Marshal(response)
+	if err != nil {
+		log.Warningf("Unable to store response in shared cache: %v", err)
+		return
+	}
+	go func() {
+		if err := h.shared.set(sharedCacheKey(key), value, time.Duration(response.TTL)*time.Second); err != nil {
+			log.Warningf("Unable to store response in shared cache: %v", err)
+		}
+	}()
+}
+
+// unshare removes the responses for the lookups with keys from the shared cache, so that they are not promoted to
+// Cache again once they were purged from it.
+func (h HTTPRecord) unshare(keys []uint64) {
+	if h.shared == nil {
+		return
+	}
+	for _, key := range keys {
+		if err := h.shared.delete(sharedCacheKey(key)); err != nil {
+			log.Warningf("Unable to remove response from shared cache: %v", err)
+		}
+	}
+}
+
+// sharedConn is a connection to a shared cache.
+type sharedConn struct {
+	net.Conn
+	*bufio.Reader
+}
+
+// connPool keeps connections to a shared cache open between lookups.
+type connPool struct {
+	addr string
+	idle chan *sharedConn
+	// init is run on new connections, e.g. to authenticate.
+	init func(*sharedConn) error
+}
+
+func newConnPool(addr string) *connPool {
+	return &connPool{addr: addr, idle: make(chan *sharedConn, maxIdleSharedCacheConns)}
+}
+
+// do runs f with a connection that is closed if f fails, as it could be left in an unknown state.
+func (p *connPool) do(f func(*sharedConn) error) error {
+	var conn *sharedConn
+	select {
+	case conn = <-p.idle:
+	default:
+		c, err := net.DialTimeout("tcp", p.addr, SharedCacheTimeout)
+		if err != nil {
+			return err
+		}
+		conn = &sharedConn{Conn: c, Reader: bufio.NewReader(c)}
+		if p.init != nil {
+			conn.SetDeadline(time.Now().Add(SharedCacheTimeout))
+			if err := p.init(conn); err != nil {
+				conn.Close()
+				return err
+			}
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(SharedCacheTimeout))
+	if err := f(conn); err != nil {
+		conn.Close()
+		return err
+	}
+
+	select {
+	case p.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return nil
+}
+
+// readLine reads a line terminated by CRLF, which is not returned.
+func (c *sharedConn) readLine() (string, error) {
+	line, err := c.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", errors.New("malformed response line")
+	}
+	return line[:len(line)-2], nil
+}
+
+// readData reads n bytes followed by CRLF.
+func (c *sharedConn) readData(n int) ([]byte, error) {
+	if n < 0 || n > MaxSharedCacheValueSize {
+		return nil, fmt.Errorf("invalid value size %d", n)
+	}
+	data := make([]byte, n+2)
+	if _, err := io.ReadFull(c.Reader, data); err != nil {
+		return nil, err
+	}
+	if string(data[n:]) != "\r\n" {
+		return nil, errors.New("malformed value")
+	}
+	return data[:n], nil
+}
+
+// redisStore is a shared cache in Redis, which is spoken to with RESP.
+type redisStore struct {
+	pool *connPool
+	user *url.Userinfo
+	db   int
+}
+
+func (s *redisStore) get(key string) ([]byte, error) {
+	var value []byte
+	err := s.pool.do(func(conn *sharedConn) error {
+		var err error
+		value, err = redisCommand(conn, "GET", key)
+		return err
+	})
+	return value, err
+}
+
+func (s *redisStore) set(key string, value []byte, ttl time.Duration) error {
+	return s.pool.do(func(conn *sharedConn) error {
+		_, err := redisCommand(conn, "SET", key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+		return err
+	})
+}
+
+func (s *redisStore) delete(key string) error {
+	return s.pool.do(func(conn *sharedConn) error {
+		_, err := redisCommand(conn, "DEL", key)
+		return err
+	})
+}
+
+// init authenticates new connections and selects the database.
+func (s *redisStore) init(conn *sharedConn) error {
+	if password, ok := s.user.Password(); ok {
+		args := []string{"AUTH", password}
+		if user := s.user.Username(); user != "" {
+			args = []string{"AUTH", user, password}
+		}
+		if _, err := redisCommand(conn, args...); err != nil {
+			return err
+		}
+	}
+	if s.db != 0 {
+		if _, err := redisCommand(conn, "SELECT", strconv.Itoa(s.db)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redisCommand sends a command and returns the bulk string it is answered with, or nil for a null, simple or integer
+// reply.
+func redisCommand(conn *sharedConn, args ...string) ([]byte, error) {
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(conn, command); err != nil {
+		return nil, err
+	}
+
+	line, err := conn.readLine()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasPrefix(line, "+"), strings.HasPrefix(line, ":"):
+		return nil, nil
+	case strings.HasPrefix(line, "-"):
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case strings.HasPrefix(line, "$"):
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed reply %q", line)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		return conn.readData(n)
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+// memcachedStore is a shared cache in memcached, which is spoken to with its text protocol.
+type memcachedStore struct {
+	pool *connPool
+}
+
+func (s *memcachedStore) get(key string) ([]byte, error) {
+	var value []byte
+	err := s.pool.do(func(conn *sharedConn) error {
+		if _, err := fmt.Fprintf(conn, "get %s\r\n", key); err != nil {
+			return err
+		}
+		for {
+			line, err := conn.readLine()
+			if err != nil {
+				return err
+			}
+			if line == "END" {
+				return nil
+			}
+
+			// VALUE <key> <flags> <bytes>
+			fields := strings.Fields(line)
+			if len(fields) != 4 || fields[0] != "VALUE" {
+				return fmt.Errorf("memcached: unexpected reply %q", line)
+			}
+			n, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return fmt.Errorf("memcached: malformed reply %q", line)
+			}
+			if value, err = conn.readData(n); err != nil {
+				return err
+			}
+		}
+	})
+	return value, err
+}
+
+func (s *memcachedStore) set(key string, value []byte, ttl time.Duration) error {
+	// Expiration times are given in whole seconds, and 0 would mean never.
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	return s.pool.do(func(conn *sharedConn) error {
+		if _, err := fmt.Fprintf(conn, "set %s 0 %d %d\r\n%s\r\n", key, seconds, len(value), value); err != nil {
+			return err
+		}
+		line, err := conn.readLine()
+		if err != nil {
+			return err
+		}
+		if line != "STORED" {
+			return fmt.Errorf("memcached: %s", line)
+		}
+		return nil
+	})
+}
+
+func (s *memcachedStore) delete(key string) error {
+	return s.pool.do(func(conn *sharedConn) error {
+		if _, err := fmt.Fprintf(conn, "delete %s\r\n", key); err != nil {
+			return err
+		}
+		line, err := conn.readLine()
+		if err != nil {
+			return err
+		}
+		if line != "DELETED" && line != "NOT_FOUND" {
+			return fmt.Errorf("memcached: %s", line)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"github.com/miekg/dns"
+	"time"
+)
+
+// Defaults for the timers of synthesized SOA records.
+const (
+	DefaultSOARefresh = 2 * time.Hour
+	DefaultSOARetry   = 30 * time.Minute
+	DefaultSOAExpire  = 14 * 24 * time.Hour
+	DefaultSOAMinTTL  = 5 * time.Minute
+)
+
+// SOAParameters are used to synthesize the SOA records of the zones of a backend, which are returned with negative
+// responses. Names without trailing dot are relative to the zone.
+type SOAParameters struct {
+	Ns   string
+	Mbox string
+	// Serial is set to the time of the setup unless it is configured.
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	// MinTTL is how long negative responses may be cached, which is also the TTL of the SOA record.
+	MinTTL uint32
+}
+
+// record returns the SOA record of the zone with origin.
+func (p *SOAParameters) record(origin string) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: p.MinTTL},
+		Ns:      qualify(p.Ns, origin),
+		Mbox:    qualify(p.Mbox, origin),
+		Serial:  p.Serial,
+		Refresh: p.Refresh,
+		Retry:   p.Retry,
+		Expire:  p.Expire,
+		Minttl:  p.MinTTL,
+	}
+}
+
+// qualify returns name relative to origin unless it has a trailing dot.
+func qualify(name, origin string) string {
+	switch {
+	case dns.IsFqdn(name):
+		return name
+	case origin == ".":
+		return name + "."
+	default:
+		return name + "." + origin
+	}
+}
+
+// soa returns the SOA record of the zone name belongs to, taken from the latest export of the zone if it is synced or
+// synthesized from the SOAParameters of its backend, or nil if there are neither. Its TTL is limited to its minimum
+// TTL, as it is returned with negative responses (RFC 2308).
+func (h HTTPRecord) soa(name string) *dns.SOA {
+	origin := h.origin(name)
+	if soa, _, ok := h.syncer.history(origin).transfer(0); ok {
+		synced := dns.Copy(soa).(*dns.SOA)
+		if synced.Hdr.Ttl > synced.Minttl {
+			synced.Hdr.Ttl = synced.Minttl
+		}
+		return synced
+	}
+
+	if soa := h.lookups().soa(origin); soa != nil {
+		return soa.record(origin)
+	}
+	return nil
+}
+
+// answer answers a query for records of the zone itself, e.g. its SOA record, with rrs.
+func answer(w dns.ResponseWriter, r *dns.Msg, rrs []dns.RR) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.Answer = rrs
+
+	w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
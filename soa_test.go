@@ -0,0 +1,75 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPRecord_SOA(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/missing.example.com." {
+			rw.Write([]byte(`{"rcode": "NXDOMAIN"}`))
+			return
+		}
+		rw.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	config := HTTPRecord{
+		Timeout: time.Second,
+		Zones: []Zone{{
+			Origin: "example.com.",
+			URI:    ts.URL + "/%(fqdn)",
+			Backend: &Backend{SOA: &SOAParameters{Ns: "ns1", Mbox: "hostmaster.example.net.", Serial: 42,
+				Refresh: 7200, Retry: 1800, Expire: 1209600, MinTTL: 300}},
+		}},
+	}
+	soa := test.SOA("example.com. 300 IN SOA ns1.example.com. hostmaster.example.net. 42 7200 1800 1209600 300")
+
+	tests := []struct {
+		qname  string
+		qtype  uint16
+		rcode  int
+		answer []dns.RR
+		ns     []dns.RR
+	}{
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, nil, []dns.RR{soa}},
+		{"missing.example.com.", dns.TypeA, dns.RcodeNameError, nil, []dns.RR{soa}},
+		{"www.example.com.", dns.TypeSOA, dns.RcodeSuccess, nil, []dns.RR{soa}},
+		{"example.com.", dns.TypeSOA, dns.RcodeSuccess, []dns.RR{soa}, nil},
+	}
+
+	for i, c := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		config.ServeDNS(context.TODO(), rec, new(dns.Msg).SetQuestion(c.qname, c.qtype))
+		if rec.Msg == nil {
+			t.Errorf("Test %d: expected a response", i)
+			continue
+		}
+		if err := test.SortAndCheck(rec.Msg, test.Case{Qname: c.qname, Qtype: c.qtype, Rcode: c.rcode,
+			Answer: c.answer, Ns: c.ns}); err != nil {
+			t.Errorf("Test %d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// ResponseTemplate extracts records from response bodies in arbitrary formats, e.g. status pages of services that
+// cannot be changed to return a supported format. Every match of Regexp is expanded with Format as done by
+// regexp.Regexp.Expand into a line of the text format.
+type ResponseTemplate struct {
+	Regexp *regexp.Regexp
+	Format string
+}
+
+func (t ResponseTemplate) Parse(name string, rtype string, ttl uint32, body []byte) (ParsedResponse, error) {
+	body = normalizeText(body)
+
+	var lines [][]byte
+	for _, match := range t.Regexp.FindAllSubmatchIndex(body, -1) {
+		lines = append(lines, t.Regexp.Expand(nil, []byte(t.Format), body, match))
+	}
+
+	return parseText(name, rtype, ttl, bytes.Join(lines, []byte("\n")))
+}
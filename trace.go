@@ -0,0 +1,94 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"fmt"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	ot "github.com/opentracing/opentracing-go"
+	otext "github.com/opentracing/opentracing-go/ext"
+	"net/http"
+	"strings"
+)
+
+// TraceparentHeader carries the W3C Trace Context of requests to backends.
+const TraceparentHeader = "traceparent"
+
+// startFetchSpan starts the span of the request r to a backend as a child of the span of the lookup, if the trace
+// plugin is enabled, and propagates it to the backend in header. The returned span is nil otherwise.
+func startFetchSpan(r backendRequest, header http.Header) ot.Span {
+	if r.Span == nil {
+		return nil
+	}
+
+	span := r.Span.Tracer().StartSpan("httprecord.fetch", ot.ChildOf(r.Span.Context()))
+	otext.SpanKindRPCClient.Set(span)
+	otext.HTTPMethod.Set(span, r.Method)
+	otext.HTTPUrl.Set(span, r.URI)
+	span.SetTag("httprecord.template", r.Template)
+	span.SetTag("httprecord.revalidation", r.Cached != nil)
+
+	if err := span.Tracer().Inject(span.Context(), ot.HTTPHeaders, ot.HTTPHeadersCarrier(header)); err != nil {
+		log.Debugf("Unable to propagate trace to backend: %v", err)
+	}
+	if header.Get(TraceparentHeader) == "" {
+		if traceparent := traceparentFromB3(header); traceparent != "" {
+			header.Set(TraceparentHeader, traceparent)
+		}
+	}
+	return span
+}
+
+// finishFetchSpan records the status of the response to a request, or the error it failed with, and finishes span.
+func finishFetchSpan(span ot.Span, response *http.Response, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		otext.Error.Set(span, true)
+		span.LogKV("event", "error", "message", err.Error())
+	} else {
+		otext.HTTPStatusCode.Set(span, uint16(response.StatusCode))
+	}
+	span.Finish()
+}
+
+// traceparentFromB3 returns the W3C traceparent for the B3 headers the zipkin tracer of the trace plugin injects, or
+// "" if there are none.
+func traceparentFromB3(header http.Header) string {
+	traceID, spanID := strings.ToLower(header.Get("X-B3-TraceId")), strings.ToLower(header.Get("X-B3-SpanId"))
+	if !isHex(traceID) || !isHex(spanID) || len(traceID) > 32 || len(spanID) > 16 {
+		return ""
+	}
+
+	flags := "00"
+	if header.Get("X-B3-Sampled") == "1" || header.Get("X-B3-Sampled") == "true" || header.Get("X-B3-Flags") == "1" {
+		flags = "01"
+	}
+	// 64 bit trace IDs are left-padded with zeros.
+	return fmt.Sprintf("00-%032s-%016s-%s", traceID, spanID, flags)
+}
+
+func isHex(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
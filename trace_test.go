@@ -0,0 +1,115 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPRecord_Trace(t *testing.T) {
+	var propagated []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		propagated = append(propagated, r.Header.Get("Mockpfx-Ids-Spanid"))
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+
+	config := HTTPRecord{
+		Zones:          []Zone{{URI: server.URL + "/%(fqdn)", Origin: "example.com."}},
+		CacheResponses: true,
+		Cache:          cache.New(100),
+		Timeout:        time.Second,
+	}
+	tracer := mocktracer.New()
+	var lookups []*mocktracer.MockSpan
+	for i := 0; i < 2; i++ {
+		span := tracer.StartSpan("servedns")
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		msg := new(dns.Msg)
+		msg.SetQuestion("foo.example.com.", dns.TypeA)
+		if _, err := config.ServeDNS(ot.ContextWithSpan(context.TODO(), span), rec, msg); err != nil {
+			t.Fatalf("Lookup %d: unexpected error %v", i, err)
+		}
+		span.Finish()
+		lookups = append(lookups, span.(*mocktracer.MockSpan))
+	}
+
+	if cache := lookups[0].Tag("httprecord.cache"); cache != "miss" {
+		t.Errorf("Expected first lookup to be a cache miss, got %v", cache)
+	}
+	if cache := lookups[1].Tag("httprecord.cache"); cache != "hit" {
+		t.Errorf("Expected second lookup to be a cache hit, got %v", cache)
+	}
+
+	var fetches []*mocktracer.MockSpan
+	for _, span := range tracer.FinishedSpans() {
+		if span.OperationName == "httprecord.fetch" {
+			fetches = append(fetches, span)
+		}
+	}
+	if len(fetches) != 1 {
+		t.Fatalf("Expected 1 fetch span, got %d", len(fetches))
+	}
+	fetch := fetches[0]
+	if fetch.ParentID != lookups[0].SpanContext.SpanID {
+		t.Errorf("Expected fetch span to be a child of the lookup span")
+	}
+	if url := fetch.Tag("http.url"); url != server.URL+"/foo.example.com." {
+		t.Errorf("Expected http.url tag %s, got %v", server.URL+"/foo.example.com.", url)
+	}
+	if status := fetch.Tag("http.status_code"); status != uint16(200) {
+		t.Errorf("Expected http.status_code tag 200, got %v", status)
+	}
+	if len(propagated) != 1 || propagated[0] == "" {
+		t.Errorf("Expected span to be propagated to the backend, got %v", propagated)
+	}
+}
+
+func TestTraceparentFromB3(t *testing.T) {
+	tests := []struct {
+		header   http.Header
+		expected string
+	}{
+		{http.Header{}, ""},
+		{
+			http.Header{"X-B3-Traceid": {"463ac35c9f6413ad48485a3953bb6124"}, "X-B3-Spanid": {"a2fb4a1d1a96d312"},
+				"X-B3-Sampled": {"1"}},
+			"00-463ac35c9f6413ad48485a3953bb6124-a2fb4a1d1a96d312-01",
+		},
+		// 64 bit trace IDs are padded.
+		{
+			http.Header{"X-B3-Traceid": {"48485A3953BB6124"}, "X-B3-Spanid": {"a2fb4a1d1a96d312"}},
+			"00-000000000000000048485a3953bb6124-a2fb4a1d1a96d312-00",
+		},
+		{http.Header{"X-B3-Traceid": {"not-hex"}, "X-B3-Spanid": {"a2fb4a1d1a96d312"}}, ""},
+	}
+
+	for i, c := range tests {
+		if traceparent := traceparentFromB3(c.header); traceparent != c.expected {
+			t.Errorf("Test %d: expected %q, got %q", i, c.expected, traceparent)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MaxExportSize limits the size of the zone exports read from backends.
+const MaxExportSize = 64 << 20
+
+// ExportTimeout limits how long a zone export is fetched for.
+const ExportTimeout = 30 * time.Second
+
+// transferBatchSize is the number of records sent to the transfer plugin at once, which writes them in one message.
+const transferBatchSize = 100
+
+// Transfer implements the transfer.Transferer interface for zones whose backend has an ExportURI. The export is
+// fetched and parsed as a whole before it is sent, so that a failing backend does not result in a partial transfer.
+// Zones that are synced are transferred from the latest version polled instead, and IXFR requests for versions that
+// are still known are answered with their differences.
+func (h HTTPRecord) Transfer(zone string, serial uint32) (<-chan []dns.RR, error) {
+	zone = plugin.Name(zone).Normalize()
+	var backend *Backend
+	for _, z := range h.Zones {
+		if z.Origin == zone && z.Backend != nil && z.Backend.ExportURI != "" {
+			backend = z.Backend
+			break
+		}
+	}
+	if backend == nil {
+		return nil, transfer.ErrNotAuthoritative
+	}
+
+	soa, records, ok := h.syncer.history(zone).transfer(serial)
+	if !ok {
+		var err error
+		if soa, records, err = h.export(zone, backend); err != nil {
+			log.Warningf("Unable to export zone %s: %v", zone, err)
+			return nil, err
+		}
+	}
+
+	ch := make(chan []dns.RR)
+	go func() {
+		defer close(ch)
+		ch <- []dns.RR{soa}
+		if serial != 0 && !serialNewer(soa.Serial, serial) {
+			// The secondary is up to date.
+			return
+		}
+		for len(records) > 0 {
+			n := transferBatchSize
+			if n > len(records) {
+				n = len(records)
+			}
+			ch <- records[:n]
+			records = records[n:]
+		}
+		ch <- []dns.RR{soa}
+	}()
+	return ch, nil
+}
+
+// serialNewer returns whether serial a is newer than b in serial number arithmetic (RFC 1982).
+func serialNewer(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// export fetches the records of zone from the ExportURI of backend and returns its SOA record and the other ones.
+func (h HTTPRecord) export(zone string, backend *Backend) (*dns.SOA, []dns.RR, error) {
+	values := placeholders{"zone": zone}
+	uri := values.expand(backend.ExportURI, uriEscaper(backend))
+	if backend.Allowlist != nil {
+		if err := backend.Allowlist.checkURI(uri); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	done, err := h.lifecycle.begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer done()
+	ctx, cancel := context.WithTimeout(h.lifecycle.context(), ExportTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", "text/csv")
+	req.Header.Set("Accept-Encoding", AcceptEncoding)
+	req.Header.Set("User-Agent", UserAgent)
+	for key, values := range values.expandHeader(backend.Header) {
+		req.Header[key] = values
+	}
+	if backend.HMAC != nil {
+		backend.HMAC.Sign(req, time.Now())
+	}
+
+	transport, done := transportFor(backend)
+	defer done()
+	response, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, nil, fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+
+	reader, err := decompress(response)
+	if err != nil {
+		return nil, nil, err
+	}
+	limited := &exportReader{r: reader, n: MaxExportSize}
+	return parseExport(zone, h.extractTTL(response.Header, backend), limited)
+}
+
+// exportReader reads up to n bytes of an export and fails if it is longer, as parsing a truncated export would result
+// in a partial transfer.
+type exportReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *exportReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, fmt.Errorf("backend returned an export longer than %d bytes", MaxExportSize)
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	return n, err
+}
+
+// parseExport parses the name,type,ttl,value records of zone in r, which need to include exactly one SOA record for
+// the origin. Like the records of lookups, records get at most ttl, which records without TTL get. Records outside of
+// zone are skipped.
+func parseExport(zone string, ttl uint32, r io.Reader) (*dns.SOA, []dns.RR, error) {
+	buffered := bufio.NewReader(r)
+	if bom, err := buffered.Peek(len(utf8BOM)); err == nil && bytes.Equal(bom, utf8BOM) {
+		buffered.Discard(len(utf8BOM))
+	}
+
+	reader := csv.NewReader(buffered)
+	reader.FieldsPerRecord = len(csvHeader)
+	reader.TrimLeadingSpace = true
+
+	var soa *dns.SOA
+	var records []dns.RR
+	for first := true; ; first = false {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if first && strings.EqualFold(strings.Join(row, ","), strings.Join(csvHeader, ",")) {
+			continue
+		}
+
+		name := strings.ToLower(dns.Fqdn(strings.TrimSpace(row[0])))
+		if !dns.IsSubDomain(zone, name) {
+			continue
+		}
+		entry := csvRecord(row)
+		rtype := entry.Type()
+		if _, ok := dns.StringToType[rtype]; !ok {
+			return nil, nil, fmt.Errorf("invalid type %s for %s", rtype, name)
+		}
+		parser, ok := responseToRR[rtype]
+		if !ok {
+			parser = parseGeneric(rtype)
+		}
+		rrs, errs := parser(name, ttl, []responseEntry{entry})
+		if len(errs) > 0 {
+			return nil, nil, errs[0]
+		}
+
+		for _, rr := range rrs {
+			if s, ok := rr.(*dns.SOA); ok {
+				if soa != nil || name != zone {
+					return nil, nil, fmt.Errorf("unexpected SOA record for %s", name)
+				}
+				soa = s
+				continue
+			}
+			records = append(records, rr)
+		}
+	}
+	if soa == nil {
+		return nil, nil, errors.New("missing SOA record")
+	}
+	return soa, records, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"github.com/coredns/coredns/plugin/transfer"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testExport = `name,type,ttl,value
+example.com.,SOA,3600,ns.example.com. hostmaster.example.com. 2021010101 7200 3600 1209600 300
+example.com.,NS,3600,ns.example.com.
+www.example.com.,A,,1.2.3.4
+www.example.com.,TXT,60,"hello world"
+www.example.org.,A,60,5.6.7.8
+`
+
+func TestHTTPRecord_Transfer(t *testing.T) {
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		rw.Header().Set("Content-Type", "text/csv")
+		rw.Write([]byte(testExport))
+	}))
+	defer server.Close()
+
+	config := HTTPRecord{
+		Zones: []Zone{
+			{Origin: "example.com.", URI: server.URL, Backend: &Backend{ExportURI: server.URL + "/zones/%(zone)"}},
+			{Origin: "example.net.", URI: server.URL},
+		},
+	}
+
+	tests := []struct {
+		zone     string
+		serial   uint32
+		expected []string
+	}{
+		{"example.com.", 0, []string{
+			"example.com.\t3600\tIN\tSOA\tns.example.com. hostmaster.example.com. 2021010101 7200 3600 1209600 300",
+			"example.com.\t3600\tIN\tNS\tns.example.com.",
+			"www.example.com.\t3600\tIN\tA\t1.2.3.4",
+			"www.example.com.\t60\tIN\tTXT\t\"hello world\"",
+			"example.com.\t3600\tIN\tSOA\tns.example.com. hostmaster.example.com. 2021010101 7200 3600 1209600 300",
+		}},
+		// Secondaries that are up to date only get the SOA record.
+		{"Example.com", 2021010101, []string{
+			"example.com.\t3600\tIN\tSOA\tns.example.com. hostmaster.example.com. 2021010101 7200 3600 1209600 300",
+		}},
+	}
+
+	for i, c := range tests {
+		ch, err := config.Transfer(c.zone, c.serial)
+		if err != nil {
+			t.Fatalf("Test %d: unexpected error %v", i, err)
+		}
+		var records []string
+		for rrs := range ch {
+			for _, rr := range rrs {
+				records = append(records, rr.String())
+			}
+		}
+		if strings.Join(records, "\n") != strings.Join(c.expected, "\n") {
+			t.Errorf("Test %d: expected records\n%s\ngot\n%s", i, strings.Join(c.expected, "\n"),
+				strings.Join(records, "\n"))
+		}
+		if path != "/zones/example.com." {
+			t.Errorf("Test %d: expected export to be fetched from /zones/example.com., got %s", i, path)
+		}
+	}
+
+	for _, zone := range []string{"example.net.", "example.org."} {
+		if _, err := config.Transfer(zone, 0); err != transfer.ErrNotAuthoritative {
+			t.Errorf("Expected %s not to be transferred, got %v", zone, err)
+		}
+	}
+}
+
+func TestParseExport(t *testing.T) {
+	tests := []struct {
+		export string
+		err    bool
+	}{
+		{testExport, false},
+		{"example.com.,A,60,1.2.3.4\n", true},
+		{"example.com.,SOA,60,ns. hostmaster. 1 2 3 4 5\nwww.example.com.,SOA,60,ns. hostmaster. 1 2 3 4 5\n", true},
+		{"example.com.,SOA,60,ns. hostmaster. 1 2 3 4 5\nwww.example.com.,A,60,not-an-ip\n", true},
+		{"example.com.,SOA,60,ns. hostmaster. 1 2 3 4 5\nwww.example.com.,BOGUS,60,1\n", true},
+	}
+
+	for i, c := range tests {
+		_, _, err := parseExport("example.com.", 3600, strings.NewReader(c.export))
+		if (err != nil) != c.err {
+			t.Errorf("Test %d: expected error to be %v, got %v", i, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"golang.org/x/net/http2"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultMaxIdleConns    = 100
+	DefaultIdleConnTimeout = 90 * time.Second
+)
+
+// HTTP versions that can be selected for requests to a backend. By default, HTTP/2 is used if the backend supports
+// it and HTTP/1.1 otherwise.
+const (
+	HTTPVersion1 = "1.1"
+	HTTPVersion2 = "2"
+)
+
+// errNoHTTP2 is returned for requests to backends that are required to but do not support HTTP/2.
+var errNoHTTP2 = errors.New("backend does not support HTTP/2")
+
+// roundTripper is a transport pooling connections.
+type roundTripper interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+// http2Transport only makes HTTP/2 requests. HTTPS requests negotiate HTTP/2 with TLS while HTTP requests use HTTP/2
+// without prior upgrade (h2c).
+type http2Transport struct {
+	tls *http.Transport
+	h2c *http2.Transport
+}
+
+func (t *http2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return t.h2c.RoundTrip(req)
+	}
+
+	response, err := t.tls.RoundTrip(req)
+	if err == nil && response.ProtoMajor != 2 {
+		response.Body.Close()
+		return nil, errNoHTTP2
+	}
+	return response, err
+}
+
+func (t *http2Transport) CloseIdleConnections() {
+	t.tls.CloseIdleConnections()
+	t.h2c.CloseIdleConnections()
+}
+
+// defaultTransport is shared by all zones and records without backend settings.
+var defaultTransport = newTransport(nil)
+
+// newTransport creates the transport for requests to a backend, which pools connections to it.
+func newTransport(backend *Backend) roundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = DefaultMaxIdleConns
+	transport.IdleConnTimeout = DefaultIdleConnTimeout
+
+	dial := newDial(backend)
+	if backend != nil && backend.Allowlist != nil {
+		dial = backend.Allowlist.dialContext(dial)
+	}
+	transport.DialContext = dial
+
+	if backend != nil {
+		if backend.MaxIdleConns > 0 {
+			transport.MaxIdleConns = backend.MaxIdleConns
+		}
+		if backend.IdleConnTimeout > 0 {
+			transport.IdleConnTimeout = backend.IdleConnTimeout
+		}
+		if backend.TLSConfig != nil {
+			transport.TLSClientConfig = backend.TLSConfig.Clone()
+		}
+		if backend.TLSSessionCacheSize > 0 {
+			if transport.TLSClientConfig == nil {
+				transport.TLSClientConfig = &tls.Config{}
+			}
+			transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(backend.TLSSessionCacheSize)
+		}
+		if backend.Proxy != nil {
+			transport.Proxy = http.ProxyURL(backend.Proxy)
+		}
+		if backend.Allowlist != nil && transport.Proxy != nil {
+			transport.Proxy = backend.Allowlist.proxy(transport.Proxy)
+		}
+	}
+
+	// Backends are usually a single host, so it gets to keep all idle connections.
+	transport.MaxIdleConnsPerHost = transport.MaxIdleConns
+
+	switch {
+	case backend == nil:
+		return transport
+	case backend.HTTPVersion == HTTPVersion1:
+		// A non-nil map disables HTTP/2.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	case backend.HTTPVersion == HTTPVersion2:
+		return &http2Transport{
+			tls: transport,
+			h2c: &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+					return dial(context.Background(), network, addr)
+				},
+			},
+		}
+	}
+	return transport
+}
+
+// transportFor returns the transport for requests to backend. If the transport was not created at setup, which only
+// happens in tests, a new one is created and has to be closed by calling the returned function.
+func transportFor(backend *Backend) (roundTripper, func()) {
+	switch {
+	case backend == nil:
+		return defaultTransport, func() {}
+	case backend.transport == nil:
+		transport := newTransport(backend)
+		return transport, transport.CloseIdleConnections
+	default:
+		return backend.transport, func() {}
+	}
+}
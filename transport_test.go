@@ -0,0 +1,68 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewTransport_TLSSessionCache(t *testing.T) {
+	var resumed bool
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		resumed = r.TLS.DidResume
+	}))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	tests := []struct {
+		cacheSize int
+		resumed   bool
+	}{
+		{0, false},
+		{1, true},
+	}
+
+	for i, test := range tests {
+		transport := newTransport(&Backend{
+			TLSConfig:           &tls.Config{RootCAs: roots},
+			TLSSessionCacheSize: test.cacheSize,
+		})
+
+		for j := 0; j < 2; j++ {
+			// Force a new connection for every request.
+			transport.CloseIdleConnections()
+
+			req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			response, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("Test %d expected no error, got %v", i, err)
+			}
+			ioutil.ReadAll(response.Body)
+			response.Body.Close()
+		}
+		transport.CloseIdleConnections()
+
+		if resumed != test.resumed {
+			t.Errorf("Test %d expected resumed: %v, got %v", i, test.resumed, resumed)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// resolver looks up names through the plugin chain, which is *upstream.Upstream outside of tests.
+type resolver interface {
+	Lookup(ctx context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error)
+}
+
+// additionalAddresses returns the A and AAAA records of the targets of the MX and SRV records in answer looked up with
+// h.upstream, so that clients do not have to look them up themselves.
+func (h HTTPRecord) additionalAddresses(ctx context.Context, w dns.ResponseWriter, state request.Request,
+	answer []dns.RR) []dns.RR {
+	var targets []string
+	seen := make(map[string]bool)
+	for _, rr := range answer {
+		var target string
+		switch rr := rr.(type) {
+		case *dns.MX:
+			target = rr.Mx
+		case *dns.SRV:
+			target = rr.Target
+		default:
+			continue
+		}
+		if target != "." && !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+
+	var extra []dns.RR
+	for _, target := range targets {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			m, err := h.resolve(ctx, w, state, target, qtype)
+			if err != nil {
+				log.Debugf("Unable to look up additional records for %s: %v", target, err)
+				continue
+			}
+			for _, rr := range m.Answer {
+				if rr.Header().Rrtype == qtype && rr.Header().Name == target {
+					extra = append(extra, rr)
+				}
+			}
+		}
+	}
+	return extra
+}
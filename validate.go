@@ -0,0 +1,67 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// MaxRdataLength is the maximum length of the data of a single record we are willing to serve.
+const MaxRdataLength = 4096
+
+// validate makes sure the parsed records are fit to be written to a client. As opposed to records skipped while
+// parsing, a response failing validation indicates a broken parser or backend and is never served.
+func validate(name string, parsed ParsedResponse) error {
+	for _, rr := range parsed.Answer {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			return fmt.Errorf("answer for %s does not match the query name %s", rr.Header().Name, name)
+		}
+	}
+
+	for _, section := range [][]dns.RR{parsed.Answer, parsed.Ns, parsed.Extra} {
+		for _, rr := range section {
+			if err := validateRR(rr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateRR(rr dns.RR) error {
+	switch rr := rr.(type) {
+	case *dns.A:
+		if rr.A.To4() == nil {
+			return fmt.Errorf("invalid IPv4 address in A record for %s", rr.Hdr.Name)
+		}
+	case *dns.AAAA:
+		if rr.AAAA.To16() == nil || rr.AAAA.To4() != nil {
+			return fmt.Errorf("invalid IPv6 address in AAAA record for %s", rr.Hdr.Name)
+		}
+	}
+
+	// Packing the record ensures it can be written and sets the Rdlength.
+	if _, err := dns.PackRR(rr, make([]byte, dns.Len(rr)), 0, nil, false); err != nil {
+		return fmt.Errorf("unable to pack %s record for %s: %v", dns.TypeToString[rr.Header().Rrtype],
+			rr.Header().Name, err)
+	}
+	if rr.Header().Rdlength > MaxRdataLength {
+		return fmt.Errorf("%s record for %s exceeds %d bytes", dns.TypeToString[rr.Header().Rrtype],
+			rr.Header().Name, MaxRdataLength)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WarmupConcurrency limits the lookups made at once to warm up the caches.
+const WarmupConcurrency = 16
+
+// WarmupTimeout limits how long the list of lookups to warm up the caches with is fetched for.
+const WarmupTimeout = 10 * time.Second
+
+// loadWarmup reads the lookups to warm up the caches with from the file or http(s) URI source.
+func loadWarmup(source string) ([]dns.Question, error) {
+	if !isURI(source) {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return parseWarmup(f)
+	}
+
+	client := &http.Client{Timeout: WarmupTimeout}
+	response, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return parseWarmup(io.LimitReader(response.Body, MaxHTTPBodySize))
+}
+
+// parseWarmup parses lookups with a name and an optional type, A by default, per line. Empty lines and lines starting
+// with # are ignored.
+func parseWarmup(r io.Reader) ([]dns.Question, error) {
+	var questions []dns.Question
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: expected a name and an optional type", line)
+		}
+
+		qtype := dns.TypeA
+		if len(fields) == 2 {
+			var ok bool
+			if qtype, ok = dns.StringToType[strings.ToUpper(fields[1])]; !ok {
+				return nil, fmt.Errorf("line %d: unknown type %s", line, fields[1])
+			}
+		}
+		questions = append(questions, dns.Question{
+			Name:   dns.Fqdn(strings.ToLower(fields[0])),
+			Qtype:  qtype,
+			Qclass: dns.ClassINET,
+		})
+	}
+	return questions, scanner.Err()
+}
+
+// warmup looks up questions to fill the caches and returns the number of lookups that were answered.
+func (h HTTPRecord) warmup(questions []dns.Question) int {
+	var answered int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, WarmupConcurrency)
+	for _, q := range questions {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(q dns.Question) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+
+			msg := new(dns.Msg)
+			msg.SetQuestion(q.Name, q.Qtype)
+			w := &warmupWriter{}
+			if _, err := h.ServeDNS(context.Background(), w, msg); err != nil {
+				log.Debugf("Unable to warm up cache with %s %s: %v", q.Name, dns.TypeToString[q.Qtype], err)
+				return
+			}
+			if w.msg != nil && w.msg.Rcode == dns.RcodeSuccess {
+				mu.Lock()
+				answered++
+				mu.Unlock()
+			}
+		}(q)
+	}
+	wg.Wait()
+	return answered
+}
+
+// warmupFrom warms up the caches with the lookups from source. Failures are only logged, as the caches fill anyway.
+func (h HTTPRecord) warmupFrom(source string) error {
+	questions, err := loadWarmup(source)
+	if err != nil {
+		log.Warningf("Unable to load warmup lookups from %s: %v", source, err)
+		return nil
+	}
+	answered := h.warmup(questions)
+	log.Infof("Warmed up cache with %d of %d lookups from %s", answered, len(questions), source)
+	return nil
+}
+
+// warmupWriter keeps the response to a lookup made to warm up the caches instead of sending it.
+type warmupWriter struct {
+	msg *dns.Msg
+}
+
+func (w *warmupWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *warmupWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *warmupWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *warmupWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *warmupWriter) Close() error        { return nil }
+func (w *warmupWriter) TsigStatus() error   { return nil }
+func (w *warmupWriter) TsigTimersOnly(bool) {}
+func (w *warmupWriter) Hijack()             {}
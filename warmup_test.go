@@ -0,0 +1,142 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"context"
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseWarmup(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  []dns.Question
+	}{
+		{"# popular names\nwww.example.com\n\nWWW.example.com. aaaa\n", false, []dns.Question{
+			{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			{Name: "www.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+		}},
+		{"", false, nil},
+		{"www.example.com BOGUS", true, nil},
+		{"www.example.com A extra", true, nil},
+	}
+
+	for i, test := range tests {
+		questions, err := parseWarmup(strings.NewReader(test.input))
+		if (err != nil) != test.shouldErr {
+			t.Errorf("Test %d: expected error to be %v, got %v", i, test.shouldErr, err)
+			continue
+		}
+		if !test.shouldErr && !reflect.DeepEqual(questions, test.expected) {
+			t.Errorf("Test %d: expected %v, got %v", i, test.expected, questions)
+		}
+	}
+}
+
+func TestLoadWarmup(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/warmup" {
+			rw.WriteHeader(404)
+			return
+		}
+		rw.Write([]byte("www.example.com\n"))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "httprecord")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "warmup.txt")
+	if err := ioutil.WriteFile(path, []byte("www.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		source    string
+		shouldErr bool
+	}{
+		{path, false},
+		{filepath.Join(dir, "missing.txt"), true},
+		{server.URL + "/warmup", false},
+		{server.URL + "/missing", true},
+	}
+
+	for i, test := range tests {
+		questions, err := loadWarmup(test.source)
+		if (err != nil) != test.shouldErr {
+			t.Errorf("Test %d: expected error to be %v, got %v", i, test.shouldErr, err)
+			continue
+		}
+		if !test.shouldErr && len(questions) != 1 {
+			t.Errorf("Test %d: expected 1 lookup, got %v", i, questions)
+		}
+	}
+}
+
+func TestHTTPRecord_Warmup(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if strings.HasPrefix(r.URL.Path, "/missing") {
+			rw.WriteHeader(404)
+			return
+		}
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Write([]byte("1.2.3.4"))
+	}))
+	defer server.Close()
+
+	config := HTTPRecord{
+		Zones:          []Zone{{URI: server.URL + "/%(fqdn)", Origin: "example.com."}},
+		CacheResponses: true,
+		Cache:          cache.New(100),
+		Timeout:        time.Second,
+	}
+	questions := []dns.Question{
+		{Name: "foo.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		{Name: "bar.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		{Name: "missing.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+	}
+	if answered := config.warmup(questions); answered != 2 {
+		t.Errorf("Expected 2 answered lookups, got %d", answered)
+	}
+
+	// The warmed up responses are answered from the cache.
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	msg := new(dns.Msg)
+	msg.SetQuestion("foo.example.com.", dns.TypeA)
+	if _, err := config.ServeDNS(context.TODO(), rec, msg); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("Expected 3 requests, got %d", n)
+	}
+}
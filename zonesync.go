@@ -0,0 +1,204 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+// MaxZoneVersions is the number of versions of a synced zone kept to answer IXFR requests with their differences.
+const MaxZoneVersions = 16
+
+// notifier is implemented by the transfer plugin.
+type notifier interface {
+	Notify(zone string) error
+}
+
+// zoneVersion is the content of a zone with a serial.
+type zoneVersion struct {
+	soa     *dns.SOA
+	records []dns.RR
+}
+
+// zoneHistory keeps the latest versions of a synced zone, oldest first.
+type zoneHistory struct {
+	mu       sync.RWMutex
+	versions []zoneVersion
+}
+
+// latest returns the latest version of the zone, or false if it was not exported yet.
+func (zh *zoneHistory) latest() (zoneVersion, bool) {
+	zh.mu.RLock()
+	defer zh.mu.RUnlock()
+	if len(zh.versions) == 0 {
+		return zoneVersion{}, false
+	}
+	return zh.versions[len(zh.versions)-1], true
+}
+
+// update adds version if its serial is newer than that of the latest version and returns whether it did.
+func (zh *zoneHistory) update(version zoneVersion) bool {
+	zh.mu.Lock()
+	defer zh.mu.Unlock()
+	if n := len(zh.versions); n > 0 && !serialNewer(version.soa.Serial, zh.versions[n-1].soa.Serial) {
+		return false
+	}
+	zh.versions = append(zh.versions, version)
+	if len(zh.versions) > MaxZoneVersions {
+		zh.versions = zh.versions[len(zh.versions)-MaxZoneVersions:]
+	}
+	return true
+}
+
+// transfer returns the SOA record of the latest version of the zone and the records to transfer for serial, or false
+// if it was not exported yet. If the version with serial is still known, the records are the differences from it to
+// the latest version in the format of IXFR responses (RFC 1995) without the leading and trailing SOA record.
+// Otherwise, they are all records of the latest version.
+func (zh *zoneHistory) transfer(serial uint32) (*dns.SOA, []dns.RR, bool) {
+	if zh == nil {
+		return nil, nil, false
+	}
+
+	zh.mu.RLock()
+	defer zh.mu.RUnlock()
+	if len(zh.versions) == 0 {
+		return nil, nil, false
+	}
+	latest := zh.versions[len(zh.versions)-1]
+
+	from := -1
+	for i, version := range zh.versions {
+		if serial != 0 && version.soa.Serial == serial {
+			from = i
+		}
+	}
+	if from < 0 {
+		return latest.soa, latest.records, true
+	}
+
+	var diffs []dns.RR
+	for i := from; i < len(zh.versions)-1; i++ {
+		older, newer := zh.versions[i], zh.versions[i+1]
+		diffs = append(diffs, older.soa)
+		diffs = append(diffs, subtractRecords(older.records, newer.records)...)
+		diffs = append(diffs, newer.soa)
+		diffs = append(diffs, subtractRecords(newer.records, older.records)...)
+	}
+	return latest.soa, diffs, true
+}
+
+// subtractRecords returns the records of a that are not in b.
+func subtractRecords(a, b []dns.RR) []dns.RR {
+	in := make(map[string]bool, len(b))
+	for _, rr := range b {
+		in[rr.String()] = true
+	}
+	var diff []dns.RR
+	for _, rr := range a {
+		if !in[rr.String()] {
+			diff = append(diff, rr)
+		}
+	}
+	return diff
+}
+
+// zoneSyncer polls the exports of zones whose backend has an ExportInterval, keeps their latest versions to answer
+// zone transfers with and notifies the secondaries configured with the transfer plugin when their serial changes.
+type zoneSyncer struct {
+	h         HTTPRecord
+	histories map[string]*zoneHistory
+	// notifier is set at startup if the transfer plugin is enabled.
+	notifier notifier
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+func newZoneSyncer(h HTTPRecord) *zoneSyncer {
+	s := &zoneSyncer{h: h, histories: map[string]*zoneHistory{}, stop: make(chan struct{})}
+	for _, zone := range h.Zones {
+		if zone.Backend != nil && zone.Backend.ExportURI != "" && zone.Backend.ExportInterval > 0 {
+			s.histories[zone.Origin] = new(zoneHistory)
+		}
+	}
+	return s
+}
+
+// history returns the versions kept of zone, or nil if it is not synced.
+func (s *zoneSyncer) history(zone string) *zoneHistory {
+	if s == nil {
+		return nil
+	}
+	return s.histories[zone]
+}
+
+// Start polls the exports of the zones periodically until Stop is called.
+func (s *zoneSyncer) Start() error {
+	for _, zone := range s.h.Zones {
+		if history := s.histories[zone.Origin]; history != nil {
+			go s.poll(zone, history)
+		}
+	}
+	return nil
+}
+
+// Stop stops polling.
+func (s *zoneSyncer) Stop() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	return nil
+}
+
+func (s *zoneSyncer) poll(zone Zone, history *zoneHistory) {
+	ticker := time.NewTicker(zone.Backend.ExportInterval)
+	defer ticker.Stop()
+
+	for {
+		s.sync(zone.Origin, zone.Backend, history)
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// sync exports the zone and notifies the secondaries if its serial changed.
+func (s *zoneSyncer) sync(origin string, backend *Backend, history *zoneHistory) {
+	soa, records, err := s.h.export(origin, backend)
+	if err != nil {
+		log.Warningf("Unable to export zone %s: %v", origin, err)
+		return
+	}
+
+	latest, ok := history.latest()
+	if !history.update(zoneVersion{soa: soa, records: records}) {
+		if ok && soa.Serial == latest.soa.Serial && len(subtractRecords(records, latest.records))+
+			len(subtractRecords(latest.records, records)) > 0 {
+			log.Warningf("Export of zone %s changed without a newer serial than %d", origin, soa.Serial)
+		}
+		return
+	}
+	if !ok || s.notifier == nil {
+		return
+	}
+
+	log.Infof("Zone %s changed to serial %d, notifying secondaries", origin, soa.Serial)
+	if err := s.notifier.Notify(origin); err != nil {
+		log.Warningf("Unable to notify secondaries of zone %s: %v", origin, err)
+	}
+}
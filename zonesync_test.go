@@ -0,0 +1,100 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httprecord
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testNotifier []string
+
+func (n *testNotifier) Notify(zone string) error {
+	*n = append(*n, zone)
+	return nil
+}
+
+func TestZoneSyncer(t *testing.T) {
+	exports := []string{
+		"example.com.,SOA,3600,ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300\n" +
+			"www.example.com.,A,3600,1.2.3.4\n",
+		// The same serial is not a new version.
+		"example.com.,SOA,3600,ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300\n" +
+			"www.example.com.,A,3600,9.9.9.9\n",
+		"example.com.,SOA,3600,ns.example.com. hostmaster.example.com. 2 7200 3600 1209600 300\n" +
+			"www.example.com.,A,3600,5.6.7.8\n" +
+			"mail.example.com.,A,3600,1.2.3.5\n",
+	}
+	export := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/csv")
+		rw.Write([]byte(exports[export]))
+	}))
+	defer server.Close()
+
+	backend := &Backend{ExportURI: server.URL + "/%(zone)", ExportInterval: time.Hour}
+	h := HTTPRecord{Zones: []Zone{{Origin: "example.com.", URI: server.URL, Backend: backend}}}
+	notifier := new(testNotifier)
+	h.syncer = newZoneSyncer(h)
+	h.syncer.notifier = notifier
+
+	history := h.syncer.history("example.com.")
+	for export = range exports {
+		h.syncer.sync("example.com.", backend, history)
+	}
+	if len(*notifier) != 1 || (*notifier)[0] != "example.com." {
+		t.Errorf("Expected secondaries to be notified once of example.com., got %v", *notifier)
+	}
+
+	tests := []struct {
+		serial   uint32
+		expected []string
+	}{
+		// Known versions are transferred incrementally.
+		{1, []string{
+			"example.com.\t3600\tIN\tSOA\tns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300",
+			"www.example.com.\t3600\tIN\tA\t1.2.3.4",
+			"example.com.\t3600\tIN\tSOA\tns.example.com. hostmaster.example.com. 2 7200 3600 1209600 300",
+			"www.example.com.\t3600\tIN\tA\t5.6.7.8",
+			"mail.example.com.\t3600\tIN\tA\t1.2.3.5",
+		}},
+		// Unknown versions get the whole zone.
+		{0, []string{
+			"www.example.com.\t3600\tIN\tA\t5.6.7.8",
+			"mail.example.com.\t3600\tIN\tA\t1.2.3.5",
+		}},
+	}
+	for i, c := range tests {
+		ch, err := h.Transfer("example.com.", c.serial)
+		if err != nil {
+			t.Fatalf("Test %d: unexpected error %v", i, err)
+		}
+		var records []string
+		for rrs := range ch {
+			for _, rr := range rrs {
+				records = append(records, rr.String())
+			}
+		}
+		soa := "example.com.\t3600\tIN\tSOA\tns.example.com. hostmaster.example.com. 2 7200 3600 1209600 300"
+		expected := append(append([]string{soa}, c.expected...), soa)
+		if strings.Join(records, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("Test %d: expected records\n%s\ngot\n%s", i, strings.Join(expected, "\n"),
+				strings.Join(records, "\n"))
+		}
+	}
+}